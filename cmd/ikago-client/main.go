@@ -1,17 +1,21 @@
 package main
 
 import (
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"ikago/internal/addr"
+	"ikago/internal/bond"
 	"ikago/internal/config"
+	"ikago/internal/control"
 	"ikago/internal/crypto"
 	"ikago/internal/exec"
 	"ikago/internal/log"
 	"ikago/internal/pcap"
 	"ikago/internal/stat"
+	"ikago/internal/tun"
 	"io"
 	"math"
 	"math/rand"
@@ -20,6 +24,7 @@
 	"os"
 	"os/signal"
 	"runtime"
+	"strconv"
 	"strings"
 	"sync"
 	"syscall"
@@ -27,7 +32,6 @@
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
-	"github.com/sparrc/go-ping"
 	"github.com/xtaci/kcp-go"
 )
 
@@ -36,9 +40,46 @@ type natIndicator struct {
 	conn            *pcap.RawConn
 }
 
+// path is a connection to the server from an upstream device.
+type path struct {
+	dev         *pcap.Device
+	gatewayDev  *pcap.Device
+	port        uint16
+	weight      int
+	lock        sync.RWMutex
+	conn        net.Conn
+	bonded      net.Conn
+	heartbeater *control.Heartbeater
+	prober      *control.Prober
+	coverer     *control.Coverer
+	isDropped   bool
+	sessionId   uint64
+	connected   time.Time
+	hopAt       time.Time
+	hopped      net.Conn
+}
+
 const name string = "IkaGo-client"
 
-const pingDeadline = 2 * time.Second
+const (
+	reconnectMinBackoff = 1 * time.Second
+	reconnectMaxBackoff = 64 * time.Second
+)
+
+// failoverAttempts is the count of consecutive failures connecting to the server before failing over to the next one.
+const failoverAttempts = 3
+
+// resolveInterval is the interval between resolutions of the server.
+const resolveInterval = 5 * time.Minute
+
+// Port hopping, a path hops in advance if it loses heartbeats more than hopLoss after it has connected for hopMinAge.
+const (
+	hopCheckInterval    = 5 * time.Second
+	hopEstablishTimeout = 3 * time.Second
+	hopGrace            = 10 * time.Second
+	hopMinAge           = 30 * time.Second
+	hopLoss             = 0.2
+)
 
 var (
 	version     = ""
@@ -49,64 +90,110 @@ type natIndicator struct {
 )
 
 var (
-	argListDevs       = flag.Bool("list-devices", false, "List all valid devices in current computer.")
-	argConfig         = flag.String("c", "", "Configuration file.")
-	argListenDevs     = flag.String("listen-devices", "", "Devices for listening.")
-	argUpDev          = flag.String("upstream-device", "", "Device for routing upstream to.")
-	argGateway        = flag.String("gateway", "", "Gateway address.")
-	argMode           = flag.String("mode", "faketcp", "Mode.")
-	argMethod         = flag.String("method", "plain", "Method of encryption.")
-	argPassword       = flag.String("password", "", "Password of encryption.")
-	argRule           = flag.Bool("rule", false, "Add firewall rule.")
-	argVerbose        = flag.Bool("v", false, "Print verbose messages.")
-	argLog            = flag.String("log", "", "Log.")
-	argMonitor        = flag.Int("monitor", 0, "Port for monitoring.")
-	argMTU            = flag.Int("mtu", 0, "MTU.")
-	argKCP            = flag.Bool("kcp", false, "Enable KCP.")
-	argKCPMTU         = flag.Int("kcp-mtu", kcp.IKCP_MTU_DEF, "KCP tuning option mtu.")
-	argKCPSendWindow  = flag.Int("kcp-sndwnd", kcp.IKCP_WND_SND, "KCP tuning option sndwnd.")
-	argKCPRecvWindow  = flag.Int("kcp-rcvwnd", kcp.IKCP_WND_RCV, "KCP tuning option rcvwnd.")
-	argKCPDataShard   = flag.Int("kcp-datashard", 10, "KCP tuning option datashard.")
-	argKCPParityShard = flag.Int("kcp-parityshard", 3, "KCP tuning option parityshard.")
-	argKCPACKNoDelay  = flag.Bool("kcp-acknodelay", false, "KCP tuning option acknodelay.")
-	argKCPNoDelay     = flag.Bool("kcp-nodelay", false, "KCP tuning option nodelay.")
-	argKCPInterval    = flag.Int("kcp-interval", kcp.IKCP_INTERVAL, "KCP tuning option interval.")
-	argKCPResend      = flag.Int("kcp-resend", 0, "KCP tuning option resend.")
-	argKCPNC          = flag.Int("kcp-nc", 0, "KCP tuning option nc.")
-	argShare          = flag.Bool("share", false, "Enable share.")
-	argPublish        = flag.String("publish", "", "ARP publishing address.")
-	argUpPort         = flag.Int("p", 0, "Port for routing upstream.")
-	argSources        = flag.String("r", "", "Sources.")
-	argServer         = flag.String("s", "", "Server.")
+	argListDevs         = flag.Bool("list-devices", false, "List all valid devices in current computer.")
+	argConfig           = flag.String("c", "", "Configuration file.")
+	argListenDevs       = flag.String("listen-devices", "", "Devices for listening.")
+	argUpDev            = flag.String("upstream-device", "", "Device for routing upstream to.")
+	argGateway          = flag.String("gateway", "", "Gateway address.")
+	argMode             = flag.String("mode", "faketcp", "Mode.")
+	argMethod           = flag.String("method", "plain", "Method of encryption.")
+	argPassword         = flag.String("password", "", "Password of encryption.")
+	argRule             = flag.Bool("rule", false, "Add firewall rule.")
+	argVerbose          = flag.Bool("v", false, "Print verbose messages.")
+	argLog              = flag.String("log", "", "Log.")
+	argMonitor          = flag.Int("monitor", 0, "Port for monitoring.")
+	argMTU              = flag.Int("mtu", 0, "MTU.")
+	argBackend          = flag.String("backend", "", "Backend of capturing and injecting packets.")
+	argAFPacketFanout   = flag.Int("afpacket-fanout", 1, "AF_PACKET tuning option fanout.")
+	argFakeTCPEmulation = flag.Bool("faketcp-emulation", false, "FakeTCP tuning option emulation.")
+	argFakeTCPProfile   = flag.String("faketcp-profile", "", "FakeTCP tuning option profile.")
+	argFakeTCPTLS       = flag.Bool("faketcp-tls", false, "FakeTCP tuning option tls.")
+	argFakeTCPSNI       = flag.String("faketcp-tls-sni", "", "FakeTCP tuning option tls-sni.")
+	argFakeTCPHopPorts  = flag.Int("faketcp-hop-ports", 0, "FakeTCP tuning option hop-ports.")
+	argFakeTCPInterval  = flag.Int("faketcp-hop-interval", 0, "FakeTCP tuning option hop-interval.")
+	argKCP              = flag.Bool("kcp", false, "Enable KCP.")
+	argKCPMTU           = flag.Int("kcp-mtu", kcp.IKCP_MTU_DEF, "KCP tuning option mtu.")
+	argKCPSendWindow    = flag.Int("kcp-sndwnd", kcp.IKCP_WND_SND, "KCP tuning option sndwnd.")
+	argKCPRecvWindow    = flag.Int("kcp-rcvwnd", kcp.IKCP_WND_RCV, "KCP tuning option rcvwnd.")
+	argKCPDataShard     = flag.Int("kcp-datashard", 10, "KCP tuning option datashard.")
+	argKCPParityShard   = flag.Int("kcp-parityshard", 3, "KCP tuning option parityshard.")
+	argKCPACKNoDelay    = flag.Bool("kcp-acknodelay", false, "KCP tuning option acknodelay.")
+	argKCPNoDelay       = flag.Bool("kcp-nodelay", false, "KCP tuning option nodelay.")
+	argKCPInterval      = flag.Int("kcp-interval", kcp.IKCP_INTERVAL, "KCP tuning option interval.")
+	argKCPResend        = flag.Int("kcp-resend", 0, "KCP tuning option resend.")
+	argKCPNC            = flag.Int("kcp-nc", 0, "KCP tuning option nc.")
+	argKCPStreams       = flag.Int("kcp-streams", 1, "KCP option streams, flows are spread across streams.")
+	argObfs             = flag.Bool("obfs", false, "Enable obfuscation.")
+	argObfsPadding      = flag.Int("obfs-padding", 128, "Obfuscation tuning option padding.")
+	argObfsBuckets      = flag.String("obfs-buckets", "", "Obfuscation tuning option buckets.")
+	argObfsCover        = flag.Int("obfs-cover", 0, "Obfuscation tuning option cover.")
+	argObfsJitter       = flag.Int("obfs-jitter", 0, "Obfuscation tuning option jitter.")
+	argTLS              = flag.Bool("tls", false, "Enable TLS.")
+	argTLSServerName    = flag.String("tls-sni", "", "TLS option sni.")
+	argTLSFingerprint   = flag.String("tls-fingerprint", "", "TLS option fingerprint.")
+	argWSPath           = flag.String("ws-path", "/", "WebSocket option path.")
+	argWSHost           = flag.String("ws-host", "", "WebSocket option host.")
+	argWSProxy          = flag.String("ws-proxy", "", "WebSocket option proxy.")
+	argTUN              = flag.Bool("tun", false, "Enable TUN.")
+	argTUNName          = flag.String("tun-name", "ikago0", "TUN option name.")
+	argTUNAddress       = flag.String("tun-address", "10.6.0.1/24", "TUN option addresses.")
+	argTUNMTU           = flag.Int("tun-mtu", 1400, "TUN option mtu.")
+	argTUNRoutes        = flag.String("tun-routes", "", "TUN option routes.")
+	argShare            = flag.Bool("share", false, "Enable share.")
+	argPublish          = flag.String("publish", "", "ARP and NDP publishing addresses.")
+	argUpPort           = flag.Int("p", 0, "Port for routing upstream.")
+	argSources          = flag.String("r", "", "Sources.")
+	argServer           = flag.String("s", "", "Server.")
+	argPaths            = flag.String("paths", "", "Paths for multipath bonding.")
+	argScheduler        = flag.String("scheduler", "round-robin", "Scheduler of multipath bonding.")
 )
 
 var (
-	publishIP  *net.IPAddr
-	upPort     uint16
-	sources    []*net.IPAddr
-	serverIP   net.IP
-	serverPort uint16
-	listenDevs []*pcap.Device
-	upDev      *pcap.Device
-	gatewayDev *pcap.Device
-	share      bool
-	mode       string
-	crypt      crypto.Crypt
-	mtu        int
-	isKCP      bool
-	kcpConfig  *config.KCPConfig
+	publishIPs    []*net.IPAddr
+	upPort        uint16
+	sources       []*net.IPAddr
+	servers       []string
+	listenDevs    []*pcap.Device
+	upDev         *pcap.Device
+	gatewayDev    *pcap.Device
+	share         bool
+	mode          string
+	crypt         crypto.Crypt
+	isObfs        bool
+	cover         time.Duration
+	jitter        time.Duration
+	mtu           int
+	fakeTCPConfig *config.FakeTCPConfig
+	hopInterval   time.Duration
+	isKCP         bool
+	kcpConfig     *config.KCPConfig
+	isTLS         bool
+	tlsConfig     *tls.Config
+	wsConfig      *config.WSConfig
+	paths         []*path
+	bondId        uint64
+	sessionToken  []byte
+	scheduler     bond.Scheduler
+	monitorPort   int
+	tunAddrs      []*net.IPNet
+	tunRoutes     []*net.IPNet
 )
 
 var (
 	isClosed    bool
 	listenConns []*pcap.RawConn
-	upConn      net.Conn
+	filterLock  sync.Mutex
+	filterIP    net.IP
+	filterPort  uint16
+	tunDev      *tun.Device
+	upBond      *bond.Bond
+	serverLock  sync.RWMutex
+	serverIndex int
+	serverIP    net.IP
+	serverPort  uint16
 	c           chan pcap.ConnPacket
 	natLock     sync.RWMutex
 	nat         map[string]*natIndicator
-	pingTime    int64
-	pingSeq     int
-	pinger      *ping.Pinger
 	monitor     *stat.TrafficMonitor
 	dnsLock     sync.RWMutex
 	dns         map[string]string
@@ -150,7 +237,6 @@ func init() {
 	listenConns = make([]*pcap.RawConn, 0)
 	c = make(chan pcap.ConnPacket, 1000)
 	nat = make(map[string]*natIndicator)
-	pingTime = -1
 	dns = make(map[string]string)
 }
 
@@ -181,6 +267,16 @@ func main() {
 		cfg.Log = *argLog
 		cfg.Monitor = *argMonitor
 		cfg.MTU = *argMTU
+		cfg.Backend = *argBackend
+		cfg.AFPacketConfig = *config.NewAFPacketConfig()
+		cfg.AFPacketConfig.Fanout = *argAFPacketFanout
+		cfg.FakeTCPConfig = *config.NewFakeTCPConfig()
+		cfg.FakeTCPConfig.Emulation = *argFakeTCPEmulation
+		cfg.FakeTCPConfig.Profile = *argFakeTCPProfile
+		cfg.FakeTCPConfig.TLS = *argFakeTCPTLS
+		cfg.FakeTCPConfig.ServerName = *argFakeTCPSNI
+		cfg.FakeTCPConfig.HopPorts = *argFakeTCPHopPorts
+		cfg.FakeTCPConfig.HopInterval = *argFakeTCPInterval
 		cfg.KCP = *argKCP
 		cfg.KCPConfig = *config.NewKCPConfig()
 		cfg.KCPConfig.MTU = *argKCPMTU
@@ -193,11 +289,40 @@ func main() {
 		cfg.KCPConfig.Interval = *argKCPInterval
 		cfg.KCPConfig.Resend = *argKCPResend
 		cfg.KCPConfig.NC = *argKCPNC
+		cfg.KCPConfig.Streams = *argKCPStreams
+		cfg.Obfs = *argObfs
+		cfg.ObfsConfig = *config.NewObfsConfig()
+		cfg.ObfsConfig.Padding = *argObfsPadding
+		cfg.ObfsConfig.Buckets, err = parseSizes(splitArg(*argObfsBuckets))
+		if err != nil {
+			log.Fatalln(fmt.Errorf("parse obfs buckets: %w", err))
+		}
+		cfg.ObfsConfig.Cover = *argObfsCover
+		cfg.ObfsConfig.Jitter = *argObfsJitter
+		cfg.TLS = *argTLS
+		cfg.TLSConfig = *config.NewTLSConfig()
+		cfg.TLSConfig.ServerName = *argTLSServerName
+		cfg.TLSConfig.Fingerprint = *argTLSFingerprint
+		cfg.WSConfig = *config.NewWSConfig()
+		cfg.WSConfig.Path = *argWSPath
+		cfg.WSConfig.Host = *argWSHost
+		cfg.WSConfig.Proxy = *argWSProxy
+		cfg.TUN = *argTUN
+		cfg.TUNConfig = *config.NewTUNConfig()
+		cfg.TUNConfig.Name = *argTUNName
+		cfg.TUNConfig.Address = *argTUNAddress
+		cfg.TUNConfig.MTU = *argTUNMTU
+		cfg.TUNConfig.Routes = splitArg(*argTUNRoutes)
 		cfg.Share = *argShare
 		cfg.Publish = *argPublish
 		cfg.Port = *argUpPort
 		cfg.Sources = splitArg(*argSources)
 		cfg.Server = *argServer
+		cfg.Paths, err = parsePaths(splitArg(*argPaths))
+		if err != nil {
+			log.Fatalln(fmt.Errorf("parse paths: %w", err))
+		}
+		cfg.Scheduler = *argScheduler
 	}
 
 	// Log
@@ -231,6 +356,28 @@ func main() {
 		}
 	}
 
+	// Backend
+	backend, err := pcap.ParseBackend(cfg.Backend)
+	if err != nil {
+		log.Fatalln(fmt.Errorf("parse backend: %w", err))
+	}
+	if cfg.AFPacketConfig.Fanout <= 0 {
+		log.Fatalln(fmt.Errorf("afpacket fanout %d out of range", cfg.AFPacketConfig.Fanout))
+	}
+	if cfg.AFPacketConfig.BlockSize <= 0 {
+		log.Fatalln(fmt.Errorf("afpacket block size %d out of range", cfg.AFPacketConfig.BlockSize))
+	}
+	if cfg.AFPacketConfig.Blocks <= 0 {
+		log.Fatalln(fmt.Errorf("afpacket blocks %d out of range", cfg.AFPacketConfig.Blocks))
+	}
+	err = pcap.SetBackend(backend, &cfg.AFPacketConfig)
+	if err != nil {
+		log.Fatalln(fmt.Errorf("set backend: %w", err))
+	}
+	if backend == pcap.BackendAFPacket {
+		log.Infoln("Capture with AF_PACKET")
+	}
+
 	// Exclusive commands
 	if *argListDevs {
 		log.Infoln("Available devices are listed below, use -listen-devices [devices] or -upstream-device [device] to designate device:")
@@ -245,10 +392,10 @@ func main() {
 	}
 
 	// Verify parameters
-	if len(cfg.Sources) <= 0 {
+	if len(cfg.Sources) <= 0 && !cfg.TUN {
 		log.Fatalln("Please provide sources by -r addresses.")
 	}
-	if cfg.Server == "" {
+	if cfg.Server == "" && len(cfg.Servers) <= 0 {
 		log.Fatalln("Please provide server by -s address.")
 	}
 	if cfg.Gateway != "" {
@@ -270,6 +417,9 @@ func main() {
 	if cfg.KCPConfig.MTU > 1500 {
 		log.Fatalln(fmt.Errorf("kcp mtu %d out of range", cfg.KCPConfig.MTU))
 	}
+	if cfg.TUN && (cfg.TUNConfig.MTU < 576 || cfg.TUNConfig.MTU > pcap.MaxMTU) {
+		log.Fatalln(fmt.Errorf("tun mtu %d out of range", cfg.TUNConfig.MTU))
+	}
 	if cfg.KCPConfig.SendWindow <= 0 || cfg.KCPConfig.SendWindow > math.MaxInt32 {
 		log.Fatalln(fmt.Errorf("kcp send window %d out of range", cfg.KCPConfig.SendWindow))
 	}
@@ -291,19 +441,56 @@ func main() {
 	if cfg.KCPConfig.NC < 0 {
 		log.Fatalln(fmt.Errorf("kcp nc %d out of range", cfg.KCPConfig.NC))
 	}
+	if cfg.KCPConfig.Streams <= 0 || cfg.KCPConfig.Streams > 256 {
+		log.Fatalln(fmt.Errorf("kcp streams %d out of range", cfg.KCPConfig.Streams))
+	}
+	if cfg.FakeTCPConfig.HopPorts < 0 || cfg.FakeTCPConfig.HopPorts > 65535 {
+		log.Fatalln(fmt.Errorf("faketcp hop ports %d out of range", cfg.FakeTCPConfig.HopPorts))
+	}
+	if cfg.FakeTCPConfig.HopInterval < 0 {
+		log.Fatalln(fmt.Errorf("faketcp hop interval %d out of range", cfg.FakeTCPConfig.HopInterval))
+	}
+	if cfg.ObfsConfig.Padding < 0 || cfg.ObfsConfig.Padding > 65535 {
+		log.Fatalln(fmt.Errorf("obfs padding %d out of range", cfg.ObfsConfig.Padding))
+	}
+	for _, bucket := range cfg.ObfsConfig.Buckets {
+		if bucket <= 0 {
+			log.Fatalln(fmt.Errorf("obfs bucket %d out of range", bucket))
+		}
+	}
+	if cfg.ObfsConfig.Cover < 0 {
+		log.Fatalln(fmt.Errorf("obfs cover %d out of range", cfg.ObfsConfig.Cover))
+	}
+	if cfg.ObfsConfig.Jitter < 0 {
+		log.Fatalln(fmt.Errorf("obfs jitter %d out of range", cfg.ObfsConfig.Jitter))
+	}
 	if cfg.Port < 0 || cfg.Port > 65535 {
 		log.Fatalln(fmt.Errorf("upstream port %d out of range", cfg.Port))
 	}
+	for _, pc := range cfg.Paths {
+		if pc.Port < 0 || pc.Port > 65535 {
+			log.Fatalln(fmt.Errorf("path port %d out of range", pc.Port))
+		}
+		if pc.Weight < 0 || pc.Weight > math.MaxUint16 {
+			log.Fatalln(fmt.Errorf("path weight %d out of range", pc.Weight))
+		}
+	}
+
+	// Paths, the upstream device and port are used if there is no path
+	if len(cfg.Paths) <= 0 {
+		cfg.Paths = []config.PathConfig{{UpDev: cfg.UpDev, Port: cfg.Port}}
+	}
 
 	// Randomize upstream port
-	if cfg.Port == 0 {
-		s := rand.NewSource(time.Now().UnixNano())
-		for cfg.Port == 0 || cfg.Port == cfg.Monitor {
+	s := rand.NewSource(time.Now().UnixNano())
+	for i := range cfg.Paths {
+		for cfg.Paths[i].Port == 0 || cfg.Paths[i].Port == cfg.Monitor {
 			r := rand.New(s)
-			cfg.Port = 49152 + r.Intn(16384)
+			cfg.Paths[i].Port = 49152 + r.Intn(16384)
 		}
 	}
-	upPort = uint16(cfg.Port)
+	upPort = uint16(cfg.Paths[0].Port)
+	monitorPort = cfg.Monitor
 
 	// Sources
 	for _, source := range cfg.Sources {
@@ -314,29 +501,103 @@ func main() {
 		sources = append(sources, &net.IPAddr{IP: ip})
 	}
 
-	// Server
-	serverAddr, err := addr.ParseTCPAddr(cfg.Server)
-	if err != nil {
-		log.Fatalln(fmt.Errorf("parse server %s: %w", cfg.Server, err))
+	// TUN, the device may have addresses in both IPv4 and IPv6
+	if cfg.TUN {
+		isIPv6 := false
+		for _, address := range splitArg(cfg.TUNConfig.Address) {
+			ip, ipNet, err := net.ParseCIDR(address)
+			if err != nil {
+				log.Fatalln(fmt.Errorf("parse tun address %s: %w", address, err))
+			}
+			if ip.To4() != nil {
+				tunAddrs = append(tunAddrs, &net.IPNet{IP: ip.To4(), Mask: ipNet.Mask})
+			} else {
+				tunAddrs = append(tunAddrs, &net.IPNet{IP: ip, Mask: ipNet.Mask})
+				isIPv6 = true
+			}
+		}
+		if len(tunAddrs) <= 0 {
+			log.Fatalln(errors.New("missing tun address"))
+		}
+
+		for _, route := range cfg.TUNConfig.Routes {
+			_, ipNet, err := net.ParseCIDR(route)
+			if err != nil {
+				// Single addresses
+				ip := net.ParseIP(route)
+				if ip == nil {
+					log.Fatalln(fmt.Errorf("invalid route %s", route))
+				}
+				if ip.To4() != nil {
+					ipNet = &net.IPNet{IP: ip.To4(), Mask: net.CIDRMask(32, 32)}
+				} else {
+					ipNet = &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+				}
+			}
+			if ipNet.IP.To4() == nil {
+				isIPv6 = true
+			}
+			tunRoutes = append(tunRoutes, ipNet)
+		}
+
+		// IPv6 is disabled in devices with an MTU under the min one, as described in RFC 8200
+		if isIPv6 && cfg.TUNConfig.MTU < 1280 {
+			log.Fatalln(fmt.Errorf("tun mtu %d out of range in ipv6", cfg.TUNConfig.MTU))
+		}
+	}
+
+	// Servers, the first server which can be resolved is used
+	servers = append(splitArg(cfg.Server), cfg.Servers...)
+	for _, server := range servers {
+		_, _, err := net.SplitHostPort(server)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("invalid server %s: %w", server, err))
+		}
+	}
+	for serverIndex = 0; serverIndex < len(servers); serverIndex++ {
+		_, err = resolveServer()
+		if err == nil {
+			break
+		}
+		log.Errorln(fmt.Errorf("resolve: %w", err))
+	}
+	if serverIndex >= len(servers) {
+		log.Fatalln(errors.New("cannot resolve any server"))
 	}
-	serverIP = serverAddr.IP
-	serverPort = uint16(serverAddr.Port)
 
-	// Publish
-	if cfg.Publish != "" {
-		ip := net.ParseIP(cfg.Publish)
+	// Publish, IPv4 addresses are published by ARP and IPv6 addresses are published by NDP
+	for _, s := range splitArg(cfg.Publish) {
+		ip := net.ParseIP(s)
 		if ip == nil {
-			log.Errorln(fmt.Errorf("invalid publish %s", cfg.Publish))
+			log.Errorln(fmt.Errorf("invalid publish %s", s))
+			continue
 		}
-		publishIP = &net.IPAddr{IP: ip}
+		publishIPs = append(publishIPs, &net.IPAddr{IP: ip})
 	}
-	if publishIP != nil {
+	for _, publishIP := range publishIPs {
 		log.Infof("Publish %s\n", publishIP.IP)
 	}
 
 	// Share
 	share = cfg.Share
 
+	// Multipath bonding
+	scheduler, err = bond.ParseScheduler(cfg.Scheduler)
+	if err != nil {
+		log.Fatalln(fmt.Errorf("parse scheduler: %w", err))
+	}
+	bondId = rand.New(s).Uint64()
+
+	// Session
+	sessionToken, err = control.NewToken()
+	if err != nil {
+		log.Fatalln(fmt.Errorf("session: %w", err))
+	}
+	upBond = bond.NewBond(bondId, scheduler, sessionToken)
+	if len(cfg.Paths) > 1 {
+		log.Infof("Bond %d paths with scheduler %s\n", len(cfg.Paths), scheduler)
+	}
+
 	// Mode
 	switch cfg.Mode {
 	case "faketcp":
@@ -345,6 +606,15 @@ func main() {
 	case "tcp":
 		mode = "tcp"
 		log.Infoln("Use standard TCP")
+	case "udp":
+		mode = "udp"
+		log.Infoln("Use standard UDP")
+	case "icmp":
+		mode = "icmp"
+		log.Infoln("Use ICMP")
+	case "ws":
+		mode = "ws"
+		log.Infoln("Use WebSocket")
 	default:
 		log.Fatalln(fmt.Errorf("mode %s not support", cfg.Mode))
 	}
@@ -359,28 +629,86 @@ func main() {
 		log.Infof("Encrypt with %s\n", method)
 	}
 
+	// Obfuscation, cover packets are sent in connections other than KCP which drops empty messages
+	if cfg.Obfs {
+		crypt, err = crypto.CreateObfsCrypt(crypt, cfg.ObfsConfig.Padding, cfg.ObfsConfig.Buckets)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("obfs: %w", err))
+		}
+		if !cfg.KCP {
+			cover = time.Duration(cfg.ObfsConfig.Cover) * time.Millisecond
+		}
+		isObfs = true
+		jitter = time.Duration(cfg.ObfsConfig.Jitter) * time.Millisecond
+		log.Infoln("Enable obfuscation")
+	}
+
 	// Monitor
 	if cfg.Monitor != 0 {
-		if cfg.Monitor == int(upPort) {
-			log.Fatalln(fmt.Errorf("same monitor port with upstream port"))
+		for _, pc := range cfg.Paths {
+			if cfg.Monitor == pc.Port {
+				log.Fatalln(fmt.Errorf("same monitor port with upstream port"))
+			}
 		}
 
 		monitor = stat.NewTrafficMonitor()
 
 		// Host HTTP server
 		http.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
+			// Ping of the fastest path, -1 for no reply yet and -2 for the server is dead
+			var (
+				h      *control.Heartbeater
+				prober *control.Prober
+			)
+			ping := int64(-2)
+			for i, p := range paths {
+				p.lock.RLock()
+				ph, pp := p.heartbeater, p.prober
+				p.lock.RUnlock()
+				if i == 0 {
+					h, prober = ph, pp
+				}
+				if ph == nil || ph.IsDead() {
+					continue
+				}
+				if rtt, ok := ph.RTT(); ok && (ping < 0 || rtt.Milliseconds() < ping) {
+					ping = rtt.Milliseconds()
+				} else if !ok && ping == -2 {
+					ping = -1
+				}
+			}
+
+			// Server in use
+			server, ip, port := currentServer()
+
+			// Paths are only shown in multipath bonding
+			var bonded *bond.Bond
+			if len(paths) > 1 {
+				bonded = upBond
+			}
+
 			b, err := json.Marshal(&struct {
-				Name    string               `json:"name"`
-				Version string               `json:"version"`
-				Time    int                  `json:"time"`
-				Monitor *stat.TrafficMonitor `json:"monitor"`
-				Ping    int64                `json:"ping"`
+				Name      string               `json:"name"`
+				Version   string               `json:"version"`
+				Time      int                  `json:"time"`
+				Monitor   *stat.TrafficMonitor `json:"monitor"`
+				Ping      int64                `json:"ping"`
+				Heartbeat *control.Heartbeater `json:"heartbeat"`
+				MTU       *control.Prober      `json:"mtu,omitempty"`
+				Bond      *bond.Bond           `json:"bond,omitempty"`
+				Server    string               `json:"server"`
+				Address   string               `json:"address"`
 			}{
-				Name:    name,
-				Version: versionInfo,
-				Time:    int(time.Now().Sub(startTime).Seconds()),
-				Monitor: monitor,
-				Ping:    pingTime,
+				Name:      name,
+				Version:   versionInfo,
+				Time:      int(time.Now().Sub(startTime).Seconds()),
+				Monitor:   monitor,
+				Ping:      ping,
+				Heartbeat: h,
+				MTU:       prober,
+				Bond:      bonded,
+				Server:    server,
+				Address:   (&net.TCPAddr{IP: ip, Port: int(port)}).String(),
 			})
 			if err != nil {
 				log.Errorln(fmt.Errorf("monitor: %w", err))
@@ -432,33 +760,6 @@ type IPName struct {
 			}
 		}()
 
-		// Ping
-		pinger, err = ping.NewPinger(serverIP.String())
-		if err != nil {
-			log.Errorln(fmt.Errorf("ping: %w", err))
-		}
-		if pinger != nil {
-			pinger.SetPrivileged(true)
-			pinger.OnRecv = func(packet *ping.Packet) {
-				if packet != nil {
-					pingTime = packet.Rtt.Milliseconds()
-					pingSeq = packet.Seq
-
-					log.Verbosef("Receive ICMP Echo Reply: %s <- %s (%d ms)\n", upDev.IPAddr().IP, serverIP, packet.Rtt.Milliseconds())
-
-					// Timeout
-					go func() {
-						time.Sleep(pingDeadline)
-						if packet.Seq == pingSeq {
-							pingTime = -2
-
-							log.Errorf("Cannot receive ICMP Echo Reply from server %s, is your network down?\n", serverIP)
-						}
-					}()
-				}
-			}
-		}
-
 		log.Infof("Monitor on :%d\n", cfg.Monitor)
 		log.Infoln("You can now observe traffic on http://ikago.ikas.ink")
 	}
@@ -472,66 +773,173 @@ type IPName struct {
 			log.Infof("Set MTU to %d Bytes\n", mtu)
 		}
 
+		// TCP emulation
+		fakeTCPConfig = &cfg.FakeTCPConfig
+		if fakeTCPConfig.Emulation {
+			log.Infoln("Enable TCP emulation")
+		}
+
+		// TCP profile
+		profile, err := pcap.ParseTCPProfile(fakeTCPConfig.Profile)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("parse tcp profile: %w", err))
+		}
+		if profile != nil {
+			log.Infof("Use TCP profile %s\n", profile)
+		}
+
+		// Fake TLS
+		if fakeTCPConfig.TLS {
+			if fakeTCPConfig.ServerName != "" {
+				log.Infof("Enable fake TLS with SNI %s\n", fakeTCPConfig.ServerName)
+			} else {
+				log.Infoln("Enable fake TLS")
+			}
+		}
+
+		// Port hopping
+		hopInterval = time.Duration(fakeTCPConfig.HopInterval) * time.Second
+		if hopInterval > 0 {
+			log.Infof("Hop ports every %d s\n", fakeTCPConfig.HopInterval)
+		}
+
+		// KCP
+		isKCP = cfg.KCP
+		kcpConfig = &cfg.KCPConfig
+		if isKCP {
+			if kcpConfig.Streams > 1 {
+				log.Infof("Enable KCP in %d streams\n", kcpConfig.Streams)
+			} else {
+				log.Infoln("Enable KCP")
+			}
+		}
+	case "tcp", "ws":
+		// TLS, the host of the server in use is the SNI by default
+		isTLS = cfg.TLS
+		if isTLS {
+			tlsConfig, err = pcap.NewTLSClientConfig(&cfg.TLSConfig)
+			if err != nil {
+				log.Fatalln(fmt.Errorf("tls: %w", err))
+			}
+			if tlsConfig.ServerName != "" {
+				log.Infof("Enable TLS with SNI %s\n", tlsConfig.ServerName)
+			} else {
+				log.Infoln("Enable TLS")
+			}
+			if cfg.TLSConfig.Fingerprint != "" {
+				log.Infof("Pin certificate %s\n", cfg.TLSConfig.Fingerprint)
+			}
+		}
+
+		// WebSocket
+		if mode == "ws" {
+			wsConfig = &cfg.WSConfig
+			if !strings.HasPrefix(wsConfig.Path, "/") {
+				log.Fatalln(fmt.Errorf("invalid ws path %s", wsConfig.Path))
+			}
+			if wsConfig.Host != "" {
+				log.Infof("Use WebSocket endpoint %s%s\n", wsConfig.Host, wsConfig.Path)
+			} else {
+				log.Infof("Use WebSocket endpoint %s\n", wsConfig.Path)
+			}
+			if wsConfig.Proxy != "" {
+				log.Infof("Use HTTP proxy %s\n", wsConfig.Proxy)
+			}
+		}
+	case "udp":
 		// KCP
 		isKCP = cfg.KCP
 		kcpConfig = &cfg.KCPConfig
 		if isKCP {
 			log.Infoln("Enable KCP")
 		}
-	case "tcp":
-		break
+	case "icmp":
+		// MTU
+		mtu = cfg.MTU
+		if mtu != pcap.MaxMTU {
+			log.Infof("Set MTU to %d Bytes\n", mtu)
+		}
 	default:
 		log.Fatalln(fmt.Errorf("mode %s not support", mode))
 	}
 
-	if len(sources) == 1 {
-		log.Infof("Proxy %s through :%d to %s\n", sources[0], upPort, serverAddr)
+	if cfg.TUN {
+		ips := make([]string, 0, len(tunAddrs))
+		for _, tunAddr := range tunAddrs {
+			ips = append(ips, tunAddr.IP.String())
+		}
+		log.Infof("Proxy %s through :%d to %s\n", strings.Join(ips, ", "), upPort, strings.Join(servers, ", "))
+	} else if len(sources) == 1 {
+		log.Infof("Proxy %s through :%d to %s\n", sources[0], upPort, strings.Join(servers, ", "))
 	} else {
 		log.Infoln("Proxy:")
 		for i, f := range sources {
 			if i != len(sources)-1 {
 				log.Infof("  %s\n", f)
 			} else {
-				log.Infof("  %s through :%d to %s\n", f, upPort, serverAddr)
+				log.Infof("  %s through :%d to %s\n", f, upPort, strings.Join(servers, ", "))
 			}
 		}
 	}
 
-	// Find devices
-	listenDevs, err = pcap.FindListenDevs(cfg.ListenDevs)
-	if err != nil {
-		log.Fatalln(fmt.Errorf("find listen devices: %w", err))
+	// Routes must not cover the server, or connections to the server in the system's stack loop in the tunnel
+	if cfg.TUN && (mode == "tcp" || mode == "udp" || mode == "ws") {
+		_, ip, _ := currentServer()
+		for _, route := range tunRoutes {
+			if route.Contains(ip) {
+				log.Fatalln(fmt.Errorf("route %s covers server %s", route, ip))
+			}
+		}
 	}
-	if len(cfg.ListenDevs) <= 0 {
-		// Remove loopback devices by default
-		result := make([]*pcap.Device, 0)
 
-		for _, dev := range listenDevs {
-			if dev.IsLoop() {
-				continue
-			}
-			result = append(result, dev)
+	// Find devices, there is no listen device with a TUN device
+	if !cfg.TUN {
+		listenDevs, err = pcap.FindListenDevs(cfg.ListenDevs)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("find listen devices: %w", err))
 		}
+		if len(cfg.ListenDevs) <= 0 {
+			// Remove loopback devices by default
+			result := make([]*pcap.Device, 0)
 
-		listenDevs = result
-	}
-	if len(listenDevs) <= 0 {
-		log.Fatalln(errors.New("cannot determine listen device"))
-	}
+			for _, dev := range listenDevs {
+				if dev.IsLoop() {
+					continue
+				}
+				result = append(result, dev)
+			}
 
-	upDev, gatewayDev, err = pcap.FindUpstreamDevAndGatewayDev(cfg.UpDev, gateway)
-	if err != nil {
-		log.Fatalln(fmt.Errorf("find upstream device and gateway device: %w", err))
-	}
-	if upDev == nil && gatewayDev == nil {
-		log.Fatalln(errors.New("cannot determine upstream device and gateway device"))
-	}
-	if upDev == nil {
-		log.Fatalln(errors.New("cannot determine upstream device"))
+			listenDevs = result
+		}
+		if len(listenDevs) <= 0 {
+			log.Fatalln(errors.New("cannot determine listen device"))
+		}
 	}
-	if gatewayDev == nil {
-		log.Fatalln(errors.New("cannot determine gateway device"))
+
+	for _, pc := range cfg.Paths {
+		upDev, gatewayDev, err := pcap.FindUpstreamDevAndGatewayDev(pc.UpDev, gateway)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("find upstream device and gateway device: %w", err))
+		}
+		if upDev == nil && gatewayDev == nil {
+			log.Fatalln(errors.New("cannot determine upstream device and gateway device"))
+		}
+		if upDev == nil {
+			log.Fatalln(errors.New("cannot determine upstream device"))
+		}
+		if gatewayDev == nil {
+			log.Fatalln(errors.New("cannot determine gateway device"))
+		}
+
+		paths = append(paths, &path{
+			dev:        upDev,
+			gatewayDev: gatewayDev,
+			port:       uint16(pc.Port),
+			weight:     pc.Weight,
+			sessionId:  rand.New(s).Uint64(),
+		})
 	}
+	upDev, gatewayDev = paths[0].dev, paths[0].gatewayDev
 
 	// Add firewall rule
 	if cfg.Rule {
@@ -554,13 +962,22 @@ type IPName struct {
 		// Firewall
 		switch mode {
 		case "faketcp":
-			err = exec.AddSpecificFirewallRule(serverIP, serverPort)
-			if err != nil {
-				log.Errorln(fmt.Errorf("add firewall rule: %w", err))
-			} else {
-				log.Infoln("Add firewall rule")
+			for _, server := range servers {
+				serverAddr, err := addr.ParseTCPAddr(server)
+				if err != nil {
+					log.Errorln(fmt.Errorf("add firewall rule: %w", fmt.Errorf("parse server %s: %w", server, err)))
+					continue
+				}
+
+				port := uint16(serverAddr.Port)
+				err = exec.AddSpecificFirewallRule(serverAddr.IP, port, pcap.HopMaxPort(port, fakeTCPConfig))
+				if err != nil {
+					log.Errorln(fmt.Errorf("add firewall rule: %w", err))
+				} else {
+					log.Infof("Add firewall rule for server %s\n", server)
+				}
 			}
-		case "tcp":
+		case "tcp", "udp", "icmp", "ws":
 			break
 		default:
 			log.Fatalln(fmt.Errorf("mode %s not support", cfg.Mode))
@@ -570,7 +987,9 @@ type IPName struct {
 		for _, dev := range listenDevs {
 			devs[dev.Alias()] = true
 		}
-		devs[upDev.Alias()] = true
+		for _, p := range paths {
+			devs[p.dev.Alias()] = true
+		}
 
 		for dev := range devs {
 			err := exec.DisableGRO(dev)
@@ -584,6 +1003,29 @@ type IPName struct {
 		}
 	}
 
+	// TUN device
+	if cfg.TUN {
+		tunDev, err = tun.Open(cfg.TUNConfig.Name)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("open tun device %s: %w", cfg.TUNConfig.Name, err))
+		}
+
+		err = exec.SetUpInterface(tunDev.Name(), tunAddrs, cfg.TUNConfig.MTU)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("set up tun device %s: %w", tunDev.Name(), err))
+		}
+
+		// Routes are removed with the device
+		for _, route := range tunRoutes {
+			err := exec.AddRoute(route, tunDev.Name())
+			if err != nil {
+				log.Errorln(fmt.Errorf("add route %s: %w", route, err))
+				continue
+			}
+			log.Infof("Route %s through %s\n", route, tunDev.Name())
+		}
+	}
+
 	// Wait signals
 	sig := make(chan os.Signal)
 	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
@@ -603,7 +1045,9 @@ type IPName struct {
 func open() error {
 	var err error
 
-	if len(listenDevs) == 1 {
+	if tunDev != nil {
+		log.Infof("Listen on %s\n", tunDev.Name())
+	} else if len(listenDevs) == 1 {
 		log.Infof("Listen on %s\n", listenDevs[0].String())
 	} else {
 		log.Infoln("Listen on:")
@@ -611,91 +1055,71 @@ func open() error {
 			log.Infof("  %s\n", dev.String())
 		}
 	}
-	if !gatewayDev.IsLoop() {
-		log.Infof("Route upstream from %s to %s\n", upDev, gatewayDev)
-	} else {
-		log.Infof("Route upstream in %s\n", upDev)
+	for _, p := range paths {
+		if !p.gatewayDev.IsLoop() {
+			log.Infof("Route upstream from %s to %s\n", p.dev, p.gatewayDev)
+		} else {
+			log.Infof("Route upstream in %s\n", p.dev)
+		}
 	}
 
-	// Filters for listening
-	fs := make([]string, 0)
-	for _, f := range sources {
-		s, err := addr.SrcBPFFilter(f)
+	// Handles for listening, packets are read from the TUN device directly if there is one
+	if tunDev == nil {
+		err = listen()
 		if err != nil {
-			return fmt.Errorf("parse filter %s: %w", f, err)
+			return err
 		}
-
-		fs = append(fs, s)
 	}
-	f := strings.Join(fs, " || ")
-	filter := fmt.Sprintf("ip && (((tcp || udp) && (%s) && not (src host %s && src port %d)) || ((icmp || (ip[6:2] & 0x1fff) != 0) && (%s) && not src host %s))",
-		f, serverIP, serverPort, f, serverIP)
-	if publishIP != nil {
-		s, err := addr.DstBPFFilter(publishIP)
-		if err != nil {
-			return fmt.Errorf("parse filter %s: %w", f, err)
+
+	// Handles for routing upstream, paths failed to connect will keep reconnecting in background
+	ok := false
+	for i := 0; i < len(servers) && !ok; i++ {
+		if i > 0 {
+			server, _, _ := currentServer()
+			failover(server)
 		}
-		filter = filter + fmt.Sprintf(" || (arp[6:2] = 1 && %s)", s)
-	}
-	// capture share response
-	if share {
-		fs := make([]string, 0)
-		for _, f := range sources {
-			s, err := addr.DstBPFFilter(f)
+
+		for _, p := range paths {
+			err = p.connect()
 			if err != nil {
-				return fmt.Errorf("parse filter %s: %w", f, err)
+				log.Errorln(fmt.Errorf("connect from %s: %w", p.dev.Alias(), err))
+				continue
 			}
-	
-			fs = append(fs, s)
+			ok = true
 		}
-		f := strings.Join(fs, " || ")
-		filter = filter + fmt.Sprintf(" || (ip && ((%s) and src host %s))", f, upDev.IPAddrs()[0].IP)
 	}
-
-	// Handles for listening
-	for _, dev := range listenDevs {
-		var (
-			err  error
-			conn *pcap.RawConn
-		)
-
-		if dev.IsLoop() {
-			conn, err = pcap.CreateRawConn(dev, dev, filter)
-		} else {
-			conn, err = pcap.CreateRawConn(dev, gatewayDev, filter)
-		}
-		if err != nil {
-			return fmt.Errorf("open listen device %s: %w", conn.LocalDev().Alias(), err)
-		}
-
-		listenConns = append(listenConns, conn)
+	if !ok {
+		return fmt.Errorf("open upstream: %w", err)
 	}
 
-	// Handle for routing upstream
-	switch mode {
-	case "faketcp":
-		if isKCP {
-			upConn, err = pcap.DialFakeTCPWithKCP(upDev, gatewayDev, upPort, &net.TCPAddr{IP: serverIP, Port: int(serverPort)}, crypt, mtu, kcpConfig)
-		} else {
-			upConn, err = pcap.DialFakeTCP(upDev, gatewayDev, upPort, &net.TCPAddr{IP: serverIP, Port: int(serverPort)}, crypt, mtu)
-		}
-	case "tcp":
-		upConn, err = pcap.DialTCP(upDev, upPort, &net.TCPAddr{IP: serverIP, Port: int(serverPort)}, crypt)
-	default:
-		err = fmt.Errorf("mode %s not support", mode)
-	}
-	if err != nil {
-		return fmt.Errorf("open upstream: %w", err)
+	go keepResolving()
+
+	if mode == "faketcp" && hopInterval > 0 {
+		go keepHopping()
 	}
 
-	// Ping
-	if pinger != nil {
+	// Start handling
+	if tunDev != nil {
 		go func() {
-			pinger.Run()
+			b := make([]byte, pcap.IPv4MaxSize)
+			for {
+				n, err := tunDev.Read(b)
+				if err != nil {
+					if isClosed {
+						return
+					}
+					log.Errorln(fmt.Errorf("read tun device %s: %w", tunDev.Name(), err))
+					continue
+				}
+
+				err = handleTUN(b[:n])
+				if err != nil {
+					log.Errorln(fmt.Errorf("handle tun device %s: %w", tunDev.Name(), err))
+					continue
+				}
+			}
 		}()
 	}
-
-	// Start handling
 	for i := 0; i < len(listenConns); i++ {
 		conn := listenConns[i]
 
@@ -726,26 +1150,656 @@ func open() error {
 		}
 	}()
 
-	b := make([]byte, pcap.IPv4MaxSize)
-	for {
-		n, err := upConn.Read(b)
-		if err != nil {
-			if isClosed {
-				return nil
-			}
-			if errors.Is(err, io.EOF) {
-				log.Fatalf("Connection to server %s is closed, is the server or your network down?\n", upConn.RemoteAddr())
-			}
-			log.Errorln(fmt.Errorf("read upstream: %w", err))
-			continue
-		}
-
-		err = handleUpstream(b[:n])
-		if err != nil {
-			log.Errorln(fmt.Errorf("handle upstream in address %s: %w", upConn.LocalAddr().String(), err))
-			log.Verbosef("Source: %s\nSize: %d Bytes\n\n", upConn.RemoteAddr().String(), n)
-			continue
-		}
+	var wg sync.WaitGroup
+	for _, p := range paths {
+		wg.Add(1)
+		go func(p *path) {
+			defer wg.Done()
+			p.serve()
+		}(p)
+	}
+	wg.Wait()
+
+	return nil
+}
+
+func listen() error {
+	_, ip, port := currentServer()
+	filter, err := listenFilter(ip, port)
+	if err != nil {
+		return err
+	}
+	filterIP, filterPort = ip, port
+
+	// Handles for listening
+	for _, dev := range listenDevs {
+		var (
+			err  error
+			conn *pcap.RawConn
+		)
+
+		if dev.IsLoop() {
+			conn, err = pcap.CreateRawConn(dev, dev, filter)
+		} else {
+			conn, err = pcap.CreateRawConn(dev, gatewayDev, filter)
+		}
+		if err != nil {
+			return fmt.Errorf("open listen device %s: %w", dev.Alias(), err)
+		}
+
+		listenConns = append(listenConns, conn)
+	}
+
+	return nil
+}
+
+// listenFilter returns the filter for listening, which leaves out packets from the server in the address.
+func listenFilter(serverIP net.IP, serverPort uint16) (string, error) {
+	fs := make([]string, 0)
+	for _, f := range sources {
+		s, err := addr.SrcBPFFilter(f)
+		if err != nil {
+			return "", fmt.Errorf("parse filter %s: %w", f, err)
+		}
+
+		fs = append(fs, s)
+	}
+	f := strings.Join(fs, " || ")
+	serverFilter, err := addr.SrcBPFFilter(&net.IPAddr{IP: serverIP})
+	if err != nil {
+		return "", fmt.Errorf("parse filter %s: %w", serverIP, err)
+	}
+	// Paths may hop across ports of the server in FakeTCP
+	maxPort := serverPort
+	if mode == "faketcp" {
+		maxPort = pcap.HopMaxPort(serverPort, fakeTCPConfig)
+	}
+	serverPortFilter := fmt.Sprintf("(%s && %s)", serverFilter, addr.PortRangeBPFFilter("src", serverPort, maxPort))
+	filter := fmt.Sprintf("ip && (((tcp || udp) && (%s) && not %s) || ((icmp || (ip[6:2] & 0x1fff) != 0) && (%s) && not %s))",
+		f, serverPortFilter, f, serverFilter)
+	// ICMPv6 errors and echo, other ICMPv6 messages like neighbor discovery are left for the system
+	filter = filter + fmt.Sprintf(" || (ip6 && (((tcp || udp) && not %s) || (icmp6 && ip6[40] < 130 && not %s)) && (%s))",
+		serverPortFilter, serverFilter, f)
+	for _, publishIP := range publishIPs {
+		if publishIP.IP.To4() == nil {
+			s, err := addr.NDPBPFFilter(publishIP.IP)
+			if err != nil {
+				return "", fmt.Errorf("parse filter %s: %w", publishIP, err)
+			}
+			filter = filter + fmt.Sprintf(" || %s", s)
+			continue
+		}
+
+		s, err := addr.DstBPFFilter(publishIP)
+		if err != nil {
+			return "", fmt.Errorf("parse filter %s: %w", publishIP, err)
+		}
+		filter = filter + fmt.Sprintf(" || (arp[6:2] = 1 && %s)", s)
+	}
+	// capture share response
+	if share {
+		fs := make([]string, 0)
+		for _, f := range sources {
+			s, err := addr.DstBPFFilter(f)
+			if err != nil {
+				return "", fmt.Errorf("parse filter %s: %w", f, err)
+			}
+	
+			fs = append(fs, s)
+		}
+		f := strings.Join(fs, " || ")
+		filter = filter + fmt.Sprintf(" || (ip && ((%s) and src host %s))", f, upDev.IPAddrs()[0].IP)
+	}
+
+	return filter, nil
+}
+
+// refilter rebuilds the filter of listen handles if the server in use is not the one it is built for, so packets from
+// the server after failing over or moving are left out of listening.
+func refilter() {
+	filterLock.Lock()
+	defer filterLock.Unlock()
+
+	// Packets are read from the TUN device without listening
+	server, ip, port := currentServer()
+	if len(listenConns) <= 0 || ip == nil || (ip.Equal(filterIP) && port == filterPort) {
+		return
+	}
+
+	filter, err := listenFilter(ip, port)
+	if err != nil {
+		log.Errorln(fmt.Errorf("refilter: %w", err))
+		return
+	}
+	for _, conn := range listenConns {
+		err := conn.SetFilter(filter)
+		if err != nil {
+			log.Errorln(fmt.Errorf("refilter listen device %s: %w", conn.LocalDev().Alias(), err))
+			return
+		}
+	}
+	filterIP, filterPort = ip, port
+
+	log.Infof("Leave server %s at %s out of listening\n", server, &net.TCPAddr{IP: ip, Port: int(port)})
+}
+
+// serve reads from the path until IkaGo is closed, the path is reconnected if the connection is lost.
+func (p *path) serve() {
+	var (
+		backoff  time.Duration
+		failures int
+	)
+	b := make([]byte, pcap.IPv4MaxSize)
+	for {
+		p.lock.Lock()
+		conn, h, isDropped, hopped := p.conn, p.heartbeater, p.isDropped, p.hopped
+		p.hopped = nil
+		p.lock.Unlock()
+
+		// The path hops from the connection, which is no longer read here
+		if hopped != nil {
+			go p.drain(hopped)
+		}
+
+		if conn != nil {
+			n, err := conn.Read(b)
+			if err == nil {
+				// The connection is alive
+				backoff = 0
+				failures = 0
+				h.Touch()
+
+				err = handleUpstream(b[:n], conn, p)
+				if err != nil {
+					log.Errorln(fmt.Errorf("handle upstream in address %s: %w", conn.LocalAddr().String(), err))
+					log.Verbosef("Source: %s\nSize: %d Bytes\n\n", conn.RemoteAddr().String(), n)
+				}
+				continue
+			}
+			if isClosed {
+				return
+			}
+			p.lock.RLock()
+			isDropped = isDropped || p.isDropped
+			isHopped := p.conn != conn
+			p.lock.RUnlock()
+			if isHopped && !isDropped {
+				continue
+			}
+			if !errors.Is(err, io.EOF) && !h.IsDead() && !isDropped {
+				log.Errorln(fmt.Errorf("read upstream: %w", err))
+				continue
+			}
+			if !isDropped {
+				log.Errorf("Connection to server %s is lost, is the server or your network down?\n", conn.RemoteAddr())
+				failures++
+			}
+		}
+
+		// Reconnect with jittered exponential backoff
+		for !isClosed {
+			// Fail over to the next server if the server in use keeps failing
+			if failures >= failoverAttempts && len(servers) > 1 {
+				server, _, _ := currentServer()
+				failover(server)
+				failures = 0
+				backoff = 0
+			}
+
+			if backoff < reconnectMinBackoff {
+				backoff = reconnectMinBackoff
+			} else if backoff < reconnectMaxBackoff {
+				backoff = backoff * 2
+			}
+			d := backoff/2 + time.Duration(rand.Int63n(int64(backoff)))
+			log.Infof("Reconnect to server in %.3f s\n", d.Seconds())
+			time.Sleep(d)
+
+			// The server may have moved
+			changed, err := resolveServer()
+			if err == nil {
+				if changed {
+					server, ip, port := currentServer()
+					log.Infof("Server %s is resolved to %s\n", server, &net.TCPAddr{IP: ip, Port: int(port)})
+				}
+				refilter()
+				err = p.connect()
+			}
+			if err != nil {
+				log.Errorln(fmt.Errorf("reconnect: %w", err))
+				failures++
+				continue
+			}
+			break
+		}
+		if isClosed {
+			return
+		}
+	}
+}
+
+// connect connects to the server from the path, the previous connection will be replaced if exists.
+func (p *path) connect() error {
+	p.lock.RLock()
+	port := p.port
+	p.lock.RUnlock()
+
+	_, _, serverPort := currentServer()
+	conn, err := p.dial(port, serverPort)
+	if err != nil {
+		return err
+	}
+
+	err = p.attach(conn)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	return p.replace(conn, port, nil)
+}
+
+// dial dials the port of the server from the port of the path.
+func (p *path) dial(port, serverPort uint16) (net.Conn, error) {
+	var (
+		err  error
+		conn net.Conn
+	)
+
+	server, serverIP, _ := currentServer()
+	if serverIP == nil {
+		return nil, fmt.Errorf("server %s not resolved", server)
+	}
+	host, _, _ := net.SplitHostPort(server)
+
+	// The host of the server in use is the SNI and the WebSocket host by default
+	tc := tlsConfig
+	if tc != nil && tc.ServerName == "" {
+		tc = tc.Clone()
+		tc.ServerName = host
+	}
+	wc := wsConfig
+	if wc != nil && wc.Host == "" {
+		temp := *wc
+		wc = &temp
+		wc.Host = server
+	}
+
+	switch mode {
+	case "faketcp":
+		if isKCP {
+			conn, err = pcap.DialFakeTCPWithKCP(p.dev, p.gatewayDev, port, &net.TCPAddr{IP: serverIP, Port: int(serverPort)}, crypt, mtu, fakeTCPConfig, kcpConfig)
+		} else {
+			conn, err = pcap.DialFakeTCP(p.dev, p.gatewayDev, port, &net.TCPAddr{IP: serverIP, Port: int(serverPort)}, crypt, mtu, fakeTCPConfig)
+		}
+	case "tcp":
+		if isTLS {
+			conn, err = pcap.DialTCPWithTLS(p.dev, port, &net.TCPAddr{IP: serverIP, Port: int(serverPort)}, crypt, tc)
+		} else {
+			conn, err = pcap.DialTCP(p.dev, port, &net.TCPAddr{IP: serverIP, Port: int(serverPort)}, crypt)
+		}
+	case "udp":
+		if isKCP {
+			conn, err = pcap.DialUDPWithKCP(p.dev, port, &net.UDPAddr{IP: serverIP, Port: int(serverPort)}, crypt, kcpConfig)
+		} else {
+			conn, err = pcap.DialUDP(p.dev, port, &net.UDPAddr{IP: serverIP, Port: int(serverPort)}, crypt)
+		}
+	case "ws":
+		conn, err = pcap.DialWS(p.dev, port, &net.TCPAddr{IP: serverIP, Port: int(serverPort)}, crypt, wc, tc)
+	case "icmp":
+		conn, err = pcap.DialICMP(p.dev, p.gatewayDev, port, serverIP, crypt, mtu)
+	default:
+		err = fmt.Errorf("mode %s not support", mode)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// attach attaches the connection to the session of the path, and binds it to the bond in multipath bonding.
+func (p *path) attach(conn net.Conn) error {
+	// Attach the connection to the session, so the server can migrate it if the client reconnects from another address
+	_, err := conn.Write(control.NewSession(p.sessionId, sessionToken, isObfs).Serialize())
+	if err != nil {
+		return fmt.Errorf("session: %w", err)
+	}
+
+	// Bind the connection to the bond in multipath bonding
+	if len(paths) > 1 {
+		_, err = conn.Write(control.NewBind(bondId, uint8(scheduler), uint16(p.weight), sessionToken).Serialize())
+		if err != nil {
+			return fmt.Errorf("bind: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// replace replaces the connection of the path with the connection from the port. If hopped is not nil, the path hops
+// from it, which is left open for draining, and the connection is replaced only if it is still in use.
+func (p *path) replace(conn net.Conn, port uint16, hopped net.Conn) error {
+	h := control.NewHeartbeater()
+
+	// Path MTU discovery, only in connections where IkaGo fragments packets itself
+	var prober *control.Prober
+	mc, isMTUConn := conn.(control.MTUConn)
+	if isMTUConn {
+		prober = control.NewProber(mtu)
+	}
+
+	// Cover packets
+	var coverer *control.Coverer
+	if cover > 0 {
+		coverer = control.NewCoverer(cover)
+	}
+
+	// Jitter, packets are delayed in the bond before being sent in the connection
+	bonded := conn
+	if jitter > 0 {
+		bonded = control.NewJitterConn(conn, jitter)
+	}
+
+	p.lock.Lock()
+	if hopped != nil && (p.conn != hopped || p.isDropped) {
+		p.lock.Unlock()
+		return errors.New("connection replaced")
+	}
+	if p.conn != nil {
+		upBond.Remove(p.bonded)
+		if jc, ok := p.bonded.(*control.JitterConn); ok {
+			jc.Stop()
+		}
+		if hopped != nil {
+			// Wake up the reader of the previous connection, which will drain it
+			if p.hopped != nil {
+				p.hopped.Close()
+			}
+			p.hopped = p.conn
+			_ = p.conn.SetReadDeadline(time.Now())
+		} else {
+			p.conn.Close()
+		}
+	}
+	if p.heartbeater != nil {
+		p.heartbeater.Stop()
+	}
+	if p.prober != nil {
+		p.prober.Stop()
+	}
+	if p.coverer != nil {
+		p.coverer.Stop()
+	}
+	p.conn, p.bonded, p.heartbeater, p.prober, p.coverer, p.isDropped = conn, bonded, h, prober, coverer, false
+	p.port, p.connected = port, time.Now()
+	// Between half and one and a half of the interval
+	if hopInterval > 0 {
+		p.hopAt = p.connected.Add(hopInterval/2 + time.Duration(rand.Int63n(int64(hopInterval)+1)))
+	}
+	p.lock.Unlock()
+	upBond.Add(bonded, p.weight, h)
+
+	// Heartbeat, the connection is closed if the server is dead so reading it will fail
+	go func() {
+		err := h.Run(conn, func() {
+			log.Errorf("Cannot receive heartbeat from server %s, is the server or your network down?\n", conn.RemoteAddr())
+			conn.Close()
+		})
+		if err != nil && !h.IsDead() {
+			log.Errorln(fmt.Errorf("heartbeat: %w", err))
+		}
+	}()
+
+	if prober != nil {
+		go prober.Run(mc, func(mtu int) {
+			log.Infof("Discover path MTU %d to server %s\n", mtu, conn.RemoteAddr())
+		})
+	}
+
+	if coverer != nil {
+		go func() {
+			err := coverer.Run(conn)
+			if err != nil {
+				log.Errorln(fmt.Errorf("cover: %w", err))
+			}
+		}()
+	}
+
+	return nil
+}
+
+// establish waits until the FakeTCP connection finishes handshaking, so the server will not miss messages sent in it.
+func (p *path) establish(conn net.Conn) error {
+	fc, ok := conn.(*pcap.FakeTCPConn)
+	if !ok {
+		return nil
+	}
+
+	_ = fc.SetReadDeadline(time.Now().Add(hopEstablishTimeout))
+	defer fc.SetReadDeadline(time.Time{})
+
+	b := make([]byte, pcap.IPv4MaxSize)
+	for !fc.IsConnected() {
+		n, err := fc.Read(b)
+		if err != nil {
+			return err
+		}
+
+		err = handleUpstream(b[:n], fc, p)
+		if err != nil {
+			log.Errorln(fmt.Errorf("handle upstream in address %s: %w", fc.LocalAddr().String(), err))
+		}
+	}
+
+	return nil
+}
+
+// hop hops the path to a random port, and to a random port of the server in the range it listens on.
+func (p *path) hop(r *rand.Rand) error {
+	p.lock.RLock()
+	prev, isDropped := p.conn, p.isDropped
+	p.lock.RUnlock()
+	if prev == nil || isDropped {
+		return errors.New("path disconnected")
+	}
+
+	port := randomPort(r)
+	_, _, serverPort := currentServer()
+	maxPort := pcap.HopMaxPort(serverPort, fakeTCPConfig)
+	serverPort = serverPort + uint16(r.Intn(int(maxPort-serverPort)+1))
+
+	conn, err := p.dial(port, serverPort)
+	if err != nil {
+		return err
+	}
+
+	err = p.establish(conn)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("establish: %w", err)
+	}
+
+	err = p.attach(conn)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	err = p.replace(conn, port, prev)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	log.Infof("Hop from %s to %s\n", prev.LocalAddr(), conn.LocalAddr())
+
+	return nil
+}
+
+// drain reads packets still in flight in the connection the path hops from, and closes it in a while.
+func (p *path) drain(conn net.Conn) {
+	defer conn.Close()
+
+	_ = conn.SetReadDeadline(time.Now().Add(hopGrace))
+
+	b := make([]byte, pcap.IPv4MaxSize)
+	for {
+		n, err := conn.Read(b)
+		if err != nil {
+			return
+		}
+
+		err = handleUpstream(b[:n], conn, p)
+		if err != nil {
+			log.Errorln(fmt.Errorf("handle upstream in address %s: %w", conn.LocalAddr().String(), err))
+		}
+	}
+}
+
+// drop closes the connection of the path so it will be reconnected.
+func (p *path) drop() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.conn != nil {
+		p.isDropped = true
+		p.conn.Close()
+	}
+}
+
+// currentServer returns the server in use and its address.
+func currentServer() (string, net.IP, uint16) {
+	serverLock.RLock()
+	defer serverLock.RUnlock()
+
+	return servers[serverIndex], serverIP, serverPort
+}
+
+// resolveServer resolves the server in use again, and returns if its address is changed.
+func resolveServer() (bool, error) {
+	serverLock.RLock()
+	server := servers[serverIndex]
+	serverLock.RUnlock()
+
+	serverAddr, err := addr.ParseTCPAddr(server)
+	if err != nil {
+		return false, fmt.Errorf("parse server %s: %w", server, err)
+	}
+
+	serverLock.Lock()
+	defer serverLock.Unlock()
+
+	// The server may be switched in between
+	if servers[serverIndex] != server {
+		return false, nil
+	}
+
+	changed := serverIP != nil && (!serverIP.Equal(serverAddr.IP) || serverPort != uint16(serverAddr.Port))
+	serverIP, serverPort = serverAddr.IP, uint16(serverAddr.Port)
+
+	return changed, nil
+}
+
+// failover switches from the server to the next one, and all paths are reconnected.
+func failover(from string) {
+	serverLock.Lock()
+	// Another path may have failed over already
+	if servers[serverIndex] != from {
+		serverLock.Unlock()
+		return
+	}
+	serverIndex = (serverIndex + 1) % len(servers)
+	to := servers[serverIndex]
+	serverIP, serverPort = nil, 0
+	serverLock.Unlock()
+
+	log.Infof("Fail over from server %s to %s\n", from, to)
+
+	_, err := resolveServer()
+	if err != nil {
+		log.Errorln(fmt.Errorf("resolve: %w", err))
+	}
+	refilter()
+
+	for _, p := range paths {
+		p.drop()
+	}
+}
+
+// keepResolving resolves the server in use periodically, and all paths are reconnected if its address changes.
+func keepResolving() {
+	for !isClosed {
+		time.Sleep(resolveInterval)
+
+		changed, err := resolveServer()
+		if err != nil {
+			log.Errorln(fmt.Errorf("resolve: %w", err))
+			continue
+		}
+		refilter()
+		if !changed {
+			continue
+		}
+
+		server, ip, port := currentServer()
+		log.Infof("Server %s is resolved to %s, reconnect\n", server, &net.TCPAddr{IP: ip, Port: int(port)})
+
+		for _, p := range paths {
+			p.drop()
+		}
+	}
+}
+
+// keepHopping hops paths to new ports periodically, and in advance if a path seems to be throttled.
+func keepHopping() {
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	for !isClosed {
+		time.Sleep(hopCheckInterval)
+
+		for _, p := range paths {
+			p.lock.RLock()
+			conn, h, isDropped, connected, hopAt := p.conn, p.heartbeater, p.isDropped, p.connected, p.hopAt
+			p.lock.RUnlock()
+			if conn == nil || isDropped {
+				continue
+			}
+
+			now := time.Now()
+			loss := h.Loss()
+			isThrottled := now.Sub(connected) >= hopMinAge && loss >= hopLoss
+			if now.Before(hopAt) && !isThrottled {
+				continue
+			}
+			if isThrottled {
+				log.Infof("Lose %.0f%% heartbeats from server %s, hop in advance\n", loss*100, conn.RemoteAddr())
+			}
+
+			err := p.hop(r)
+			if err != nil {
+				log.Errorln(fmt.Errorf("hop from %s: %w", p.dev.Alias(), err))
+			}
+		}
+	}
+}
+
+// randomPort returns a random port for routing upstream which is not in use.
+func randomPort(r *rand.Rand) uint16 {
+	for {
+		port := uint16(49152 + r.Intn(16384))
+		if int(port) == monitorPort {
+			continue
+		}
+
+		isUsed := false
+		for _, p := range paths {
+			p.lock.RLock()
+			isUsed = isUsed || p.port == port
+			p.lock.RUnlock()
+		}
+		if !isUsed {
+			return port
+		}
 	}
 }
 
@@ -756,21 +1810,35 @@ func closeAll() {
 			handle.Close()
 		}
 	}
-	if upConn != nil {
-		upConn.Close()
+	if tunDev != nil {
+		tunDev.Close()
 	}
-	if pinger != nil {
-		pinger.Stop()
+	for _, p := range paths {
+		p.lock.RLock()
+		if p.conn != nil {
+			p.conn.Close()
+		}
+		if jc, ok := p.bonded.(*control.JitterConn); ok {
+			jc.Stop()
+		}
+		if p.heartbeater != nil {
+			p.heartbeater.Stop()
+		}
+		if p.prober != nil {
+			p.prober.Stop()
+		}
+		if p.coverer != nil {
+			p.coverer.Stop()
+		}
+		p.lock.RUnlock()
 	}
 }
 
 func publish(packet gopacket.Packet, conn *pcap.RawConn) error {
 	var (
-		indicator    *pcap.PacketIndicator
-		arpLayer     *layers.ARP
-		newARPLayer  *layers.ARP
-		linkLayer    gopacket.Layer
-		newLinkLayer *layers.Ethernet
+		indicator *pcap.PacketIndicator
+		linkLayer gopacket.Layer
+		data      []byte
 	)
 
 	// Parse packet
@@ -779,13 +1847,61 @@ func publish(packet gopacket.Packet, conn *pcap.RawConn) error {
 		return fmt.Errorf("parse packet: %w", err)
 	}
 
-	if t := indicator.NetworkLayer().LayerType(); t != layers.LayerTypeARP {
+	linkLayer = packet.LinkLayer()
+	if t := linkLayer.LayerType(); t != layers.LayerTypeEthernet {
+		return fmt.Errorf("link layer type %s not support", t)
+	}
+
+	switch t := indicator.NetworkLayer().LayerType(); t {
+	case layers.LayerTypeARP:
+		data, err = createARPReply(indicator, linkLayer.(*layers.Ethernet), conn)
+	case layers.LayerTypeIPv6:
+		// Duplicate address detections are not replied
+		if indicator.SrcIP().IsUnspecified() {
+			return nil
+		}
+
+		data, err = createNeighborAdvertisement(indicator, linkLayer.(*layers.Ethernet), conn)
+	default:
 		return fmt.Errorf("network layer type %s not support", t)
 	}
+	if err != nil {
+		return err
+	}
+
+	// Write packet data
+	_, err = conn.Write(data)
+	if err != nil {
+		return fmt.Errorf("write: %w", err)
+	}
+
+	// Reconnect
+	for _, p := range paths {
+		p.lock.RLock()
+		if p.conn != nil {
+			switch p.conn.(type) {
+			case *pcap.FakeTCPConn:
+				err = p.conn.(*pcap.FakeTCPConn).Reconnect()
+			default:
+				break
+			}
+		}
+		p.lock.RUnlock()
+		if err != nil {
+			return fmt.Errorf("reconnect: %w", err)
+		}
+	}
+
+	log.Infof("Device %s [%s] joined the network\n", indicator.SrcIP(), indicator.SrcHardwareAddr())
+	log.Verbosef("Reply an %s request: %s -> %s\n", indicator.NetworkLayer().LayerType(), indicator.SrcIP(), indicator.DstIP())
+
+	return nil
+}
 
+func createARPReply(indicator *pcap.PacketIndicator, ethernetLayer *layers.Ethernet, conn *pcap.RawConn) ([]byte, error) {
 	// Create new ARP layer
-	arpLayer = indicator.ARPLayer()
-	newARPLayer = &layers.ARP{
+	arpLayer := indicator.ARPLayer()
+	newARPLayer := &layers.ARP{
 		AddrType:          arpLayer.AddrType,
 		Protocol:          arpLayer.Protocol,
 		HwAddressSize:     arpLayer.HwAddressSize,
@@ -798,48 +1914,58 @@ func publish(packet gopacket.Packet, conn *pcap.RawConn) error {
 	}
 
 	// Create new link layer
-	linkLayer = packet.LinkLayer()
-
-	switch t := linkLayer.LayerType(); t {
-	case layers.LayerTypeEthernet:
-		newLinkLayer = &layers.Ethernet{
-			SrcMAC:       conn.LocalDev().HardwareAddr(),
-			DstMAC:       linkLayer.(*layers.Ethernet).SrcMAC,
-			EthernetType: linkLayer.(*layers.Ethernet).EthernetType,
-		}
-	default:
-		return fmt.Errorf("link layer type %s not support", t)
+	newLinkLayer := &layers.Ethernet{
+		SrcMAC:       conn.LocalDev().HardwareAddr(),
+		DstMAC:       ethernetLayer.SrcMAC,
+		EthernetType: ethernetLayer.EthernetType,
 	}
 
 	// Serialize layers
 	data, err := pcap.Serialize(newLinkLayer, newARPLayer)
 	if err != nil {
-		return fmt.Errorf("serialize: %w", err)
+		return nil, fmt.Errorf("serialize: %w", err)
 	}
 
-	// Write packet data
-	_, err = conn.Write(data)
-	if err != nil {
-		return fmt.Errorf("write: %w", err)
+	return data, nil
+}
+
+func createNeighborAdvertisement(indicator *pcap.PacketIndicator, ethernetLayer *layers.Ethernet, conn *pcap.RawConn) ([]byte, error) {
+	if indicator.ICMPv6Indicator() == nil || !indicator.ICMPv6Indicator().IsNDP() {
+		return nil, errors.New("missing neighbor solicitation")
 	}
+	target := indicator.ICMPv6Indicator().NeighborSolicitationLayer().TargetAddress
 
-	// Reconnect
-	if upConn != nil {
-		switch upConn.(type) {
-		case *pcap.FakeTCPConn:
-			err = upConn.(*pcap.FakeTCPConn).Reconnect()
-		default:
-			break
-		}
+	// Create new ICMPv6 layer, flags are solicited and override
+	newICMPv6Layer := &layers.ICMPv6{
+		TypeCode: layers.CreateICMPv6TypeCode(layers.ICMPv6TypeNeighborAdvertisement, 0),
+	}
+	newNALayer := &layers.ICMPv6NeighborAdvertisement{
+		Flags:         0x60,
+		TargetAddress: target,
+		Options: layers.ICMPv6Options{
+			layers.ICMPv6Option{Type: layers.ICMPv6OptTargetAddress, Data: conn.LocalDev().HardwareAddr()},
+		},
 	}
+
+	// Create new network layer, neighbor discovery messages are sent with hop limit 255
+	newIPv6Layer, err := pcap.CreateIPv6Layer(target, indicator.SrcIP(), 255, newICMPv6Layer)
 	if err != nil {
-		return fmt.Errorf("reconnect: %w", err)
+		return nil, fmt.Errorf("create network layer: %w", err)
 	}
 
-	log.Infof("Device %s [%s] joined the network\n", indicator.SrcIP(), net.HardwareAddr(arpLayer.SourceHwAddress))
-	log.Verbosef("Reply an %s request: %s -> %s\n", indicator.NetworkLayer().LayerType(), indicator.SrcIP(), indicator.DstIP())
+	// Create new link layer
+	newLinkLayer, err := pcap.CreateEthernetLayer(conn.LocalDev().HardwareAddr(), ethernetLayer.SrcMAC, newIPv6Layer)
+	if err != nil {
+		return nil, fmt.Errorf("create link layer: %w", err)
+	}
 
-	return nil
+	// Serialize layers
+	data, err := pcap.Serialize(newLinkLayer, newIPv6Layer, newICMPv6Layer, newNALayer)
+	if err != nil {
+		return nil, fmt.Errorf("serialize: %w", err)
+	}
+
+	return data, nil
 }
 
 func handleListen(packet gopacket.Packet, conn *pcap.RawConn) error {
@@ -856,8 +1982,9 @@ func handleListen(packet gopacket.Packet, conn *pcap.RawConn) error {
 		return fmt.Errorf("parse packet: %w", err)
 	}
 
-	// ARP
-	if indicator.NetworkLayer().LayerType() == layers.LayerTypeARP {
+	// ARP and NDP
+	if indicator.NetworkLayer().LayerType() == layers.LayerTypeARP ||
+		(indicator.ICMPv6Indicator() != nil && indicator.ICMPv6Indicator().IsNDP()) {
 		err := publish(packet, conn)
 		if err != nil {
 			return fmt.Errorf("publish: %w", err)
@@ -877,7 +2004,7 @@ func handleListen(packet gopacket.Packet, conn *pcap.RawConn) error {
 		data = append(data, packet.NetworkLayer().LayerContents()...)
 		data = append(data, packet.NetworkLayer().LayerPayload()...)
 		// Write packet data
-		_, err = upConn.Write(data)
+		_, err = upBond.Write(data)
 		if err != nil {
 			return fmt.Errorf("write: %w", err)
 		}
@@ -927,7 +2054,7 @@ func handleListen(packet gopacket.Packet, conn *pcap.RawConn) error {
 	return nil
 }
 
-func handleUpstream(contents []byte) error {
+func handleUpstream(contents []byte, conn net.Conn, p *path) error {
 	var (
 		embIndicator     *pcap.PacketIndicator
 		newLinkLayer     gopacket.Layer
@@ -941,12 +2068,29 @@ func handleUpstream(contents []byte) error {
 		return nil
 	}
 
+	// Control message
+	if control.IsControl(contents) {
+		return handleControl(contents, conn, p)
+	}
+
 	// Parse embedded packet
 	embIndicator, err := pcap.ParseEmbPacket(contents)
 	if err != nil {
 		return fmt.Errorf("parse embedded packet: %w", err)
 	}
 
+	// Packets to the TUN device have no link layer
+	if tunDev != nil {
+		_, err = tunDev.Write(contents)
+		if err != nil {
+			return fmt.Errorf("write: %w", err)
+		}
+
+		recordUpstream(embIndicator)
+
+		return nil
+	}
+
 	// Check map
 	natLock.RLock()
 	ni, ok := nat[embIndicator.DstIP().String()]
@@ -979,7 +2123,7 @@ func handleUpstream(contents []byte) error {
 	data, err = pcap.SerializeRaw(newLinkLayer.(gopacket.SerializableLayer),
 		gopacket.Payload(embIndicator.NetworkLayer().LayerContents()),
 		gopacket.Payload(embIndicator.NetworkPayload()))
-	if share && embIndicator.DNSIndicator() != nil {
+	if share && embIndicator.DNSIndicator() != nil && embIndicator.IPv4Layer() != nil {
 		if embIndicator.DNSIndicator().IsResponse() {
 			name, _ := embIndicator.DNSIndicator().Answers()
 			if name == "api.twitter.com" || name == "www.facebook.com" {
@@ -1007,6 +2151,13 @@ func handleUpstream(contents []byte) error {
 		return fmt.Errorf("write: %w", err)
 	}
 
+	recordUpstream(embIndicator)
+
+	return nil
+}
+
+// recordUpstream records statistics and DNS of an inbound packet.
+func recordUpstream(embIndicator *pcap.PacketIndicator) {
 	// Statistics
 	if monitor != nil {
 		monitor.AddBidirectional(embIndicator.DstIP().String(), embIndicator.SrcIP().String(), stat.DirectionIn, uint(embIndicator.Size()))
@@ -1029,6 +2180,47 @@ func handleUpstream(contents []byte) error {
 
 	log.Verbosef("Redirect an inbound %s packet: %s <- %s (%d Bytes)\n",
 		embIndicator.TransportProtocol(), embIndicator.Dst().String(), embIndicator.Src().String(), embIndicator.Size())
+}
+
+func handleTUN(contents []byte) error {
+	if len(contents) <= 0 {
+		return nil
+	}
+	switch contents[0] >> 4 {
+	case 4:
+		break
+	case 6:
+		// Packets the system sends to the link on its own, like router solicitations and multicast listener reports,
+		// are ignored
+		if len(contents) >= 40 {
+			dstIP := net.IP(contents[24:40])
+			if dstIP.IsLinkLocalUnicast() || dstIP.IsLinkLocalMulticast() || dstIP.IsInterfaceLocalMulticast() {
+				return nil
+			}
+		}
+	default:
+		return nil
+	}
+
+	indicator, err := pcap.ParseEmbPacket(contents)
+	if err != nil {
+		return fmt.Errorf("parse packet: %w", err)
+	}
+
+	// Write packet data
+	_, err = upBond.Write(contents)
+	if err != nil {
+		return fmt.Errorf("write: %w", err)
+	}
+
+	// Statistics
+	size := indicator.MTU()
+	if monitor != nil {
+		monitor.AddBidirectional(indicator.SrcIP().String(), indicator.DstIP().String(), stat.DirectionOut, uint(size))
+	}
+
+	log.Verbosef("Redirect an outbound %s packet: %s -> %s (%d Bytes)\n",
+		indicator.TransportProtocol(), indicator.Src().String(), indicator.Dst().String(), size)
 
 	return nil
 }
@@ -1048,3 +2240,103 @@ func splitArg(s string) []string {
 
 	return result
 }
+
+// parseSizes parses sizes in bytes.
+func parseSizes(strs []string) ([]int, error) {
+	result := make([]int, 0)
+
+	for _, str := range strs {
+		size, err := strconv.Atoi(str)
+		if err != nil {
+			return nil, fmt.Errorf("parse size %s: %w", str, err)
+		}
+
+		result = append(result, size)
+	}
+
+	return result, nil
+}
+
+// parsePaths parses paths described as device[:port[:weight]].
+func parsePaths(strs []string) ([]config.PathConfig, error) {
+	result := make([]config.PathConfig, 0)
+
+	for _, str := range strs {
+		var (
+			err error
+			pc  config.PathConfig
+		)
+
+		parts := strings.Split(str, ":")
+		if len(parts) > 3 {
+			return nil, fmt.Errorf("invalid path %s", str)
+		}
+
+		pc.UpDev = parts[0]
+		if len(parts) > 1 {
+			pc.Port, err = strconv.Atoi(parts[1])
+			if err != nil {
+				return nil, fmt.Errorf("parse port %s: %w", parts[1], err)
+			}
+		}
+		if len(parts) > 2 {
+			pc.Weight, err = strconv.Atoi(parts[2])
+			if err != nil {
+				return nil, fmt.Errorf("parse weight %s: %w", parts[2], err)
+			}
+		}
+
+		result = append(result, pc)
+	}
+
+	return result, nil
+}
+
+func handleControl(contents []byte, conn net.Conn, p *path) error {
+	message, err := control.Parse(contents)
+	if err != nil {
+		return fmt.Errorf("parse control message: %w", err)
+	}
+
+	// Reply in the connection the message is received, which may be the one the path hops from or to
+	p.lock.RLock()
+	h, prober := p.heartbeater, p.prober
+	p.lock.RUnlock()
+
+	switch t := message.Type(); t {
+	case control.TypeHeartbeat:
+		_, err := conn.Write(message.(*control.Heartbeat).Reply().Serialize())
+		if err != nil {
+			return fmt.Errorf("reply heartbeat: %w", err)
+		}
+	case control.TypeProbe:
+		_, err := conn.Write(message.(*control.Probe).Reply().Serialize())
+		if err != nil {
+			return fmt.Errorf("reply probe: %w", err)
+		}
+	case control.TypeProbeReply:
+		if prober == nil {
+			return fmt.Errorf("missing prober of server %s", conn.RemoteAddr())
+		}
+
+		prober.Receive(message.(*control.Probe))
+	case control.TypeHeartbeatReply:
+		h.Receive(message.(*control.Heartbeat))
+
+		if rtt, ok := h.RTT(); ok {
+			log.Verbosef("Receive heartbeat reply: %s <- %s (%d ms)\n", conn.LocalAddr(), conn.RemoteAddr(), rtt.Milliseconds())
+		}
+	case control.TypeSession:
+		// The server rejects the session, obfuscation is not enabled in both sides
+		if message.(*control.Session).IsObfs() != isObfs {
+			if isObfs {
+				log.Fatalf("Obfuscation is not enabled in server %s\n", conn.RemoteAddr())
+			}
+			log.Fatalf("Obfuscation is enabled in server %s\n", conn.RemoteAddr())
+		}
+	default:
+		return fmt.Errorf("%s not support", t)
+	}
+
+	return nil
+}
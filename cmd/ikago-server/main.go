@@ -1,6 +1,7 @@
 package main
 
 import (
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"flag"
@@ -9,11 +10,14 @@
 	"github.com/google/gopacket/layers"
 	"github.com/xtaci/kcp-go"
 	"ikago/internal/addr"
+	"ikago/internal/bond"
 	"ikago/internal/config"
+	"ikago/internal/control"
 	"ikago/internal/crypto"
 	"ikago/internal/exec"
 	"ikago/internal/log"
 	"ikago/internal/pcap"
+	"ikago/internal/session"
 	"ikago/internal/stat"
 	"io"
 	"math"
@@ -22,6 +26,7 @@
 	"os"
 	"os/signal"
 	"runtime"
+	"strconv"
 	"strings"
 	"sync"
 	"syscall"
@@ -37,7 +42,7 @@ type quintuple struct {
 type natIndicator struct {
 	src    net.Addr
 	embSrc net.Addr
-	conn   net.Conn
+	conn   io.Writer
 }
 
 func (indicator *natIndicator) embSrcIP() net.IP {
@@ -55,10 +60,69 @@ func (indicator *natIndicator) embSrcIP() net.IP {
 	}
 }
 
+// endpoint is a mode and a port the server listens on, with its own encryption and KCP.
+type endpoint struct {
+	mode      string
+	port      uint16
+	crypt     crypto.Crypt
+	cover     time.Duration
+	jitter    time.Duration
+	isKCP     bool
+	kcpConfig *config.KCPConfig
+}
+
+// maxPort returns the max port the endpoint listens on, which covers ports clients can hop to in FakeTCP.
+func (e *endpoint) maxPort() uint16 {
+	if e.mode == "faketcp" {
+		return pcap.HopMaxPort(e.port, fakeTCPConfig)
+	}
+
+	return e.port
+}
+
+func (e *endpoint) String() string {
+	var s string
+
+	switch e.mode {
+	case "faketcp":
+		s = "FakeTCP"
+	case "tcp":
+		s = "standard TCP"
+	case "udp":
+		s = "standard UDP"
+	case "icmp":
+		s = "ICMP"
+	case "ws":
+		s = "WebSocket"
+	default:
+		s = e.mode
+	}
+
+	// Listeners in mode ICMP have no port
+	if e.mode != "icmp" {
+		if maxPort := e.maxPort(); maxPort > e.port {
+			s = s + fmt.Sprintf(" on :%d-%d", e.port, maxPort)
+		} else {
+			s = s + fmt.Sprintf(" on :%d", e.port)
+		}
+	}
+
+	if method := e.crypt.Method(); method != crypto.MethodPlain {
+		s = s + fmt.Sprintf(" encrypted with %s", method)
+	}
+	if e.isKCP {
+		s = s + " with KCP"
+	}
+
+	return s
+}
+
 const name string = "IkaGo-server"
 
 const keepAlive = 30 * time.Second
 const keepFragments = 30 * time.Second
+const keepSession = 2 * time.Minute
+const keepMigrated = 5 * time.Second
 
 var (
 	version     = ""
@@ -69,63 +133,95 @@ func (indicator *natIndicator) embSrcIP() net.IP {
 )
 
 var (
-	argListDevs       = flag.Bool("list-devices", false, "List all valid devices in current computer.")
-	argConfig         = flag.String("c", "", "Configuration file.")
-	argListenDevs     = flag.String("listen-devices", "", "Devices for listening.")
-	argUpDev          = flag.String("upstream-device", "", "Device for routing upstream to.")
-	argGateway        = flag.String("gateway", "", "Gateway address.")
-	argMode           = flag.String("mode", "faketcp", "Mode.")
-	argMethod         = flag.String("method", "plain", "Method of encryption.")
-	argPassword       = flag.String("password", "", "Password of encryption.")
-	argRule           = flag.Bool("rule", false, "Add firewall rule.")
-	argVerbose        = flag.Bool("v", false, "Print verbose messages.")
-	argLog            = flag.String("log", "", "Log.")
-	argMonitor        = flag.Int("monitor", 0, "Port for monitoring.")
-	argMTU            = flag.Int("mtu", 0, "MTU.")
-	argKCP            = flag.Bool("kcp", false, "Enable KCP.")
-	argKCPMTU         = flag.Int("kcp-mtu", kcp.IKCP_MTU_DEF, "KCP tuning option mtu.")
-	argKCPSendWindow  = flag.Int("kcp-sndwnd", kcp.IKCP_WND_SND, "KCP tuning option sndwnd.")
-	argKCPRecvWindow  = flag.Int("kcp-rcvwnd", kcp.IKCP_WND_RCV, "KCP tuning option rcvwnd.")
-	argKCPDataShard   = flag.Int("kcp-datashard", 10, "KCP tuning option datashard.")
-	argKCPParityShard = flag.Int("kcp-parityshard", 3, "KCP tuning option parityshard.")
-	argKCPACKNoDelay  = flag.Bool("kcp-acknodelay", false, "KCP tuning option acknodelay.")
-	argKCPNoDelay     = flag.Bool("kcp-nodelay", false, "KCP tuning option nodelay.")
-	argKCPInterval    = flag.Int("kcp-interval", kcp.IKCP_INTERVAL, "KCP tuning option interval.")
-	argKCPResend      = flag.Int("kcp-resend", 0, "KCP tuning option resend.")
-	argKCPNC          = flag.Int("kcp-nc", 0, "KCP tuning option nc.")
-	argPort           = flag.Int("p", 0, "Port for listening.")
+	argListDevs         = flag.Bool("list-devices", false, "List all valid devices in current computer.")
+	argConfig           = flag.String("c", "", "Configuration file.")
+	argListenDevs       = flag.String("listen-devices", "", "Devices for listening.")
+	argUpDev            = flag.String("upstream-device", "", "Device for routing upstream to.")
+	argGateway          = flag.String("gateway", "", "Gateway address.")
+	argMode             = flag.String("mode", "faketcp", "Mode.")
+	argMethod           = flag.String("method", "plain", "Method of encryption.")
+	argPassword         = flag.String("password", "", "Password of encryption.")
+	argRule             = flag.Bool("rule", false, "Add firewall rule.")
+	argVerbose          = flag.Bool("v", false, "Print verbose messages.")
+	argLog              = flag.String("log", "", "Log.")
+	argMonitor          = flag.Int("monitor", 0, "Port for monitoring.")
+	argMTU              = flag.Int("mtu", 0, "MTU.")
+	argBackend          = flag.String("backend", "", "Backend of capturing and injecting packets.")
+	argAFPacketFanout   = flag.Int("afpacket-fanout", 1, "AF_PACKET tuning option fanout.")
+	argFakeTCPEmulation = flag.Bool("faketcp-emulation", false, "FakeTCP tuning option emulation.")
+	argFakeTCPProfile   = flag.String("faketcp-profile", "", "FakeTCP tuning option profile.")
+	argFakeTCPTLS       = flag.Bool("faketcp-tls", false, "FakeTCP tuning option tls.")
+	argFakeTCPIdle      = flag.Int("faketcp-idle-timeout", 60, "FakeTCP tuning option idle-timeout.")
+	argFakeTCPClients   = flag.Int("faketcp-max-clients", 1024, "FakeTCP tuning option max-clients.")
+	argFakeTCPHopPorts  = flag.Int("faketcp-hop-ports", 0, "FakeTCP tuning option hop-ports.")
+	argKCP              = flag.Bool("kcp", false, "Enable KCP.")
+	argKCPMTU           = flag.Int("kcp-mtu", kcp.IKCP_MTU_DEF, "KCP tuning option mtu.")
+	argKCPSendWindow    = flag.Int("kcp-sndwnd", kcp.IKCP_WND_SND, "KCP tuning option sndwnd.")
+	argKCPRecvWindow    = flag.Int("kcp-rcvwnd", kcp.IKCP_WND_RCV, "KCP tuning option rcvwnd.")
+	argKCPDataShard     = flag.Int("kcp-datashard", 10, "KCP tuning option datashard.")
+	argKCPParityShard   = flag.Int("kcp-parityshard", 3, "KCP tuning option parityshard.")
+	argKCPACKNoDelay    = flag.Bool("kcp-acknodelay", false, "KCP tuning option acknodelay.")
+	argKCPNoDelay       = flag.Bool("kcp-nodelay", false, "KCP tuning option nodelay.")
+	argKCPInterval      = flag.Int("kcp-interval", kcp.IKCP_INTERVAL, "KCP tuning option interval.")
+	argKCPResend        = flag.Int("kcp-resend", 0, "KCP tuning option resend.")
+	argKCPNC            = flag.Int("kcp-nc", 0, "KCP tuning option nc.")
+	argObfs             = flag.Bool("obfs", false, "Enable obfuscation.")
+	argObfsPadding      = flag.Int("obfs-padding", 128, "Obfuscation tuning option padding.")
+	argObfsBuckets      = flag.String("obfs-buckets", "", "Obfuscation tuning option buckets.")
+	argObfsCover        = flag.Int("obfs-cover", 0, "Obfuscation tuning option cover.")
+	argObfsJitter       = flag.Int("obfs-jitter", 0, "Obfuscation tuning option jitter.")
+	argTLS              = flag.Bool("tls", false, "Enable TLS.")
+	argTLSServerName    = flag.String("tls-sni", "", "TLS option sni.")
+	argTLSCert          = flag.String("tls-cert", "", "TLS option cert.")
+	argTLSKey           = flag.String("tls-key", "", "TLS option key.")
+	argWSPath           = flag.String("ws-path", "/", "WebSocket option path.")
+	argPort             = flag.Int("p", 0, "Port for listening.")
+	argListeners        = flag.String("listeners", "", "Listeners in multiple modes and ports.")
 )
 
 var (
-	port       uint16
-	listenDevs []*pcap.Device
-	upDev      *pcap.Device
-	gatewayDev *pcap.Device
-	mode       string
-	crypt      crypto.Crypt
-	mtu        int
-	isKCP      bool
-	kcpConfig  *config.KCPConfig
+	endpoints     []*endpoint
+	listenDevs    []*pcap.Device
+	upDev         *pcap.Device
+	gatewayDev    *pcap.Device
+	mtu           int
+	fakeTCPConfig *config.FakeTCPConfig
+	isObfs        bool
+	isTLS         bool
+	tlsConfig     *tls.Config
+	wsConfig      *config.WSConfig
 )
 
 var (
-	isClosed     bool
-	listeners    []net.Listener
-	upConn       *pcap.RawConn
-	c            chan pcap.ConnBytes
-	defrag       *pcap.EasyDefragmenter
-	nextTCPPort  uint16
-	tcpPortPool  []time.Time
-	nextUDPPort  uint16
-	udpPortPool  []time.Time
-	nextICMPv4Id uint16
-	icmpv4IdPool []time.Time
-	patMap       map[quintuple]uint16
-	natLock      sync.RWMutex
-	nat          map[pcap.NATGuide]*natIndicator
-	monitor      *stat.TrafficMonitor
-	dnsLock      sync.RWMutex
-	dns          map[string]string
+	isClosed      bool
+	listeners     []net.Listener
+	upConn        *pcap.RawConn
+	c             chan pcap.ConnBytes
+	defrag        *pcap.EasyDefragmenter
+	nextTCPPort   uint16
+	tcpPortPool   []time.Time
+	nextUDPPort   uint16
+	udpPortPool   []time.Time
+	nextICMPv4Id  uint16
+	icmpv4IdPool  []time.Time
+	nextICMPv6Id  uint16
+	icmpv6IdPool  []time.Time
+	patMap        map[quintuple]uint16
+	natLock       sync.RWMutex
+	nat           map[pcap.NATGuide]*natIndicator
+	heartbeatLock sync.RWMutex
+	heartbeaters  map[string]*control.Heartbeater
+	proberLock    sync.RWMutex
+	probers       map[string]*control.Prober
+	bondLock      sync.RWMutex
+	bonds         map[uint64]*bond.Bond
+	bindings      map[net.Conn]*bond.Bond
+	sessionLock   sync.RWMutex
+	sessions      map[uint64]*session.Session
+	attachments   map[net.Conn]*session.Session
+	monitor       *stat.TrafficMonitor
+	dnsLock       sync.RWMutex
+	dns           map[string]string
 )
 
 func init() {
@@ -169,8 +265,15 @@ func init() {
 	tcpPortPool = make([]time.Time, 16384)
 	udpPortPool = make([]time.Time, 16384)
 	icmpv4IdPool = make([]time.Time, 65536)
+	icmpv6IdPool = make([]time.Time, 65536)
 	patMap = make(map[quintuple]uint16)
 	nat = make(map[pcap.NATGuide]*natIndicator)
+	heartbeaters = make(map[string]*control.Heartbeater)
+	probers = make(map[string]*control.Prober)
+	bonds = make(map[uint64]*bond.Bond)
+	bindings = make(map[net.Conn]*bond.Bond)
+	sessions = make(map[uint64]*session.Session)
+	attachments = make(map[net.Conn]*session.Session)
 	dns = make(map[string]string)
 }
 
@@ -201,6 +304,16 @@ func main() {
 		cfg.Log = *argLog
 		cfg.Monitor = *argMonitor
 		cfg.MTU = *argMTU
+		cfg.Backend = *argBackend
+		cfg.AFPacketConfig = *config.NewAFPacketConfig()
+		cfg.AFPacketConfig.Fanout = *argAFPacketFanout
+		cfg.FakeTCPConfig = *config.NewFakeTCPConfig()
+		cfg.FakeTCPConfig.Emulation = *argFakeTCPEmulation
+		cfg.FakeTCPConfig.Profile = *argFakeTCPProfile
+		cfg.FakeTCPConfig.TLS = *argFakeTCPTLS
+		cfg.FakeTCPConfig.IdleTimeout = *argFakeTCPIdle
+		cfg.FakeTCPConfig.MaxClients = *argFakeTCPClients
+		cfg.FakeTCPConfig.HopPorts = *argFakeTCPHopPorts
 		cfg.KCP = *argKCP
 		cfg.KCPConfig = *config.NewKCPConfig()
 		cfg.KCPConfig.MTU = *argKCPMTU
@@ -213,7 +326,27 @@ func main() {
 		cfg.KCPConfig.Interval = *argKCPInterval
 		cfg.KCPConfig.Resend = *argKCPResend
 		cfg.KCPConfig.NC = *argKCPNC
+		cfg.Obfs = *argObfs
+		cfg.ObfsConfig = *config.NewObfsConfig()
+		cfg.ObfsConfig.Padding = *argObfsPadding
+		cfg.ObfsConfig.Buckets, err = parseSizes(splitArg(*argObfsBuckets))
+		if err != nil {
+			log.Fatalln(fmt.Errorf("parse obfs buckets: %w", err))
+		}
+		cfg.ObfsConfig.Cover = *argObfsCover
+		cfg.ObfsConfig.Jitter = *argObfsJitter
+		cfg.TLS = *argTLS
+		cfg.TLSConfig = *config.NewTLSConfig()
+		cfg.TLSConfig.ServerName = *argTLSServerName
+		cfg.TLSConfig.Cert = *argTLSCert
+		cfg.TLSConfig.Key = *argTLSKey
+		cfg.WSConfig = *config.NewWSConfig()
+		cfg.WSConfig.Path = *argWSPath
 		cfg.Port = *argPort
+		cfg.Listeners, err = parseListeners(splitArg(*argListeners))
+		if err != nil {
+			log.Fatalln(fmt.Errorf("parse listeners: %w", err))
+		}
 	}
 
 	// Log
@@ -247,6 +380,28 @@ func main() {
 		}
 	}
 
+	// Backend
+	backend, err := pcap.ParseBackend(cfg.Backend)
+	if err != nil {
+		log.Fatalln(fmt.Errorf("parse backend: %w", err))
+	}
+	if cfg.AFPacketConfig.Fanout <= 0 {
+		log.Fatalln(fmt.Errorf("afpacket fanout %d out of range", cfg.AFPacketConfig.Fanout))
+	}
+	if cfg.AFPacketConfig.BlockSize <= 0 {
+		log.Fatalln(fmt.Errorf("afpacket block size %d out of range", cfg.AFPacketConfig.BlockSize))
+	}
+	if cfg.AFPacketConfig.Blocks <= 0 {
+		log.Fatalln(fmt.Errorf("afpacket blocks %d out of range", cfg.AFPacketConfig.Blocks))
+	}
+	err = pcap.SetBackend(backend, &cfg.AFPacketConfig)
+	if err != nil {
+		log.Fatalln(fmt.Errorf("set backend: %w", err))
+	}
+	if backend == pcap.BackendAFPacket {
+		log.Infoln("Capture with AF_PACKET")
+	}
+
 	// Exclusive commands
 	if *argListDevs {
 		log.Infoln("Available devices are listed below, use -listen-devices [devices] or -upstream-device [device] to designate device:")
@@ -261,7 +416,7 @@ func main() {
 	}
 
 	// Verify parameters
-	if cfg.Port == 0 {
+	if cfg.Port == 0 && len(cfg.Listeners) <= 0 {
 		log.Fatalln("Please provide listen port by -p port.")
 	}
 	if cfg.Gateway != "" {
@@ -280,79 +435,124 @@ func main() {
 			log.Fatalln(fmt.Errorf("mtu %d out of range", cfg.MTU))
 		}
 	}
-	if cfg.KCPConfig.MTU > 1500 {
-		log.Fatalln(fmt.Errorf("kcp mtu %d out of range", cfg.KCPConfig.MTU))
-	}
-	if cfg.KCPConfig.SendWindow <= 0 || cfg.KCPConfig.SendWindow > math.MaxInt32 {
-		log.Fatalln(fmt.Errorf("kcp send window %d out of range", cfg.KCPConfig.SendWindow))
+	err = verifyKCPConfig(&cfg.KCPConfig)
+	if err != nil {
+		log.Fatalln(err)
 	}
-	if cfg.KCPConfig.RecvWindow <= 0 || cfg.KCPConfig.RecvWindow > math.MaxInt32 {
-		log.Fatalln(fmt.Errorf("kcp receive window %d out of range", cfg.KCPConfig.RecvWindow))
+	if cfg.FakeTCPConfig.IdleTimeout < 0 {
+		log.Fatalln(fmt.Errorf("faketcp idle timeout %d out of range", cfg.FakeTCPConfig.IdleTimeout))
 	}
-	if cfg.KCPConfig.DataShard < 0 {
-		log.Fatalln(fmt.Errorf("kcp data shard %d out of range", cfg.KCPConfig.DataShard))
+	if cfg.FakeTCPConfig.MaxClients < 0 {
+		log.Fatalln(fmt.Errorf("faketcp max clients %d out of range", cfg.FakeTCPConfig.MaxClients))
 	}
-	if cfg.KCPConfig.ParityShard < 0 {
-		log.Fatalln(fmt.Errorf("kcp parity shard %d out of range", cfg.KCPConfig.ParityShard))
+	if cfg.FakeTCPConfig.HopPorts < 0 || cfg.FakeTCPConfig.HopPorts > 65535 {
+		log.Fatalln(fmt.Errorf("faketcp hop ports %d out of range", cfg.FakeTCPConfig.HopPorts))
 	}
-	if cfg.KCPConfig.Interval < 0 {
-		log.Fatalln(fmt.Errorf("kcp interval %d out of range", cfg.KCPConfig.Interval))
+	if cfg.ObfsConfig.Padding < 0 || cfg.ObfsConfig.Padding > 65535 {
+		log.Fatalln(fmt.Errorf("obfs padding %d out of range", cfg.ObfsConfig.Padding))
 	}
-	if cfg.KCPConfig.Resend < 0 {
-		log.Fatalln(fmt.Errorf("kcp resend %d out of range", cfg.KCPConfig.Resend))
+	for _, bucket := range cfg.ObfsConfig.Buckets {
+		if bucket <= 0 {
+			log.Fatalln(fmt.Errorf("obfs bucket %d out of range", bucket))
+		}
 	}
-	if cfg.KCPConfig.NC < 0 {
-		log.Fatalln(fmt.Errorf("kcp nc %d out of range", cfg.KCPConfig.NC))
+	if cfg.ObfsConfig.Cover < 0 {
+		log.Fatalln(fmt.Errorf("obfs cover %d out of range", cfg.ObfsConfig.Cover))
 	}
-	if cfg.Port <= 0 || cfg.Port > 65535 {
-		log.Fatalln(fmt.Errorf("listen port %d out of range", cfg.Port))
+	if cfg.ObfsConfig.Jitter < 0 {
+		log.Fatalln(fmt.Errorf("obfs jitter %d out of range", cfg.ObfsConfig.Jitter))
 	}
 
-	// Port
-	port = uint16(cfg.Port)
-
-	// Mode
-	switch cfg.Mode {
-	case "faketcp":
-		mode = "faketcp"
-		log.Infoln("Use FakeTCP")
-	case "tcp":
-		mode = "tcp"
-		log.Infoln("Use standard TCP")
-	default:
-		log.Fatalln(fmt.Errorf("mode %s not support", cfg.Mode))
+	// Listeners, the mode and the port are used if there is no listener
+	if len(cfg.Listeners) <= 0 {
+		cfg.Listeners = []config.ListenerConfig{{Mode: cfg.Mode, Port: cfg.Port}}
 	}
 
-	// Crypt
-	crypt, err = crypto.ParseCrypt(cfg.Method, cfg.Password)
-	if err != nil {
-		log.Fatalln(fmt.Errorf("parse crypt: %w", err))
+	// Obfuscation
+	isObfs = cfg.Obfs
+	if isObfs {
+		log.Infoln("Enable obfuscation")
 	}
-	method := crypt.Method()
-	if method != crypto.MethodPlain {
-		log.Infof("Encrypt with %s\n", method)
+
+	// Endpoints
+	fakeTCPConfig = &cfg.FakeTCPConfig
+	for _, lc := range cfg.Listeners {
+		e, err := parseEndpoint(&lc, cfg)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("parse listener %s: %w", lc.Mode, err))
+		}
+
+		// Ports of listeners must not overlap, and there is only one listener in mode ICMP
+		for _, prev := range endpoints {
+			if e.mode == "icmp" && prev.mode == "icmp" {
+				log.Fatalln(errors.New("duplicate listener in mode icmp"))
+			}
+			if e.mode != "icmp" && prev.mode != "icmp" && e.port <= prev.maxPort() && prev.port <= e.maxPort() {
+				log.Fatalln(fmt.Errorf("same listen port with listener %s", prev))
+			}
+		}
+
+		endpoints = append(endpoints, e)
 	}
 
 	// Monitor
 	if cfg.Monitor != 0 {
-		if cfg.Monitor == int(port) {
-			log.Fatalln(fmt.Errorf("same monitor port with listen port"))
+		for _, e := range endpoints {
+			if e.mode != "icmp" && cfg.Monitor >= int(e.port) && cfg.Monitor <= int(e.maxPort()) {
+				log.Fatalln(fmt.Errorf("same monitor port with listen port"))
+			}
 		}
 
 		monitor = stat.NewTrafficMonitor()
 
 		// Host HTTP server
 		http.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
+			clients := make(map[string]*control.Heartbeater)
+			heartbeatLock.RLock()
+			for client, heartbeater := range heartbeaters {
+				clients[client] = heartbeater
+			}
+			heartbeatLock.RUnlock()
+
+			mtus := make(map[string]*control.Prober)
+			proberLock.RLock()
+			for client, prober := range probers {
+				mtus[client] = prober
+			}
+			proberLock.RUnlock()
+
+			bs := make([]*bond.Bond, 0)
+			bondLock.RLock()
+			for _, b := range bonds {
+				bs = append(bs, b)
+			}
+			bondLock.RUnlock()
+
+			ss := make([]*session.Session, 0)
+			sessionLock.RLock()
+			for _, s := range sessions {
+				ss = append(ss, s)
+			}
+			sessionLock.RUnlock()
+
 			b, err := json.Marshal(&struct {
-				Name    string               `json:"name"`
-				Version string               `json:"version"`
-				Time    int                  `json:"time"`
-				Monitor *stat.TrafficMonitor `json:"monitor"`
+				Name     string                          `json:"name"`
+				Version  string                          `json:"version"`
+				Time     int                             `json:"time"`
+				Monitor  *stat.TrafficMonitor            `json:"monitor"`
+				Clients  map[string]*control.Heartbeater `json:"clients"`
+				MTUs     map[string]*control.Prober      `json:"mtus"`
+				Bonds    []*bond.Bond                    `json:"bonds"`
+				Sessions []*session.Session              `json:"sessions"`
 			}{
-				Name:    name,
-				Version: versionInfo,
-				Time:    int(time.Now().Sub(startTime).Seconds()),
-				Monitor: monitor,
+				Name:     name,
+				Version:  versionInfo,
+				Time:     int(time.Now().Sub(startTime).Seconds()),
+				Monitor:  monitor,
+				Clients:  clients,
+				MTUs:     mtus,
+				Bonds:    bs,
+				Sessions: ss,
 			})
 			if err != nil {
 				log.Errorln(fmt.Errorf("monitor: %w", err))
@@ -409,27 +609,56 @@ type IPName struct {
 	}
 
 	// Mode-related options
-	switch mode {
-	case "faketcp":
-		// MTU
-		mtu = cfg.MTU
-		if mtu != pcap.MaxMTU {
-			log.Infof("Set MTU to %d Bytes\n", mtu)
+	mtu = cfg.MTU
+	if hasMode("faketcp", "icmp") && mtu != pcap.MaxMTU {
+		log.Infof("Set MTU to %d Bytes\n", mtu)
+	}
+	if hasMode("faketcp") {
+		// TCP emulation
+		if fakeTCPConfig.Emulation {
+			log.Infoln("Enable TCP emulation")
 		}
 
-		// KCP
-		isKCP = cfg.KCP
-		kcpConfig = &cfg.KCPConfig
-		if isKCP {
-			log.Infoln("Enable KCP")
+		// TCP profile
+		profile, err := pcap.ParseTCPProfile(fakeTCPConfig.Profile)
+		if err != nil {
+			log.Fatalln(fmt.Errorf("parse tcp profile: %w", err))
+		}
+		if profile != nil {
+			log.Infof("Use TCP profile %s\n", profile)
+		}
+
+		// Fake TLS
+		if fakeTCPConfig.TLS {
+			log.Infoln("Enable fake TLS")
 		}
-	case "tcp":
-		break
-	default:
-		log.Fatalln(fmt.Errorf("mode %s not support", mode))
+	}
+	if hasMode("tcp", "ws") {
+		// TLS
+		isTLS = cfg.TLS
+		if isTLS {
+			tlsConfig, err = pcap.NewTLSServerConfig(&cfg.TLSConfig)
+			if err != nil {
+				log.Fatalln(fmt.Errorf("tls: %w", err))
+			}
+			log.Infoln("Enable TLS")
+			if cfg.TLSConfig.Cert == "" {
+				log.Infof("Use self-signed certificate %s\n", pcap.Fingerprint(tlsConfig.Certificates[0].Certificate[0]))
+			}
+		}
+	}
+	if hasMode("ws") {
+		// WebSocket
+		wsConfig = &cfg.WSConfig
+		if !strings.HasPrefix(wsConfig.Path, "/") {
+			log.Fatalln(fmt.Errorf("invalid ws path %s", wsConfig.Path))
+		}
+		log.Infof("Use WebSocket endpoint %s\n", wsConfig.Path)
 	}
 
-	log.Infof("Proxy from :%d\n", cfg.Port)
+	for _, e := range endpoints {
+		log.Infof("Proxy from %s\n", e)
+	}
 
 	// Find devices
 	listenDevs, err = pcap.FindListenDevs(cfg.ListenDevs)
@@ -489,6 +718,33 @@ type IPName struct {
 
 		log.Infoln("Add firewall rule")
 
+		// IPv6 egress
+		if upDev.IPv6Addr() != nil {
+			err := exec.DisableIPv6Forwarding()
+			if err != nil {
+				log.Fatalln(fmt.Errorf("disable ipv6 forwarding: %w", err))
+			}
+
+			log.Infoln("Disable IPv6 forwarding")
+
+			err = exec.AddGlobalIPv6FirewallRule()
+			if err != nil {
+				log.Fatalln(fmt.Errorf("add ipv6 firewall rule: %w", err))
+			}
+
+			log.Infoln("Add IPv6 firewall rule")
+		}
+
+		// The system should not reply echo requests carrying packets
+		if hasMode("icmp") {
+			err := exec.DisableICMPEcho()
+			if err != nil {
+				log.Fatalln(fmt.Errorf("disable icmp echo: %w", err))
+			}
+
+			log.Infoln("Disable ICMP echo")
+		}
+
 		for _, dev := range listenDevs {
 			devs[dev.Alias()] = true
 		}
@@ -524,8 +780,8 @@ func open() error {
 	var err error
 
 	// Verify
-	if port <= 0 || port > 65535 {
-		return fmt.Errorf("port %d out of range", port)
+	if len(endpoints) <= 0 {
+		return errors.New("missing listener")
 	}
 	if len(listenDevs) <= 0 {
 		return errors.New("missing listen device")
@@ -551,48 +807,90 @@ func open() error {
 		log.Infof("Route upstream in %s\n", upDev)
 	}
 
-	for _, dev := range listenDevs {
-		var (
-			err      error
-			listener net.Listener
-		)
-
-		switch mode {
-		case "faketcp":
-			if dev.IsLoop() {
-				if isKCP {
-					listener, err = pcap.ListenFakeTCPWithKCP(dev, dev, port, crypt, mtu, kcpConfig)
+	// Listeners of all endpoints share handling and NAT
+	listenEndpoints := make([]*endpoint, 0)
+	for _, e := range endpoints {
+		for _, dev := range listenDevs {
+			var (
+				err      error
+				listener net.Listener
+			)
+
+			switch e.mode {
+			case "faketcp":
+				if dev.IsLoop() {
+					if e.isKCP {
+						listener, err = pcap.ListenFakeTCPWithKCP(dev, dev, e.port, e.crypt, mtu, fakeTCPConfig, e.kcpConfig)
+					} else {
+						listener, err = pcap.ListenFakeTCP(dev, dev, e.port, e.crypt, mtu, fakeTCPConfig)
+					}
 				} else {
-					listener, err = pcap.ListenFakeTCP(dev, dev, port, crypt, mtu)
+					if e.isKCP {
+						listener, err = pcap.ListenFakeTCPWithKCP(dev, gatewayDev, e.port, e.crypt, mtu, fakeTCPConfig, e.kcpConfig)
+					} else {
+						listener, err = pcap.ListenFakeTCP(dev, gatewayDev, e.port, e.crypt, mtu, fakeTCPConfig)
+					}
 				}
-			} else {
-				if isKCP {
-					listener, err = pcap.ListenFakeTCPWithKCP(dev, gatewayDev, port, crypt, mtu, kcpConfig)
+			case "tcp":
+				if isTLS {
+					listener, err = pcap.ListenTCPWithTLS(dev, e.port, e.crypt, tlsConfig)
+				} else {
+					listener, err = pcap.ListenTCP(dev, e.port, e.crypt)
+				}
+			case "udp":
+				if e.isKCP {
+					listener, err = pcap.ListenUDPWithKCP(dev, e.port, e.crypt, e.kcpConfig)
+				} else {
+					listener, err = pcap.ListenUDP(dev, e.port, e.crypt)
+				}
+			case "ws":
+				listener, err = pcap.ListenWS(dev, e.port, e.crypt, wsConfig, tlsConfig)
+			case "icmp":
+				if dev.IsLoop() {
+					listener, err = pcap.ListenICMP(dev, dev, e.crypt, mtu)
 				} else {
-					listener, err = pcap.ListenFakeTCP(dev, gatewayDev, port, crypt, mtu)
+					listener, err = pcap.ListenICMP(dev, gatewayDev, e.crypt, mtu)
 				}
+			default:
+				err = fmt.Errorf("mode %s not support", e.mode)
+			}
+			if err != nil {
+				return fmt.Errorf("open listen device %s: %w", dev.Alias(), err)
 			}
-		case "tcp":
-			listener, err = pcap.ListenTCP(dev, port, crypt)
-		default:
-			err = fmt.Errorf("mode %s not support", mode)
-		}
-		if err != nil {
-			return fmt.Errorf("open listen device %s: %w", dev.Alias(), err)
-		}
 
-		listeners = append(listeners, listener)
+			listeners = append(listeners, listener)
+			listenEndpoints = append(listenEndpoints, e)
+		}
 	}
 
-	// Handles for routing upstream
-	upConn, err = pcap.CreateRawConn(upDev, gatewayDev, fmt.Sprintf("ip && (((tcp || udp) && not dst port %d) || icmp || (ip[6:2] & 0x1fff) != 0)", port))
+	// Handles for routing upstream, echo requests are left for the listeners in mode ICMP
+	portFilters := make([]string, 0)
+	for _, e := range endpoints {
+		if e.mode != "icmp" {
+			portFilters = append(portFilters, addr.PortRangeBPFFilter("dst", e.port, e.maxPort()))
+		}
+	}
+	transportFilter := "(tcp || udp)"
+	if len(portFilters) > 0 {
+		transportFilter = fmt.Sprintf("((tcp || udp) && not (%s))", strings.Join(portFilters, " || "))
+	}
+	icmpFilter := "icmp"
+	if hasMode("icmp") {
+		icmpFilter = "(icmp && icmp[icmptype] != icmp-echo)"
+	}
+	filter := fmt.Sprintf("ip && (%s || %s || (ip[6:2] & 0x1fff) != 0)", transportFilter, icmpFilter)
+	// ICMPv6 errors and echo, other ICMPv6 messages like neighbor discovery are left for the system
+	if upDev.IPv6Addr() != nil {
+		filter = filter + fmt.Sprintf(" || (ip6 && (%s || (icmp6 && ip6[40] < 130)))", transportFilter)
+	}
+	upConn, err = pcap.CreateRawConn(upDev, gatewayDev, filter)
 	if err != nil {
 		return fmt.Errorf("open upstream device %s: %w", upDev.Alias(), err)
 	}
 
 	// Start handling
 	for i := 0; i < len(listeners); i++ {
-		listener := listeners[i]
+		listener, e := listeners[i], listenEndpoints[i]
 		go func() {
 			for {
 				conn, err := listener.Accept()
@@ -610,7 +908,7 @@ func open() error {
 				// Tune
 				switch conn.(type) {
 				case *kcp.UDPSession:
-					err := pcap.TuneKCP(conn.(*kcp.UDPSession), kcpConfig)
+					err := pcap.TuneKCP(conn.(*kcp.UDPSession), e.kcpConfig)
 					if err != nil {
 						conn.Close()
 						log.Errorln(fmt.Errorf("tune: %w", err))
@@ -622,12 +920,85 @@ func open() error {
 
 				log.Infof("Connect from client %s\n", conn.RemoteAddr().String())
 
+				// Heartbeat
+				heartbeater := control.NewHeartbeater()
+				heartbeatLock.Lock()
+				heartbeaters[conn.RemoteAddr().String()] = heartbeater
+				heartbeatLock.Unlock()
 				go func() {
-					b := make([]byte, pcap.IPv4MaxSize)
+					err := heartbeater.Run(conn, func() {
+						log.Errorf("Cannot receive heartbeat from client %s, disconnect\n", conn.RemoteAddr())
+						conn.Close()
+					})
+					if err != nil && !heartbeater.IsDead() {
+						log.Errorln(fmt.Errorf("heartbeat: %w", err))
+					}
+				}()
+
+				// Path MTU discovery, only in connections where IkaGo fragments packets itself
+				var prober *control.Prober
+				if mc, ok := conn.(control.MTUConn); ok {
+					prober = control.NewProber(mtu)
+					proberLock.Lock()
+					probers[conn.RemoteAddr().String()] = prober
+					proberLock.Unlock()
+					go prober.Run(mc, func(mtu int) {
+						log.Infof("Discover path MTU %d to client %s\n", mtu, conn.RemoteAddr())
+					})
+				}
+
+				// Cover packets
+				var coverer *control.Coverer
+				if e.cover > 0 {
+					coverer = control.NewCoverer(e.cover)
+					go func() {
+						err := coverer.Run(conn)
+						if err != nil {
+							log.Errorln(fmt.Errorf("cover: %w", err))
+						}
+					}()
+				}
+
+				// Jitter, packets to the client are delayed before being sent in the connection
+				jittered := conn
+				if e.jitter > 0 {
+					jittered = control.NewJitterConn(conn, e.jitter)
+				}
+
+				go func() {
+					defer func() {
+						heartbeater.Stop()
+						heartbeatLock.Lock()
+						if heartbeaters[conn.RemoteAddr().String()] == heartbeater {
+							delete(heartbeaters, conn.RemoteAddr().String())
+						}
+						heartbeatLock.Unlock()
+						if prober != nil {
+							prober.Stop()
+							proberLock.Lock()
+							if probers[conn.RemoteAddr().String()] == prober {
+								delete(probers, conn.RemoteAddr().String())
+							}
+							proberLock.Unlock()
+						}
+						if coverer != nil {
+							coverer.Stop()
+						}
+						if jc, ok := jittered.(*control.JitterConn); ok {
+							jc.Stop()
+						}
+						unbind(jittered)
+						detach(jittered)
+					}()
+
 					for {
+						// The buffer is handed over to the handler, which puts it back after handling
+						b := pcap.GetBuffer()
+
 						n, err := conn.Read(b)
 						if err != nil {
-							if isClosed {
+							pcap.PutBuffer(b)
+							if isClosed || heartbeater.IsDead() {
 								return
 							}
 							if errors.Is(err, io.EOF) {
@@ -638,11 +1009,11 @@ func open() error {
 							continue
 						}
 
-						newB := make([]byte, n)
-						copy(newB, b[:n])
+						heartbeater.Touch()
+
 						c <- pcap.ConnBytes{
-							Bytes: newB,
-							Conn:  conn,
+							Bytes: b[:n],
+							Conn:  jittered,
 						}
 					}
 				}()
@@ -656,8 +1027,8 @@ func open() error {
 			if err != nil {
 				log.Errorln(fmt.Errorf("handle listen in address %s: %w", cab.Conn.LocalAddr().String(), err))
 				log.Verbosef("Source: %s\nSize: %d Bytes\n\n", cab.Conn.RemoteAddr().String(), len(cab.Bytes))
-				continue
 			}
+			pcap.PutBuffer(cab.Bytes)
 		}
 	}()
 
@@ -701,6 +1072,8 @@ func handleListen(contents []byte, conn net.Conn) error {
 		upIP              net.IP
 		newLinkLayerType  gopacket.LayerType
 		newLinkLayer      gopacket.Layer
+		newEchoLayer      *layers.ICMPv6Echo
+		payload           []byte
 		data              []byte
 		guide             pcap.NATGuide
 		ni                *natIndicator
@@ -712,11 +1085,38 @@ func handleListen(contents []byte, conn net.Conn) error {
 		return nil
 	}
 
+	// Control message
+	if control.IsControl(contents) {
+		return handleControl(contents, conn)
+	}
+
+	// Connections in a session or a bond share NAT as one client
+	var (
+		src net.Addr  = conn.RemoteAddr()
+		w   io.Writer = conn
+	)
+	sessionLock.RLock()
+	s, ok := attachments[conn]
+	sessionLock.RUnlock()
+	if ok {
+		src, w = s.Addr(), s
+	}
+	bondLock.RLock()
+	b, ok := bindings[conn]
+	bondLock.RUnlock()
+	if ok {
+		src, w = b.Addr(), b
+	}
+
 	// Parse embedded packet
 	embIndicator, err := pcap.ParseEmbPacket(contents)
 	if err != nil {
 		return fmt.Errorf("parse embedded packet: %w", err)
 	}
+	if embIndicator.ICMPv6Indicator() != nil && embIndicator.ICMPv6Indicator().IsNDP() {
+		return errors.New("neighbor discovery not support")
+	}
+	payload = embIndicator.Payload()
 
 	// Distribute port/Id by source and client address and protocol
 	if !embIndicator.IsFrag() {
@@ -724,17 +1124,20 @@ func handleListen(contents []byte, conn net.Conn) error {
 
 		q := quintuple{
 			src:      embIndicator.NATSrc().String(),
-			dst:      conn.RemoteAddr().String(),
+			dst:      src.String(),
 			protocol: embIndicator.NATProtocol(),
 		}
 		upValue, ok = patMap[q]
 		if !ok {
 			var err error
 
-			// if ICMPv4 error is not in NAT, drop it
+			// if ICMPv4 or ICMPv6 error is not in NAT, drop it
 			if t := embIndicator.TransportLayer().LayerType(); t == layers.LayerTypeICMPv4 && !embIndicator.ICMPv4Indicator().IsQuery() {
 				return errors.New("missing nat")
 			}
+			if t := embIndicator.TransportLayer().LayerType(); t == layers.LayerTypeICMPv6 && !embIndicator.ICMPv6Indicator().IsQuery() {
+				return errors.New("missing nat")
+			}
 
 			upValue, err = dist(embIndicator.TransportLayer().LayerType())
 			if err != nil {
@@ -823,12 +1226,95 @@ func handleListen(contents []byte, conn net.Conn) error {
 					return fmt.Errorf("create transport layer: %w", fmt.Errorf("set network layer for checksum: %w", err))
 				}
 
-				payload, err := pcap.Serialize(newEmbIPv4Layer, newEmbTransportLayer.(gopacket.SerializableLayer))
+				embPayload, err := pcap.Serialize(newEmbIPv4Layer, newEmbTransportLayer.(gopacket.SerializableLayer))
+				if err != nil {
+					return fmt.Errorf("create transport layer: %w", fmt.Errorf("serialize: %w", err))
+				}
+
+				newICMPv4Layer.Payload = embPayload
+				payload = embPayload
+			}
+		case layers.LayerTypeICMPv6:
+			if embIndicator.ICMPv6Indicator().IsQuery() {
+				temp := *embIndicator.ICMPv6Indicator().ICMPv6Layer()
+				newTransportLayer = &temp
+
+				tempEcho := *embIndicator.ICMPv6Indicator().EchoLayer()
+				newEchoLayer = &tempEcho
+
+				newEchoLayer.Identifier = upValue
+			} else {
+				newTransportLayer = embIndicator.ICMPv6Indicator().NewPureICMPv6Layer()
+
+				upIPv6 := upConn.LocalDev().IPv6Addr()
+				if upIPv6 == nil {
+					return errors.New("missing ipv6 address in upstream device")
+				}
+
+				temp := *embIndicator.ICMPv6Indicator().EmbIPv6Layer()
+				newEmbIPv6Layer := &temp
+
+				newEmbIPv6Layer.DstIP = upIPv6.IP
+
+				var (
+					err                  error
+					newEmbTransportLayer gopacket.Layer
+					newEmbEchoLayer      *layers.ICMPv6Echo
+				)
+
+				embTransportLayerType := embIndicator.ICMPv6Indicator().EmbTransportLayer().LayerType()
+				switch embTransportLayerType {
+				case layers.LayerTypeTCP:
+					temp := *embIndicator.ICMPv6Indicator().EmbTCPLayer()
+					newEmbTransportLayer = &temp
+
+					newEmbTCPLayer := newEmbTransportLayer.(*layers.TCP)
+
+					newEmbTCPLayer.DstPort = layers.TCPPort(upValue)
+
+					err = newEmbTCPLayer.SetNetworkLayerForChecksum(newEmbIPv6Layer)
+				case layers.LayerTypeUDP:
+					temp := *embIndicator.ICMPv6Indicator().EmbUDPLayer()
+					newEmbTransportLayer = &temp
+
+					newEmbUDPLayer := newEmbTransportLayer.(*layers.UDP)
+
+					newEmbUDPLayer.DstPort = layers.UDPPort(upValue)
+
+					err = newEmbUDPLayer.SetNetworkLayerForChecksum(newEmbIPv6Layer)
+				case layers.LayerTypeICMPv6:
+					temp := *embIndicator.ICMPv6Indicator().EmbICMPv6Layer()
+					newEmbTransportLayer = &temp
+
+					newEmbICMPv6Layer := newEmbTransportLayer.(*layers.ICMPv6)
+
+					if embIndicator.ICMPv6Indicator().IsEmbQuery() {
+						tempEcho := *embIndicator.ICMPv6Indicator().EmbEchoLayer()
+						newEmbEchoLayer = &tempEcho
+
+						newEmbEchoLayer.Identifier = upValue
+					}
+
+					err = newEmbICMPv6Layer.SetNetworkLayerForChecksum(newEmbIPv6Layer)
+				default:
+					return fmt.Errorf("create transport layer: %w", fmt.Errorf("transport layer type %s not support", embTransportLayerType))
+				}
+				if err != nil {
+					return fmt.Errorf("create transport layer: %w", fmt.Errorf("set network layer for checksum: %w", err))
+				}
+
+				var embPayload []byte
+				if newEmbEchoLayer == nil {
+					embPayload, err = pcap.Serialize(newEmbIPv6Layer, newEmbTransportLayer.(gopacket.SerializableLayer))
+				} else {
+					embPayload, err = pcap.Serialize(newEmbIPv6Layer, newEmbTransportLayer.(gopacket.SerializableLayer), newEmbEchoLayer)
+				}
 				if err != nil {
 					return fmt.Errorf("create transport layer: %w", fmt.Errorf("serialize: %w", err))
 				}
 
-				newICMPv4Layer.Payload = payload
+				// Unused, MTU or pointer is kept in front of the embedded packet
+				payload = append(append(make([]byte, 0), embIndicator.ICMPv6Indicator().Prefix()...), embPayload...)
 			}
 		default:
 			return fmt.Errorf("transport layer type %s not support", t)
@@ -846,6 +1332,20 @@ func handleListen(contents []byte, conn net.Conn) error {
 
 		newIPv4Layer.SrcIP = upConn.LocalDev().IPAddr().IP
 		upIP = newIPv4Layer.SrcIP
+	case layers.LayerTypeIPv6:
+		upIPv6 := upConn.LocalDev().IPv6Addr()
+		if upIPv6 == nil {
+			return errors.New("missing ipv6 address in upstream device")
+		}
+
+		ipv6Layer := embIndicator.NetworkLayer().(*layers.IPv6)
+		temp := *ipv6Layer
+		newNetworkLayer = &temp
+
+		newIPv6Layer := newNetworkLayer.(*layers.IPv6)
+
+		newIPv6Layer.SrcIP = upIPv6.IP
+		upIP = newIPv6Layer.SrcIP
 	default:
 		return fmt.Errorf("network layer type %s not support", t)
 	}
@@ -863,6 +1363,10 @@ func handleListen(contents []byte, conn net.Conn) error {
 			err = udpLayer.SetNetworkLayerForChecksum(newNetworkLayer)
 		case layers.LayerTypeICMPv4:
 			break
+		case layers.LayerTypeICMPv6:
+			icmpv6Layer := newTransportLayer.(*layers.ICMPv6)
+
+			err = icmpv6Layer.SetNetworkLayerForChecksum(newNetworkLayer)
 		default:
 			return fmt.Errorf("transport layer type %s not support", t)
 		}
@@ -895,12 +1399,18 @@ func handleListen(contents []byte, conn net.Conn) error {
 	if newTransportLayer == nil {
 		data, err = pcap.Serialize(newLinkLayer.(gopacket.SerializableLayer),
 			newNetworkLayer.(gopacket.SerializableLayer),
-			gopacket.Payload(embIndicator.Payload()))
+			gopacket.Payload(payload))
+	} else if newEchoLayer == nil {
+		data, err = pcap.Serialize(newLinkLayer.(gopacket.SerializableLayer),
+			newNetworkLayer.(gopacket.SerializableLayer),
+			newTransportLayer.(gopacket.SerializableLayer),
+			gopacket.Payload(payload))
 	} else {
 		data, err = pcap.Serialize(newLinkLayer.(gopacket.SerializableLayer),
 			newNetworkLayer.(gopacket.SerializableLayer),
 			newTransportLayer.(gopacket.SerializableLayer),
-			gopacket.Payload(embIndicator.Payload()))
+			newEchoLayer,
+			gopacket.Payload(payload))
 	}
 	if err != nil {
 		return fmt.Errorf("serialize: %w", err)
@@ -948,14 +1458,25 @@ func handleListen(contents []byte, conn net.Conn) error {
 				}
 				addNAT = true
 			}
+		case layers.LayerTypeICMPv6:
+			if embIndicator.ICMPv6Indicator().IsQuery() {
+				guide = pcap.NATGuide{
+					Src: addr.ICMPQueryAddr{
+						IP: upIP,
+						Id: upValue,
+					}.String(),
+					Protocol: t,
+				}
+				addNAT = true
+			}
 		default:
 			return fmt.Errorf("transport layer type %s not support", t)
 		}
 		if addNAT {
 			ni = &natIndicator{
-				src:    conn.RemoteAddr(),
+				src:    src,
 				embSrc: embIndicator.NATSrc(),
-				conn:   conn,
+				conn:   w,
 			}
 			natLock.Lock()
 			nat[guide] = ni
@@ -971,6 +1492,8 @@ func handleListen(contents []byte, conn net.Conn) error {
 			udpPortPool[convertFromPort(upValue)] = time.Now()
 		case layers.LayerTypeICMPv4:
 			icmpv4IdPool[upValue] = time.Now()
+		case layers.LayerTypeICMPv6:
+			icmpv6IdPool[upValue] = time.Now()
 		default:
 			return fmt.Errorf("transport layer type %s not support", protocol)
 		}
@@ -978,11 +1501,11 @@ func handleListen(contents []byte, conn net.Conn) error {
 
 	// Statistics
 	if monitor != nil {
-		monitor.Add(conn.RemoteAddr().String(), stat.DirectionOut, uint(embIndicator.Size()))
+		monitor.Add(src.String(), stat.DirectionOut, uint(embIndicator.Size()))
 	}
 
 	log.Verbosef("Redirect an inbound %s packet: %s -> %s -> %s (%d Bytes)\n",
-		embIndicator.TransportProtocol(), embIndicator.Src().String(), conn.RemoteAddr().String(), embIndicator.Dst().String(), embIndicator.Size())
+		embIndicator.TransportProtocol(), embIndicator.Src().String(), src.String(), embIndicator.Dst().String(), embIndicator.Size())
 
 	return nil
 }
@@ -995,6 +1518,8 @@ func handleUpstream(packet gopacket.Packet) error {
 		ni                *natIndicator
 		embTransportLayer gopacket.Layer
 		embNetworkLayer   gopacket.NetworkLayer
+		embEchoLayer      *layers.ICMPv6Echo
+		payload           []byte
 		data              []byte
 	)
 
@@ -1013,10 +1538,10 @@ func handleUpstream(packet gopacket.Packet) error {
 		return nil
 	}
 
-	// NAT
+	// NAT, errors are guided by their embedded packets
 	guide := pcap.NATGuide{
 		Src:      indicator.NATDst().String(),
-		Protocol: indicator.TransportLayer().LayerType(),
+		Protocol: indicator.NATProtocol(),
 	}
 	natLock.RLock()
 	ni, ok := nat[guide]
@@ -1027,18 +1552,24 @@ func handleUpstream(packet gopacket.Packet) error {
 
 	// Keep alive
 	protocol := indicator.NATProtocol()
+	dst := indicator.NATDst()
 	switch protocol {
 	case layers.LayerTypeTCP:
-		tcpPortPool[convertFromPort(indicator.DstPort())] = time.Now()
+		tcpPortPool[convertFromPort(uint16(dst.(*net.TCPAddr).Port))] = time.Now()
 	case layers.LayerTypeUDP:
-		udpPortPool[convertFromPort(indicator.DstPort())] = time.Now()
+		udpPortPool[convertFromPort(uint16(dst.(*net.UDPAddr).Port))] = time.Now()
 	case layers.LayerTypeICMPv4:
-		icmpv4IdPool[indicator.ICMPv4Indicator().Id()] = time.Now()
+		icmpv4IdPool[dst.(*addr.ICMPQueryAddr).Id] = time.Now()
+	case layers.LayerTypeICMPv6:
+		icmpv6IdPool[dst.(*addr.ICMPQueryAddr).Id] = time.Now()
 	default:
 		return fmt.Errorf("transport layer type %s not support", protocol)
 	}
 
 	for _, frag := range frags {
+		embEchoLayer = nil
+		payload = frag.Payload()
+
 		// Create embedded transport layer
 		if frag.TransportLayer() != nil {
 			switch t := frag.TransportLayer().LayerType(); t {
@@ -1117,12 +1648,90 @@ func handleUpstream(packet gopacket.Packet) error {
 						return fmt.Errorf("create embedded transport layer: %w", fmt.Errorf("set network layer for checksum: %w", err))
 					}
 
-					payload, err := pcap.Serialize(newEmbEmbIPv4Layer, newEmbEmbTransportLayer.(gopacket.SerializableLayer))
+					embPayload, err := pcap.Serialize(newEmbEmbIPv4Layer, newEmbEmbTransportLayer.(gopacket.SerializableLayer))
+					if err != nil {
+						return fmt.Errorf("create embedded transport layer: %w", fmt.Errorf("serialize: %w", err))
+					}
+
+					newEmbICMPv4Layer.Payload = embPayload
+					payload = embPayload
+				}
+			case layers.LayerTypeICMPv6:
+				if frag.ICMPv6Indicator().IsQuery() {
+					embICMPv6Layer := frag.ICMPv6Indicator().ICMPv6Layer()
+					temp := *embICMPv6Layer
+					embTransportLayer = &temp
+
+					tempEcho := *frag.ICMPv6Indicator().EchoLayer()
+					embEchoLayer = &tempEcho
+
+					embEchoLayer.Identifier = ni.embSrc.(*addr.ICMPQueryAddr).Id
+				} else {
+					embTransportLayer = frag.ICMPv6Indicator().NewPureICMPv6Layer()
+
+					temp := *frag.ICMPv6Indicator().EmbIPv6Layer()
+					newEmbEmbIPv6Layer := &temp
+
+					newEmbEmbIPv6Layer.SrcIP = ni.embSrcIP()
+
+					var (
+						err                     error
+						newEmbEmbTransportLayer gopacket.Layer
+						newEmbEmbEchoLayer      *layers.ICMPv6Echo
+					)
+
+					switch t := frag.ICMPv6Indicator().EmbTransportLayer().LayerType(); t {
+					case layers.LayerTypeTCP:
+						temp := *frag.ICMPv6Indicator().EmbTCPLayer()
+						newEmbEmbTransportLayer = &temp
+
+						newEmbEmbTCPLayer := newEmbEmbTransportLayer.(*layers.TCP)
+
+						newEmbEmbTCPLayer.SrcPort = layers.TCPPort(ni.embSrc.(*net.TCPAddr).Port)
+
+						err = newEmbEmbTCPLayer.SetNetworkLayerForChecksum(newEmbEmbIPv6Layer)
+					case layers.LayerTypeUDP:
+						temp := *frag.ICMPv6Indicator().EmbUDPLayer()
+						newEmbEmbTransportLayer = &temp
+
+						newEmbEmbUDPLayer := newEmbEmbTransportLayer.(*layers.UDP)
+
+						newEmbEmbUDPLayer.SrcPort = layers.UDPPort(ni.embSrc.(*net.UDPAddr).Port)
+
+						err = newEmbEmbUDPLayer.SetNetworkLayerForChecksum(newEmbEmbIPv6Layer)
+					case layers.LayerTypeICMPv6:
+						temp := *frag.ICMPv6Indicator().EmbICMPv6Layer()
+						newEmbEmbTransportLayer = &temp
+
+						newEmbEmbICMPv6Layer := newEmbEmbTransportLayer.(*layers.ICMPv6)
+
+						if frag.ICMPv6Indicator().IsEmbQuery() {
+							tempEcho := *frag.ICMPv6Indicator().EmbEchoLayer()
+							newEmbEmbEchoLayer = &tempEcho
+
+							newEmbEmbEchoLayer.Identifier = ni.embSrc.(*addr.ICMPQueryAddr).Id
+						}
+
+						err = newEmbEmbICMPv6Layer.SetNetworkLayerForChecksum(newEmbEmbIPv6Layer)
+					default:
+						return fmt.Errorf("create embedded transport layer: %w", fmt.Errorf("transport layer type %s not support", t))
+					}
+					if err != nil {
+						return fmt.Errorf("create embedded transport layer: %w", fmt.Errorf("set network layer for checksum: %w", err))
+					}
+
+					var embPayload []byte
+					if newEmbEmbEchoLayer == nil {
+						embPayload, err = pcap.Serialize(newEmbEmbIPv6Layer, newEmbEmbTransportLayer.(gopacket.SerializableLayer))
+					} else {
+						embPayload, err = pcap.Serialize(newEmbEmbIPv6Layer, newEmbEmbTransportLayer.(gopacket.SerializableLayer), newEmbEmbEchoLayer)
+					}
 					if err != nil {
 						return fmt.Errorf("create embedded transport layer: %w", fmt.Errorf("serialize: %w", err))
 					}
 
-					newEmbICMPv4Layer.Payload = payload
+					// Unused, MTU or pointer is kept in front of the embedded packet
+					payload = append(append(make([]byte, 0), frag.ICMPv6Indicator().Prefix()...), embPayload...)
 				}
 			default:
 				return fmt.Errorf("embedded transport layer type %s not support", t)
@@ -1139,6 +1748,14 @@ func handleUpstream(packet gopacket.Packet) error {
 			newEmbIPv4Layer := embNetworkLayer.(*layers.IPv4)
 
 			newEmbIPv4Layer.DstIP = ni.embSrcIP()
+		case layers.LayerTypeIPv6:
+			embIPv6Layer := frag.IPv6Layer()
+			temp := *embIPv6Layer
+			embNetworkLayer = &temp
+
+			newEmbIPv6Layer := embNetworkLayer.(*layers.IPv6)
+
+			newEmbIPv6Layer.DstIP = ni.embSrcIP()
 		default:
 			return fmt.Errorf("embedded network layer type %s not support", t)
 		}
@@ -1156,6 +1773,10 @@ func handleUpstream(packet gopacket.Packet) error {
 				err = embUDPLayer.SetNetworkLayerForChecksum(embNetworkLayer)
 			case layers.LayerTypeICMPv4:
 				break
+			case layers.LayerTypeICMPv6:
+				embICMPv6Layer := embTransportLayer.(*layers.ICMPv6)
+
+				err = embICMPv6Layer.SetNetworkLayerForChecksum(embNetworkLayer)
 			default:
 				return fmt.Errorf("embedded transport layer type %s not support", t)
 			}
@@ -1167,11 +1788,16 @@ func handleUpstream(packet gopacket.Packet) error {
 		// Serialize layers
 		if embTransportLayer == nil {
 			data, err = pcap.Serialize(embNetworkLayer.(gopacket.SerializableLayer),
-				gopacket.Payload(frag.Payload()))
+				gopacket.Payload(payload))
+		} else if embEchoLayer == nil {
+			data, err = pcap.Serialize(embNetworkLayer.(gopacket.SerializableLayer),
+				embTransportLayer.(gopacket.SerializableLayer),
+				gopacket.Payload(payload))
 		} else {
 			data, err = pcap.Serialize(embNetworkLayer.(gopacket.SerializableLayer),
 				embTransportLayer.(gopacket.SerializableLayer),
-				gopacket.Payload(frag.Payload()))
+				embEchoLayer,
+				gopacket.Payload(payload))
 		}
 		if err != nil {
 			return fmt.Errorf("serialize: %w", err)
@@ -1186,7 +1812,7 @@ func handleUpstream(packet gopacket.Packet) error {
 		// Statistics
 		size := frag.MTU()
 		if monitor != nil {
-			monitor.Add(ni.conn.RemoteAddr().String(), stat.DirectionIn, uint(size))
+			monitor.Add(ni.src.String(), stat.DirectionIn, uint(size))
 		}
 
 		log.Verbosef("Redirect an outbound %s packet: %s <- %s <- %s (%d Bytes)\n",
@@ -1263,6 +1889,22 @@ func dist(t gopacket.LayerType) (uint16, error) {
 				return s, nil
 			}
 		}
+	case layers.LayerTypeICMPv6:
+		for i := 0; i < 65536; i++ {
+			s := nextICMPv6Id
+
+			// Point to next Id
+			nextICMPv6Id++
+
+			// Check if the Id is alive
+			last := icmpv6IdPool[s]
+			if now.Sub(last) > keepAlive {
+				if !last.IsZero() {
+					log.Verbosef("Recycle %s ID %d\n", t, s)
+				}
+				return s, nil
+			}
+		}
 	default:
 		return 0, fmt.Errorf("transport layer type %s not support", t)
 	}
@@ -1289,3 +1931,317 @@ func splitArg(s string) []string {
 
 	return result
 }
+
+// parseSizes parses sizes in bytes.
+func parseSizes(strs []string) ([]int, error) {
+	result := make([]int, 0)
+
+	for _, str := range strs {
+		size, err := strconv.Atoi(str)
+		if err != nil {
+			return nil, fmt.Errorf("parse size %s: %w", str, err)
+		}
+
+		result = append(result, size)
+	}
+
+	return result, nil
+}
+
+// parseListeners parses listeners in mode[:port].
+func parseListeners(strs []string) ([]config.ListenerConfig, error) {
+	result := make([]config.ListenerConfig, 0)
+
+	for _, str := range strs {
+		var (
+			err error
+			lc  config.ListenerConfig
+		)
+
+		parts := strings.Split(str, ":")
+		if len(parts) > 2 {
+			return nil, fmt.Errorf("invalid listener %s", str)
+		}
+
+		lc.Mode = parts[0]
+		if len(parts) > 1 {
+			lc.Port, err = strconv.Atoi(parts[1])
+			if err != nil {
+				return nil, fmt.Errorf("parse port %s: %w", parts[1], err)
+			}
+		}
+
+		result = append(result, lc)
+	}
+
+	return result, nil
+}
+
+// parseEndpoint returns the endpoint of the listener, the method of encryption and KCP of the configuration are used if
+// the listener does not set them.
+func parseEndpoint(lc *config.ListenerConfig, cfg *config.Config) (*endpoint, error) {
+	e := &endpoint{mode: lc.Mode}
+
+	// Mode
+	switch lc.Mode {
+	case "faketcp", "tcp", "udp", "ws":
+		if lc.Port <= 0 || lc.Port > 65535 {
+			return nil, fmt.Errorf("listen port %d out of range", lc.Port)
+		}
+		e.port = uint16(lc.Port)
+	case "icmp":
+		break
+	default:
+		return nil, fmt.Errorf("mode %s not support", lc.Mode)
+	}
+	if lc.Mode == "faketcp" && lc.Port+cfg.FakeTCPConfig.HopPorts-1 > 65535 {
+		return nil, fmt.Errorf("faketcp hop ports %d out of range", cfg.FakeTCPConfig.HopPorts)
+	}
+
+	// Crypt
+	method, password := cfg.Method, cfg.Password
+	if lc.Method != "" {
+		method, password = lc.Method, lc.Password
+	}
+	crypt, err := crypto.ParseCrypt(method, password)
+	if err != nil {
+		return nil, fmt.Errorf("parse crypt: %w", err)
+	}
+
+	// KCP, only in mode FakeTCP and UDP
+	e.isKCP = cfg.KCP
+	if lc.KCP != nil {
+		e.isKCP = *lc.KCP
+	}
+	e.isKCP = e.isKCP && (lc.Mode == "faketcp" || lc.Mode == "udp")
+	e.kcpConfig = &cfg.KCPConfig
+	if lc.KCPConfig != nil {
+		err = verifyKCPConfig(lc.KCPConfig)
+		if err != nil {
+			return nil, err
+		}
+		e.kcpConfig = lc.KCPConfig
+	}
+
+	// Obfuscation, cover packets are sent in connections other than KCP which drops empty messages
+	if cfg.Obfs {
+		crypt, err = crypto.CreateObfsCrypt(crypt, cfg.ObfsConfig.Padding, cfg.ObfsConfig.Buckets)
+		if err != nil {
+			return nil, fmt.Errorf("obfs: %w", err)
+		}
+		if !e.isKCP {
+			e.cover = time.Duration(cfg.ObfsConfig.Cover) * time.Millisecond
+		}
+		e.jitter = time.Duration(cfg.ObfsConfig.Jitter) * time.Millisecond
+	}
+	e.crypt = crypt
+
+	return e, nil
+}
+
+// verifyKCPConfig returns an error if any option of KCP is out of range.
+func verifyKCPConfig(kc *config.KCPConfig) error {
+	if kc.MTU > 1500 {
+		return fmt.Errorf("kcp mtu %d out of range", kc.MTU)
+	}
+	if kc.SendWindow <= 0 || kc.SendWindow > math.MaxInt32 {
+		return fmt.Errorf("kcp send window %d out of range", kc.SendWindow)
+	}
+	if kc.RecvWindow <= 0 || kc.RecvWindow > math.MaxInt32 {
+		return fmt.Errorf("kcp receive window %d out of range", kc.RecvWindow)
+	}
+	if kc.DataShard < 0 {
+		return fmt.Errorf("kcp data shard %d out of range", kc.DataShard)
+	}
+	if kc.ParityShard < 0 {
+		return fmt.Errorf("kcp parity shard %d out of range", kc.ParityShard)
+	}
+	if kc.Interval < 0 {
+		return fmt.Errorf("kcp interval %d out of range", kc.Interval)
+	}
+	if kc.Resend < 0 {
+		return fmt.Errorf("kcp resend %d out of range", kc.Resend)
+	}
+	if kc.NC < 0 {
+		return fmt.Errorf("kcp nc %d out of range", kc.NC)
+	}
+
+	return nil
+}
+
+// hasMode returns if the server listens in any of the modes.
+func hasMode(modes ...string) bool {
+	for _, e := range endpoints {
+		for _, mode := range modes {
+			if e.mode == mode {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// unbind removes the connection from its bond, the bond is removed if it is empty.
+func unbind(conn net.Conn) {
+	bondLock.Lock()
+	defer bondLock.Unlock()
+
+	b, ok := bindings[conn]
+	if !ok {
+		return
+	}
+	delete(bindings, conn)
+
+	if b.Remove(conn) <= 0 {
+		delete(bonds, b.Id())
+		log.Infof("Remove %s\n", b.Addr())
+	}
+}
+
+// detach detaches the connection from its session, the session is removed if no connection is attached to it in time.
+func detach(conn net.Conn) {
+	sessionLock.Lock()
+	defer sessionLock.Unlock()
+
+	s, ok := attachments[conn]
+	if !ok {
+		return
+	}
+	delete(attachments, conn)
+
+	if !s.Detach(conn) {
+		return
+	}
+
+	time.AfterFunc(keepSession, func() {
+		sessionLock.Lock()
+		defer sessionLock.Unlock()
+
+		if sessions[s.Id()] == s && s.IsExpired(keepSession) {
+			delete(sessions, s.Id())
+			log.Infof("Remove %s\n", s.Addr())
+		}
+	})
+}
+
+func handleControl(contents []byte, conn net.Conn) error {
+	message, err := control.Parse(contents)
+	if err != nil {
+		return fmt.Errorf("parse control message: %w", err)
+	}
+
+	switch t := message.Type(); t {
+	case control.TypeHeartbeat:
+		_, err := conn.Write(message.(*control.Heartbeat).Reply().Serialize())
+		if err != nil {
+			return fmt.Errorf("reply heartbeat: %w", err)
+		}
+	case control.TypeHeartbeatReply:
+		heartbeatLock.RLock()
+		heartbeater, ok := heartbeaters[conn.RemoteAddr().String()]
+		heartbeatLock.RUnlock()
+		if !ok {
+			return fmt.Errorf("missing heartbeater of client %s", conn.RemoteAddr())
+		}
+
+		heartbeater.Receive(message.(*control.Heartbeat))
+	case control.TypeProbe:
+		_, err := conn.Write(message.(*control.Probe).Reply().Serialize())
+		if err != nil {
+			return fmt.Errorf("reply probe: %w", err)
+		}
+	case control.TypeProbeReply:
+		proberLock.RLock()
+		prober, ok := probers[conn.RemoteAddr().String()]
+		proberLock.RUnlock()
+		if !ok {
+			return fmt.Errorf("missing prober of client %s", conn.RemoteAddr())
+		}
+
+		prober.Receive(message.(*control.Probe))
+	case control.TypeBind:
+		bind := message.(*control.Bind)
+
+		scheduler := bond.Scheduler(bind.Scheduler())
+		switch scheduler {
+		case bond.SchedulerRoundRobin, bond.SchedulerWeighted, bond.SchedulerLowestRTT:
+			break
+		default:
+			return fmt.Errorf("%s not support", scheduler)
+		}
+
+		// Only the client owning the bond can bind, which is proved by the token of the session the connection is
+		// attached to
+		sessionLock.RLock()
+		s, ok := attachments[conn]
+		sessionLock.RUnlock()
+		if !ok {
+			return fmt.Errorf("bind client %s: %w", conn.RemoteAddr(), errors.New("missing session"))
+		}
+		if !s.Authenticate(bind.Token()) {
+			return fmt.Errorf("bind client %s: %w", conn.RemoteAddr(), errors.New("token mismatch"))
+		}
+
+		heartbeatLock.RLock()
+		heartbeater := heartbeaters[conn.RemoteAddr().String()]
+		heartbeatLock.RUnlock()
+
+		bondLock.Lock()
+		b, ok := bonds[bind.Id()]
+		if !ok {
+			b = bond.NewBond(bind.Id(), scheduler, bind.Token())
+			bonds[bind.Id()] = b
+		} else if !b.Authenticate(bind.Token()) {
+			bondLock.Unlock()
+			return fmt.Errorf("bind client %s to %s: %w", conn.RemoteAddr(), b.Addr(), errors.New("token mismatch"))
+		}
+		if _, ok := bindings[conn]; !ok {
+			b.Add(conn, int(bind.Weight()), heartbeater)
+			bindings[conn] = b
+		}
+		bondLock.Unlock()
+
+		log.Infof("Bind client %s to %s (%s)\n", conn.RemoteAddr(), b.Addr(), b.Scheduler())
+	case control.TypeSession:
+		m := message.(*control.Session)
+
+		// Obfuscation must be enabled in both sides, the client is told so it fails instead of reconnecting
+		if m.IsObfs() != isObfs {
+			_, err := conn.Write(control.NewSession(m.Id(), m.Token(), isObfs).Serialize())
+			if err != nil {
+				return fmt.Errorf("reply session: %w", err)
+			}
+
+			return fmt.Errorf("attach client %s: %w", conn.RemoteAddr(), errors.New("obfuscation mismatch"))
+		}
+
+		sessionLock.Lock()
+		s, ok := sessions[m.Id()]
+		if !ok {
+			s = session.NewSession(m.Id(), m.Token())
+			sessions[m.Id()] = s
+		} else if !s.Authenticate(m.Token()) {
+			sessionLock.Unlock()
+			return fmt.Errorf("attach client %s to %s: %w", conn.RemoteAddr(), s.Addr(), errors.New("token mismatch"))
+		}
+		prev := s.Attach(conn)
+		attachments[conn] = s
+		sessionLock.Unlock()
+
+		// The client reconnects from another address or hops to another port, and the previous connection is replaced.
+		// It is kept attached for a while so packets in flight in it are still handled in the session
+		if prev != nil && prev != conn {
+			log.Infof("Migrate %s from client %s to %s\n", s.Addr(), prev.RemoteAddr(), conn.RemoteAddr())
+			time.AfterFunc(keepMigrated, func() {
+				prev.Close()
+			})
+		} else if prev == nil {
+			log.Infof("Attach client %s to %s\n", conn.RemoteAddr(), s.Addr())
+		}
+	default:
+		return fmt.Errorf("%s not support", t)
+	}
+
+	return nil
+}
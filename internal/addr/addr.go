@@ -22,6 +22,32 @@ func (addr ICMPQueryAddr) Network() string {
 	return "icmp query"
 }
 
+// BondAddr represents the address of a bond of connections.
+type BondAddr struct {
+	Id uint64
+}
+
+func (addr BondAddr) String() string {
+	return fmt.Sprintf("bond#%016x", addr.Id)
+}
+
+func (addr BondAddr) Network() string {
+	return "bond"
+}
+
+// SessionAddr represents the address of a session of a client.
+type SessionAddr struct {
+	Id uint64
+}
+
+func (addr SessionAddr) String() string {
+	return fmt.Sprintf("session#%016x", addr.Id)
+}
+
+func (addr SessionAddr) Network() string {
+	return "session"
+}
+
 // MultiTCPAddr represents multiple TCP addresses.
 type MultiTCPAddr struct {
 	Addrs []*net.TCPAddr
@@ -55,6 +81,14 @@ func ParseTCPAddr(s string) (*net.TCPAddr, error) {
 			return nil, fmt.Errorf("lookup: %w", err)
 		}
 		ip = addrs[0]
+
+		// Prefer IPv4 addresses
+		for _, addr := range addrs {
+			if addr.To4() != nil {
+				ip = addr
+				break
+			}
+		}
 	}
 
 	port, err := strconv.ParseUint(portStr, 10, 16)
@@ -92,6 +126,31 @@ func DstBPFFilter(addr net.Addr) (string, error) {
 	return bpfFilter("dst", addr)
 }
 
+// PortRangeBPFFilter returns a BPF filter of ports from port to maxPort in the direction.
+func PortRangeBPFFilter(dir string, port, maxPort uint16) string {
+	if port == maxPort {
+		return fmt.Sprintf("(%s port %d)", dir, port)
+	}
+
+	return fmt.Sprintf("(%s portrange %d-%d)", dir, port, maxPort)
+}
+
+// NDPBPFFilter returns a BPF filter of neighbor solicitations for the given IPv6 address.
+func NDPBPFFilter(ip net.IP) (string, error) {
+	if ip.To4() != nil || ip.To16() == nil {
+		return "", fmt.Errorf("invalid ipv6 address %s", ip)
+	}
+
+	// Target address is behind the ICMPv6 header and 4 bytes reserved
+	ip = ip.To16()
+	fs := make([]string, 0)
+	for i := 0; i < 16; i = i + 4 {
+		fs = append(fs, fmt.Sprintf("ip6[%d:4] = 0x%s", 48+i, hex.EncodeToString(ip[i:i+4])))
+	}
+
+	return fmt.Sprintf("(icmp6 && ip6[40] = 135 && %s)", strings.Join(fs, " && ")), nil
+}
+
 func formatIP(ip net.IP) string {
 	if ip == nil {
 		return ""
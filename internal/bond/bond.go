@@ -0,0 +1,258 @@
+package bond
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"ikago/internal/addr"
+	"ikago/internal/control"
+	"net"
+	"sync"
+)
+
+// Scheduler describes how packets are scheduled across connections in a bond.
+type Scheduler uint8
+
+const (
+	// SchedulerRoundRobin describes packets are sent in each connection in turn.
+	SchedulerRoundRobin Scheduler = iota
+	// SchedulerWeighted describes packets are sent in each connection in proportion to its weight.
+	SchedulerWeighted
+	// SchedulerLowestRTT describes packets are sent in the connection with the lowest RTT.
+	SchedulerLowestRTT
+)
+
+func (s Scheduler) String() string {
+	switch s {
+	case SchedulerRoundRobin:
+		return "round-robin"
+	case SchedulerWeighted:
+		return "weighted"
+	case SchedulerLowestRTT:
+		return "lowest-rtt"
+	default:
+		return fmt.Sprintf("scheduler %d", s)
+	}
+}
+
+// ParseScheduler returns a scheduler by the given name.
+func ParseScheduler(s string) (Scheduler, error) {
+	switch s {
+	case "round-robin", "":
+		return SchedulerRoundRobin, nil
+	case "weighted":
+		return SchedulerWeighted, nil
+	case "lowest-rtt":
+		return SchedulerLowestRTT, nil
+	default:
+		return 0, fmt.Errorf("scheduler %s not support", s)
+	}
+}
+
+type path struct {
+	conn        net.Conn
+	weight      int
+	heartbeater *control.Heartbeater
+	current     int
+}
+
+func (p *path) isDead() bool {
+	return p.heartbeater != nil && p.heartbeater.IsDead()
+}
+
+// Bond is a group of connections to the same peer, packets written to a bond are scheduled across its connections. A
+// bond can only be joined with the token it is created with.
+type Bond struct {
+	lock      sync.Mutex
+	id        uint64
+	scheduler Scheduler
+	token     []byte
+	paths     []*path
+	next      int
+}
+
+// NewBond returns a new bond.
+func NewBond(id uint64, scheduler Scheduler, token []byte) *Bond {
+	return &Bond{
+		id:        id,
+		scheduler: scheduler,
+		token:     token,
+		paths:     make([]*path, 0),
+	}
+}
+
+// Authenticate returns if the token matches the token of the bond.
+func (b *Bond) Authenticate(token []byte) bool {
+	return subtle.ConstantTimeCompare(b.token, token) == 1
+}
+
+// Add adds a connection to the bond. The connection is considered dead if its heartbeater is.
+func (b *Bond) Add(conn net.Conn, weight int, heartbeater *control.Heartbeater) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if weight <= 0 {
+		weight = 1
+	}
+
+	b.paths = append(b.paths, &path{
+		conn:        conn,
+		weight:      weight,
+		heartbeater: heartbeater,
+	})
+}
+
+// Remove removes a connection from the bond and returns the count of remaining connections.
+func (b *Bond) Remove(conn net.Conn) int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	for i, p := range b.paths {
+		if p.conn == conn {
+			b.paths = append(b.paths[:i], b.paths[i+1:]...)
+			break
+		}
+	}
+
+	return len(b.paths)
+}
+
+// Len returns the count of connections in the bond.
+func (b *Bond) Len() int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	return len(b.paths)
+}
+
+// Id returns the identifier of the bond.
+func (b *Bond) Id() uint64 {
+	return b.id
+}
+
+// Scheduler returns the scheduler of the bond.
+func (b *Bond) Scheduler() Scheduler {
+	return b.scheduler
+}
+
+// Addr returns the address of the bond.
+func (b *Bond) Addr() net.Addr {
+	return &addr.BondAddr{Id: b.id}
+}
+
+// schedule returns the connections in the order they should be tried. Dead connections are tried at last.
+func (b *Bond) schedule() []net.Conn {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	alive := make([]*path, 0, len(b.paths))
+	dead := make([]*path, 0)
+	for _, p := range b.paths {
+		if p.isDead() {
+			dead = append(dead, p)
+		} else {
+			alive = append(alive, p)
+		}
+	}
+
+	var first *path
+	if len(alive) > 0 {
+		switch b.scheduler {
+		case SchedulerRoundRobin:
+			first = alive[b.next%len(alive)]
+			b.next++
+		case SchedulerWeighted:
+			// Smooth weighted round-robin
+			total := 0
+			for _, p := range alive {
+				p.current = p.current + p.weight
+				total = total + p.weight
+				if first == nil || p.current > first.current {
+					first = p
+				}
+			}
+			first.current = first.current - total
+		case SchedulerLowestRTT:
+			var lowest int64 = -1
+			for _, p := range alive {
+				if p.heartbeater == nil {
+					continue
+				}
+				rtt, ok := p.heartbeater.RTT()
+				if !ok {
+					continue
+				}
+				if lowest < 0 || int64(rtt) < lowest {
+					first, lowest = p, int64(rtt)
+				}
+			}
+			if first == nil {
+				first = alive[0]
+			}
+		default:
+			panic(fmt.Errorf("scheduler %d out of range", b.scheduler))
+		}
+	}
+
+	conns := make([]net.Conn, 0, len(b.paths))
+	if first != nil {
+		conns = append(conns, first.conn)
+	}
+	for _, p := range append(alive, dead...) {
+		if p != first {
+			conns = append(conns, p.conn)
+		}
+	}
+
+	return conns
+}
+
+// Write writes b to one connection of the bond chosen by the scheduler, other connections are tried in turn if it
+// fails.
+func (b *Bond) Write(p []byte) (n int, err error) {
+	conns := b.schedule()
+	if len(conns) <= 0 {
+		return 0, errors.New("empty bond")
+	}
+
+	for _, conn := range conns {
+		n, err = conn.Write(p)
+		if err == nil {
+			return n, nil
+		}
+	}
+
+	return n, err
+}
+
+func (b *Bond) MarshalJSON() ([]byte, error) {
+	type Path struct {
+		Local     string               `json:"local"`
+		Remote    string               `json:"remote"`
+		Weight    int                  `json:"weight"`
+		Heartbeat *control.Heartbeater `json:"heartbeat"`
+	}
+
+	b.lock.Lock()
+	paths := make([]Path, 0, len(b.paths))
+	for _, p := range b.paths {
+		paths = append(paths, Path{
+			Local:     p.conn.LocalAddr().String(),
+			Remote:    p.conn.RemoteAddr().String(),
+			Weight:    p.weight,
+			Heartbeat: p.heartbeater,
+		})
+	}
+	b.lock.Unlock()
+
+	return json.Marshal(&struct {
+		Id        string `json:"id"`
+		Scheduler string `json:"scheduler"`
+		Paths     []Path `json:"paths"`
+	}{
+		Id:        b.Addr().String(),
+		Scheduler: b.scheduler.String(),
+		Paths:     paths,
+	})
+}
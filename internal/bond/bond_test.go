@@ -0,0 +1,179 @@
+package bond
+
+import (
+	"bytes"
+	"errors"
+	"ikago/internal/control"
+	"net"
+	"testing"
+	"time"
+)
+
+// bondConn is a connection in a bond which counts packets written to it.
+type bondConn struct {
+	net.Conn
+	n        int
+	isFailed bool
+}
+
+func (c *bondConn) Write(b []byte) (int, error) {
+	if c.isFailed {
+		return 0, errors.New("failed")
+	}
+	c.n++
+
+	return len(b), nil
+}
+
+func TestBondWrite(t *testing.T) {
+	tests := []struct {
+		name      string
+		scheduler Scheduler
+		weights   []int
+		failed    []bool
+		writes    int
+		counts    []int
+		isErr     bool
+	}{
+		{name: "round-robin", scheduler: SchedulerRoundRobin, weights: []int{1, 1, 1}, writes: 6, counts: []int{2, 2, 2}},
+		{name: "round-robin ignores weights", scheduler: SchedulerRoundRobin, weights: []int{5, 1}, writes: 4, counts: []int{2, 2}},
+		{name: "weighted", scheduler: SchedulerWeighted, weights: []int{5, 1, 1}, writes: 7, counts: []int{5, 1, 1}},
+		{name: "weighted without weight", scheduler: SchedulerWeighted, weights: []int{0, 1}, writes: 4, counts: []int{2, 2}},
+		{name: "lowest-rtt without rtt", scheduler: SchedulerLowestRTT, weights: []int{1, 1}, writes: 3, counts: []int{3, 0}},
+		{name: "failed", scheduler: SchedulerRoundRobin, weights: []int{1, 1}, failed: []bool{false, true}, writes: 4, counts: []int{4, 0}},
+		{name: "weighted failed", scheduler: SchedulerWeighted, weights: []int{1, 3}, failed: []bool{false, true}, writes: 4, counts: []int{4, 0}},
+		{name: "all failed", scheduler: SchedulerRoundRobin, weights: []int{1, 1}, failed: []bool{true, true}, writes: 1, counts: []int{0, 0}, isErr: true},
+		{name: "empty", scheduler: SchedulerRoundRobin, writes: 1, isErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b := NewBond(1, test.scheduler, nil)
+
+			conns := make([]*bondConn, 0)
+			for i, weight := range test.weights {
+				conn := &bondConn{isFailed: test.failed != nil && test.failed[i]}
+				b.Add(conn, weight, nil)
+				conns = append(conns, conn)
+			}
+
+			// Packets in failed connections are written in others in turn
+			for i := 0; i < test.writes; i++ {
+				_, err := b.Write([]byte{0})
+				if test.isErr {
+					if err == nil {
+						t.Fatal("write in failed bond")
+					}
+					return
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			for i, conn := range conns {
+				if conn.n != test.counts[i] {
+					t.Fatalf("write %d packets in connection %d, want %d", conn.n, i, test.counts[i])
+				}
+			}
+		})
+	}
+}
+
+// replyWriter replies heartbeats written to it after the delay.
+type replyWriter struct {
+	heartbeater *control.Heartbeater
+	delay       time.Duration
+}
+
+func (w *replyWriter) Write(b []byte) (int, error) {
+	message, err := control.Parse(b)
+	if err != nil {
+		return 0, err
+	}
+
+	time.AfterFunc(w.delay, func() {
+		w.heartbeater.Receive(message.(*control.Heartbeat).Reply())
+	})
+
+	return len(b), nil
+}
+
+func TestBondLowestRTT(t *testing.T) {
+	tests := []struct {
+		name   string
+		delays []time.Duration
+		lowest int
+	}{
+		{name: "first", delays: []time.Duration{10 * time.Millisecond, 200 * time.Millisecond}, lowest: 0},
+		{name: "last", delays: []time.Duration{200 * time.Millisecond, 100 * time.Millisecond, 10 * time.Millisecond}, lowest: 2},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b := NewBond(1, SchedulerLowestRTT, nil)
+
+			conns := make([]*bondConn, 0)
+			for _, delay := range test.delays {
+				h := control.NewHeartbeater()
+				go h.Run(&replyWriter{heartbeater: h, delay: delay}, nil)
+				defer h.Stop()
+
+				conn := &bondConn{}
+				b.Add(conn, 1, h)
+				conns = append(conns, conn)
+			}
+
+			// Wait for the first heartbeat of each connection to be replied
+			time.Sleep(control.HeartbeatInterval + 500*time.Millisecond)
+
+			for i := 0; i < 3; i++ {
+				_, err := b.Write([]byte{0})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			if conns[test.lowest].n != 3 {
+				t.Fatalf("write %d packets in connection of the lowest RTT", conns[test.lowest].n)
+			}
+
+			// Packets are written in the connection of the next lowest RTT after it is removed
+			if n := b.Remove(conns[test.lowest]); n != len(conns)-1 {
+				t.Fatalf("remain %d connections", n)
+			}
+			_, err := b.Write([]byte{0})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if conns[test.lowest].n != 3 {
+				t.Fatal("write packet in removed connection")
+			}
+		})
+	}
+}
+
+func TestBondAuthenticate(t *testing.T) {
+	token := bytes.Repeat([]byte{0xa5}, control.TokenSize)
+
+	tests := []struct {
+		name   string
+		token  []byte
+		isAuth bool
+	}{
+		{name: "token", token: bytes.Repeat([]byte{0xa5}, control.TokenSize), isAuth: true},
+		{name: "token mismatch", token: append(bytes.Repeat([]byte{0xa5}, control.TokenSize-1), 0xa4)},
+		{name: "truncated", token: token[:control.TokenSize-1]},
+		{name: "trailer", token: append(bytes.Repeat([]byte{0xa5}, control.TokenSize), 0xa5)},
+		{name: "zero", token: make([]byte, control.TokenSize)},
+		{name: "nil", token: nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b := NewBond(1, SchedulerRoundRobin, token)
+			if isAuth := b.Authenticate(test.token); isAuth != test.isAuth {
+				t.Fatalf("authenticate %x: %t", test.token, isAuth)
+			}
+		})
+	}
+}
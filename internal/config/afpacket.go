@@ -0,0 +1,17 @@
+package config
+
+// AFPacketConfig describes the configuration of AF_PACKET.
+type AFPacketConfig struct {
+	Fanout    int `json:"fanout"`
+	BlockSize int `json:"block-size"`
+	Blocks    int `json:"blocks"`
+}
+
+// NewAFPacketConfig returns a new AF_PACKET config.
+func NewAFPacketConfig() *AFPacketConfig {
+	return &AFPacketConfig{
+		Fanout:    1,
+		BlockSize: 1 << 18,
+		Blocks:    8,
+	}
+}
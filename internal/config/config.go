@@ -11,33 +11,57 @@
 
 // Config describes the configuration of IkaGo.
 type Config struct {
-	ListenDevs []string  `json:"listen-devices"`
-	UpDev      string    `json:"upstream-device"`
-	Gateway    string    `json:"gateway"`
-	Mode       string    `json:"mode"`
-	Method     string    `json:"method"`
-	Password   string    `json:"password"`
-	Rule       bool      `json:"rule"`
-	Verbose    bool      `json:"verbose"`
-	Log        string    `json:"log"`
-	Monitor    int       `json:"monitor"`
-	MTU        int       `json:"mtu"`
-	KCP        bool      `json:"kcp"`
-	KCPConfig  KCPConfig `json:"kcp-tuning"`
-	Share      bool      `json:"share"`
-	Port       int       `json:"port"`
-	Publish    string    `json:"publish"`
-	Sources    []string  `json:"sources"`
-	Server     string    `json:"server"`
+	ListenDevs     []string         `json:"listen-devices"`
+	UpDev          string           `json:"upstream-device"`
+	Gateway        string           `json:"gateway"`
+	Mode           string           `json:"mode"`
+	Method         string           `json:"method"`
+	Password       string           `json:"password"`
+	Rule           bool             `json:"rule"`
+	Verbose        bool             `json:"verbose"`
+	Log            string           `json:"log"`
+	Monitor        int              `json:"monitor"`
+	MTU            int              `json:"mtu"`
+	Backend        string           `json:"backend"`
+	AFPacketConfig AFPacketConfig   `json:"afpacket-tuning"`
+	FakeTCPConfig  FakeTCPConfig    `json:"faketcp-tuning"`
+	KCP            bool             `json:"kcp"`
+	KCPConfig      KCPConfig        `json:"kcp-tuning"`
+	Obfs           bool             `json:"obfs"`
+	ObfsConfig     ObfsConfig       `json:"obfs-tuning"`
+	TLS            bool             `json:"tls"`
+	TLSConfig      TLSConfig        `json:"tls-tuning"`
+	WSConfig       WSConfig         `json:"ws-tuning"`
+	TUN            bool             `json:"tun"`
+	TUNConfig      TUNConfig        `json:"tun-tuning"`
+	Share          bool             `json:"share"`
+	Port           int              `json:"port"`
+	Publish        string           `json:"publish"`
+	Sources        []string         `json:"sources"`
+	Server         string           `json:"server"`
+	Servers        []string         `json:"servers"`
+	Paths          []PathConfig     `json:"paths"`
+	Scheduler      string           `json:"scheduler"`
+	Listeners      []ListenerConfig `json:"listeners"`
 }
 
 // NewConfig returns a new config.
 func NewConfig() *Config {
 	return &Config{
-		Mode:      "faketcp",
-		Method:    "plain",
-		KCPConfig: *NewKCPConfig(),
-		Sources:   make([]string, 0),
+		Mode:           "faketcp",
+		Method:         "plain",
+		AFPacketConfig: *NewAFPacketConfig(),
+		FakeTCPConfig:  *NewFakeTCPConfig(),
+		KCPConfig:      *NewKCPConfig(),
+		ObfsConfig:     *NewObfsConfig(),
+		TLSConfig:      *NewTLSConfig(),
+		WSConfig:       *NewWSConfig(),
+		TUNConfig:      *NewTUNConfig(),
+		Sources:        make([]string, 0),
+		Servers:        make([]string, 0),
+		Paths:          make([]PathConfig, 0),
+		Scheduler:      "round-robin",
+		Listeners:      make([]ListenerConfig, 0),
 	}
 }
 
@@ -84,6 +108,29 @@ func ParseFile(path string) (*Config, error) {
 		return nil, fmt.Errorf("unmarshal: %w", err)
 	}
 
+	// KCP options of listeners are based on KCP options of the server
+	var listeners struct {
+		Listeners []struct {
+			KCPConfig json.RawMessage `json:"kcp-tuning"`
+		} `json:"listeners"`
+	}
+	err = json.Unmarshal(buffer, &listeners)
+	if err != nil {
+		return nil, fmt.Errorf("unmarshal: %w", err)
+	}
+	for i, listener := range listeners.Listeners {
+		if len(listener.KCPConfig) <= 0 {
+			continue
+		}
+
+		kcpConfig := config.KCPConfig
+		err = json.Unmarshal(listener.KCPConfig, &kcpConfig)
+		if err != nil {
+			return nil, fmt.Errorf("unmarshal kcp tuning of listener %d: %w", i, err)
+		}
+		config.Listeners[i].KCPConfig = &kcpConfig
+	}
+
 	return config, nil
 }
 
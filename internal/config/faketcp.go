@@ -0,0 +1,21 @@
+package config
+
+// FakeTCPConfig describes the configuration of FakeTCP.
+type FakeTCPConfig struct {
+	Emulation   bool   `json:"emulation"`
+	Profile     string `json:"profile"`
+	TLS         bool   `json:"tls"`
+	ServerName  string `json:"tls-sni"`
+	HopPorts    int    `json:"hop-ports"`
+	HopInterval int    `json:"hop-interval"`
+	IdleTimeout int    `json:"idle-timeout"`
+	MaxClients  int    `json:"max-clients"`
+}
+
+// NewFakeTCPConfig returns a new FakeTCP config.
+func NewFakeTCPConfig() *FakeTCPConfig {
+	return &FakeTCPConfig{
+		IdleTimeout: 60,
+		MaxClients:  1024,
+	}
+}
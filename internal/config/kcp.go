@@ -14,6 +14,7 @@ type KCPConfig struct {
 	Interval    int  `json:"interval"`
 	Resend      int  `json:"resend"`
 	NC          int  `json:"nc"`
+	Streams     int  `json:"streams"`
 }
 
 // NewKCPConfig returns a new KCP config.
@@ -25,5 +26,6 @@ func NewKCPConfig() *KCPConfig {
 		DataShard:   10,
 		ParityShard: 3,
 		Interval:    kcp.IKCP_INTERVAL,
+		Streams:     1,
 	}
 }
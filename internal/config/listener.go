@@ -0,0 +1,12 @@
+package config
+
+// ListenerConfig describes the configuration of a listener of the server. The method of encryption and KCP of the
+// server are used if they are not set, and KCP tuning options not set are those of the server.
+type ListenerConfig struct {
+	Mode      string     `json:"mode"`
+	Port      int        `json:"port"`
+	Method    string     `json:"method"`
+	Password  string     `json:"password"`
+	KCP       *bool      `json:"kcp"`
+	KCPConfig *KCPConfig `json:"kcp-tuning"`
+}
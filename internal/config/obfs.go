@@ -0,0 +1,17 @@
+package config
+
+// ObfsConfig describes the configuration of obfuscation.
+type ObfsConfig struct {
+	Padding int   `json:"padding"`
+	Buckets []int `json:"buckets"`
+	Cover   int   `json:"cover"`
+	Jitter  int   `json:"jitter"`
+}
+
+// NewObfsConfig returns a new obfuscation config.
+func NewObfsConfig() *ObfsConfig {
+	return &ObfsConfig{
+		Padding: 128,
+		Buckets: make([]int, 0),
+	}
+}
@@ -0,0 +1,8 @@
+package config
+
+// PathConfig describes the configuration of a connection in multipath bonding.
+type PathConfig struct {
+	UpDev  string `json:"upstream-device"`
+	Port   int    `json:"port"`
+	Weight int    `json:"weight"`
+}
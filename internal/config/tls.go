@@ -0,0 +1,14 @@
+package config
+
+// TLSConfig describes the configuration of TLS.
+type TLSConfig struct {
+	ServerName  string `json:"sni"`
+	Cert        string `json:"cert"`
+	Key         string `json:"key"`
+	Fingerprint string `json:"fingerprint"`
+}
+
+// NewTLSConfig returns a new TLS config.
+func NewTLSConfig() *TLSConfig {
+	return &TLSConfig{}
+}
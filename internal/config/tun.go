@@ -0,0 +1,19 @@
+package config
+
+// TUNConfig describes the configuration of TUN devices.
+type TUNConfig struct {
+	Name    string   `json:"name"`
+	Address string   `json:"address"`
+	MTU     int      `json:"mtu"`
+	Routes  []string `json:"routes"`
+}
+
+// NewTUNConfig returns a new TUN config.
+func NewTUNConfig() *TUNConfig {
+	return &TUNConfig{
+		Name:    "ikago0",
+		Address: "10.6.0.1/24",
+		MTU:     1400,
+		Routes:  make([]string, 0),
+	}
+}
@@ -0,0 +1,15 @@
+package config
+
+// WSConfig describes the configuration of WebSocket.
+type WSConfig struct {
+	Path  string `json:"path"`
+	Host  string `json:"host"`
+	Proxy string `json:"proxy"`
+}
+
+// NewWSConfig returns a new WebSocket config.
+func NewWSConfig() *WSConfig {
+	return &WSConfig{
+		Path: "/",
+	}
+}
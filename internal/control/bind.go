@@ -0,0 +1,80 @@
+package control
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// bindSize is the size of a bind message.
+const bindSize = 12 + TokenSize
+
+// Bind is a message which binds the connection it is sent in to a bond of connections from the same client. The token
+// is the session token of the client, a bond can only be joined with the token it is created with.
+type Bind struct {
+	id        uint64
+	scheduler uint8
+	weight    uint16
+	token     []byte
+}
+
+// NewBind returns a new bind message.
+func NewBind(id uint64, scheduler uint8, weight uint16, token []byte) *Bind {
+	return &Bind{
+		id:        id,
+		scheduler: scheduler,
+		weight:    weight,
+		token:     token,
+	}
+}
+
+func parseBind(contents []byte) (*Bind, error) {
+	if len(contents) < bindSize {
+		return nil, fmt.Errorf("bind size %d out of range", len(contents))
+	}
+
+	token := make([]byte, TokenSize)
+	copy(token, contents[12:bindSize])
+
+	return &Bind{
+		id:        binary.BigEndian.Uint64(contents[1:]),
+		scheduler: contents[9],
+		weight:    binary.BigEndian.Uint16(contents[10:]),
+		token:     token,
+	}, nil
+}
+
+func (b *Bind) Type() Type {
+	return TypeBind
+}
+
+func (b *Bind) Serialize() []byte {
+	s := make([]byte, bindSize)
+
+	s[0] = byte(TypeBind)
+	binary.BigEndian.PutUint64(s[1:], b.id)
+	s[9] = b.scheduler
+	binary.BigEndian.PutUint16(s[10:], b.weight)
+	copy(s[12:], b.token)
+
+	return s
+}
+
+// Id returns the identifier of the bond.
+func (b *Bind) Id() uint64 {
+	return b.id
+}
+
+// Scheduler returns the scheduler of the bond.
+func (b *Bind) Scheduler() uint8 {
+	return b.scheduler
+}
+
+// Weight returns the weight of the connection in the bond.
+func (b *Bind) Weight() uint16 {
+	return b.weight
+}
+
+// Token returns the session token of the client.
+func (b *Bind) Token() []byte {
+	return b.token
+}
@@ -0,0 +1,57 @@
+package control
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestBind(t *testing.T) {
+	token := bytes.Repeat([]byte{0xa5}, TokenSize)
+
+	tests := []struct {
+		name  string
+		bind  *Bind
+		size  int
+		isErr bool
+	}{
+		{name: "bind", bind: NewBind(1, 0, 1, token), size: bindSize},
+		{name: "max fields", bind: NewBind(^uint64(0), 0xff, 0xffff, token), size: bindSize},
+		{name: "zero token", bind: NewBind(1, 1, 10, make([]byte, TokenSize)), size: bindSize},
+		{name: "without token", bind: NewBind(1, 0, 1, token), size: bindSize - TokenSize, isErr: true},
+		{name: "truncated", bind: NewBind(1, 0, 1, token), size: bindSize - 1, isErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			contents := test.bind.Serialize()[:test.size]
+
+			message, err := Parse(contents)
+			if test.isErr {
+				if err == nil {
+					t.Fatalf("parse %s", message.Type())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			b, ok := message.(*Bind)
+			if !ok {
+				t.Fatalf("parse %s, want bind", message.Type())
+			}
+			if b.Id() != test.bind.Id() || b.Scheduler() != test.bind.Scheduler() || b.Weight() != test.bind.Weight() {
+				t.Fatalf("parse bind %d, %d, %d", b.Id(), b.Scheduler(), b.Weight())
+			}
+			if !bytes.Equal(b.Token(), test.bind.Token()) {
+				t.Fatalf("parse bind token %x", b.Token())
+			}
+
+			// The token is kept after the message is reused
+			contents[12] = ^contents[12]
+			if !bytes.Equal(b.Token(), test.bind.Token()) {
+				t.Fatalf("token %x changed with message", b.Token())
+			}
+		})
+	}
+}
@@ -0,0 +1,78 @@
+package control
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Type describes the type of a control message.
+type Type uint8
+
+const (
+	// TypeHeartbeat describes the message is a heartbeat.
+	TypeHeartbeat Type = iota + 1
+	// TypeHeartbeatReply describes the message is a reply of a heartbeat.
+	TypeHeartbeatReply
+	// TypeBind describes the message is a bind.
+	TypeBind
+	// TypeSession describes the message is a session.
+	TypeSession
+	// TypeProbe describes the message is a probe of the path MTU.
+	TypeProbe
+	// TypeProbeReply describes the message is a reply of a probe.
+	TypeProbeReply
+)
+
+func (t Type) String() string {
+	switch t {
+	case TypeHeartbeat:
+		return "heartbeat"
+	case TypeHeartbeatReply:
+		return "heartbeat reply"
+	case TypeBind:
+		return "bind"
+	case TypeSession:
+		return "session"
+	case TypeProbe:
+		return "probe"
+	case TypeProbeReply:
+		return "probe reply"
+	default:
+		return fmt.Sprintf("type %d", t)
+	}
+}
+
+// Message is a control message transmitted next to tunneled packets.
+type Message interface {
+	// Type returns the type of the message.
+	Type() Type
+	// Serialize returns the message in bytes.
+	Serialize() []byte
+}
+
+// IsControl returns if the contents is a control message. Tunneled packets always start with the version of IP, which
+// is never 0, so control messages are marked by a first byte whose high 4 bits are 0.
+func IsControl(contents []byte) bool {
+	return len(contents) > 0 && contents[0]>>4 == 0
+}
+
+// Parse parses a control message.
+func Parse(contents []byte) (Message, error) {
+	if !IsControl(contents) {
+		return nil, errors.New("not control message")
+	}
+
+	t := Type(contents[0])
+	switch t {
+	case TypeHeartbeat, TypeHeartbeatReply:
+		return parseHeartbeat(contents)
+	case TypeBind:
+		return parseBind(contents)
+	case TypeSession:
+		return parseSession(contents)
+	case TypeProbe, TypeProbeReply:
+		return parseProbe(contents)
+	default:
+		return nil, fmt.Errorf("%s not support", t)
+	}
+}
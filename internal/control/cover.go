@@ -0,0 +1,56 @@
+package control
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Coverer sends empty cover packets to a peer at random intervals, which are padded like other packets and dropped by
+// the peer, so the silence of a connection does not reveal the traffic in it.
+type Coverer struct {
+	interval time.Duration
+	done     chan struct{}
+	once     sync.Once
+}
+
+// NewCoverer returns a new coverer which sends cover packets in the interval on average.
+func NewCoverer(interval time.Duration) *Coverer {
+	return &Coverer{
+		interval: interval,
+		done:     make(chan struct{}),
+	}
+}
+
+// Run sends cover packets to w until the coverer is stopped.
+func (c *Coverer) Run(w io.Writer) error {
+	for {
+		// Between half and one and a half of the interval
+		d := c.interval/2 + time.Duration(rand.Int63n(int64(c.interval)+1))
+
+		select {
+		case <-c.done:
+			return nil
+		case <-time.After(d):
+		}
+
+		_, err := w.Write(nil)
+		if err != nil {
+			select {
+			case <-c.done:
+				return nil
+			default:
+				return fmt.Errorf("write: %w", err)
+			}
+		}
+	}
+}
+
+// Stop stops sending cover packets.
+func (c *Coverer) Stop() {
+	c.once.Do(func() {
+		close(c.done)
+	})
+}
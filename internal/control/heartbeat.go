@@ -0,0 +1,280 @@
+package control
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// heartbeatSize is the size of a heartbeat message.
+const heartbeatSize = 13
+
+// heartbeatWindow is the count of recent heartbeats loss is measured in.
+const heartbeatWindow = 64
+
+// HeartbeatInterval is the interval between heartbeats.
+const HeartbeatInterval = 1 * time.Second
+
+// HeartbeatDeadline is the max duration without any message from the peer before it is considered dead.
+const HeartbeatDeadline = 10 * time.Second
+
+// Heartbeat is a heartbeat or a heartbeat reply message.
+type Heartbeat struct {
+	isReply   bool
+	seq       uint32
+	timestamp int64
+}
+
+// NewHeartbeat returns a new heartbeat.
+func NewHeartbeat(seq uint32, t time.Time) *Heartbeat {
+	return &Heartbeat{
+		seq:       seq,
+		timestamp: t.UnixNano(),
+	}
+}
+
+func parseHeartbeat(contents []byte) (*Heartbeat, error) {
+	if len(contents) < heartbeatSize {
+		return nil, fmt.Errorf("heartbeat size %d out of range", len(contents))
+	}
+
+	return &Heartbeat{
+		isReply:   Type(contents[0]) == TypeHeartbeatReply,
+		seq:       binary.BigEndian.Uint32(contents[1:]),
+		timestamp: int64(binary.BigEndian.Uint64(contents[5:])),
+	}, nil
+}
+
+func (h *Heartbeat) Type() Type {
+	if h.isReply {
+		return TypeHeartbeatReply
+	}
+
+	return TypeHeartbeat
+}
+
+func (h *Heartbeat) Serialize() []byte {
+	b := make([]byte, heartbeatSize)
+
+	b[0] = byte(h.Type())
+	binary.BigEndian.PutUint32(b[1:], h.seq)
+	binary.BigEndian.PutUint64(b[5:], uint64(h.timestamp))
+
+	return b
+}
+
+// Seq returns the sequence of the heartbeat.
+func (h *Heartbeat) Seq() uint32 {
+	return h.seq
+}
+
+// Time returns the time the heartbeat was sent.
+func (h *Heartbeat) Time() time.Time {
+	return time.Unix(0, h.timestamp)
+}
+
+// Reply returns the reply of the heartbeat, which echoes its sequence and timestamp.
+func (h *Heartbeat) Reply() *Heartbeat {
+	return &Heartbeat{
+		isReply:   true,
+		seq:       h.seq,
+		timestamp: h.timestamp,
+	}
+}
+
+// Heartbeater sends heartbeats to a peer and measures RTT, jitter and loss of the tunnel.
+type Heartbeater struct {
+	lock     sync.RWMutex
+	seq      uint32
+	sent     [heartbeatWindow]time.Time
+	replied  [heartbeatWindow]bool
+	rtt      time.Duration
+	jitter   time.Duration
+	isRTT    bool
+	lastSeen time.Time
+	isDead   bool
+	done     chan struct{}
+	once     sync.Once
+}
+
+// NewHeartbeater returns a new heartbeater.
+func NewHeartbeater() *Heartbeater {
+	return &Heartbeater{
+		lastSeen: time.Now(),
+		done:     make(chan struct{}),
+	}
+}
+
+// Run sends heartbeats to w periodically until the heartbeater is stopped. dead will be called once if the peer is
+// considered dead.
+func (h *Heartbeater) Run(w io.Writer, dead func()) error {
+	ticker := time.NewTicker(HeartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-h.done:
+			return nil
+		case <-ticker.C:
+		}
+
+		// Dead peer
+		h.lock.Lock()
+		isDead := !h.isDead && time.Now().Sub(h.lastSeen) > HeartbeatDeadline
+		if isDead {
+			h.isDead = true
+		}
+		h.lock.Unlock()
+		if isDead && dead != nil {
+			dead()
+		}
+
+		_, err := w.Write(h.next().Serialize())
+		if err != nil {
+			select {
+			case <-h.done:
+				return nil
+			default:
+				return fmt.Errorf("write: %w", err)
+			}
+		}
+	}
+}
+
+// Stop stops sending heartbeats.
+func (h *Heartbeater) Stop() {
+	h.once.Do(func() {
+		close(h.done)
+	})
+}
+
+func (h *Heartbeater) next() *Heartbeat {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.seq++
+	t := time.Now()
+	h.sent[h.seq%heartbeatWindow] = t
+	h.replied[h.seq%heartbeatWindow] = false
+
+	return NewHeartbeat(h.seq, t)
+}
+
+// Touch records a message is received from the peer.
+func (h *Heartbeater) Touch() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.lastSeen = time.Now()
+	h.isDead = false
+}
+
+// Receive records a heartbeat reply from the peer.
+func (h *Heartbeater) Receive(reply *Heartbeat) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	// Ignore replies out of window or duplicated
+	if h.seq-reply.Seq() >= heartbeatWindow {
+		return
+	}
+	i := reply.Seq() % heartbeatWindow
+	if h.replied[i] || !h.sent[i].Equal(reply.Time()) {
+		return
+	}
+	h.replied[i] = true
+
+	rtt := time.Now().Sub(h.sent[i])
+
+	// Jitter, as described in RFC 3550
+	if h.isRTT {
+		d := rtt - h.rtt
+		if d < 0 {
+			d = -d
+		}
+		h.jitter = h.jitter + (d-h.jitter)/16
+	}
+	h.rtt = rtt
+	h.isRTT = true
+}
+
+// RTT returns the RTT of the last replied heartbeat, and if there is any.
+func (h *Heartbeater) RTT() (time.Duration, bool) {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+
+	return h.rtt, h.isRTT
+}
+
+// Jitter returns the jitter of RTT.
+func (h *Heartbeater) Jitter() time.Duration {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+
+	return h.jitter
+}
+
+// Loss returns the ratio of heartbeats not replied in time among recent heartbeats.
+func (h *Heartbeater) Loss() float64 {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+
+	var total, lost int
+	now := time.Now()
+	for i := 0; i < heartbeatWindow; i++ {
+		// Heartbeats which are not sent yet or may be still on the way
+		if h.sent[i].IsZero() || now.Sub(h.sent[i]) < HeartbeatDeadline/2 {
+			continue
+		}
+
+		total++
+		if !h.replied[i] {
+			lost++
+		}
+	}
+	if total == 0 {
+		return 0
+	}
+
+	return float64(lost) / float64(total)
+}
+
+// IsDead returns if the peer is considered dead.
+func (h *Heartbeater) IsDead() bool {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+
+	return h.isDead
+}
+
+// LastSeen returns the last time a message is received from the peer.
+func (h *Heartbeater) LastSeen() time.Time {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+
+	return h.lastSeen
+}
+
+func (h *Heartbeater) MarshalJSON() ([]byte, error) {
+	rtt := int64(-1)
+	if d, ok := h.RTT(); ok {
+		rtt = d.Milliseconds()
+	}
+
+	return json.Marshal(&struct {
+		RTT      int64   `json:"rtt"`
+		Jitter   int64   `json:"jitter"`
+		Loss     float64 `json:"loss"`
+		Dead     bool    `json:"dead"`
+		LastSeen int64   `json:"lastSeen"`
+	}{
+		RTT:      rtt,
+		Jitter:   h.Jitter().Milliseconds(),
+		Loss:     h.Loss(),
+		Dead:     h.IsDead(),
+		LastSeen: h.LastSeen().Unix(),
+	})
+}
@@ -0,0 +1,233 @@
+package control
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHeartbeat(t *testing.T) {
+	heartbeat := NewHeartbeat(42, time.Unix(0, 1234567890))
+
+	tests := []struct {
+		name     string
+		contents []byte
+		t        Type
+		isErr    bool
+	}{
+		{name: "heartbeat", contents: heartbeat.Serialize(), t: TypeHeartbeat},
+		{name: "reply", contents: heartbeat.Reply().Serialize(), t: TypeHeartbeatReply},
+		{name: "trailer", contents: append(heartbeat.Serialize(), 0, 0), t: TypeHeartbeat},
+		{name: "truncated", contents: heartbeat.Serialize()[:heartbeatSize-1], isErr: true},
+		{name: "empty", contents: []byte{}, isErr: true},
+		{name: "packet", contents: []byte{0x45, 0, 0, 20}, isErr: true},
+		{name: "unknown type", contents: []byte{0x0f}, isErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			message, err := Parse(test.contents)
+			if test.isErr {
+				if err == nil {
+					t.Fatalf("parse %s", message.Type())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			h, ok := message.(*Heartbeat)
+			if !ok {
+				t.Fatalf("parse %s, want heartbeat", message.Type())
+			}
+			if h.Type() != test.t {
+				t.Fatalf("parse %s, want %s", h.Type(), test.t)
+			}
+			if h.Seq() != heartbeat.Seq() || !h.Time().Equal(heartbeat.Time()) {
+				t.Fatalf("parse heartbeat %d at %s", h.Seq(), h.Time())
+			}
+		})
+	}
+}
+
+func TestHeartbeaterReceive(t *testing.T) {
+	sent := time.Now().Add(-100 * time.Millisecond)
+
+	tests := []struct {
+		name  string
+		seq   uint32
+		reply *Heartbeat
+		isRTT bool
+	}{
+		{name: "reply", seq: 1, reply: NewHeartbeat(1, sent).Reply(), isRTT: true},
+		{name: "reply of later heartbeat", seq: heartbeatWindow, reply: NewHeartbeat(1, sent).Reply(), isRTT: true},
+		{name: "forged timestamp", seq: 1, reply: NewHeartbeat(1, sent.Add(time.Millisecond)).Reply()},
+		{name: "unsent", seq: 1, reply: NewHeartbeat(2, sent).Reply()},
+		{name: "out of window", seq: heartbeatWindow + 1, reply: NewHeartbeat(1, sent).Reply()},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h := NewHeartbeater()
+			h.seq = test.seq
+			h.sent[1] = sent
+
+			h.Receive(test.reply)
+			rtt, ok := h.RTT()
+			if ok != test.isRTT {
+				t.Fatalf("measure RTT: %t", ok)
+			}
+			if !ok {
+				return
+			}
+			if rtt < 100*time.Millisecond || rtt > HeartbeatDeadline {
+				t.Fatalf("RTT %s out of range", rtt)
+			}
+
+			// Duplicated replies are ignored
+			h.Receive(test.reply)
+			if d, _ := h.RTT(); d != rtt {
+				t.Fatalf("RTT %s after duplicated reply, want %s", d, rtt)
+			}
+			if h.Jitter() != 0 {
+				t.Fatalf("jitter %s after duplicated reply", h.Jitter())
+			}
+		})
+	}
+}
+
+func TestHeartbeaterJitter(t *testing.T) {
+	tests := []struct {
+		name   string
+		rtts   []time.Duration
+		jitter time.Duration
+	}{
+		{name: "single", rtts: []time.Duration{100 * time.Millisecond}, jitter: 0},
+		{name: "stable", rtts: []time.Duration{100 * time.Millisecond, 100 * time.Millisecond, 100 * time.Millisecond}, jitter: 0},
+		{name: "step", rtts: []time.Duration{100 * time.Millisecond, 260 * time.Millisecond}, jitter: 10 * time.Millisecond},
+		{name: "alternating", rtts: []time.Duration{100 * time.Millisecond, 260 * time.Millisecond, 100 * time.Millisecond}, jitter: 19375 * time.Microsecond},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h := NewHeartbeater()
+
+			var rtt time.Duration
+			for i, d := range test.rtts {
+				seq := uint32(i + 1)
+				sent := time.Now().Add(-d)
+				h.seq = seq
+				h.sent[seq%heartbeatWindow] = sent
+
+				h.Receive(NewHeartbeat(seq, sent).Reply())
+				rtt, _ = h.RTT()
+			}
+
+			// RTT is of the last reply, and jitter is smoothed as described in RFC 3550
+			if last := test.rtts[len(test.rtts)-1]; rtt < last || rtt > last+10*time.Millisecond {
+				t.Fatalf("RTT %s, want %s", rtt, last)
+			}
+			if jitter := h.Jitter(); jitter < test.jitter-time.Millisecond || jitter > test.jitter+time.Millisecond {
+				t.Fatalf("jitter %s, want %s", jitter, test.jitter)
+			}
+		})
+	}
+}
+
+func TestHeartbeaterLoss(t *testing.T) {
+	old := HeartbeatDeadline
+
+	tests := []struct {
+		name    string
+		ages    []time.Duration
+		replied []bool
+		loss    float64
+	}{
+		{name: "none", loss: 0},
+		{name: "all replied", ages: []time.Duration{old, old, old}, replied: []bool{true, true, true}, loss: 0},
+		{name: "all lost", ages: []time.Duration{old, old}, replied: []bool{false, false}, loss: 1},
+		{name: "half lost", ages: []time.Duration{old, old, old, old}, replied: []bool{true, false, true, false}, loss: 0.5},
+		{name: "on the way", ages: []time.Duration{old, time.Second, time.Second}, replied: []bool{true, false, false}, loss: 0},
+		{name: "lost and on the way", ages: []time.Duration{old, old, time.Second}, replied: []bool{true, false, false}, loss: 0.5},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h := NewHeartbeater()
+
+			now := time.Now()
+			for i, age := range test.ages {
+				h.sent[i+1] = now.Add(-age)
+				h.replied[i+1] = test.replied[i]
+			}
+			h.seq = uint32(len(test.ages))
+
+			if loss := h.Loss(); loss != test.loss {
+				t.Fatalf("loss %f, want %f", loss, test.loss)
+			}
+		})
+	}
+}
+
+// heartbeatWriter passes heartbeats written to it to a channel.
+type heartbeatWriter chan *Heartbeat
+
+func (w heartbeatWriter) Write(b []byte) (int, error) {
+	message, err := Parse(b)
+	if err != nil {
+		return 0, err
+	}
+	w <- message.(*Heartbeat)
+
+	return len(b), nil
+}
+
+func TestHeartbeaterRun(t *testing.T) {
+	tests := []struct {
+		name     string
+		lastSeen time.Duration
+		isDead   bool
+	}{
+		{name: "alive", lastSeen: 0},
+		{name: "near deadline", lastSeen: HeartbeatDeadline - 2*HeartbeatInterval},
+		{name: "dead", lastSeen: HeartbeatDeadline + time.Second, isDead: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h := NewHeartbeater()
+			h.lastSeen = time.Now().Add(-test.lastSeen)
+
+			isDead := make(chan struct{}, 2)
+			w := make(heartbeatWriter, 1)
+			go h.Run(w, func() {
+				isDead <- struct{}{}
+			})
+			defer h.Stop()
+
+			// The peer is checked before each heartbeat is sent
+			heartbeat := <-w
+			if heartbeat.Type() != TypeHeartbeat || heartbeat.Seq() != 1 {
+				t.Fatalf("send %s %d", heartbeat.Type(), heartbeat.Seq())
+			}
+			if len(isDead) > 0 != test.isDead || h.IsDead() != test.isDead {
+				t.Fatalf("peer is dead: %t", h.IsDead())
+			}
+
+			h.Receive(heartbeat.Reply())
+			if _, ok := h.RTT(); !ok {
+				t.Fatal("missing RTT of replied heartbeat")
+			}
+
+			// Dead is only called once, and the peer is alive again once a message is received from it
+			<-w
+			if len(isDead) > 1 {
+				t.Fatal("dead is called again")
+			}
+			h.Touch()
+			if h.IsDead() {
+				t.Fatal("peer is dead after touch")
+			}
+		})
+	}
+}
@@ -0,0 +1,145 @@
+package control
+
+import (
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// jitterQueueSize is the max count of packets waiting to be sent in a jitter connection.
+const jitterQueueSize = 1024
+
+type jitterPacket struct {
+	b  []byte
+	at time.Time
+}
+
+// JitterConn is a connection which delays packets by random durations before sending them, so the timing of packets
+// does not reveal the traffic in it. Packets are queued and sent in order, writers are never blocked by the delay.
+type JitterConn struct {
+	net.Conn
+	jitter  time.Duration
+	lock    sync.Mutex
+	last    time.Time
+	queue   chan jitterPacket
+	errLock sync.Mutex
+	err     error
+	done    chan struct{}
+	once    sync.Once
+}
+
+// NewJitterConn returns a connection over conn which delays packets by a random duration up to jitter.
+func NewJitterConn(conn net.Conn, jitter time.Duration) *JitterConn {
+	c := &JitterConn{
+		Conn:   conn,
+		jitter: jitter,
+		queue:  make(chan jitterPacket, jitterQueueSize),
+		done:   make(chan struct{}),
+	}
+
+	go c.run()
+
+	return c
+}
+
+// Write queues the packet to be sent after a random delay, an error in sending a previous packet is returned.
+func (c *JitterConn) Write(p []byte) (n int, err error) {
+	c.errLock.Lock()
+	err = c.err
+	c.errLock.Unlock()
+	if err != nil {
+		return 0, err
+	}
+
+	b := make([]byte, len(p))
+	copy(b, p)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	select {
+	case <-c.done:
+		return 0, io.ErrClosedPipe
+	default:
+	}
+
+	// A packet is never sent before the previous one
+	at := time.Now().Add(time.Duration(rand.Int63n(int64(c.jitter) + 1)))
+	if at.Before(c.last) {
+		at = c.last
+	}
+	c.last = at
+
+	select {
+	case c.queue <- jitterPacket{b: b, at: at}:
+		return len(p), nil
+	case <-c.done:
+		return 0, io.ErrClosedPipe
+	}
+}
+
+func (c *JitterConn) run() {
+	timer := time.NewTimer(0)
+	<-timer.C
+
+	for {
+		var packet jitterPacket
+		select {
+		case <-c.done:
+			c.flush()
+			return
+		case packet = <-c.queue:
+		}
+
+		if d := time.Until(packet.at); d > 0 {
+			timer.Reset(d)
+			select {
+			case <-c.done:
+				timer.Stop()
+				c.send(packet)
+				c.flush()
+				return
+			case <-timer.C:
+			}
+		}
+
+		c.send(packet)
+	}
+}
+
+// flush sends packets still in the queue without delay.
+func (c *JitterConn) flush() {
+	for {
+		select {
+		case packet := <-c.queue:
+			c.send(packet)
+		default:
+			return
+		}
+	}
+}
+
+func (c *JitterConn) send(packet jitterPacket) {
+	_, err := c.Conn.Write(packet.b)
+	if err != nil {
+		c.errLock.Lock()
+		c.err = err
+		c.errLock.Unlock()
+	}
+}
+
+// Stop stops delaying packets, packets still in the queue are sent at once. The underlying connection is left open.
+func (c *JitterConn) Stop() {
+	c.once.Do(func() {
+		close(c.done)
+	})
+}
+
+// Close stops delaying packets and closes the underlying connection.
+func (c *JitterConn) Close() error {
+	c.Stop()
+
+	return c.Conn.Close()
+}
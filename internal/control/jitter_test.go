@@ -0,0 +1,65 @@
+package control
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestJitterConn(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+
+	c := NewJitterConn(a, 20*time.Millisecond)
+	defer c.Close()
+
+	// Writes return before packets are sent
+	start := time.Now()
+	for i := 0; i < 100; i++ {
+		_, err := c.Write([]byte{byte(i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if d := time.Since(start); d >= 20*time.Millisecond {
+		t.Fatalf("writes are blocked for %s", d)
+	}
+
+	// Packets are sent in order
+	buffer := make([]byte, 1)
+	for i := 0; i < 100; i++ {
+		_, err := b.Read(buffer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if buffer[0] != byte(i) {
+			t.Fatalf("read packet %d, want %d", buffer[0], i)
+		}
+	}
+}
+
+func TestJitterConnStop(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	c := NewJitterConn(a, time.Hour)
+	_, err := c.Write([]byte{1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Queued packets are sent at once after stopping
+	c.Stop()
+	_ = b.SetReadDeadline(time.Now().Add(time.Second))
+	buffer := make([]byte, 1)
+	n, err := b.Read(buffer)
+	if err != nil || n != 1 || buffer[0] != 1 {
+		t.Fatalf("read after stop: %d, %v", n, err)
+	}
+
+	_, err = c.Write([]byte{2})
+	if err == nil {
+		t.Fatal("write after stop succeeds")
+	}
+}
@@ -0,0 +1,275 @@
+package control
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// probeSize is the size of a probe message without padding.
+const probeSize = 7
+
+// probeTimeout is the duration to wait for the reply of a probe.
+const probeTimeout = 1 * time.Second
+
+// probeAttempts is the count of probes sent in a size before the size is considered too large.
+const probeAttempts = 2
+
+// probeRetryInterval is the interval between discoveries if the peer cannot be reached.
+const probeRetryInterval = 10 * time.Second
+
+// minMTU is the min MTU every host must accept, as described in RFC 791.
+const minMTU = 576
+
+// ProbeInterval is the interval between discoveries of the path MTU.
+const ProbeInterval = 10 * time.Minute
+
+// Probe is a probe or a probe reply message of the path MTU discovery. A probe is padded to fill up the packet it is
+// sent in, and its reply only echoes the sequence and the size.
+type Probe struct {
+	isReply bool
+	seq     uint32
+	size    uint16
+	length  int
+}
+
+// NewProbe returns a new probe for a packet of the size, which is padded to the length.
+func NewProbe(seq uint32, size uint16, length int) *Probe {
+	if length < probeSize {
+		length = probeSize
+	}
+
+	return &Probe{
+		seq:    seq,
+		size:   size,
+		length: length,
+	}
+}
+
+func parseProbe(contents []byte) (*Probe, error) {
+	if len(contents) < probeSize {
+		return nil, fmt.Errorf("probe size %d out of range", len(contents))
+	}
+
+	return &Probe{
+		isReply: Type(contents[0]) == TypeProbeReply,
+		seq:     binary.BigEndian.Uint32(contents[1:]),
+		size:    binary.BigEndian.Uint16(contents[5:]),
+		length:  len(contents),
+	}, nil
+}
+
+func (p *Probe) Type() Type {
+	if p.isReply {
+		return TypeProbeReply
+	}
+
+	return TypeProbe
+}
+
+func (p *Probe) Serialize() []byte {
+	b := make([]byte, p.length)
+
+	b[0] = byte(p.Type())
+	binary.BigEndian.PutUint32(b[1:], p.seq)
+	binary.BigEndian.PutUint16(b[5:], p.size)
+
+	return b
+}
+
+// Seq returns the sequence of the probe.
+func (p *Probe) Seq() uint32 {
+	return p.seq
+}
+
+// Size returns the size of the packet the probe is sent in.
+func (p *Probe) Size() uint16 {
+	return p.size
+}
+
+// Reply returns the reply of the probe, which echoes its sequence and size without padding.
+func (p *Probe) Reply() *Probe {
+	return &Probe{
+		isReply: true,
+		seq:     p.seq,
+		size:    p.size,
+		length:  probeSize,
+	}
+}
+
+// MTUConn is a connection whose path MTU can be discovered.
+type MTUConn interface {
+	// WriteProbe writes a message in a single packet which must not be fragmented on the way.
+	WriteProbe(b []byte) (int, error)
+	// Overhead returns the size of headers and encryption in a packet besides the message.
+	Overhead() int
+	// SetMTU sets the MTU of the connection.
+	SetMTU(mtu int)
+}
+
+// Prober discovers the path MTU to a peer by probes of different sizes periodically.
+type Prober struct {
+	lock       sync.RWMutex
+	seq        uint32
+	max        int
+	mtu        int
+	lastProbed time.Time
+	replies    chan uint32
+	done       chan struct{}
+	once       sync.Once
+}
+
+// NewProber returns a new prober which discovers the path MTU up to max.
+func NewProber(max int) *Prober {
+	return &Prober{
+		max:     max,
+		replies: make(chan uint32, probeAttempts),
+		done:    make(chan struct{}),
+	}
+}
+
+// Run discovers the path MTU of conn at once and periodically until the prober is stopped. found will be called with
+// the path MTU every time it is discovered, after it is set to conn.
+func (p *Prober) Run(conn MTUConn, found func(mtu int)) {
+	for {
+		interval := ProbeInterval
+
+		mtu := p.discover(conn)
+		select {
+		case <-p.done:
+			return
+		default:
+		}
+		if mtu > 0 {
+			p.lock.Lock()
+			p.mtu = mtu
+			p.lastProbed = time.Now()
+			p.lock.Unlock()
+
+			conn.SetMTU(mtu)
+			if found != nil {
+				found(mtu)
+			}
+		} else {
+			interval = probeRetryInterval
+		}
+
+		select {
+		case <-p.done:
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// discover returns the path MTU of conn by a binary search, or 0 if the peer cannot be reached.
+func (p *Prober) discover(conn MTUConn) int {
+	// The peer may be not ready or down if even the min MTU does not work
+	if !p.probe(conn, minMTU) {
+		return 0
+	}
+
+	// The max MTU works in most cases
+	if p.probe(conn, p.max) {
+		return p.max
+	}
+
+	lo, hi := minMTU, p.max-1
+	for lo < hi {
+		mid := (lo + hi + 1) / 2
+		if p.probe(conn, mid) {
+			lo = mid
+		} else {
+			hi = mid - 1
+		}
+	}
+
+	return lo
+}
+
+// probe returns if a packet of the size can reach the peer.
+func (p *Prober) probe(conn MTUConn, size int) bool {
+	for i := 0; i < probeAttempts; i++ {
+		p.lock.Lock()
+		p.seq++
+		seq := p.seq
+		p.lock.Unlock()
+
+		// Packets larger than the MTU of the local device fail in writing
+		_, err := conn.WriteProbe(NewProbe(seq, uint16(size), size-conn.Overhead()).Serialize())
+		if err != nil {
+			continue
+		}
+
+		timer := time.NewTimer(probeTimeout)
+		for isWaiting := true; isWaiting; {
+			select {
+			case <-p.done:
+				timer.Stop()
+				return false
+			case <-timer.C:
+				isWaiting = false
+			case s := <-p.replies:
+				if s == seq {
+					timer.Stop()
+					return true
+				}
+			}
+		}
+	}
+
+	return false
+}
+
+// Stop stops discovering.
+func (p *Prober) Stop() {
+	p.once.Do(func() {
+		close(p.done)
+	})
+}
+
+// Receive records a probe reply from the peer.
+func (p *Prober) Receive(reply *Probe) {
+	select {
+	case p.replies <- reply.Seq():
+	default:
+	}
+}
+
+// MTU returns the discovered path MTU, and if there is any.
+func (p *Prober) MTU() (int, bool) {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	return p.mtu, p.mtu > 0
+}
+
+// LastProbed returns the last time the path MTU is discovered.
+func (p *Prober) LastProbed() time.Time {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	return p.lastProbed
+}
+
+func (p *Prober) MarshalJSON() ([]byte, error) {
+	mtu := -1
+	if n, ok := p.MTU(); ok {
+		mtu = n
+	}
+
+	var lastProbed int64
+	if t := p.LastProbed(); !t.IsZero() {
+		lastProbed = t.Unix()
+	}
+
+	return json.Marshal(&struct {
+		MTU        int   `json:"mtu"`
+		LastProbed int64 `json:"lastProbed"`
+	}{
+		MTU:        mtu,
+		LastProbed: lastProbed,
+	})
+}
@@ -0,0 +1,132 @@
+package control
+
+import (
+	"errors"
+	"fmt"
+	"math/bits"
+	"testing"
+)
+
+func TestProbe(t *testing.T) {
+	tests := []struct {
+		name   string
+		probe  *Probe
+		t      Type
+		length int
+		isErr  bool
+	}{
+		{name: "probe", probe: NewProbe(7, 1400, 1372), t: TypeProbe, length: 1372},
+		{name: "under size", probe: NewProbe(7, 1400, 1), t: TypeProbe, length: probeSize},
+		{name: "min mtu", probe: NewProbe(^uint32(0), minMTU, minMTU), t: TypeProbe, length: minMTU},
+		{name: "reply", probe: NewProbe(7, 1400, 1372).Reply(), t: TypeProbeReply, length: probeSize},
+		{name: "truncated", probe: NewProbe(7, 1400, 1).Reply(), length: probeSize - 1, isErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			contents := test.probe.Serialize()
+			if test.isErr {
+				contents = contents[:test.length]
+			} else if len(contents) != test.length {
+				t.Fatalf("serialize %d bytes, want %d", len(contents), test.length)
+			}
+
+			message, err := Parse(contents)
+			if test.isErr {
+				if err == nil {
+					t.Fatalf("parse %s", message.Type())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			p, ok := message.(*Probe)
+			if !ok {
+				t.Fatalf("parse %s, want probe", message.Type())
+			}
+			if p.Type() != test.t || p.Seq() != test.probe.Seq() || p.Size() != test.probe.Size() {
+				t.Fatalf("parse %s %d of size %d", p.Type(), p.Seq(), p.Size())
+			}
+
+			// Replies never carry the padding
+			if len(p.Reply().Serialize()) != probeSize {
+				t.Fatalf("reply in %d bytes", len(p.Reply().Serialize()))
+			}
+		})
+	}
+}
+
+// probeConn is a connection in which packets larger than the MTU fail in writing, and probes are replied at once.
+type probeConn struct {
+	prober   *Prober
+	mtu      int
+	overhead int
+	sizes    []int
+}
+
+func (c *probeConn) WriteProbe(b []byte) (int, error) {
+	size := len(b) + c.overhead
+	c.sizes = append(c.sizes, size)
+	if size > c.mtu {
+		return 0, errors.New("message too long")
+	}
+
+	message, err := Parse(b)
+	if err != nil {
+		return 0, err
+	}
+	probe := message.(*Probe)
+	if int(probe.Size()) != size {
+		return 0, fmt.Errorf("probe of size %d in %d", probe.Size(), size)
+	}
+	c.prober.Receive(probe.Reply())
+
+	return len(b), nil
+}
+
+func (c *probeConn) Overhead() int {
+	return c.overhead
+}
+
+func (c *probeConn) SetMTU(mtu int) {
+	c.mtu = mtu
+}
+
+func TestProberDiscover(t *testing.T) {
+	tests := []struct {
+		name string
+		max  int
+		mtu  int
+		want int
+	}{
+		{name: "max", max: 1500, mtu: 1500, want: 1500},
+		{name: "over max", max: 1500, mtu: 9000, want: 1500},
+		{name: "under max", max: 1500, mtu: 1400, want: 1400},
+		{name: "odd", max: 1500, mtu: 1321, want: 1321},
+		{name: "min mtu", max: 1500, mtu: minMTU, want: minMTU},
+		{name: "under min mtu", max: 1500, mtu: minMTU - 1, want: 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p := NewProber(test.max)
+			conn := &probeConn{prober: p, mtu: test.mtu, overhead: 48}
+
+			if mtu := p.discover(conn); mtu != test.want {
+				t.Fatalf("discover path MTU %d, want %d", mtu, test.want)
+			}
+
+			// Each size is probed in a binary search, and in several attempts before it is considered too large
+			for _, size := range conn.sizes {
+				if size < minMTU || size > test.max {
+					t.Fatalf("probe of size %d out of range", size)
+				}
+			}
+			if max := probeAttempts * (2 + bits.Len(uint(test.max-minMTU))); len(conn.sizes) > max {
+				t.Fatalf("discover in %d probes", len(conn.sizes))
+			}
+		})
+	}
+}
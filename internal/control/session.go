@@ -0,0 +1,97 @@
+package control
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+)
+
+// TokenSize is the size of a session token.
+const TokenSize = 16
+
+// sessionSize is the size of a session message without the reserved bytes.
+const sessionSize = 10 + TokenSize
+
+// sessionReservedSize is the size of the reserved bytes in zeros at the end of a session message, which are read as an
+// empty padding trailer by a peer in obfuscation, so the message can be parsed whether obfuscation is enabled or not.
+const sessionReservedSize = 2
+
+// sessionFlagObfs is the flag in a session message which describes obfuscation is enabled.
+const sessionFlagObfs = 1 << 0
+
+// Session is a message which attaches the connection it is sent in to a session of a client. A session with the same
+// identifier can only be attached again with the same token. The message also describes if obfuscation is enabled, so
+// a mismatch between the client and the server is detected.
+type Session struct {
+	id     uint64
+	token  []byte
+	isObfs bool
+}
+
+// NewSession returns a new session message.
+func NewSession(id uint64, token []byte, isObfs bool) *Session {
+	return &Session{
+		id:     id,
+		token:  token,
+		isObfs: isObfs,
+	}
+}
+
+// NewToken returns a new random session token.
+func NewToken() ([]byte, error) {
+	token := make([]byte, TokenSize)
+
+	_, err := rand.Read(token)
+	if err != nil {
+		return nil, err
+	}
+
+	return token, nil
+}
+
+func parseSession(contents []byte) (*Session, error) {
+	if len(contents) < sessionSize {
+		return nil, fmt.Errorf("session size %d out of range", len(contents))
+	}
+
+	token := make([]byte, TokenSize)
+	copy(token, contents[9:sessionSize])
+
+	return &Session{
+		id:     binary.BigEndian.Uint64(contents[1:]),
+		token:  token,
+		isObfs: contents[9+TokenSize]&sessionFlagObfs != 0,
+	}, nil
+}
+
+func (s *Session) Type() Type {
+	return TypeSession
+}
+
+func (s *Session) Serialize() []byte {
+	b := make([]byte, sessionSize+sessionReservedSize)
+
+	b[0] = byte(TypeSession)
+	binary.BigEndian.PutUint64(b[1:], s.id)
+	copy(b[9:], s.token)
+	if s.isObfs {
+		b[9+TokenSize] = sessionFlagObfs
+	}
+
+	return b
+}
+
+// Id returns the identifier of the session.
+func (s *Session) Id() uint64 {
+	return s.id
+}
+
+// Token returns the token of the session.
+func (s *Session) Token() []byte {
+	return s.token
+}
+
+// IsObfs returns if obfuscation is enabled in the peer.
+func (s *Session) IsObfs() bool {
+	return s.isObfs
+}
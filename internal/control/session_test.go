@@ -0,0 +1,126 @@
+package control
+
+import (
+	"bytes"
+	"ikago/internal/crypto"
+	"testing"
+)
+
+func TestSession(t *testing.T) {
+	token := bytes.Repeat([]byte{0x5a}, TokenSize)
+
+	tests := []struct {
+		name    string
+		session *Session
+		size    int
+		isErr   bool
+	}{
+		{name: "session", session: NewSession(1, token, false), size: sessionSize + sessionReservedSize},
+		{name: "obfs", session: NewSession(1, token, true), size: sessionSize + sessionReservedSize},
+		{name: "max id", session: NewSession(^uint64(0), token, false), size: sessionSize + sessionReservedSize},
+		{name: "without reserved", session: NewSession(1, token, true), size: sessionSize},
+		{name: "without flags", session: NewSession(1, token, false), size: sessionSize - 1, isErr: true},
+		{name: "truncated token", session: NewSession(1, token, false), size: 9 + TokenSize/2, isErr: true},
+		{name: "type only", session: NewSession(1, token, false), size: 1, isErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			contents := test.session.Serialize()[:test.size]
+
+			message, err := Parse(contents)
+			if test.isErr {
+				if err == nil {
+					t.Fatalf("parse %s", message.Type())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			s, ok := message.(*Session)
+			if !ok {
+				t.Fatalf("parse %s, want session", message.Type())
+			}
+			if s.Id() != test.session.Id() || !bytes.Equal(s.Token(), token) || s.IsObfs() != test.session.IsObfs() {
+				t.Fatalf("parse session %d, %x, %t", s.Id(), s.Token(), s.IsObfs())
+			}
+
+			// The token is kept after the message is reused
+			contents[9] = ^contents[9]
+			if !bytes.Equal(s.Token(), token) {
+				t.Fatalf("token %x changed with message", s.Token())
+			}
+		})
+	}
+}
+
+func TestNewToken(t *testing.T) {
+	a, err := NewToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(a) != TokenSize || len(b) != TokenSize {
+		t.Fatalf("token size %d", len(a))
+	}
+	if bytes.Equal(a, b) {
+		t.Fatalf("duplicated token %x", a)
+	}
+}
+
+func TestSessionObfs(t *testing.T) {
+	plain, err := crypto.ParseCrypt("aes-128-gcm", "ikago")
+	if err != nil {
+		t.Fatal(err)
+	}
+	obfs, err := crypto.CreateObfsCrypt(plain, 128, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		from crypto.Crypt
+		to   crypto.Crypt
+	}{
+		{name: "plain", from: plain, to: plain},
+		{name: "obfs", from: obfs, to: obfs},
+		{name: "obfs to plain", from: obfs, to: plain},
+		{name: "plain to obfs", from: plain, to: obfs},
+	}
+
+	token := bytes.Repeat([]byte{0xff}, TokenSize)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			isObfs := test.from == obfs
+
+			// Sessions are parsed in the peer whether obfuscation is enabled in it or not
+			encrypted, err := test.from.Encrypt(NewSession(1, token, isObfs).Serialize())
+			if err != nil {
+				t.Fatal(err)
+			}
+			decrypted, err := test.to.Decrypt(encrypted)
+			if err != nil {
+				t.Fatal(err)
+			}
+			message, err := Parse(decrypted)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			s, ok := message.(*Session)
+			if !ok {
+				t.Fatalf("parse %s, want session", message.Type())
+			}
+			if s.Id() != 1 || !bytes.Equal(s.Token(), token) || s.IsObfs() != isObfs {
+				t.Fatalf("parse session %d, %x, %t", s.Id(), s.Token(), s.IsObfs())
+			}
+		})
+	}
+}
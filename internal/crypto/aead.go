@@ -0,0 +1,47 @@
+package crypto
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// seal seals data with a random nonce in front, and appends the result to dst.
+func seal(aead cipher.AEAD, dst, data []byte) ([]byte, error) {
+	size := aead.NonceSize()
+
+	// Grow for the nonce
+	n := len(dst)
+	if cap(dst)-n < size {
+		temp := make([]byte, n, n+size+len(data)+aead.Overhead())
+		copy(temp, dst)
+		dst = temp
+	}
+	dst = dst[:n+size]
+	nonce := dst[n:]
+
+	_, err := io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return nil, fmt.Errorf("generate nonce: %w", err)
+	}
+
+	return aead.Seal(dst, nonce, data, nil), nil
+}
+
+// open opens data with the nonce in front in place.
+func open(aead cipher.AEAD, data []byte) ([]byte, error) {
+	size := aead.NonceSize()
+	if len(data) < size {
+		return nil, errors.New("missing nonce")
+	}
+	nonce, ciphertext := data[:size], data[size:]
+
+	result, err := aead.Open(ciphertext[:0], nonce, ciphertext, nil)
+	if err != nil {
+		return nil, fmt.Errorf("open: %w", err)
+	}
+
+	return result, nil
+}
@@ -35,7 +35,7 @@ func CreateAESCFBCrypt(key, iv []byte) (*AESCFBCrypt, error) {
 func (c *AESCFBCrypt) Encrypt(data []byte) ([]byte, error) {
 	result := make([]byte, len(data))
 
-	c.encrypter.XORKeyStream(data, result)
+	c.encrypter.XORKeyStream(result, data)
 
 	return result, nil
 }
@@ -51,10 +51,16 @@ func (c *AESCFBCrypt) EncryptInPlace(data []byte) error {
 	return nil
 }
 
+func (c *AESCFBCrypt) EncryptNoCopy(data []byte) error {
+	c.encrypter.XORKeyStream(data, data)
+
+	return nil
+}
+
 func (c *AESCFBCrypt) Decrypt(data []byte) ([]byte, error) {
 	result := make([]byte, len(data))
 
-	c.decrypter.XORKeyStream(data, result)
+	c.decrypter.XORKeyStream(result, data)
 
 	return result, nil
 }
@@ -70,6 +76,12 @@ func (c *AESCFBCrypt) DecryptInPlace(data []byte) error {
 	return nil
 }
 
+func (c *AESCFBCrypt) DecryptNoCopy(data []byte) error {
+	c.decrypter.XORKeyStream(data, data)
+
+	return nil
+}
+
 func (c *AESCFBCrypt) Method() Method {
 	return MethodAESCFB
 }
@@ -131,6 +143,14 @@ func (c *AESGCMCrypt) Decrypt(data []byte) ([]byte, error) {
 	return result, nil
 }
 
+func (c *AESGCMCrypt) Seal(dst, data []byte) ([]byte, error) {
+	return seal(c.aead, dst, data)
+}
+
+func (c *AESGCMCrypt) Open(data []byte) ([]byte, error) {
+	return open(c.aead, data)
+}
+
 func (c *AESGCMCrypt) Method() Method {
 	return MethodAESGCM
 }
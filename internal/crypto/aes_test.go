@@ -0,0 +1,55 @@
+package crypto
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestAESCFBCrypt(t *testing.T) {
+	key, iv := DeriveKey("ikago", 16), make([]byte, 16)
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{name: "empty", data: []byte{}},
+		{name: "single byte", data: []byte{1}},
+		{name: "block", data: bytes.Repeat([]byte{0xff}, 16)},
+		{name: "partial block", data: []byte("ikago aes-cfb crypt")},
+		{name: "packet", data: bytes.Repeat([]byte{0x5a}, 1400)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			encrypter, err := CreateAESCFBCrypt(key, iv)
+			if err != nil {
+				t.Fatal(err)
+			}
+			decrypter, err := CreateAESCFBCrypt(key, iv)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			origin := append([]byte{}, test.data...)
+
+			encrypted, err := encrypter.Encrypt(test.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(test.data, origin) {
+				t.Fatal("data is modified in encryption")
+			}
+			if len(encrypted) != len(test.data) || (len(test.data) > 0 && bytes.Equal(encrypted, test.data)) {
+				t.Fatalf("encrypt %x to %x", test.data, encrypted)
+			}
+
+			decrypted, err := decrypter.Decrypt(encrypted)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(decrypted, test.data) {
+				t.Fatalf("decrypt %x, want %x", decrypted, test.data)
+			}
+		})
+	}
+}
@@ -51,6 +51,14 @@ func (c *ChaCha20Poly1305Crypt) Decrypt(data []byte) ([]byte, error) {
 	return result, nil
 }
 
+func (c *ChaCha20Poly1305Crypt) Seal(dst, data []byte) ([]byte, error) {
+	return seal(c.aead, dst, data)
+}
+
+func (c *ChaCha20Poly1305Crypt) Open(data []byte) ([]byte, error) {
+	return open(c.aead, data)
+}
+
 func (c *ChaCha20Poly1305Crypt) Method() Method {
 	return MethodChaCha20Poly1305
 }
@@ -102,6 +110,14 @@ func (c *XChaCha20Poly1305Crypt) Decrypt(data []byte) ([]byte, error) {
 	return result, nil
 }
 
+func (c *XChaCha20Poly1305Crypt) Seal(dst, data []byte) ([]byte, error) {
+	return seal(c.aead, dst, data)
+}
+
+func (c *XChaCha20Poly1305Crypt) Open(data []byte) ([]byte, error) {
+	return open(c.aead, data)
+}
+
 func (c *XChaCha20Poly1305Crypt) Method() Method {
 	return MethodXChaCha20Poly1305
 }
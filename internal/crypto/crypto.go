@@ -69,6 +69,88 @@ type NoCopyCrypt interface {
 	DecryptNoCopy([]byte) error
 }
 
+// SealCrypt describes a crypt which encrypts into a given buffer and decrypts in place, so buffers can be reused.
+type SealCrypt interface {
+	Crypt
+	// Seal encrypts data and appends the result to dst, dst must not overlap data.
+	Seal(dst, data []byte) ([]byte, error)
+	// Open decrypts data in place and returns the result, which shares the space of data.
+	Open(data []byte) ([]byte, error)
+}
+
+// SizedCrypt describes a crypt whose ciphertext varies in size, the size is decided before data is encrypted so the
+// ciphertext can be encrypted into a buffer of the exact size.
+type SizedCrypt interface {
+	Crypt
+	// Size returns a size of the ciphertext of data in the size n, which is not over max unless the ciphertext without
+	// padding is.
+	Size(n, max int) int
+	// SealSized encrypts data into the ciphertext in the size and appends the result to dst, dst must not overlap data.
+	SealSized(dst, data []byte, size int) ([]byte, error)
+}
+
+// Size returns a size of the ciphertext of data in the size n encrypted with the crypt, which is not over max unless
+// the ciphertext without padding is.
+func Size(c Crypt, n, max int) int {
+	if t, ok := c.(SizedCrypt); ok {
+		return t.Size(n, max)
+	}
+
+	return n + c.Cost()
+}
+
+// SealSized encrypts data with the crypt into the ciphertext in the size and appends the result to dst, dst must not
+// overlap data. The size must be the one returned by Size, or the size of data plus the cost.
+func SealSized(c Crypt, dst, data []byte, size int) ([]byte, error) {
+	if t, ok := c.(SizedCrypt); ok {
+		return t.SealSized(dst, data, size)
+	}
+
+	return Seal(c, dst, data)
+}
+
+// Seal encrypts data with the crypt and appends the result to dst, dst must not overlap data.
+func Seal(c Crypt, dst, data []byte) ([]byte, error) {
+	switch t := c.(type) {
+	case SealCrypt:
+		return t.Seal(dst, data)
+	case NoCopyCrypt:
+		dst = append(dst, data...)
+
+		err := t.EncryptNoCopy(dst[len(dst)-len(data):])
+		if err != nil {
+			return nil, err
+		}
+
+		return dst, nil
+	default:
+		result, err := c.Encrypt(data)
+		if err != nil {
+			return nil, err
+		}
+
+		return append(dst, result...), nil
+	}
+}
+
+// Open decrypts data in place with the crypt and returns the result, which shares the space of data unless the crypt
+// is neither a SealCrypt nor a NoCopyCrypt.
+func Open(c Crypt, data []byte) ([]byte, error) {
+	switch t := c.(type) {
+	case SealCrypt:
+		return t.Open(data)
+	case NoCopyCrypt:
+		err := t.DecryptNoCopy(data)
+		if err != nil {
+			return nil, err
+		}
+
+		return data, nil
+	default:
+		return c.Decrypt(data)
+	}
+}
+
 // ParseCrypt returns a crypt by given method and password.
 func ParseCrypt(method, password string) (Crypt, error) {
 	var (
@@ -0,0 +1,153 @@
+package crypto
+
+import (
+	"bytes"
+	"testing"
+)
+
+var testMethods = []string{"plain", "aes-128-gcm", "aes-256-gcm", "chacha20-poly1305", "xchacha20-poly1305"}
+
+func TestSealOpen(t *testing.T) {
+	for _, method := range testMethods {
+		t.Run(method, func(t *testing.T) {
+			c, err := ParseCrypt(method, "ikago")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, size := range []int{0, 1, 1400} {
+				data := bytes.Repeat([]byte{byte(size)}, size)
+
+				// Seal behind existing contents
+				sealed, err := Seal(c, []byte{1, 2, 3}, data)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(sealed[:3], []byte{1, 2, 3}) {
+					t.Fatalf("size %d: contents in front are overwritten", size)
+				}
+				if len(sealed)-3 != size+c.Cost() {
+					t.Fatalf("size %d: sealed size %d, want %d", size, len(sealed)-3, size+c.Cost())
+				}
+
+				// Sealed data can be decrypted, and opened data can be encrypted
+				decrypted, err := c.Decrypt(sealed[3:])
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(decrypted, data) {
+					t.Fatalf("size %d: decrypted data mismatch", size)
+				}
+				encrypted, err := c.Encrypt(data)
+				if err != nil {
+					t.Fatal(err)
+				}
+				opened, err := Open(c, encrypted)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(opened, data) {
+					t.Fatalf("size %d: opened data mismatch", size)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkSeal(b *testing.B) {
+	for _, method := range testMethods {
+		b.Run(method, func(b *testing.B) {
+			c, err := ParseCrypt(method, "ikago")
+			if err != nil {
+				b.Fatal(err)
+			}
+			data := make([]byte, 1024)
+			buffer := make([]byte, 0, 2048)
+
+			b.SetBytes(int64(len(data)))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_, err := Seal(c, buffer[:0], data)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkEncrypt(b *testing.B) {
+	for _, method := range testMethods {
+		b.Run(method, func(b *testing.B) {
+			c, err := ParseCrypt(method, "ikago")
+			if err != nil {
+				b.Fatal(err)
+			}
+			data := make([]byte, 1024)
+
+			b.SetBytes(int64(len(data)))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_, err := c.Encrypt(data)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkOpen(b *testing.B) {
+	for _, method := range testMethods {
+		b.Run(method, func(b *testing.B) {
+			c, err := ParseCrypt(method, "ikago")
+			if err != nil {
+				b.Fatal(err)
+			}
+			encrypted, err := c.Encrypt(make([]byte, 1024))
+			if err != nil {
+				b.Fatal(err)
+			}
+			// Data is opened in place, so it is restored in every iteration
+			buffer := make([]byte, len(encrypted))
+
+			b.SetBytes(1024)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				copy(buffer, encrypted)
+				_, err := Open(c, buffer)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkDecrypt(b *testing.B) {
+	for _, method := range testMethods {
+		b.Run(method, func(b *testing.B) {
+			c, err := ParseCrypt(method, "ikago")
+			if err != nil {
+				b.Fatal(err)
+			}
+			encrypted, err := c.Encrypt(make([]byte, 1024))
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			b.SetBytes(1024)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_, err := c.Decrypt(encrypted)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
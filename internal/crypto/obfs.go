@@ -0,0 +1,163 @@
+package crypto
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+)
+
+// obfsTrailerSize is the size of the trailer which records the size of padding behind data.
+const obfsTrailerSize = 2
+
+// obfsMaxPadding is the max size of padding the trailer can record.
+const obfsMaxPadding = 65535
+
+var obfsPool = sync.Pool{
+	New: func() interface{} {
+		return make([]byte, 0, 2048)
+	},
+}
+
+// ObfsCrypt describes a crypt which pads data with random padding before encryption, so the size of the ciphertext does
+// not reveal the size of data. Padding is encrypted and authenticated with data by the underlying crypt.
+type ObfsCrypt struct {
+	crypt   Crypt
+	padding int
+	buckets []int
+}
+
+// CreateObfsCrypt returns an obfuscation crypt over the crypt. Data is padded by random padding up to padding, and
+// then up to the smallest bucket the result fits in.
+func CreateObfsCrypt(crypt Crypt, padding int, buckets []int) (*ObfsCrypt, error) {
+	if padding < 0 || padding > obfsMaxPadding {
+		return nil, fmt.Errorf("padding %d out of range", padding)
+	}
+	sorted := make([]int, len(buckets))
+	copy(sorted, buckets)
+	sort.Ints(sorted)
+	for _, bucket := range sorted {
+		if bucket <= 0 {
+			return nil, fmt.Errorf("bucket %d out of range", bucket)
+		}
+	}
+
+	return &ObfsCrypt{
+		crypt:   crypt,
+		padding: padding,
+		buckets: sorted,
+	}, nil
+}
+
+// Size returns a random size of the ciphertext of data in the size n, which is not over max unless the ciphertext
+// without padding is.
+func (c *ObfsCrypt) Size(n, max int) int {
+	min := n + c.Cost()
+
+	// Too large to be recorded in the trailer
+	if max > min+obfsMaxPadding {
+		max = min + obfsMaxPadding
+	}
+	if max <= min {
+		return min
+	}
+
+	size := min
+	if c.padding > 0 {
+		size = size + rand.Intn(c.padding+1)
+	}
+
+	// Buckets over max are skipped
+	for _, bucket := range c.buckets {
+		if bucket >= size {
+			if bucket <= max {
+				size = bucket
+			}
+			break
+		}
+	}
+
+	if size > max {
+		size = max
+	}
+
+	return size
+}
+
+// SealSized encrypts data with padding into the ciphertext in the size, and appends the result to dst, dst must not
+// overlap data.
+func (c *ObfsCrypt) SealSized(dst, data []byte, size int) ([]byte, error) {
+	padding := size - len(data) - c.Cost()
+	if padding < 0 || padding > obfsMaxPadding {
+		return nil, fmt.Errorf("size %d out of range", size)
+	}
+
+	// Data, padding in zeros and the trailer
+	n := len(data) + padding + obfsTrailerSize
+	plain := obfsPool.Get().([]byte)
+	if cap(plain) < n {
+		plain = make([]byte, 0, n)
+	}
+	defer func() {
+		obfsPool.Put(plain[:0])
+	}()
+	plain = plain[:n]
+	copy(plain, data)
+	for i := len(data); i < n-obfsTrailerSize; i++ {
+		plain[i] = 0
+	}
+	binary.BigEndian.PutUint16(plain[n-obfsTrailerSize:], uint16(padding))
+
+	return Seal(c.crypt, dst, plain)
+}
+
+// unpad returns data without padding and the trailer.
+func unpad(plain []byte) ([]byte, error) {
+	if len(plain) < obfsTrailerSize {
+		return nil, errors.New("missing trailer")
+	}
+
+	padding := int(binary.BigEndian.Uint16(plain[len(plain)-obfsTrailerSize:]))
+	if padding > len(plain)-obfsTrailerSize {
+		return nil, fmt.Errorf("padding %d out of range", padding)
+	}
+
+	return plain[:len(plain)-obfsTrailerSize-padding], nil
+}
+
+func (c *ObfsCrypt) Encrypt(data []byte) ([]byte, error) {
+	return c.SealSized(nil, data, c.Size(len(data), len(data)+c.Cost()+obfsMaxPadding))
+}
+
+func (c *ObfsCrypt) Decrypt(data []byte) ([]byte, error) {
+	plain, err := c.crypt.Decrypt(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return unpad(plain)
+}
+
+func (c *ObfsCrypt) Seal(dst, data []byte) ([]byte, error) {
+	return c.SealSized(dst, data, c.Size(len(data), len(data)+c.Cost()+obfsMaxPadding))
+}
+
+func (c *ObfsCrypt) Open(data []byte) ([]byte, error) {
+	plain, err := Open(c.crypt, data)
+	if err != nil {
+		return nil, err
+	}
+
+	return unpad(plain)
+}
+
+func (c *ObfsCrypt) Method() Method {
+	return c.crypt.Method()
+}
+
+// Cost returns the size of cost without padding.
+func (c *ObfsCrypt) Cost() int {
+	return c.crypt.Cost() + obfsTrailerSize
+}
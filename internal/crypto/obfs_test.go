@@ -0,0 +1,155 @@
+package crypto
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestObfsSize(t *testing.T) {
+	plain, err := ParseCrypt("aes-128-gcm", "ikago")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cost := plain.Cost() + obfsTrailerSize
+
+	tests := []struct {
+		name    string
+		padding int
+		buckets []int
+		n       int
+		max     int
+		min     int
+		want    int
+	}{
+		{name: "no padding", padding: 0, n: 100, max: 1500, min: 100 + cost, want: 100 + cost},
+		{name: "padding", padding: 200, n: 100, max: 1500, min: 100 + cost, want: 300 + cost},
+		{name: "under max", padding: 1000, n: 100, max: 200, min: 100 + cost, want: 200},
+		{name: "max under min", padding: 1000, n: 1400, max: 1000, min: 1400 + cost, want: 1400 + cost},
+		{name: "bucket", padding: 0, buckets: []int{512, 1024}, n: 100, max: 1500, min: 512, want: 512},
+		{name: "larger bucket", padding: 0, buckets: []int{512, 1024}, n: 600, max: 1500, min: 1024, want: 1024},
+		{name: "over buckets", padding: 0, buckets: []int{512, 1024}, n: 1100, max: 1500, min: 1100 + cost, want: 1100 + cost},
+		{name: "padding in bucket", padding: 100, buckets: []int{1024}, n: 100, max: 1500, min: 1024, want: 1024},
+		{name: "bucket over max", padding: 0, buckets: []int{1500}, n: 100, max: 1400, min: 100 + cost, want: 100 + cost},
+		{name: "trailer limit", padding: obfsMaxPadding, n: 0, max: 1 << 20, min: cost, want: cost + obfsMaxPadding},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c, err := CreateObfsCrypt(plain, test.padding, test.buckets)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for i := 0; i < 100; i++ {
+				size := c.Size(test.n, test.max)
+				if size < test.min || size > test.want {
+					t.Fatalf("size %d out of range [%d, %d]", size, test.min, test.want)
+				}
+			}
+		})
+	}
+}
+
+func TestObfsSealOpen(t *testing.T) {
+	plain, err := ParseCrypt("aes-128-gcm", "ikago")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := CreateObfsCrypt(plain, 512, []int{256, 1024})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		n     int
+		size  int
+		isErr bool
+	}{
+		{name: "empty", n: 0, size: c.Cost()},
+		{name: "padded", n: 10, size: 200},
+		{name: "unpadded", n: 1400, size: 1400 + c.Cost()},
+		{name: "max padding", n: 1, size: 1 + c.Cost() + obfsMaxPadding},
+		{name: "under size", n: 100, size: 100 + c.Cost() - 1, isErr: true},
+		{name: "over padding", n: 1, size: 1 + c.Cost() + obfsMaxPadding + 1, isErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data := bytes.Repeat([]byte{0xff}, test.n)
+
+			sealed, err := c.SealSized(nil, data, test.size)
+			if test.isErr {
+				if err == nil {
+					t.Fatalf("seal %d bytes in size %d", test.n, test.size)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(sealed) != test.size {
+				t.Fatalf("sealed size %d, want %d", len(sealed), test.size)
+			}
+
+			opened, err := c.Open(sealed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(opened, data) {
+				t.Fatalf("opened %d bytes mismatch", len(opened))
+			}
+		})
+	}
+}
+
+func TestObfsUnpad(t *testing.T) {
+	plain, err := ParseCrypt("aes-128-gcm", "ikago")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := CreateObfsCrypt(plain, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		plain []byte
+		want  []byte
+		isErr bool
+	}{
+		{name: "no padding", plain: []byte{1, 2, 0, 0}, want: []byte{1, 2}},
+		{name: "padding", plain: []byte{1, 2, 0, 0, 0, 0, 3}, want: []byte{1, 2}},
+		{name: "all padding", plain: []byte{0, 0, 0, 2}, want: []byte{}},
+		{name: "trailer only", plain: []byte{0, 0}, want: []byte{}},
+		{name: "padding over data", plain: []byte{1, 2, 0, 3}, isErr: true},
+		{name: "padding over max", plain: []byte{1, 2, 0xff, 0xff}, isErr: true},
+		{name: "missing trailer", plain: []byte{1}, isErr: true},
+		{name: "empty", plain: []byte{}, isErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// The trailer is encrypted and authenticated with data
+			encrypted, err := plain.Encrypt(test.plain)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			decrypted, err := c.Decrypt(encrypted)
+			if test.isErr {
+				if err == nil {
+					t.Fatalf("decrypt %x with wrong trailer", test.plain)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(decrypted, test.want) {
+				t.Fatalf("decrypt %x, want %x", decrypted, test.want)
+			}
+		})
+	}
+}
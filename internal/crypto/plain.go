@@ -45,6 +45,14 @@ func (c *PlainCrypt) DecryptNoCopy(_ []byte) error {
 	return nil
 }
 
+func (c *PlainCrypt) Seal(dst, data []byte) ([]byte, error) {
+	return append(dst, data...), nil
+}
+
+func (c *PlainCrypt) Open(data []byte) ([]byte, error) {
+	return data, nil
+}
+
 func (c *PlainCrypt) Method() Method {
 	return MethodPlain
 }
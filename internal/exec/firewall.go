@@ -23,15 +23,34 @@ func AddGlobalFirewallRule() error {
 	return nil
 }
 
-// AddSpecificFirewallRule adds a rule for firewall blocking certain traffic in packets transmission with specific host.
-func AddSpecificFirewallRule(ip net.IP, port uint16) error {
+// AddGlobalIPv6FirewallRule adds a rule for firewall blocking certain traffic in all incoming and outgoing IPv6
+// packets.
+func AddGlobalIPv6FirewallRule() error {
+	var err error
+
+	switch t := runtime.GOOS; t {
+	case "linux":
+		err = addGlobalIPv6FirewallRule()
+	default:
+		return fmt.Errorf("os %s not support", t)
+	}
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// AddSpecificFirewallRule adds a rule for firewall blocking certain traffic in packets transmission with specific host
+// in ports from port to maxPort.
+func AddSpecificFirewallRule(ip net.IP, port, maxPort uint16) error {
 	var err error
 
 	switch t := runtime.GOOS; t {
 	case "darwin", "freebsd":
-		err = addSpecificFirewallRule(ip, port)
+		err = addSpecificFirewallRule(ip, port, maxPort)
 	case "linux":
-		err = addSpecificFirewallRule(ip, port)
+		err = addSpecificFirewallRule(ip, port, maxPort)
 	default:
 		return fmt.Errorf("os %s not support", t)
 	}
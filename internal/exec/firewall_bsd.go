@@ -13,13 +13,22 @@ func addGlobalFirewallRule() error {
 	return nil
 }
 
-func addSpecificFirewallRule(ip net.IP, port uint16) error {
+func addGlobalIPv6FirewallRule() error {
+	return nil
+}
+
+func addSpecificFirewallRule(ip net.IP, port, maxPort uint16) error {
+	ports := fmt.Sprintf("%d", port)
+	if maxPort > port {
+		ports = fmt.Sprintf("%d:%d", port, maxPort)
+	}
+
 	file, err := os.OpenFile("./pf.conf", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 755)
 	if err != nil {
 		return fmt.Errorf("open: %w", err)
 	}
 
-	_, err = file.WriteString(fmt.Sprintf("block drop proto tcp from any to %s port %d\n", ip, port))
+	_, err = file.WriteString(fmt.Sprintf("block drop proto tcp from any to %s port %s\n", ip, ports))
 	if err != nil {
 		return fmt.Errorf("write: %w", err)
 	}
@@ -17,11 +17,31 @@ func addGlobalFirewallRule() error {
 	return nil
 }
 
-func addSpecificFirewallRule(ip net.IP, port uint16) error {
-	routeCmd := exec.Command("iptables", "-A", "OUTPUT", "-s", ip.String(), "-p", "tcp", "--dport", strconv.Itoa(int(port)), "-j", "DROP")
+func addGlobalIPv6FirewallRule() error {
+	routeCmd := exec.Command("ip6tables", "-A", "OUTPUT", "-p", "tcp", "--tcp-flags", "RST", "RST", "-j", "DROP")
 	_, err := routeCmd.CombinedOutput()
 	if err != nil {
-		return fmt.Errorf("exec iptables: %w", err)
+		return fmt.Errorf("exec ip6tables: %w", err)
+	}
+
+	return nil
+}
+
+func addSpecificFirewallRule(ip net.IP, port, maxPort uint16) error {
+	name := "iptables"
+	if ip.To4() == nil {
+		name = "ip6tables"
+	}
+
+	dport := strconv.Itoa(int(port))
+	if maxPort > port {
+		dport = fmt.Sprintf("%d:%d", port, maxPort)
+	}
+
+	routeCmd := exec.Command(name, "-A", "OUTPUT", "-s", ip.String(), "-p", "tcp", "--dport", dport, "-j", "DROP")
+	_, err := routeCmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("exec %s: %w", name, err)
 	}
 
 	return nil
@@ -8,6 +8,10 @@ func addGlobalFirewallRule() error {
 	return nil
 }
 
-func addSpecificFirewallRule(_ net.IP, _ uint16) error {
+func addGlobalIPv6FirewallRule() error {
+	return nil
+}
+
+func addSpecificFirewallRule(_ net.IP, _, _ uint16) error {
 	return nil
 }
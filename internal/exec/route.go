@@ -0,0 +1,41 @@
+package exec
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+)
+
+// SetUpInterface assigns addresses and MTU to an interface and brings it up.
+func SetUpInterface(name string, ipNets []*net.IPNet, mtu int) error {
+	var err error
+
+	switch t := runtime.GOOS; t {
+	case "linux":
+		err = setUpInterface(name, ipNets, mtu)
+	default:
+		return fmt.Errorf("os %s not support", t)
+	}
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// AddRoute adds a route to the destination through an interface.
+func AddRoute(dst *net.IPNet, name string) error {
+	var err error
+
+	switch t := runtime.GOOS; t {
+	case "linux":
+		err = addRoute(dst, name)
+	default:
+		return fmt.Errorf("os %s not support", t)
+	}
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
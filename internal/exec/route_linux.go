@@ -0,0 +1,36 @@
+package exec
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+	"strconv"
+)
+
+func setUpInterface(name string, ipNets []*net.IPNet, mtu int) error {
+	for _, ipNet := range ipNets {
+		addrCmd := exec.Command("ip", "addr", "add", ipNet.String(), "dev", name)
+		_, err := addrCmd.CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("exec ip: %w", err)
+		}
+	}
+
+	linkCmd := exec.Command("ip", "link", "set", "dev", name, "mtu", strconv.Itoa(mtu), "up")
+	_, err := linkCmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("exec ip: %w", err)
+	}
+
+	return nil
+}
+
+func addRoute(dst *net.IPNet, name string) error {
+	routeCmd := exec.Command("ip", "route", "add", dst.String(), "dev", name)
+	_, err := routeCmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("exec ip: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,13 @@
+// +build !linux
+
+package exec
+
+import "net"
+
+func setUpInterface(_ string, _ []*net.IPNet, _ int) error {
+	return nil
+}
+
+func addRoute(_ *net.IPNet, _ string) error {
+	return nil
+}
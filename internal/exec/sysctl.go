@@ -23,3 +23,39 @@ func DisableIPForwarding() error {
 
 	return nil
 }
+
+// DisableIPv6Forwarding disables IPv6 forwarding.
+func DisableIPv6Forwarding() error {
+	var err error
+
+	switch t := runtime.GOOS; t {
+	case "darwin", "freebsd":
+		err = disableIPv6Forwarding()
+	case "linux":
+		err = disableIPv6Forwarding()
+	default:
+		return fmt.Errorf("os %s not support", t)
+	}
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// DisableICMPEcho disables replying ICMP echo requests by the system.
+func DisableICMPEcho() error {
+	var err error
+
+	switch t := runtime.GOOS; t {
+	case "linux":
+		err = disableICMPEcho()
+	default:
+		return fmt.Errorf("os %s not support", t)
+	}
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
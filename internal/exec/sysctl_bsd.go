@@ -16,3 +16,17 @@ func disableIPForwarding() error {
 
 	return nil
 }
+
+func disableIPv6Forwarding() error {
+	routeCmd := exec.Command("sysctl", "-w", "net.inet6.ip6.forwarding=0")
+	_, err := routeCmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("exec sysctl: %w", err)
+	}
+
+	return nil
+}
+
+func disableICMPEcho() error {
+	return nil
+}
@@ -14,3 +14,23 @@ func disableIPForwarding() error {
 
 	return nil
 }
+
+func disableIPv6Forwarding() error {
+	routeCmd := exec.Command("sysctl", "-w", "net.ipv6.conf.all.forwarding=0")
+	_, err := routeCmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("exec sysctl: %w", err)
+	}
+
+	return nil
+}
+
+func disableICMPEcho() error {
+	routeCmd := exec.Command("sysctl", "-w", "net.ipv4.icmp_echo_ignore_all=1")
+	_, err := routeCmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("exec sysctl: %w", err)
+	}
+
+	return nil
+}
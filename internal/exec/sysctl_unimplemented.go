@@ -5,3 +5,11 @@
 func disableIPForwarding() error {
 	return nil
 }
+
+func disableIPv6Forwarding() error {
+	return nil
+}
+
+func disableICMPEcho() error {
+	return nil
+}
@@ -0,0 +1,448 @@
+package pcap
+
+import (
+	"errors"
+	"fmt"
+	"ikago/internal/config"
+	"ikago/internal/log"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"golang.org/x/net/bpf"
+	"golang.org/x/sys/unix"
+)
+
+// isAFPacketSupported describes if AF_PACKET sockets are available.
+const isAFPacketSupported = true
+
+const (
+	// afpacketFrameSize is the size of each frame in transmit rings.
+	afpacketFrameSize = 2048
+	// afpacketTxOffset is the offset of packets in frames of transmit rings.
+	afpacketTxOffset = 48
+	// afpacketBlockTimeout is the max milliseconds before a block in receive rings is handed to users even if it is
+	// not full.
+	afpacketBlockTimeout = 1
+	// afpacketPollTimeout is the max milliseconds a ring is polled before the handle checks if it is closed.
+	afpacketPollTimeout = 100
+	// afpacketQueueSize is the max count of packets queued from receive rings.
+	afpacketQueueSize = 1000
+)
+
+// afpacketFanoutId is the identifier of the last fanout group.
+var afpacketFanoutId uint32
+
+// afpacketBlock is the header of a block in TPACKET_V3 receive rings.
+type afpacketBlock struct {
+	version          uint32
+	offsetToPriv     uint32
+	status           uint32
+	numPkts          uint32
+	offsetToFirstPkt uint32
+}
+
+type afpacketSocket struct {
+	fd    int
+	ring  []byte
+	rx    [][]byte
+	tx    [][]byte
+	block int
+	frame int
+}
+
+func newAFPacketSocket(index int, program []bpf.RawInstruction, config *config.AFPacketConfig, isTx bool) (*afpacketSocket, error) {
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW, 0)
+	if err != nil {
+		return nil, fmt.Errorf("socket: %w", err)
+	}
+
+	s := &afpacketSocket{fd: fd}
+
+	err = s.setup(index, program, config, isTx)
+	if err != nil {
+		s.close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *afpacketSocket) setup(index int, program []bpf.RawInstruction, config *config.AFPacketConfig, isTx bool) error {
+	// Filter is attached before the socket is bound, so no packet sneaks in
+	err := s.attachFilter(program)
+	if err != nil {
+		return err
+	}
+
+	err = unix.SetsockoptInt(s.fd, unix.SOL_PACKET, unix.PACKET_VERSION, unix.TPACKET_V3)
+	if err != nil {
+		return fmt.Errorf("set version: %w", err)
+	}
+
+	// Malformed frames in transmit rings are skipped instead of blocking the ring
+	err = unix.SetsockoptInt(s.fd, unix.SOL_PACKET, unix.PACKET_LOSS, 1)
+	if err != nil {
+		return fmt.Errorf("set loss: %w", err)
+	}
+
+	size := config.BlockSize * config.Blocks
+	req := &unix.TpacketReq3{
+		Block_size:     uint32(config.BlockSize),
+		Block_nr:       uint32(config.Blocks),
+		Frame_size:     afpacketFrameSize,
+		Frame_nr:       uint32(size / afpacketFrameSize),
+		Retire_blk_tov: afpacketBlockTimeout,
+	}
+	err = unix.SetsockoptTpacketReq3(s.fd, unix.SOL_PACKET, unix.PACKET_RX_RING, req)
+	if err != nil {
+		return fmt.Errorf("set receive ring: %w", err)
+	}
+
+	length := size
+	if isTx {
+		req.Retire_blk_tov = 0
+		err = unix.SetsockoptTpacketReq3(s.fd, unix.SOL_PACKET, unix.PACKET_TX_RING, req)
+		if err != nil {
+			return fmt.Errorf("set transmit ring: %w", err)
+		}
+		length = length + size
+	}
+
+	// The transmit ring is mapped right after the receive ring
+	s.ring, err = unix.Mmap(s.fd, 0, length, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+	if err != nil {
+		return fmt.Errorf("mmap: %w", err)
+	}
+	s.rx = make([][]byte, 0, config.Blocks)
+	for i := 0; i < config.Blocks; i++ {
+		s.rx = append(s.rx, s.ring[i*config.BlockSize:(i+1)*config.BlockSize])
+	}
+	if isTx {
+		s.tx = make([][]byte, 0, size/afpacketFrameSize)
+		for i := size; i < length; i = i + afpacketFrameSize {
+			s.tx = append(s.tx, s.ring[i:i+afpacketFrameSize])
+		}
+	}
+
+	err = unix.Bind(s.fd, &unix.SockaddrLinklayer{
+		Protocol: htons(unix.ETH_P_ALL),
+		Ifindex:  index,
+	})
+	if err != nil {
+		return fmt.Errorf("bind: %w", err)
+	}
+
+	return nil
+}
+
+// attachFilter attaches the filter to the socket, replacing the previous one at once.
+func (s *afpacketSocket) attachFilter(program []bpf.RawInstruction) error {
+	filter := make([]unix.SockFilter, 0, len(program))
+	for _, insn := range program {
+		filter = append(filter, unix.SockFilter{Code: insn.Op, Jt: insn.Jt, Jf: insn.Jf, K: insn.K})
+	}
+	err := unix.SetsockoptSockFprog(s.fd, unix.SOL_SOCKET, unix.SO_ATTACH_FILTER, &unix.SockFprog{
+		Len:    uint16(len(filter)),
+		Filter: &filter[0],
+	})
+	if err != nil {
+		return fmt.Errorf("attach filter: %w", err)
+	}
+
+	return nil
+}
+
+func (s *afpacketSocket) close() {
+	if s.ring != nil {
+		_ = unix.Munmap(s.ring)
+	}
+	_ = unix.Close(s.fd)
+}
+
+type afpacketPacket struct {
+	data []byte
+	ci   gopacket.CaptureInfo
+}
+
+// afpacketHandle is a handle of memory-mapped AF_PACKET sockets. Packets are received from sockets in a fanout group
+// and transmitted in batches.
+type afpacketHandle struct {
+	sockets   []*afpacketSocket
+	linkType  layers.LinkType
+	queue     chan afpacketPacket
+	current   []byte
+	writeLock sync.Mutex
+	pending   chan struct{}
+	wg        sync.WaitGroup
+	done      chan struct{}
+	once      sync.Once
+}
+
+func openAFPacket(dev, filter string, config *config.AFPacketConfig) (handle, error) {
+	inter, err := net.InterfaceByName(dev)
+	if err != nil {
+		return nil, fmt.Errorf("find interface: %w", err)
+	}
+
+	// Devices without hardware addresses, like TUN devices, have no link layer
+	linkType := layers.LinkTypeEthernet
+	if inter.Flags&net.FlagLoopback == 0 && len(inter.HardwareAddr) <= 0 {
+		linkType = layers.LinkTypeRaw
+	}
+
+	program, err := assembleFilter(filter, linkType)
+	if err != nil {
+		return nil, err
+	}
+
+	h := &afpacketHandle{
+		sockets:  make([]*afpacketSocket, 0, config.Fanout),
+		linkType: linkType,
+		queue:    make(chan afpacketPacket, afpacketQueueSize),
+		pending:  make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+
+	// Only the first socket transmits
+	id := uint16(os.Getpid()) + uint16(atomic.AddUint32(&afpacketFanoutId, 1))
+	for i := 0; i < config.Fanout; i++ {
+		s, err := newAFPacketSocket(inter.Index, program, config, i == 0)
+		if err != nil {
+			h.closeSockets()
+			return nil, err
+		}
+		h.sockets = append(h.sockets, s)
+
+		if config.Fanout > 1 {
+			err = unix.SetsockoptInt(s.fd, unix.SOL_PACKET, unix.PACKET_FANOUT, int(id)|unix.PACKET_FANOUT_HASH<<16)
+			if err != nil {
+				h.closeSockets()
+				return nil, fmt.Errorf("fanout: %w", err)
+			}
+		}
+	}
+
+	for _, s := range h.sockets {
+		h.wg.Add(1)
+		go h.read(s)
+	}
+	h.wg.Add(1)
+	go h.flush()
+
+	return h, nil
+}
+
+// assembleFilter compiles the filter and assembles it into a program for sockets.
+func assembleFilter(filter string, linkType layers.LinkType) ([]bpf.RawInstruction, error) {
+	insns, err := compileFilter(filter, linkType)
+	if err != nil {
+		return nil, fmt.Errorf("compile filter %s: %w", filter, err)
+	}
+	program, err := bpf.Assemble(insns)
+	if err != nil {
+		return nil, fmt.Errorf("assemble filter %s: %w", filter, err)
+	}
+
+	return program, nil
+}
+
+func (h *afpacketHandle) read(s *afpacketSocket) {
+	defer h.wg.Done()
+
+	fds := []unix.PollFd{{Fd: int32(s.fd), Events: unix.POLLIN | unix.POLLERR}}
+
+	for {
+		block := s.rx[s.block]
+		hdr := (*afpacketBlock)(unsafe.Pointer(&block[0]))
+
+		if atomic.LoadUint32(&hdr.status)&unix.TP_STATUS_USER == 0 {
+			_, err := unix.Poll(fds, afpacketPollTimeout)
+
+			select {
+			case <-h.done:
+				return
+			default:
+			}
+
+			if err != nil && err != unix.EINTR {
+				log.Errorln(fmt.Errorf("poll: %w", err))
+				return
+			}
+
+			continue
+		}
+
+		offset := int(hdr.offsetToFirstPkt)
+		for i := 0; i < int(hdr.numPkts); i++ {
+			ph := (*unix.Tpacket3Hdr)(unsafe.Pointer(&block[offset]))
+			start := offset + int(ph.Mac)
+
+			b := GetBuffer()
+			n := copy(b, block[start:start+int(ph.Snaplen)])
+
+			select {
+			case h.queue <- afpacketPacket{
+				data: b[:n],
+				ci: gopacket.CaptureInfo{
+					Timestamp:     time.Unix(int64(ph.Sec), int64(ph.Nsec)),
+					CaptureLength: n,
+					Length:        int(ph.Len),
+				},
+			}:
+			case <-h.done:
+				PutBuffer(b)
+				return
+			}
+
+			offset = offset + int(ph.Next_offset)
+		}
+
+		// Hand the block back to the kernel
+		atomic.StoreUint32(&hdr.status, unix.TP_STATUS_KERNEL)
+		s.block = (s.block + 1) % len(s.rx)
+	}
+}
+
+func (h *afpacketHandle) flush() {
+	defer h.wg.Done()
+
+	s := h.sockets[0]
+
+	for {
+		select {
+		case <-h.done:
+			return
+		case <-h.pending:
+		}
+
+		// All frames requested are sent in one system call
+		_, err := unix.SendmsgN(s.fd, nil, nil, nil, unix.MSG_DONTWAIT)
+		if err != nil && err != unix.EAGAIN && err != unix.ENOBUFS {
+			log.Errorln(fmt.Errorf("send: %w", err))
+		}
+	}
+}
+
+func (h *afpacketHandle) kick() {
+	select {
+	case h.pending <- struct{}{}:
+	default:
+	}
+}
+
+func (h *afpacketHandle) ZeroCopyReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	// Data returned last time is valid until now
+	if h.current != nil {
+		PutBuffer(h.current)
+		h.current = nil
+	}
+
+	select {
+	case packet := <-h.queue:
+		h.current = packet.data
+
+		return packet.data, packet.ci, nil
+	case <-h.done:
+		return nil, gopacket.CaptureInfo{}, io.EOF
+	}
+}
+
+func (h *afpacketHandle) WritePacketData(data []byte) error {
+	if len(data) > afpacketFrameSize-afpacketTxOffset {
+		return fmt.Errorf("packet size %d out of range", len(data))
+	}
+
+	h.writeLock.Lock()
+	defer h.writeLock.Unlock()
+
+	s := h.sockets[0]
+	fds := []unix.PollFd{{Fd: int32(s.fd), Events: unix.POLLOUT | unix.POLLERR}}
+
+	for {
+		select {
+		case <-h.done:
+			return errors.New("handle closed")
+		default:
+		}
+
+		hdr := (*unix.Tpacket3Hdr)(unsafe.Pointer(&s.tx[s.frame][0]))
+		if atomic.LoadUint32(&hdr.Status) == unix.TP_STATUS_AVAILABLE {
+			break
+		}
+
+		// Wait for the kernel to send pending frames if the ring is full
+		h.kick()
+		_, err := unix.Poll(fds, afpacketPollTimeout)
+		if err != nil && err != unix.EINTR {
+			return fmt.Errorf("poll: %w", err)
+		}
+	}
+
+	frame := s.tx[s.frame]
+	hdr := (*unix.Tpacket3Hdr)(unsafe.Pointer(&frame[0]))
+	copy(frame[afpacketTxOffset:], data)
+	hdr.Len = uint32(len(data))
+	hdr.Snaplen = uint32(len(data))
+	atomic.StoreUint32(&hdr.Status, unix.TP_STATUS_SEND_REQUEST)
+	s.frame = (s.frame + 1) % len(s.tx)
+
+	h.kick()
+
+	return nil
+}
+
+func (h *afpacketHandle) LinkType() layers.LinkType {
+	return h.linkType
+}
+
+func (h *afpacketHandle) SetBPFFilter(filter string) error {
+	program, err := assembleFilter(filter, h.linkType)
+	if err != nil {
+		return err
+	}
+
+	// Sockets are closed under the write lock
+	h.writeLock.Lock()
+	defer h.writeLock.Unlock()
+
+	if isDone(h.done) {
+		return errors.New("handle closed")
+	}
+	for _, s := range h.sockets {
+		err := s.attachFilter(program)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (h *afpacketHandle) Close() {
+	h.once.Do(func() {
+		close(h.done)
+
+		// Rings are unmapped after all readers and writers leave
+		h.wg.Wait()
+		h.writeLock.Lock()
+		h.closeSockets()
+		h.writeLock.Unlock()
+	})
+}
+
+func (h *afpacketHandle) closeSockets() {
+	for _, s := range h.sockets {
+		s.close()
+	}
+}
+
+func htons(i uint16) uint16 {
+	return i<<8 | i>>8
+}
@@ -0,0 +1,15 @@
+// +build !linux
+
+package pcap
+
+import (
+	"errors"
+	"ikago/internal/config"
+)
+
+// isAFPacketSupported describes if AF_PACKET sockets are available.
+const isAFPacketSupported = false
+
+func openAFPacket(_, _ string, _ *config.AFPacketConfig) (handle, error) {
+	return nil, errors.New("afpacket not support")
+}
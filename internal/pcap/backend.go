@@ -0,0 +1,98 @@
+package pcap
+
+import (
+	"fmt"
+	"ikago/internal/config"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// Backend describes how packets are captured and injected in raw connections.
+type Backend int
+
+const (
+	// BackendPcap describes packets are captured and injected by libpcap.
+	BackendPcap Backend = iota
+	// BackendAFPacket describes packets are captured and injected by memory-mapped AF_PACKET sockets in Linux.
+	BackendAFPacket
+)
+
+func (b Backend) String() string {
+	switch b {
+	case BackendPcap:
+		return "pcap"
+	case BackendAFPacket:
+		return "afpacket"
+	default:
+		return fmt.Sprintf("backend %d", b)
+	}
+}
+
+// ParseBackend returns a backend by the given name, or the default backend if the name is empty.
+func ParseBackend(s string) (Backend, error) {
+	switch s {
+	case "":
+		return defaultBackend(), nil
+	case "pcap":
+		return BackendPcap, nil
+	case "afpacket":
+		return BackendAFPacket, nil
+	default:
+		return 0, fmt.Errorf("backend %s not support", s)
+	}
+}
+
+func defaultBackend() Backend {
+	if isPcapSupported {
+		return BackendPcap
+	}
+
+	return BackendAFPacket
+}
+
+var (
+	backend        = defaultBackend()
+	afpacketConfig = config.NewAFPacketConfig()
+)
+
+// SetBackend sets the backend of raw connections created afterwards.
+func SetBackend(b Backend, config *config.AFPacketConfig) error {
+	switch b {
+	case BackendPcap:
+		if !isPcapSupported {
+			return fmt.Errorf("backend %s not support", b)
+		}
+	case BackendAFPacket:
+		if !isAFPacketSupported {
+			return fmt.Errorf("backend %s not support", b)
+		}
+	default:
+		return fmt.Errorf("backend %d out of range", b)
+	}
+
+	backend = b
+	afpacketConfig = config
+
+	return nil
+}
+
+// handle is a handle which captures and injects packets in a device.
+type handle interface {
+	ZeroCopyReadPacketData() ([]byte, gopacket.CaptureInfo, error)
+	WritePacketData([]byte) error
+	LinkType() layers.LinkType
+	SetBPFFilter(filter string) error
+	Close()
+}
+
+func openHandle(dev, filter string) (handle, error) {
+	switch backend {
+	case BackendPcap:
+		return openPcap(dev, filter)
+	case BackendAFPacket:
+		return openAFPacket(dev, filter, afpacketConfig)
+	default:
+		panic(fmt.Errorf("backend %d out of range", backend))
+	}
+}
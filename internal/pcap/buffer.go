@@ -0,0 +1,43 @@
+package pcap
+
+import (
+	"github.com/google/gopacket"
+	"sync"
+)
+
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		return make([]byte, IPv4MaxSize)
+	},
+}
+
+var serializeBufferPool = sync.Pool{
+	New: func() interface{} {
+		return gopacket.NewSerializeBuffer()
+	},
+}
+
+// GetBuffer returns a buffer which can hold any IPv4 packet from the pool.
+func GetBuffer() []byte {
+	return bufferPool.Get().([]byte)
+}
+
+// PutBuffer puts a buffer got from GetBuffer back to the pool, the buffer must not be used afterwards.
+func PutBuffer(b []byte) {
+	if cap(b) < IPv4MaxSize {
+		return
+	}
+
+	bufferPool.Put(b[:IPv4MaxSize])
+}
+
+func getSerializeBuffer() gopacket.SerializeBuffer {
+	buffer := serializeBufferPool.Get().(gopacket.SerializeBuffer)
+	_ = buffer.Clear()
+
+	return buffer
+}
+
+func putSerializeBuffer(buffer gopacket.SerializeBuffer) {
+	serializeBufferPool.Put(buffer)
+}
@@ -0,0 +1,72 @@
+package pcap
+
+import (
+	"sync"
+	"time"
+)
+
+// deadline is a deadline which can be waited on, waiters follow the deadline even if it is set after they start waiting.
+type deadline struct {
+	lock   sync.Mutex
+	timer  *time.Timer
+	cancel chan struct{}
+}
+
+func newDeadline() *deadline {
+	return &deadline{cancel: make(chan struct{})}
+}
+
+// set sets the deadline, a zero value means no deadline.
+func (d *deadline) set(t time.Time) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.timer != nil && !d.timer.Stop() {
+		// The timer has fired, wait for the channel being closed
+		<-d.cancel
+	}
+	d.timer = nil
+
+	// Wake up waiters on a passed deadline
+	isClosed := isDone(d.cancel)
+	if t.IsZero() {
+		if isClosed {
+			d.cancel = make(chan struct{})
+		}
+		return
+	}
+
+	duration := t.Sub(time.Now())
+	if duration > 0 {
+		if isClosed {
+			d.cancel = make(chan struct{})
+		}
+		cancel := d.cancel
+		d.timer = time.AfterFunc(duration, func() {
+			close(cancel)
+		})
+		return
+	}
+
+	// The deadline is passed already
+	if !isClosed {
+		close(d.cancel)
+	}
+}
+
+// wait returns a channel which is closed when the deadline is exceeded.
+func (d *deadline) wait() chan struct{} {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	return d.cancel
+}
+
+func isDone(c chan struct{}) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
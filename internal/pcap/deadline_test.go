@@ -0,0 +1,83 @@
+package pcap
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDeadline(t *testing.T) {
+	tests := []struct {
+		name    string
+		set     []time.Duration
+		zero    bool
+		after   time.Duration
+		isDone  bool
+		isEarly bool
+	}{
+		{name: "none", after: 20 * time.Millisecond},
+		{name: "passed", set: []time.Duration{-time.Second}, after: 100 * time.Millisecond, isDone: true},
+		{name: "now", set: []time.Duration{0}, after: 100 * time.Millisecond, isDone: true},
+		{name: "future", set: []time.Duration{20 * time.Millisecond}, after: 100 * time.Millisecond, isDone: true, isEarly: true},
+		{name: "extended", set: []time.Duration{20 * time.Millisecond, time.Hour}, after: 100 * time.Millisecond},
+		{name: "shortened", set: []time.Duration{time.Hour, 20 * time.Millisecond}, after: 100 * time.Millisecond, isDone: true, isEarly: true},
+		{name: "cleared", set: []time.Duration{20 * time.Millisecond}, zero: true, after: 100 * time.Millisecond},
+		{name: "cleared after passed", set: []time.Duration{-time.Second}, zero: true, after: 20 * time.Millisecond},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			d := newDeadline()
+			for _, duration := range test.set {
+				if duration == 0 {
+					d.set(time.Now())
+				} else {
+					d.set(time.Now().Add(duration))
+				}
+			}
+			if test.zero {
+				d.set(time.Time{})
+			}
+
+			if test.isEarly && isDone(d.wait()) {
+				t.Fatal("deadline is exceeded early")
+			}
+
+			select {
+			case <-d.wait():
+				if !test.isDone {
+					t.Fatal("deadline is exceeded")
+				}
+			case <-time.After(test.after):
+				if test.isDone {
+					t.Fatal("deadline is not exceeded")
+				}
+			}
+		})
+	}
+}
+
+func TestDeadlineWaiter(t *testing.T) {
+	d := newDeadline()
+
+	// Waiters follow the deadline set after they start waiting
+	ch := d.wait()
+	d.set(time.Now().Add(20 * time.Millisecond))
+	select {
+	case <-ch:
+	case <-time.After(time.Second):
+		t.Fatal("waiter is not woken by a later deadline")
+	}
+
+	// Waiters after the deadline is reset wait again
+	d.set(time.Now().Add(time.Hour))
+	if isDone(d.wait()) {
+		t.Fatal("deadline is exceeded after reset")
+	}
+
+	// Waiters are woken at once by a passed deadline
+	ch = d.wait()
+	d.set(time.Now().Add(-time.Second))
+	if !isDone(ch) {
+		t.Fatal("waiter is not woken by a passed deadline")
+	}
+}
@@ -5,7 +5,6 @@
 	"fmt"
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
-	"github.com/google/gopacket/pcap"
 	"github.com/jackpal/gateway"
 	"ikago/internal/addr"
 	"ikago/internal/log"
@@ -48,15 +47,67 @@ func (dev *Device) IsLoop() bool {
 	return dev.isLoop
 }
 
-// IPAddr returns the first IP address of the device.
+// IPAddr returns the first IPv4 address of the device.
 func (dev *Device) IPAddr() *net.IPNet {
-	if len(dev.ipAddrs) > 0 {
-		return dev.ipAddrs[0]
+	for _, a := range dev.ipAddrs {
+		if a.IP.To4() != nil {
+			return a
+		}
+	}
+
+	return nil
+}
+
+// IPv6Addr returns the first global unicast IPv6 address of the device.
+func (dev *Device) IPv6Addr() *net.IPNet {
+	for _, a := range dev.ipAddrs {
+		if a.IP.To4() == nil && a.IP.IsGlobalUnicast() {
+			return a
+		}
 	}
 
 	return nil
 }
 
+// srcIP returns the IP of the device in the same family of the given IP, or nil if there is none.
+func (dev *Device) srcIP(ip net.IP) net.IP {
+	var a *net.IPNet
+
+	if ip.To4() == nil {
+		a = dev.IPv6Addr()
+	} else {
+		a = dev.IPAddr()
+	}
+	if a == nil {
+		return nil
+	}
+
+	return a.IP
+}
+
+// listenIP returns the IP to listen on the device, which is unspecified for dual-stack if the device has an IPv6
+// address.
+func (dev *Device) listenIP() net.IP {
+	if dev.IPv6Addr() != nil {
+		return net.IPv6unspecified
+	}
+
+	return dev.IPAddr().IP
+}
+
+// ipv6Addrs returns all IPv6 addresses of the device.
+func (dev *Device) ipv6Addrs() []*net.IPNet {
+	result := make([]*net.IPNet, 0)
+
+	for _, a := range dev.ipAddrs {
+		if a.IP.To4() == nil {
+			result = append(result, a)
+		}
+	}
+
+	return result
+}
+
 func (dev Device) String() string {
 	var result string
 
@@ -79,17 +130,9 @@ func (dev Device) String() string {
 	return result
 }
 
-const flagPcapLoopback = 1
-
-var blacklist map[string]bool
-
 // FindAllDevs returns all valid network devices in current computer.
 func FindAllDevs() ([]*Device, error) {
 	t := make([]*Device, 0)
-	result := make([]*Device, 0)
-	if blacklist == nil {
-		blacklist = make(map[string]bool)
-	}
 
 	// Enumerate system's network interfaces
 	inters, err := net.Interfaces()
@@ -114,7 +157,7 @@ func FindAllDevs() ([]*Device, error) {
 			continue
 		}
 
-		as := make([]*net.IPNet, 0)
+		as, as6 := make([]*net.IPNet, 0), make([]*net.IPNet, 0)
 		for _, a := range addrs {
 			ipnet, ok := a.(*net.IPNet)
 			if !ok {
@@ -122,76 +165,29 @@ func FindAllDevs() ([]*Device, error) {
 				continue
 			}
 
-			// Only pass IPv4 address
+			// IPv6 addresses are behind IPv4 addresses
 			if ipnet.IP.To4() == nil {
+				as6 = append(as6, ipnet)
 				continue
 			}
 
 			as = append(as, ipnet)
 		}
+		as = append(as, as6...)
 
 		t = append(t, &Device{alias: inter.Name, ipAddrs: as, hardwareAddr: inter.HardwareAddr, isLoop: isLoop})
 	}
 
-	// Enumerate pcap devices
-	mid := make([]*Device, 0)
-	devs, err := pcap.FindAllDevs()
-	if err != nil {
-		return nil, fmt.Errorf("find pcap devices: %w", err)
-	}
-	for _, dev := range devs {
-		// Check blacklist
-		_, ok := blacklist[dev.Name]
-		if ok {
-			continue
-		}
-
-		// Match pcap device with interface
-		if dev.Flags&flagPcapLoopback != 0 {
-			d := FindLoopDev(t)
-			if d == nil {
-				continue
-			}
-			if d.name != "" {
-				// return nil, errors.New("too many loopback devices")
-				blacklist[dev.Name] = true
-				blacklist[d.name] = true
-				log.Infof("Device %s is a loopback device but so is %s, these devices will not be used\n", dev.Name, d.name)
-			}
-			d.name = dev.Name
-			mid = append(mid, d)
-		} else {
-			if len(dev.Addresses) <= 0 {
-				continue
-			}
-			for _, a := range dev.Addresses {
-				d := FindDev(t, a.IP)
-				if d == nil {
-					continue
-				}
-				if d.name != "" {
-					// return nil, fmt.Errorf("parse pcap device %s: %w", dev.Name, fmt.Errorf("same address with %s", d.Name))
-					blacklist[dev.Name] = true
-					blacklist[d.name] = true
-					log.Infof("Device %s has the same address with %s, these devices will not be used\n", dev.Name, d.name)
-					break
-				}
-				d.name = dev.Name
-				mid = append(mid, d)
-				break
-			}
+	// AF_PACKET sockets are bound to interfaces by their names
+	if backend == BackendAFPacket {
+		for _, dev := range t {
+			dev.name = dev.alias
 		}
-	}
 
-	// Check blacklist
-	for _, dev := range mid {
-		_, ok := blacklist[dev.name]
-		if !ok {
-			result = append(result, dev)
-		}
+		return t, nil
 	}
 
-	return result, nil
+	return matchPcapDevs(t)
 }
 
 // FindLoopDev returns the loop device in designated devices.
@@ -353,7 +349,7 @@ func FindUpstreamDevAndGatewayDev(name string, gateway net.IP) (upDev, gatewayDe
 					newUpDev = &Device{
 						name:         upDev.name,
 						alias:        upDev.alias,
-						ipAddrs:      append(make([]*net.IPNet, 0), a),
+						ipAddrs:      append(append(make([]*net.IPNet, 0), a), upDev.ipv6Addrs()...),
 						hardwareAddr: upDev.hardwareAddr,
 						isLoop:       upDev.isLoop,
 					}
@@ -391,7 +387,7 @@ func FindUpstreamDevAndGatewayDev(name string, gateway net.IP) (upDev, gatewayDe
 					upDev = &Device{
 						name:         dev.name,
 						alias:        dev.alias,
-						ipAddrs:      append(make([]*net.IPNet, 0), a),
+						ipAddrs:      append(append(make([]*net.IPNet, 0), a), dev.ipv6Addrs()...),
 						hardwareAddr: dev.hardwareAddr,
 						isLoop:       dev.isLoop,
 					}
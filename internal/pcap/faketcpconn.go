@@ -1,6 +1,7 @@
 package pcap
 
 import (
+	"encoding/binary"
 	"fmt"
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
@@ -9,21 +10,79 @@
 	"ikago/internal/config"
 	"ikago/internal/crypto"
 	"ikago/internal/log"
-	"math"
+	"io"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// clientFlow identifies a client by its address.
+type clientFlow struct {
+	ip   [net.IPv6len]byte
+	port uint16
+}
+
+func newClientFlow(ip net.IP, port uint16) clientFlow {
+	flow := clientFlow{port: port}
+	copy(flow.ip[:], ip.To16())
+
+	return flow
+}
+
 type clientIndicator struct {
-	crypt crypto.Crypt
-	seq   uint32
-	ack   uint32
+	addr           *net.UDPAddr
+	crypt          crypto.Crypt
+	port           uint16
+	seq            uint32
+	ack            uint32
+	isSynchronized bool
+	state          *tcpState
+	options        *tcpOptions
+	hello          []byte
+	helloSeq       uint32
+	helloTimer     *time.Timer
+	delayedACK     func()
+}
+
+func newClientIndicator(addr *net.UDPAddr, crypt crypto.Crypt, emulation bool, profile *TCPProfile) *clientIndicator {
+	client := &clientIndicator{addr: addr, crypt: crypt}
+
+	// Initial TCP Seq
+	if emulation || profile != nil {
+		client.seq = randUint32()
+	}
+	if emulation {
+		client.state = newTCPState()
+	}
+	if profile != nil {
+		client.options = newTCPOptions()
+	}
+
+	return client
 }
 
 const establishDeadline = 3 * time.Second
 const keepFragments = 30 * time.Second
 
+// tlsRetransmitTimeout is the timeout before the TLS ClientHello is retransmitted, which doubles in every retry.
+const tlsRetransmitTimeout = 1 * time.Second
+
+// tlsMaxRetransmits is the max count of retransmissions of the TLS ClientHello.
+const tlsMaxRetransmits = 5
+
+// evictInterval is the interval between checks of idle clients in a listener.
+const evictInterval = 5 * time.Second
+
+// fakeTCPQueueSize is the max count of captured packets queued in a connection.
+const fakeTCPQueueSize = 1000
+
+// capture is a packet or an error captured in a connection.
+type capture struct {
+	indicator *PacketIndicator
+	err       error
+}
+
 // FakeTCPConn is a packet pcap network connection add fake TCP header to all traffic.
 type FakeTCPConn struct {
 	lock          sync.Mutex
@@ -33,35 +92,91 @@ type FakeTCPConn struct {
 	dstAddr       *net.TCPAddr
 	crypt         crypto.Crypt
 	mtu           int
+	emulation     bool
+	profile       *TCPProfile
+	isTLS         bool
+	serverName    string
 	appear        time.Time
-	isConnected   bool
-	isReconnected bool
-	isClosed      bool
+	isConnected   uint32
+	isReconnected uint32
+	once          sync.Once
+	queue         chan capture
+	done          chan struct{}
 	clientsLock   sync.RWMutex
-	clients       map[string]*clientIndicator
+	clients       map[clientFlow]*clientIndicator
 	id            uint16
-	readDeadline  time.Time
-	writeDeadline time.Time
+	layers        packetLayers
+	readDeadline  *deadline
+	writeDeadline *deadline
+	listener      *FakeTCPListener
+	seenLock      sync.RWMutex
+	lastSeen      time.Time
 }
 
 func newConn() *FakeTCPConn {
 	conn := &FakeTCPConn{
-		defrag:  NewEasyDefragmenter(),
-		mtu:     MaxMTU,
-		clients: make(map[string]*clientIndicator),
+		defrag:        NewEasyDefragmenter(),
+		mtu:           MaxMTU,
+		queue:         make(chan capture, fakeTCPQueueSize),
+		done:          make(chan struct{}),
+		clients:       make(map[clientFlow]*clientIndicator),
+		readDeadline:  newDeadline(),
+		writeDeadline: newDeadline(),
+		lastSeen:      time.Now(),
 	}
 	conn.defrag.SetDeadline(keepFragments)
 	return conn
 }
 
+// capture captures packets from the raw connection and queues them until the connection is closed. It is the only
+// reader of the raw connection.
+func (c *FakeTCPConn) capture() {
+	for {
+		var item capture
+
+		packet, err := c.conn.ReadPacket()
+		if err != nil {
+			if c.isClosed() {
+				return
+			}
+			item.err = err
+		} else if mtu := c.reportedMTU(packet); mtu > 0 {
+			c.reduceMTU(mtu)
+			continue
+		} else {
+			// Parse packet
+			indicator, err := ParsePacket(packet)
+			if err != nil {
+				item.err = fmt.Errorf("parse packet: %w", err)
+			} else {
+				// Handle fragments
+				indicator, err = c.defrag.Append(indicator)
+				if err != nil {
+					item.err = fmt.Errorf("defrag: %w", err)
+				} else if indicator == nil {
+					continue
+				} else {
+					item.indicator = indicator
+				}
+			}
+		}
+
+		select {
+		case c.queue <- item:
+		case <-c.done:
+			return
+		}
+	}
+}
+
 // DialFakeTCP establishes FakeTCP connection for pcap networks.
-func DialFakeTCP(srcDev, dstDev *Device, srcPort uint16, dstAddr *net.TCPAddr, crypt crypto.Crypt, mtu int) (*FakeTCPConn, error) {
+func DialFakeTCP(srcDev, dstDev *Device, srcPort uint16, dstAddr *net.TCPAddr, crypt crypto.Crypt, mtu int, config *config.FakeTCPConfig) (*FakeTCPConn, error) {
 	srcAddr := &net.TCPAddr{
-		IP:   srcDev.IPAddr().IP,
+		IP:   srcDev.srcIP(dstAddr.IP),
 		Port: int(srcPort),
 	}
 
-	conn, err := dialFakeTCPPassive(srcDev, dstDev, srcPort, dstAddr, crypt, mtu)
+	conn, err := dialFakeTCPPassive(srcDev, dstDev, srcPort, dstAddr, crypt, mtu, config)
 	if err != nil {
 		return nil, &net.OpError{
 			Op:     "dial",
@@ -91,7 +206,7 @@ func DialFakeTCP(srcDev, dstDev *Device, srcPort uint16, dstAddr *net.TCPAddr, c
 	go func() {
 		time.Sleep(establishDeadline)
 
-		if !conn.isConnected {
+		if !conn.IsConnected() {
 			log.Errorf("Cannot receive response from server %s, is your network down?\n", dstAddr.String())
 		}
 	}()
@@ -99,11 +214,14 @@ func DialFakeTCP(srcDev, dstDev *Device, srcPort uint16, dstAddr *net.TCPAddr, c
 	return conn, nil
 }
 
-func dialFakeTCPPassive(srcDev, dstDev *Device, srcPort uint16, dstAddr *net.TCPAddr, crypt crypto.Crypt, mtu int) (*FakeTCPConn, error) {
+func dialFakeTCPPassive(srcDev, dstDev *Device, srcPort uint16, dstAddr *net.TCPAddr, crypt crypto.Crypt, mtu int, config *config.FakeTCPConfig) (*FakeTCPConn, error) {
 	srcAddr := &net.TCPAddr{
-		IP:   srcDev.IPAddr().IP,
+		IP:   srcDev.srcIP(dstAddr.IP),
 		Port: int(srcPort),
 	}
+	if srcAddr.IP == nil {
+		return nil, fmt.Errorf("missing address to %s", dstAddr.IP)
+	}
 
 	filter, err := addr.SrcBPFFilter(dstAddr)
 	if err != nil {
@@ -115,7 +233,16 @@ func dialFakeTCPPassive(srcDev, dstDev *Device, srcPort uint16, dstAddr *net.TCP
 		return nil, fmt.Errorf("parse filter %s: %w", dstIP, err)
 	}
 
-	rawConn, err := CreateRawConn(srcDev, dstDev, fmt.Sprintf("ip && ((tcp && dst port %d && %s) || ((ip[6:2] & 0x1fff) != 0 && %s))", srcAddr.Port, filter, filter2))
+	// Fragments are recognized by the fragment offset in IPv4, or the fragment header in IPv6. Fragmentation Needed and
+	// Packet Too Big may come from any router on the way
+	var f string
+	if dstAddr.IP.To4() == nil {
+		f = fmt.Sprintf("ip6 && ((tcp && dst port %d && %s) || (ip6[6] = 44 && %s) || (icmp6 && ip6[40] = 2))", srcAddr.Port, filter, filter2)
+	} else {
+		f = fmt.Sprintf("ip && ((tcp && dst port %d && %s) || ((ip[6:2] & 0x1fff) != 0 && %s) || (icmp && icmp[icmptype] = icmp-unreach && icmp[icmpcode] = 4))", srcAddr.Port, filter, filter2)
+	}
+
+	rawConn, err := CreateRawConn(srcDev, dstDev, f)
 	if err != nil {
 		return nil, fmt.Errorf("create raw connection: %w", err)
 	}
@@ -126,18 +253,29 @@ func dialFakeTCPPassive(srcDev, dstDev *Device, srcPort uint16, dstAddr *net.TCP
 	conn.crypt = crypt
 	conn.mtu = mtu
 	conn.conn = rawConn
+	err = conn.setConfig(config)
+	if err != nil {
+		rawConn.Close()
+		return nil, err
+	}
+
+	go conn.capture()
 
 	return conn, nil
 }
 
-func listenFakeTCPMulticast(srcDev, dstDev *Device, srcPort uint16, crypt crypto.Crypt, mtu int) (*FakeTCPConn, error) {
+func listenFakeTCPMulticast(srcDev, dstDev *Device, srcPort uint16, crypt crypto.Crypt, mtu int, config *config.FakeTCPConfig) (*FakeTCPConn, error) {
 	addrs := make([]*net.TCPAddr, 0)
 	for _, ip := range srcDev.IPAddrs() {
+		// Link-local IPv6 addresses are not reachable from the Internet
+		if ip.IP.To4() == nil && !ip.IP.IsGlobalUnicast() {
+			continue
+		}
 		addrs = append(addrs, &net.TCPAddr{IP: ip.IP, Port: int(srcPort)})
 	}
 	srcAddrs := addr.MultiTCPAddr{Addrs: addrs}
 
-	rawConn, err := CreateRawConn(srcDev, dstDev, fmt.Sprintf("tcp && dst port %d", srcPort))
+	rawConn, err := CreateRawConn(srcDev, dstDev, fmt.Sprintf("(ip || ip6) && tcp && %s", addr.PortRangeBPFFilter("dst", srcPort, HopMaxPort(srcPort, config))))
 	if err != nil {
 		return nil, &net.OpError{
 			Op:     "dial",
@@ -152,10 +290,200 @@ func listenFakeTCPMulticast(srcDev, dstDev *Device, srcPort uint16, crypt crypto
 	conn.crypt = crypt
 	conn.mtu = mtu
 	conn.conn = rawConn
+	err = conn.setConfig(config)
+	if err != nil {
+		rawConn.Close()
+		return nil, &net.OpError{
+			Op:     "dial",
+			Net:    "pcap",
+			Source: srcAddrs,
+			Err:    err,
+		}
+	}
+
+	go conn.capture()
 
 	return conn, nil
 }
 
+func (c *FakeTCPConn) setConfig(config *config.FakeTCPConfig) error {
+	profile, err := ParseTCPProfile(config.Profile)
+	if err != nil {
+		return fmt.Errorf("parse profile: %w", err)
+	}
+
+	c.emulation = config.Emulation
+	c.profile = profile
+	c.isTLS = config.TLS
+	c.serverName = config.ServerName
+
+	// Initial IPv4 Id
+	if c.emulation || c.profile != nil {
+		c.id = uint16(randUint32())
+	}
+
+	return nil
+}
+
+// hop returns the hop of segments, which is the given default one unless TCP emulation is enabled or a TCP profile is
+// in use.
+func (c *FakeTCPConn) hop(hop uint8) uint8 {
+	// Segments leave in the initial TTL of the profile
+	if c.profile != nil {
+		return c.profile.ttl + 1
+	}
+	if c.emulation {
+		return emulatedHop
+	}
+
+	return hop
+}
+
+// isAcceptable returns if the RST or FIN from the client is acceptable, and if a challenge ACK should be replied to it.
+// A RST is acceptable only in the exact sequence, and a FIN in the receive window (RFC 5961). A RST before
+// synchronizing is acceptable if it acknowledges the SYN.
+func (c *FakeTCPConn) isAcceptable(client *clientIndicator, indicator *PacketIndicator) (isAcceptable, isChallenge bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if !client.isSynchronized {
+		return indicator.IsRST() && indicator.IsACK() && indicator.TCPLayer().Ack == client.seq, false
+	}
+
+	seq := indicator.TCPLayer().Seq
+	if indicator.IsRST() && seq == client.ack {
+		return true, false
+	}
+
+	isInWindow := !seqBefore(seq, client.ack) && seqBefore(seq, client.ack+uint32(c.recvWindow(client)))
+	if indicator.IsRST() {
+		return false, isInWindow
+	}
+
+	return isInWindow, false
+}
+
+// recvWindow returns the receive window to the client before scaling.
+func (c *FakeTCPConn) recvWindow(client *clientIndicator) uint16 {
+	if client.state != nil {
+		return client.state.advertise()
+	}
+	if c.profile != nil {
+		return c.profile.window
+	}
+
+	return 65535
+}
+
+// window returns the window to advertise to the client.
+func (c *FakeTCPConn) window(client *clientIndicator) uint16 {
+	window := c.recvWindow(client)
+	if client.options != nil {
+		return client.options.scaleWindow(window)
+	}
+
+	return window
+}
+
+// synWindow returns the window to advertise to the client in SYN and SYN+ACK, which is never scaled.
+func (c *FakeTCPConn) synWindow(client *clientIndicator) uint16 {
+	if c.profile != nil {
+		return c.profile.window
+	}
+
+	return c.window(client)
+}
+
+// mss returns the MSS to announce to the peer.
+func (c *FakeTCPConn) mss(dstIP net.IP) uint16 {
+	mss := c.mtu - 20 - 20
+	if dstIP.To4() == nil {
+		mss = mss - 20
+	}
+
+	return uint16(mss)
+}
+
+// localPort returns the local port segments to the client are sent from, which is the port the client connects to.
+func (c *FakeTCPConn) localPort(client *clientIndicator) uint16 {
+	if client.port != 0 {
+		return client.port
+	}
+
+	return c.srcPort
+}
+
+// nextSeq returns the next sequence to send to the client.
+func (c *FakeTCPConn) nextSeq(client *clientIndicator) uint32 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return client.seq
+}
+
+// advanceAck advances the acknowledgement to the client to ack if it is after the current one.
+func (c *FakeTCPConn) advanceAck(client *clientIndicator, ack uint32) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if seqAfter(ack, client.ack) {
+		client.ack = ack
+	}
+}
+
+// client returns the client at the address.
+func (c *FakeTCPConn) client(ip net.IP, port uint16) (*clientIndicator, bool) {
+	c.clientsLock.RLock()
+	defer c.clientsLock.RUnlock()
+
+	client, ok := c.clients[newClientFlow(ip, port)]
+
+	return client, ok
+}
+
+// mapClient maps a new client at the address and returns it.
+func (c *FakeTCPConn) mapClient(ip net.IP, port uint16, crypt crypto.Crypt) *clientIndicator {
+	client := newClientIndicator(&net.UDPAddr{IP: ip, Port: int(port)}, crypt, c.emulation, c.profile)
+
+	// Delayed ACKs share a single function, so receiving data never allocates one
+	if client.state != nil {
+		client.delayedACK = func() {
+			err := c.replyACK(client, client.addr.IP, uint16(client.addr.Port))
+			if err != nil {
+				log.Errorln(fmt.Errorf("reply ack: %w", err))
+			}
+		}
+	}
+
+	c.clientsLock.Lock()
+	c.clients[newClientFlow(ip, port)] = client
+	c.clientsLock.Unlock()
+
+	return client
+}
+
+// unmapClient forgets the client at the address, which has to handshake again to come back.
+func (c *FakeTCPConn) unmapClient(ip net.IP, port uint16) {
+	flow := newClientFlow(ip, port)
+
+	c.clientsLock.Lock()
+	client, ok := c.clients[flow]
+	delete(c.clients, flow)
+	c.clientsLock.Unlock()
+
+	// Stop delayed ACKs
+	if ok && client.state != nil {
+		client.state.close()
+	}
+}
+
+// setOptions sets options of the profile in a TCP layer which is neither SYN nor SYN+ACK, the lock must be held.
+func (c *FakeTCPConn) setOptions(client *clientIndicator, layer *layers.TCP) {
+	if client.options != nil {
+		layer.Options = client.options.segmentOptions()
+	}
+}
+
 func (c *FakeTCPConn) Read(b []byte) (n int, err error) {
 	n, _, err = c.ReadFrom(b)
 
@@ -173,30 +501,22 @@ func (c *FakeTCPConn) handshakeSYN() error {
 	defer c.lock.Unlock()
 
 	// Client
-	c.clientsLock.RLock()
-	client, ok := c.clients[c.RemoteAddr().String()]
-	c.clientsLock.RUnlock()
+	client, ok := c.client(c.dstAddr.IP, uint16(c.dstAddr.Port))
 	if !ok {
-		// Initial TCP Seq
-		client = &clientIndicator{
-			crypt: c.crypt,
-			seq:   0,
-		}
-
-		// Map client
-		c.clientsLock.Lock()
-		c.clients[c.RemoteAddr().String()] = client
-		c.clientsLock.Unlock()
+		client = c.mapClient(c.dstAddr.IP, uint16(c.dstAddr.Port), c.crypt)
 	}
 
 	// Create layers
-	transportLayer, networkLayer, linkLayer, err := CreateLayers(c.srcPort, uint16(c.dstAddr.Port), client.seq, client.ack, c.conn, c.dstAddr.IP, c.id, 128, c.RemoteDev().HardwareAddr())
+	transportLayer, networkLayer, linkLayer, err := CreateLayers(c.srcPort, uint16(c.dstAddr.Port), client.seq, client.ack, c.synWindow(client), c.conn, c.dstAddr.IP, c.id, c.hop(128), c.RemoteDev().HardwareAddr())
 	if err != nil {
 		return err
 	}
 
 	// Make TCP layer SYN
 	FlagTCPLayer(transportLayer.(*layers.TCP), true, false, false)
+	if client.options != nil {
+		transportLayer.(*layers.TCP).Options = client.options.synOptions(c.profile, c.mss(c.dstAddr.IP), false)
+	}
 
 	// Serialize layers
 	data, err := Serialize(linkLayer, networkLayer, transportLayer)
@@ -219,7 +539,7 @@ func (c *FakeTCPConn) handshakeSYN() error {
 	}
 
 	srcAddr := &net.TCPAddr{
-		IP:   c.LocalDev().IPAddr().IP,
+		IP:   c.LocalDev().srcIP(c.dstAddr.IP),
 		Port: int(c.srcPort),
 	}
 	log.Verbosef("Send TCP SYN: %s -> %s\n", srcAddr.String(), c.RemoteAddr().String())
@@ -239,31 +559,32 @@ func (c *FakeTCPConn) handshakeSYNACK(indicator *PacketIndicator) error {
 	defer c.lock.Unlock()
 
 	// Client
-	c.clientsLock.RLock()
-	client, ok := c.clients[indicator.Src().String()]
-	c.clientsLock.RUnlock()
+	client, ok := c.client(indicator.SrcIP(), indicator.SrcPort())
 	if !ok {
-		// Initial TCP Seq
-		client = &clientIndicator{
-			crypt: c.crypt,
-			seq:   0,
-		}
-
-		// Map client
-		c.clientsLock.Lock()
-		c.clients[indicator.Src().String()] = client
-		c.clientsLock.Unlock()
+		client = c.mapClient(indicator.SrcIP(), indicator.SrcPort(), c.crypt)
 	}
+	client.port = indicator.DstPort()
 	client.ack = indicator.TCPLayer().Seq + 1
+	client.isSynchronized = true
+	client.hello = nil
+	if client.state != nil {
+		client.state.handshake(client.seq+1, uint32(indicator.TCPLayer().Window))
+	}
+	if client.options != nil {
+		client.options.negotiate(c.profile, indicator.TCPLayer().Options)
+	}
 
 	// Create layers
-	newTransportLayer, newNetworkLayer, newLinkLayer, err = CreateLayers(indicator.DstPort(), indicator.SrcPort(), client.seq, client.ack, c.conn, indicator.SrcIP(), c.id, 64, indicator.SrcHardwareAddr())
+	newTransportLayer, newNetworkLayer, newLinkLayer, err = CreateLayers(indicator.DstPort(), indicator.SrcPort(), client.seq, client.ack, c.synWindow(client), c.conn, indicator.SrcIP(), c.id, c.hop(64), indicator.SrcHardwareAddr())
 	if err != nil {
 		return fmt.Errorf("create layers: %w", err)
 	}
 
-	// Make TCP layer SYN & ACK
+	// Make TCP layer SYN & ACK, with options the client offers
 	FlagTCPLayer(newTransportLayer.(*layers.TCP), true, false, true)
+	if client.options != nil {
+		newTransportLayer.(*layers.TCP).Options = client.options.synOptions(c.profile, c.mss(indicator.SrcIP()), true)
+	}
 
 	// Serialize layers
 	data, err := Serialize(newLinkLayer, newNetworkLayer, newTransportLayer)
@@ -286,7 +607,7 @@ func (c *FakeTCPConn) handshakeSYNACK(indicator *PacketIndicator) error {
 	}
 
 	srcAddr := &net.TCPAddr{
-		IP:   c.LocalDev().IPAddr().IP,
+		IP:   indicator.DstIP(),
 		Port: int(indicator.DstPort()),
 	}
 	log.Verbosef("Send TCP SYN+ACK: %s <- %s\n", indicator.Src().String(), srcAddr.String())
@@ -306,24 +627,30 @@ func (c *FakeTCPConn) handshakeACK(indicator *PacketIndicator) error {
 	defer c.lock.Unlock()
 
 	// Client
-	c.clientsLock.RLock()
-	client, ok := c.clients[indicator.Src().String()]
-	c.clientsLock.RUnlock()
+	client, ok := c.client(indicator.SrcIP(), indicator.SrcPort())
 	if !ok {
 		return fmt.Errorf("client %s unauthorized", indicator.Src().String())
 	}
 
 	// TCP Ack
 	client.ack = indicator.TCPLayer().Seq + 1
+	client.isSynchronized = true
+	if client.state != nil {
+		client.state.handshake(indicator.TCPLayer().Ack, uint32(indicator.TCPLayer().Window))
+	}
+	if client.options != nil {
+		client.options.negotiate(c.profile, indicator.TCPLayer().Options)
+	}
 
 	// Create layers
-	newTransportLayer, newNetworkLayer, newLinkLayer, err = CreateLayers(indicator.DstPort(), indicator.SrcPort(), client.seq, client.ack, c.conn, indicator.SrcIP(), c.id, 128, indicator.SrcHardwareAddr())
+	newTransportLayer, newNetworkLayer, newLinkLayer, err = CreateLayers(indicator.DstPort(), indicator.SrcPort(), client.seq, client.ack, c.window(client), c.conn, indicator.SrcIP(), c.id, c.hop(128), indicator.SrcHardwareAddr())
 	if err != nil {
 		return fmt.Errorf("create layers: %w", err)
 	}
 
 	// Make TCP layer ACK
 	FlagTCPLayer(newTransportLayer.(*layers.TCP), false, false, true)
+	c.setOptions(client, newTransportLayer.(*layers.TCP))
 
 	// Serialize layers
 	data, err := Serialize(newLinkLayer, newNetworkLayer, newTransportLayer)
@@ -343,137 +670,319 @@ func (c *FakeTCPConn) handshakeACK(indicator *PacketIndicator) error {
 	}
 
 	srcAddr := &net.TCPAddr{
-		IP:   c.LocalDev().IPAddr().IP,
+		IP:   indicator.DstIP(),
 		Port: int(indicator.DstPort()),
 	}
 	log.Verbosef("Send TCP ACK: %s -> %s\n", srcAddr.String(), indicator.Src().String())
 
-	return nil
-}
+	// TLS handshaking follows TCP handshaking, the ClientHello is retransmitted until the ServerHello arrives
+	if c.isTLS {
+		client.hello, client.helloSeq = createTLSClientHello(c.serverName), client.seq
 
-func (c *FakeTCPConn) Write(b []byte) (n int, err error) {
-	return c.WriteTo(b, c.RemoteAddr())
-}
+		err = c.writeSegment(client, indicator.SrcIP(), indicator.SrcPort(), client.hello)
+		if err != nil {
+			return fmt.Errorf("tls: %w", err)
+		}
 
-func (c *FakeTCPConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
-	type tuple struct {
-		indicator *PacketIndicator
-		err       error
+		log.Verbosef("Send TLS ClientHello: %s -> %s\n", srcAddr.String(), indicator.Src().String())
+
+		c.retransmitHello(client, indicator.SrcIP(), indicator.SrcPort(), 0)
 	}
 
-	ch := make(chan tuple)
-	go func() {
-		for {
-			packet, err := c.conn.ReadPacket()
-			if err != nil {
-				ch <- tuple{err: err}
-				return
-			}
+	return nil
+}
 
-			// Parse packet
-			indicator, err := ParsePacket(packet)
-			if err != nil {
-				ch <- tuple{err: fmt.Errorf("parse packet: %w", err)}
-				return
-			}
+// retransmitHello retransmits the TLS ClientHello to the client after a timeout unless the ServerHello arrives in
+// between, the lock must be held.
+func (c *FakeTCPConn) retransmitHello(client *clientIndicator, dstIP net.IP, dstPort uint16, retries int) {
+	if client.helloTimer != nil {
+		client.helloTimer.Stop()
+		client.helloTimer = nil
+	}
+	if retries >= tlsMaxRetransmits {
+		return
+	}
 
-			// Handle fragments
-			indicator, err = c.defrag.Append(indicator)
-			if err != nil {
-				ch <- tuple{err: fmt.Errorf("defrag: %w", err)}
-				return
-			}
-			if indicator != nil {
-				ch <- tuple{indicator: indicator}
-				return
-			}
+	hello := client.hello
+	client.helloTimer = time.AfterFunc(tlsRetransmitTimeout<<uint(retries), func() {
+		c.lock.Lock()
+		defer c.lock.Unlock()
+
+		// The ServerHello arrives, or another ClientHello is sent in reconnecting
+		if c.isClosed() || len(client.hello) <= 0 || &client.hello[0] != &hello[0] {
+			return
 		}
-	}()
-	// Timeout
-	if !c.readDeadline.IsZero() {
-		go func() {
-			duration := c.readDeadline.Sub(time.Now())
-			if duration > 0 {
-				time.Sleep(duration)
-			}
-			ch <- tuple{err: &timeoutError{Err: "timeout"}}
-		}()
-	}
 
-	tu := <-ch
-	if tu.err != nil {
-		return 0, nil, &net.OpError{
-			Op:     "read",
-			Net:    "pcap",
-			Source: c.LocalAddr(),
-			Err:    err,
+		err := c.writeSegmentSeq(client, dstIP, dstPort, client.helloSeq, hello)
+		if err != nil {
+			log.Errorln(fmt.Errorf("retransmit tls client hello: %w", err))
+			return
 		}
+
+		log.Verbosef("Retransmit TLS ClientHello: %s -> %s\n", c.LocalAddr().String(), c.RemoteAddr().String())
+
+		c.retransmitHello(client, dstIP, dstPort, retries+1)
+	})
+}
+
+// handshakeTLS replies a TLS handshake message from the client in the segment.
+func (c *FakeTCPConn) handshakeTLS(client *clientIndicator, indicator *PacketIndicator) error {
+	var (
+		payload []byte
+		err     error
+	)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	srcAddr := &net.TCPAddr{
+		IP:   indicator.DstIP(),
+		Port: int(indicator.DstPort()),
 	}
 
-	indicator := tu.indicator
-	if indicator.TransportLayer() == nil {
-		addr = &net.IPAddr{IP: indicator.SrcIP()}
-	} else {
-		switch t := indicator.TransportLayer().LayerType(); t {
-		case layers.LayerTypeTCP:
-			addr = &net.UDPAddr{
-				IP:   indicator.SrcIP(),
-				Port: int(indicator.SrcPort()),
-			}
-		case layers.LayerTypeUDP:
-			addr = indicator.Src()
-		default:
-			return 0, nil, &net.OpError{
-				Op:     "read",
-				Net:    "pcap",
-				Source: c.LocalAddr(),
-				Err:    fmt.Errorf("transport layer type %s not support", t),
-			}
+	switch t := tlsHandshakeType(indicator.Payload()); t {
+	case tlsHandshakeClientHello:
+		log.Verbosef("Receive TLS ClientHello: %s -> %s\n", indicator.Src().String(), srcAddr.String())
+
+		// The ClientHello is retransmitted if the flight is lost, which is retransmitted in its sequence
+		if client.hello != nil {
+			return c.writeSegmentSeq(client, indicator.SrcIP(), indicator.SrcPort(), client.helloSeq, client.hello)
 		}
-	}
 
-	// Check TCP flags
-	if indicator.TransportLayer() != nil && indicator.TransportLayer().LayerType() == layers.LayerTypeTCP {
-		if indicator.IsRST() {
-			log.Errorf("Receive TCP RST: %s <- %s\n", indicator.Dst().String(), addr.String())
+		// The flight fits in a segment without timestamps and paddings
+		payload, err = createTLSServerFlight(indicator.Payload(), int(c.mss(indicator.SrcIP()))-12)
+		if err != nil {
+			return fmt.Errorf("create server hello: %w", err)
+		}
+		client.hello, client.helloSeq = payload, client.seq
+	case tlsHandshakeServerHello:
+		log.Verbosef("Receive TLS ServerHello: %s <- %s\n", srcAddr.String(), indicator.Src().String())
 
-			// Re-establish connection
-			err := c.Reconnect()
-			if err != nil {
-				return 0, addr, &net.OpError{
-					Op:     "read",
-					Net:    "pcap",
-					Source: c.LocalAddr(),
-					Addr:   addr,
-					Err:    fmt.Errorf("reconnect: %w", err),
-				}
-			}
+		// The flight is retransmitted if the ClientHello is retransmitted, and is only replied once
+		if client.hello == nil {
+			return nil
 		}
-		if indicator.IsFIN() {
-			log.Infof("Receive TCP FIN: %s <- %s\n", indicator.Dst().String(), addr.String())
+		client.hello = nil
+		if client.helloTimer != nil {
+			client.helloTimer.Stop()
+			client.helloTimer = nil
 		}
+
+		payload = createTLSClientFinished()
+	default:
+		// ChangeCipherSpec and Finished
+		return nil
 	}
 
-	// Reply TCP SYN
-	if indicator.TransportLayer() != nil && indicator.TransportLayer().LayerType() == layers.LayerTypeTCP {
-		if indicator.IsSYN() {
-			// SYN+ACK
-			if indicator.IsACK() {
-				log.Verbosef("Receive TCP SYN+ACK: %s <- %s\n", indicator.Dst().String(), addr.String())
+	err = c.writeSegment(client, indicator.SrcIP(), indicator.SrcPort(), payload)
+	if err != nil {
+		return err
+	}
 
-				if !c.isConnected {
-					t := time.Now()
-					duration := t.Sub(c.appear)
+	return nil
+}
 
-					log.Infof("Connected to server %s in %.3f ms (RTT)\n", addr.String(), float64(duration.Microseconds())/1000)
+// writeSegment writes a segment carrying the payload to the client, the lock must be held.
+func (c *FakeTCPConn) writeSegment(client *clientIndicator, dstIP net.IP, dstPort uint16, payload []byte) error {
+	err := c.writeSegmentSeq(client, dstIP, dstPort, client.seq, payload)
+	if err != nil {
+		return err
+	}
 
-					c.isConnected = true
-				}
-				c.isReconnected = true
+	// TCP Seq
+	client.seq = client.seq + uint32(len(payload))
 
-				err = c.handshakeACK(indicator)
-			} else {
-				log.Verbosef("Receive TCP SYN: %s -> %s\n", addr.String(), indicator.Dst().String())
+	// Piggyback ACK
+	if client.state != nil {
+		client.state.acknowledge()
+	}
+
+	return nil
+}
+
+// writeSegmentSeq writes a segment carrying the payload in the sequence to the client, the lock must be held.
+func (c *FakeTCPConn) writeSegmentSeq(client *clientIndicator, dstIP net.IP, dstPort uint16, seq uint32, payload []byte) error {
+	// Create layers
+	transportLayer, networkLayer, linkLayer, err := CreateLayers(c.localPort(client), dstPort, seq, client.ack, c.window(client), c.conn, dstIP, c.id, c.hop(128), c.conn.RemoteDev().HardwareAddr())
+	if err != nil {
+		return fmt.Errorf("create layers: %w", err)
+	}
+
+	c.setOptions(client, transportLayer.(*layers.TCP))
+
+	// Serialize layers
+	data, err := Serialize(linkLayer, networkLayer, transportLayer, gopacket.Payload(payload))
+	if err != nil {
+		return fmt.Errorf("serialize: %w", err)
+	}
+
+	// Write packet data
+	_, err = c.conn.Write(data)
+	if err != nil {
+		return fmt.Errorf("write: %w", err)
+	}
+
+	// IPv4 Id
+	if networkLayer.LayerType() == layers.LayerTypeIPv4 {
+		c.id++
+	}
+
+	return nil
+}
+
+func (c *FakeTCPConn) Write(b []byte) (n int, err error) {
+	return c.WriteTo(b, c.RemoteAddr())
+}
+
+// WriteProbe writes a probe of the path MTU to the peer in a single packet, which is not allowed to be fragmented.
+func (c *FakeTCPConn) WriteProbe(b []byte) (n int, err error) {
+	err = c.writeTo(b, c.dstAddr.IP, uint16(c.dstAddr.Port), c.dstAddr, true)
+	if err != nil {
+		return 0, &net.OpError{
+			Op:     "write",
+			Net:    "pcap",
+			Source: c.LocalAddr(),
+			Addr:   c.RemoteAddr(),
+			Err:    err,
+		}
+	}
+
+	return len(b), nil
+}
+
+// ReadFrom reads a packet from the connection. A RST or FIN in sequence closes a connection to a single peer and
+// returns io.EOF, the connection is never reconnected by itself so the caller redials. A connection to many clients
+// forgets the client instead, which has to handshake again.
+func (c *FakeTCPConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	var item capture
+
+	select {
+	case item = <-c.queue:
+		break
+	case <-c.done:
+		return 0, nil, io.EOF
+	case <-c.readDeadline.wait():
+		return 0, nil, &net.OpError{
+			Op:     "read",
+			Net:    "pcap",
+			Source: c.LocalAddr(),
+			Err:    &timeoutError{Err: "timeout"},
+		}
+	}
+	if item.err != nil {
+		return 0, nil, &net.OpError{
+			Op:     "read",
+			Net:    "pcap",
+			Source: c.LocalAddr(),
+			Err:    item.err,
+		}
+	}
+
+	c.seenLock.Lock()
+	c.lastSeen = time.Now()
+	c.seenLock.Unlock()
+
+	// Client, whose address is returned instead of a new one
+	var (
+		client *clientIndicator
+		ok     bool
+	)
+	indicator := item.indicator
+	if indicator.TransportLayer() == nil {
+		addr = &net.IPAddr{IP: indicator.SrcIP()}
+	} else {
+		switch t := indicator.TransportLayer().LayerType(); t {
+		case layers.LayerTypeTCP:
+			client, ok = c.client(indicator.SrcIP(), indicator.SrcPort())
+			if ok {
+				addr = client.addr
+			} else {
+				addr = &net.UDPAddr{
+					IP:   indicator.SrcIP(),
+					Port: int(indicator.SrcPort()),
+				}
+			}
+		case layers.LayerTypeUDP:
+			client, ok = c.client(indicator.SrcIP(), indicator.SrcPort())
+			addr = indicator.Src()
+		default:
+			return 0, nil, &net.OpError{
+				Op:     "read",
+				Net:    "pcap",
+				Source: c.LocalAddr(),
+				Err:    fmt.Errorf("transport layer type %s not support", t),
+			}
+		}
+	}
+
+	// Check TCP flags, the connection to a single peer is torn down if the peer resets or finishes it
+	if indicator.TransportLayer() != nil && indicator.TransportLayer().LayerType() == layers.LayerTypeTCP && (indicator.IsRST() || indicator.IsFIN()) {
+		if !ok {
+			return 0, addr, nil
+		}
+
+		isAcceptable, isChallenge := c.isAcceptable(client, indicator)
+		if isChallenge {
+			log.Verbosef("Receive TCP RST in window: %s <- %s\n", indicator.Dst().String(), addr.String())
+
+			err := c.challengeACK(client, indicator.SrcIP(), indicator.SrcPort())
+			if err != nil {
+				return 0, addr, &net.OpError{
+					Op:     "read",
+					Net:    "pcap",
+					Source: c.LocalAddr(),
+					Addr:   addr,
+					Err:    fmt.Errorf("challenge ack: %w", err),
+				}
+			}
+		}
+		if !isAcceptable {
+			log.Verbosef("Ignore TCP RST or FIN out of sequence: %s <- %s\n", indicator.Dst().String(), addr.String())
+
+			return 0, addr, nil
+		}
+
+		if indicator.IsRST() {
+			log.Errorf("Receive TCP RST: %s <- %s\n", indicator.Dst().String(), addr.String())
+		}
+		if indicator.IsFIN() {
+			log.Infof("Receive TCP FIN: %s <- %s\n", indicator.Dst().String(), addr.String())
+		}
+		if c.dstAddr != nil {
+			c.close(false)
+
+			return 0, addr, io.EOF
+		}
+
+		log.Infof("Forget client %s\n", addr.String())
+		c.unmapClient(indicator.SrcIP(), indicator.SrcPort())
+
+		return 0, addr, nil
+	}
+
+	// Reply TCP SYN
+	if indicator.TransportLayer() != nil && indicator.TransportLayer().LayerType() == layers.LayerTypeTCP {
+		if indicator.IsSYN() {
+			// Connections accepted by a listener leave new handshakes to the listener
+			if c.listener != nil && !indicator.IsACK() {
+				return 0, addr, nil
+			}
+
+			// SYN+ACK
+			if indicator.IsACK() {
+				log.Verbosef("Receive TCP SYN+ACK: %s <- %s\n", indicator.Dst().String(), addr.String())
+
+				if atomic.CompareAndSwapUint32(&c.isConnected, 0, 1) {
+					t := time.Now()
+					duration := t.Sub(c.appear)
+
+					log.Infof("Connected to server %s in %.3f ms (RTT)\n", addr.String(), float64(duration.Microseconds())/1000)
+				}
+				atomic.StoreUint32(&c.isReconnected, 1)
+
+				err = c.handshakeACK(indicator)
+			} else {
+				log.Verbosef("Receive TCP SYN: %s -> %s\n", addr.String(), indicator.Dst().String())
 
 				err = c.handshakeSYNACK(indicator)
 			}
@@ -491,14 +1000,22 @@ type tuple struct {
 		}
 	}
 
+	// Honour the peer's acknowledgement, window and timestamp
+	if ok && indicator.TransportLayer() != nil && indicator.TransportLayer().LayerType() == layers.LayerTypeTCP {
+		window := uint32(indicator.TCPLayer().Window)
+		if client.options != nil {
+			client.options.receive(indicator.TCPLayer().Options)
+			window = client.options.peerWindow(indicator.TCPLayer().Window)
+		}
+		if client.state != nil && indicator.IsACK() {
+			client.state.receive(indicator.TCPLayer().Ack, window, c.nextSeq(client))
+		}
+	}
+
 	if indicator.Payload() == nil {
 		return 0, addr, nil
 	}
 
-	// Client
-	c.clientsLock.RLock()
-	client, ok := c.clients[addr.String()]
-	c.clientsLock.RUnlock()
 	if !ok {
 		return 0, addr, &net.OpError{
 			Op:     "read",
@@ -511,14 +1028,57 @@ type tuple struct {
 
 	// TCP Ack, always use the expected one
 	if indicator.TransportLayer() != nil && indicator.TransportLayer().LayerType() == layers.LayerTypeTCP {
-		expectedAck := indicator.TCPLayer().Seq + uint32(len(indicator.Payload()))
-		if expectedAck > client.ack || (math.MaxUint32-indicator.TCPLayer().Seq < uint32(len(indicator.Payload()))) {
-			client.ack = expectedAck
+		c.advanceAck(client, indicator.TCPLayer().Seq+uint32(len(indicator.Payload())))
+
+		// ACK passively
+		if client.state != nil {
+			if client.state.data(len(indicator.Payload()), client.delayedACK) {
+				err := c.replyACK(client, indicator.SrcIP(), indicator.SrcPort())
+				if err != nil {
+					return 0, addr, &net.OpError{
+						Op:     "read",
+						Net:    "pcap",
+						Source: c.LocalAddr(),
+						Addr:   addr,
+						Err:    fmt.Errorf("reply ack: %w", err),
+					}
+				}
+			}
+		}
+	}
+
+	// Unframe TLS records, handshake messages are replied and dropped
+	payload := indicator.Payload()
+	if c.isTLS {
+		var t uint8
+		t, payload, err = parseTLSRecords(payload)
+		if err != nil {
+			return 0, addr, &net.OpError{
+				Op:     "read",
+				Net:    "pcap",
+				Source: c.LocalAddr(),
+				Addr:   addr,
+				Err:    fmt.Errorf("parse tls: %w", err),
+			}
+		}
+		if t != tlsTypeApplicationData {
+			err = c.handshakeTLS(client, indicator)
+			if err != nil {
+				return 0, addr, &net.OpError{
+					Op:     "read",
+					Net:    "pcap",
+					Source: c.LocalAddr(),
+					Addr:   addr,
+					Err:    fmt.Errorf("handshake tls: %w", err),
+				}
+			}
+
+			return 0, addr, nil
 		}
 	}
 
-	// Decrypt
-	contents, err := client.crypt.Decrypt(indicator.Payload())
+	// Decrypt in place, the payload is owned by the captured packet
+	contents, err := crypto.Open(client.crypt, payload)
 	if err != nil {
 		return 0, addr, &net.OpError{
 			Op:     "read",
@@ -529,9 +1089,18 @@ type tuple struct {
 		}
 	}
 
-	copy(p, contents)
+	n = copy(p, contents)
+	if n < len(contents) {
+		return n, addr, &net.OpError{
+			Op:     "read",
+			Net:    "pcap",
+			Source: c.LocalAddr(),
+			Addr:   addr,
+			Err:    io.ErrShortBuffer,
+		}
+	}
 
-	return len(contents), addr, err
+	return n, addr, nil
 }
 
 func (c *FakeTCPConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
@@ -540,8 +1109,6 @@ func (c *FakeTCPConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
 		dstPort uint16
 	)
 
-	ch := make(chan error)
-
 	switch t := addr.(type) {
 	case *net.TCPAddr:
 		dstIP = addr.(*net.TCPAddr).IP
@@ -559,96 +1126,274 @@ func (c *FakeTCPConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
 		}
 	}
 
-	go func() {
-		var (
-			transportLayer gopacket.SerializableLayer
-			networkLayer   gopacket.SerializableLayer
-			linkLayer      gopacket.SerializableLayer
-			fragments      [][]byte
-		)
+	err = c.writeTo(p, dstIP, dstPort, addr, false)
+	if err != nil {
+		return 0, &net.OpError{
+			Op:     "write",
+			Net:    "pcap",
+			Source: c.LocalAddr(),
+			Addr:   addr,
+			Err:    err,
+		}
+	}
 
-		c.lock.Lock()
-		defer c.lock.Unlock()
+	return len(p), nil
+}
 
-		// Client
-		c.clientsLock.RLock()
-		client, ok := c.clients[addr.String()]
-		c.clientsLock.RUnlock()
-		if !ok {
-			ch <- fmt.Errorf("client %s unrecognized", addr.String())
-			return
+// writeTo writes to the peer, the packet is sent in Don't Fragment and never fragmented if it is a probe.
+func (c *FakeTCPConn) writeTo(p []byte, dstIP net.IP, dstPort uint16, addr net.Addr, isProbe bool) error {
+	if c.isClosed() {
+		return io.ErrClosedPipe
+	}
+	if isDone(c.writeDeadline.wait()) {
+		return &timeoutError{Err: "timeout"}
+	}
+
+	// Client
+	client, ok := c.client(dstIP, dstPort)
+	if !ok {
+		return fmt.Errorf("client %s unrecognized", addr.String())
+	}
+
+	// Encrypt into the buffer, headers will be serialized in front of it. Probes are never padded so they are sent in
+	// the exact size, and padding never pushes other packets over the MTU
+	size := len(p) + client.crypt.Cost()
+	if !isProbe {
+		room := c.MTU() - c.headerSize(dstIP)
+		if c.isTLS {
+			room = room - tlsRecordHeaderSize
 		}
+		size = crypto.Size(client.crypt, len(p), room)
+	}
+	recordsSize := size
+	if c.isTLS {
+		recordsSize = tlsRecordsSize(size)
+	}
+	buffer := getSerializeBuffer()
+	defer putSerializeBuffer(buffer)
+	contents, err := buffer.AppendBytes(recordsSize)
+	if err != nil {
+		return fmt.Errorf("append bytes: %w", err)
+	}
+	encrypted, err := crypto.SealSized(client.crypt, contents[recordsSize-size:recordsSize-size], p, size)
+	if err != nil {
+		return fmt.Errorf("encrypt: %w", err)
+	}
+	if len(encrypted) != size {
+		return fmt.Errorf("encrypted size %d out of range", len(encrypted))
+	}
+
+	// Frame in TLS records in place
+	if c.isTLS {
+		frameTLSRecords(contents, size)
+	}
+
+	// Wait for the peer's window
+	if client.state != nil {
+		client.state.wait(c.nextSeq(client), len(contents))
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
 
-		// Create layers
-		transportLayer, networkLayer, linkLayer, err := CreateLayers(c.srcPort, dstPort, client.seq, client.ack, c.conn, dstIP, c.id, 128, c.conn.RemoteDev().HardwareAddr())
+	// Create layers, which are reused under the lock
+	transportLayer, networkLayer, linkLayer, err := createLayersIn(&c.layers, c.localPort(client), dstPort, client.seq, client.ack, c.window(client), c.conn, dstIP, c.id, c.hop(128), c.conn.RemoteDev().HardwareAddr())
+	if err != nil {
+		return fmt.Errorf("create layers: %w", err)
+	}
+
+	c.setOptions(client, transportLayer.(*layers.TCP))
+
+	// Routers never fragment IPv6 packets
+	if isProbe && networkLayer.LayerType() == layers.LayerTypeIPv4 {
+		FlagIPv4Layer(networkLayer.(*layers.IPv4), true, false, 0)
+	}
+
+	// Serialize layers
+	err = serializeTo(buffer, networkLayer, transportLayer)
+	if err != nil {
+		return fmt.Errorf("serialize: %w", err)
+	}
+
+	// Write packet data, or fragments if the packet is oversize
+	if len(buffer.Bytes()) <= c.mtu || isProbe {
+		err := serializeTo(buffer, linkLayer)
 		if err != nil {
-			ch <- fmt.Errorf("create layers: %w", err)
-			return
+			return fmt.Errorf("serialize: %w", err)
 		}
 
-		// Encrypt
-		contents, err := client.crypt.Encrypt(p)
+		_, err = c.conn.Write(buffer.Bytes())
 		if err != nil {
-			ch <- fmt.Errorf("encrypt: %w", err)
-			return
+			return fmt.Errorf("write: %w", err)
 		}
-
-		// Fragment
-		fragments, err = CreateFragmentPackets(linkLayer.(gopacket.Layer), networkLayer.(gopacket.Layer), transportLayer.(gopacket.Layer), gopacket.Payload(contents), c.mtu)
+	} else {
+		fragments, err := CreateFragmentPackets(linkLayer.(gopacket.Layer), networkLayer.(gopacket.Layer), transportLayer.(gopacket.Layer), gopacket.Payload(contents), c.mtu)
 		if err != nil {
-			ch <- fmt.Errorf("fragment: %w", err)
-			return
+			return fmt.Errorf("fragment: %w", err)
 		}
 
-		// Write packet data
 		for _, frag := range fragments {
 			_, err := c.conn.Write(frag)
 			if err != nil {
-				ch <- fmt.Errorf("write: %w", err)
-				return
+				return fmt.Errorf("write: %w", err)
 			}
 		}
+	}
 
-		// TCP Seq
-		client.seq = client.seq + uint32(len(contents))
+	// TCP Seq
+	client.seq = client.seq + uint32(len(contents))
 
-		// IPv4 Id
-		if networkLayer.LayerType() == layers.LayerTypeIPv4 {
-			c.id++
-		}
+	// Piggyback ACK
+	if client.state != nil {
+		client.state.acknowledge()
+	}
 
-		ch <- nil
-		return
-	}()
-	// Timeout
-	if !c.writeDeadline.IsZero() {
-		go func() {
-			duration := c.readDeadline.Sub(time.Now())
-			if duration > 0 {
-				time.Sleep(duration)
-			}
-			ch <- &timeoutError{Err: "timeout"}
-		}()
+	// IPv4 Id
+	if networkLayer.LayerType() == layers.LayerTypeIPv4 {
+		c.id++
+	}
+
+	return nil
+}
+
+// replyACK acknowledges received data of the client with a pure ACK.
+func (c *FakeTCPConn) replyACK(client *clientIndicator, dstIP net.IP, dstPort uint16) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.isClosed() || !client.state.isPending() {
+		return nil
+	}
+
+	return c.writeACK(client, dstIP, dstPort)
+}
+
+// challengeACK replies a RST in the window but not in the exact sequence with an ACK, so a legitimate peer can reset
+// again in the exact sequence (RFC 5961).
+func (c *FakeTCPConn) challengeACK(client *clientIndicator, dstIP net.IP, dstPort uint16) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.isClosed() {
+		return nil
 	}
 
-	err = <-ch
+	return c.writeACK(client, dstIP, dstPort)
+}
+
+// writeACK writes a pure ACK to the client, the caller must hold the lock.
+func (c *FakeTCPConn) writeACK(client *clientIndicator, dstIP net.IP, dstPort uint16) error {
+	// Create layers, which are reused under the lock
+	transportLayer, networkLayer, linkLayer, err := createLayersIn(&c.layers, c.localPort(client), dstPort, client.seq, client.ack, c.window(client), c.conn, dstIP, c.id, c.hop(128), c.conn.RemoteDev().HardwareAddr())
 	if err != nil {
-		return 0, &net.OpError{
-			Op:     "write",
-			Net:    "pcap",
-			Source: c.LocalAddr(),
-			Addr:   addr,
-			Err:    err,
-		}
+		return fmt.Errorf("create layers: %w", err)
 	}
 
-	return len(p), nil
+	// Make TCP layer ACK
+	FlagTCPLayer(transportLayer.(*layers.TCP), false, false, true)
+	c.setOptions(client, transportLayer.(*layers.TCP))
+
+	// Serialize layers
+	buffer := getSerializeBuffer()
+	defer putSerializeBuffer(buffer)
+	err = serializeTo(buffer, linkLayer, networkLayer, transportLayer)
+	if err != nil {
+		return fmt.Errorf("serialize: %w", err)
+	}
+
+	// Write packet data
+	_, err = c.conn.Write(buffer.Bytes())
+	if err != nil {
+		return fmt.Errorf("write: %w", err)
+	}
+
+	if client.state != nil {
+		client.state.acknowledge()
+	}
+
+	// IPv4 Id
+	if networkLayer.LayerType() == layers.LayerTypeIPv4 {
+		c.id++
+	}
+
+	return nil
+}
+
+// reset resets the connection to the peer by sending TCP RST.
+func (c *FakeTCPConn) reset() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	client, ok := c.client(c.dstAddr.IP, uint16(c.dstAddr.Port))
+	if !ok {
+		return nil
+	}
+
+	// Create layers
+	transportLayer, networkLayer, linkLayer, err := CreateLayers(c.srcPort, uint16(c.dstAddr.Port), client.seq, client.ack, c.window(client), c.conn, c.dstAddr.IP, c.id, c.hop(128), c.conn.RemoteDev().HardwareAddr())
+	if err != nil {
+		return fmt.Errorf("create layers: %w", err)
+	}
+
+	// Make TCP layer RST & ACK
+	FlagTCPLayer(transportLayer.(*layers.TCP), false, false, true)
+	transportLayer.(*layers.TCP).RST = true
+	c.setOptions(client, transportLayer.(*layers.TCP))
+
+	// Serialize layers
+	data, err := Serialize(linkLayer, networkLayer, transportLayer)
+	if err != nil {
+		return fmt.Errorf("serialize: %w", err)
+	}
+
+	// Write packet data
+	_, err = c.conn.Write(data)
+	if err != nil {
+		return fmt.Errorf("write: %w", err)
+	}
+
+	// IPv4 Id
+	if networkLayer.LayerType() == layers.LayerTypeIPv4 {
+		c.id++
+	}
+
+	return nil
 }
 
 func (c *FakeTCPConn) Close() error {
-	c.isClosed = true
+	return c.close(true)
+}
+
+// close closes the connection, and resets the connection to the peer if reset is true.
+func (c *FakeTCPConn) close(reset bool) error {
+	var err error
+
+	c.once.Do(func() {
+		// Notify the peer so it can reconnect at once
+		if reset && c.dstAddr != nil {
+			err := c.reset()
+			if err != nil {
+				log.Verboseln(fmt.Errorf("reset: %w", err))
+			}
+		}
 
-	err := c.conn.Close()
+		close(c.done)
+
+		// Stop delayed ACKs
+		c.clientsLock.RLock()
+		for _, client := range c.clients {
+			if client.state != nil {
+				client.state.close()
+			}
+		}
+		c.clientsLock.RUnlock()
+
+		if c.listener != nil {
+			c.listener.remove(c)
+		}
+
+		err = c.conn.Close()
+	})
 	if err != nil {
 		return &net.OpError{
 			Op:   "close",
@@ -661,12 +1406,145 @@ func (c *FakeTCPConn) Close() error {
 	return nil
 }
 
+// headerSize returns the size of network and transport headers in a packet to the IP.
+func (c *FakeTCPConn) headerSize(ip net.IP) int {
+	size := 20 + 20
+	if ip.To4() == nil {
+		size = size + 20
+	}
+	// Timestamps with paddings
+	if c.profile != nil && c.profile.has(layers.TCPOptionKindTimestamps) {
+		size = size + 12
+	}
+
+	return size
+}
+
+// Overhead returns the size of headers and encryption in a packet besides the data.
+func (c *FakeTCPConn) Overhead() int {
+	ip := net.IPv4zero
+	if c.dstAddr != nil {
+		ip = c.dstAddr.IP
+	}
+
+	overhead := c.headerSize(ip) + c.crypt.Cost()
+	if c.isTLS {
+		overhead = overhead + tlsRecordHeaderSize
+	}
+
+	return overhead
+}
+
+// MTU returns the MTU of the connection, larger packets are fragmented.
+func (c *FakeTCPConn) MTU() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.mtu
+}
+
+// SetMTU sets the MTU of the connection.
+func (c *FakeTCPConn) SetMTU(mtu int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.mtu = mtu
+}
+
+// reduceMTU reduces the MTU of the connection as reported by routers on the way.
+func (c *FakeTCPConn) reduceMTU(mtu int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if mtu < minMTU {
+		mtu = minMTU
+	}
+	if mtu >= c.mtu {
+		return
+	}
+
+	log.Infof("Reduce MTU to %s from %d to %d\n", c.RemoteAddr(), c.mtu, mtu)
+	c.mtu = mtu
+}
+
+// reportedMTU returns the MTU reported in an ICMPv4 Fragmentation Needed or an ICMPv6 Packet Too Big of a packet sent
+// by the connection, or 0 if the packet is not.
+func (c *FakeTCPConn) reportedMTU(packet gopacket.Packet) int {
+	var (
+		mtu      int
+		contents []byte
+		dstIP    net.IP
+		srcPort  uint16
+	)
+
+	if c.dstAddr == nil {
+		return 0
+	}
+
+	// Packets in front of the report keep the IP header and at least 8 bytes of the transport layer
+	if layer, ok := packet.Layer(layers.LayerTypeICMPv4).(*layers.ICMPv4); ok {
+		if layer.TypeCode != layers.CreateICMPv4TypeCode(layers.ICMPv4TypeDestinationUnreachable, layers.ICMPv4CodeFragmentationNeeded) {
+			return 0
+		}
+		contents = layer.Payload
+		if len(contents) < 20 || int(contents[0]&0x0f)*4+2 > len(contents) || contents[9] != byte(layers.IPProtocolTCP) {
+			return 0
+		}
+
+		mtu = int(layer.Seq)
+		dstIP = contents[16:20]
+		srcPort = binary.BigEndian.Uint16(contents[int(contents[0]&0x0f)*4:])
+	} else if layer, ok := packet.Layer(layers.LayerTypeICMPv6).(*layers.ICMPv6); ok {
+		if layer.TypeCode.Type() != layers.ICMPv6TypePacketTooBig {
+			return 0
+		}
+		contents = layer.Payload
+		if len(contents) < 4+40+2 || contents[4+6] != byte(layers.IPProtocolTCP) {
+			return 0
+		}
+
+		mtu = int(binary.BigEndian.Uint32(contents))
+		dstIP = contents[4+24 : 4+40]
+		srcPort = binary.BigEndian.Uint16(contents[4+40:])
+	} else {
+		return 0
+	}
+
+	if !dstIP.Equal(c.dstAddr.IP) || srcPort != c.srcPort {
+		return 0
+	}
+
+	return mtu
+}
+
+// isIdle returns if nothing is received from the peer for the duration.
+func (c *FakeTCPConn) isIdle(d time.Duration) bool {
+	c.seenLock.RLock()
+	defer c.seenLock.RUnlock()
+
+	return time.Now().Sub(c.lastSeen) > d
+}
+
+// isClosed returns if the connection is closed.
+func (c *FakeTCPConn) isClosed() bool {
+	return isDone(c.done)
+}
+
+// IsConnected returns if the handshake with the server is completed.
+func (c *FakeTCPConn) IsConnected() bool {
+	return atomic.LoadUint32(&c.isConnected) != 0
+}
+
 // LocalDev returns the local device.
 func (c *FakeTCPConn) LocalDev() *Device {
 	return c.conn.LocalDev()
 }
 
 func (c *FakeTCPConn) LocalAddr() net.Addr {
+	if c.dstAddr != nil {
+		return &net.UDPAddr{IP: c.LocalDev().srcIP(c.dstAddr.IP), Port: int(c.srcPort)}
+	}
+
 	return &net.UDPAddr{IP: c.LocalDev().IPAddr().IP, Port: int(c.srcPort)}
 }
 
@@ -680,37 +1558,28 @@ func (c *FakeTCPConn) RemoteAddr() net.Addr {
 }
 
 func (c *FakeTCPConn) SetDeadline(t time.Time) error {
-	readDeadline := c.readDeadline
-
-	err := c.SetReadDeadline(t)
-	if err != nil {
-		return err
-	}
-
-	err = c.SetWriteDeadline(t)
-	if err != nil {
-		_ = c.SetReadDeadline(readDeadline)
-		return err
-	}
+	c.readDeadline.set(t)
+	c.writeDeadline.set(t)
 
 	return nil
 }
 
 func (c *FakeTCPConn) SetReadDeadline(t time.Time) error {
-	c.readDeadline = t
+	c.readDeadline.set(t)
 
 	return nil
 }
 
 func (c *FakeTCPConn) SetWriteDeadline(t time.Time) error {
-	c.writeDeadline = t
+	c.writeDeadline.set(t)
 
 	return nil
 }
 
-// Reconnect reconnects the connection by sending TCP SYN.
+// Reconnect reconnects the connection by sending TCP SYN. Reading never reconnects, a connection closed by a RST or FIN
+// from the peer has to be dialed again.
 func (c *FakeTCPConn) Reconnect() error {
-	c.isReconnected = false
+	atomic.StoreUint32(&c.isReconnected, 0)
 
 	err := c.handshakeSYN()
 	if err != nil {
@@ -720,7 +1589,7 @@ func (c *FakeTCPConn) Reconnect() error {
 	go func() {
 		time.Sleep(establishDeadline)
 
-		if !c.isReconnected {
+		if atomic.LoadUint32(&c.isReconnected) == 0 {
 			log.Errorf("Cannot receive response from server %s, is it down?\n", c.RemoteAddr().String())
 		}
 	}()
@@ -728,24 +1597,46 @@ func (c *FakeTCPConn) Reconnect() error {
 	return nil
 }
 
-// FakeTCPListener is a pcap network listener in FakeTCP network.
+// FakeTCPListener is a pcap network listener in FakeTCP network. Clients idle for too long are evicted.
 type FakeTCPListener struct {
-	conn    *RawConn
-	srcPort uint16
-	crypt   crypto.Crypt
-	mtu     int
-	clients map[string]net.Conn
+	conn        *RawConn
+	srcPort     uint16
+	crypt       crypto.Crypt
+	mtu         int
+	config      *config.FakeTCPConfig
+	clientsLock sync.Mutex
+	clients     map[string]*FakeTCPConn
+	done        chan struct{}
+	once        sync.Once
 }
 
-// ListenFakeTCP announces on the local network address in FakeTCP network.
-func ListenFakeTCP(srcDev, dstDev *Device, srcPort uint16, crypt crypto.Crypt, mtu int) (*FakeTCPListener, error) {
+// HopMaxPort returns the max port clients can hop to from the port in FakeTCP network.
+func HopMaxPort(port uint16, config *config.FakeTCPConfig) uint16 {
+	if config.HopPorts <= 1 {
+		return port
+	}
+	if int(port)+config.HopPorts-1 > 65535 {
+		return 65535
+	}
+
+	return port + uint16(config.HopPorts-1)
+}
+
+// ListenFakeTCP announces on the local network address in FakeTCP network. It listens on ports clients can hop to
+// from the port as well.
+func ListenFakeTCP(srcDev, dstDev *Device, srcPort uint16, crypt crypto.Crypt, mtu int, config *config.FakeTCPConfig) (*FakeTCPListener, error) {
 	addrs := make([]*net.TCPAddr, 0)
 	for _, ip := range srcDev.IPAddrs() {
+		// Link-local IPv6 addresses are not reachable from the Internet
+		if ip.IP.To4() == nil && !ip.IP.IsGlobalUnicast() {
+			continue
+		}
 		addrs = append(addrs, &net.TCPAddr{IP: ip.IP, Port: int(srcPort)})
 	}
 	srcAddrs := addr.MultiTCPAddr{Addrs: addrs}
 
-	conn, err := CreateRawConn(srcDev, dstDev, fmt.Sprintf("tcp && tcp[tcpflags] & tcp-syn != 0 && dst port %d", srcPort))
+	// TCP headers in IPv6 are accessed directly behind the fixed header
+	conn, err := CreateRawConn(srcDev, dstDev, fmt.Sprintf("((ip && tcp && tcp[tcpflags] & tcp-syn != 0) || (ip6 && tcp && ip6[53] & tcp-syn != 0)) && %s", addr.PortRangeBPFFilter("dst", srcPort, HopMaxPort(srcPort, config))))
 	if err != nil {
 		return nil, &net.OpError{
 			Op:     "dial",
@@ -760,12 +1651,56 @@ func ListenFakeTCP(srcDev, dstDev *Device, srcPort uint16, crypt crypto.Crypt, m
 		srcPort: srcPort,
 		crypt:   crypt,
 		mtu:     mtu,
-		clients: make(map[string]net.Conn),
+		config:  config,
+		clients: make(map[string]*FakeTCPConn),
+		done:    make(chan struct{}),
+	}
+
+	if config.IdleTimeout > 0 {
+		go listener.evict()
 	}
 
 	return listener, nil
 }
 
+// evict closes clients idle for too long periodically until the listener is closed.
+func (l *FakeTCPListener) evict() {
+	ticker := time.NewTicker(evictInterval)
+	defer ticker.Stop()
+
+	timeout := time.Duration(l.config.IdleTimeout) * time.Second
+	for {
+		select {
+		case <-l.done:
+			return
+		case <-ticker.C:
+		}
+
+		idles := make([]*FakeTCPConn, 0)
+		l.clientsLock.Lock()
+		for _, conn := range l.clients {
+			if conn.isIdle(timeout) {
+				idles = append(idles, conn)
+			}
+		}
+		l.clientsLock.Unlock()
+
+		for _, conn := range idles {
+			log.Infof("Evict idle client %s\n", conn.RemoteAddr())
+			conn.Close()
+		}
+	}
+}
+
+func (l *FakeTCPListener) remove(conn *FakeTCPConn) {
+	l.clientsLock.Lock()
+	defer l.clientsLock.Unlock()
+
+	if l.clients[conn.RemoteAddr().String()] == conn {
+		delete(l.clients, conn.RemoteAddr().String())
+	}
+}
+
 func (l *FakeTCPListener) Accept() (net.Conn, error) {
 	packet, err := l.conn.ReadPacket()
 	if err != nil {
@@ -788,13 +1723,29 @@ func (l *FakeTCPListener) Accept() (net.Conn, error) {
 		}
 	}
 
-	_, ok := l.clients[indicator.Src().String()]
+	// Duplicate, the client starts over so the previous connection is replaced
+	l.clientsLock.Lock()
+	client, ok := l.clients[indicator.Src().String()]
+	n := len(l.clients)
+	l.clientsLock.Unlock()
 	if ok {
-		// Duplicate
-		return nil, nil
+		log.Infof("Client %s handshakes again, replace the previous connection\n", indicator.Src())
+		client.close(false)
+		n--
 	}
 
-	conn, err := dialFakeTCPPassive(l.Dev(), l.conn.RemoteDev(), l.srcPort, indicator.Src().(*net.TCPAddr), l.crypt, l.mtu)
+	// Too many clients
+	if l.config.MaxClients > 0 && n >= l.config.MaxClients {
+		return nil, &net.OpError{
+			Op:   "accept",
+			Net:  "pcap",
+			Addr: l.Addr(),
+			Err:  fmt.Errorf("client %s: %w", indicator.Src(), fmt.Errorf("too many clients (%d)", n)),
+		}
+	}
+
+	// The client may connect to any port in the range
+	conn, err := dialFakeTCPPassive(l.Dev(), l.conn.RemoteDev(), indicator.DstPort(), indicator.Src().(*net.TCPAddr), l.crypt, l.mtu, l.config)
 	if err != nil {
 		return nil, &net.OpError{
 			Op:     "dial",
@@ -805,15 +1756,13 @@ func (l *FakeTCPListener) Accept() (net.Conn, error) {
 		}
 	}
 
-	conn.clients[indicator.Src().String()] = &clientIndicator{
-		crypt: l.crypt,
-		seq:   0,
-		ack:   0,
-	}
+	conn.mapClient(indicator.SrcIP(), indicator.SrcPort(), l.crypt)
+	conn.listener = l
 
 	// Handshaking with client (SYN+ACK)
 	err = conn.handshakeSYNACK(indicator)
 	if err != nil {
+		conn.conn.Close()
 		return nil, &net.OpError{
 			Op:     "handshake",
 			Net:    "pcap",
@@ -824,12 +1773,29 @@ func (l *FakeTCPListener) Accept() (net.Conn, error) {
 	}
 
 	// Map client
+	l.clientsLock.Lock()
 	l.clients[indicator.Src().String()] = conn
+	l.clientsLock.Unlock()
 
 	return conn, nil
 }
 
 func (l *FakeTCPListener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+	})
+
+	// Close clients
+	l.clientsLock.Lock()
+	clients := make([]*FakeTCPConn, 0, len(l.clients))
+	for _, conn := range l.clients {
+		clients = append(clients, conn)
+	}
+	l.clientsLock.Unlock()
+	for _, conn := range clients {
+		conn.Close()
+	}
+
 	err := l.conn.Close()
 	if err != nil {
 		return &net.OpError{
@@ -855,58 +1821,26 @@ func (l *FakeTCPListener) Addr() net.Addr {
 	}
 }
 
-// DialFakeTCPWithKCP connects to the remote address in the FakeTCP network with KCP support.
-func DialFakeTCPWithKCP(srcDev, dstDev *Device, srcPort uint16, dstAddr *net.TCPAddr, crypt crypto.Crypt, mtu int, config *config.KCPConfig) (*kcp.UDPSession, error) {
-	conn, err := DialFakeTCP(srcDev, dstDev, srcPort, dstAddr, crypt, mtu)
+// DialFakeTCPWithKCP connects to the remote address in the FakeTCP network with KCP support. Flows are spread across
+// KCP streams in the count configured.
+func DialFakeTCPWithKCP(srcDev, dstDev *Device, srcPort uint16, dstAddr *net.TCPAddr, crypt crypto.Crypt, mtu int, fakeTCPConfig *config.FakeTCPConfig, config *config.KCPConfig) (net.Conn, error) {
+	conn, err := DialFakeTCP(srcDev, dstDev, srcPort, dstAddr, crypt, mtu, fakeTCPConfig)
 	if err != nil {
 		return nil, err
 	}
 
-	sess, err := kcp.NewConn(dstAddr.String(), nil, config.DataShard, config.ParityShard, conn)
-	if err != nil {
-		return nil, &net.OpError{
-			Op:     "dial",
-			Net:    "pcap",
-			Source: conn.LocalAddr(),
-			Addr:   conn.RemoteAddr(),
-			Err:    fmt.Errorf("kcp: %w", err),
-		}
-	}
-
-	// Tuning
-	err = tuneKCP(sess, config)
-	if err != nil {
-		sess.Close()
-		return nil, &net.OpError{
-			Op:     "dial",
-			Net:    "pcap",
-			Source: conn.LocalAddr(),
-			Addr:   conn.RemoteAddr(),
-			Err:    fmt.Errorf("tune: %w", err),
-		}
-	}
-
-	return sess, nil
+	return dialKCPStreams(conn, dstAddr, config)
 }
 
 // ListenFakeTCPWithKCP listens for incoming packets addressed to the local address in the FakeTCP network with KCP support.
-func ListenFakeTCPWithKCP(srcDev, dstDev *Device, srcPort uint16, crypt crypto.Crypt, mtu int, config *config.KCPConfig) (*kcp.Listener, error) {
-	conn, err := listenFakeTCPMulticast(srcDev, dstDev, srcPort, crypt, mtu)
+// Streams of a client are accepted as one connection in the count of streams of the client.
+func ListenFakeTCPWithKCP(srcDev, dstDev *Device, srcPort uint16, crypt crypto.Crypt, mtu int, fakeTCPConfig *config.FakeTCPConfig, config *config.KCPConfig) (net.Listener, error) {
+	conn, err := listenFakeTCPMulticast(srcDev, dstDev, srcPort, crypt, mtu, fakeTCPConfig)
 	if err != nil {
 		return nil, err
 	}
 
-	listener, err := kcp.ServeConn(nil, config.DataShard, config.ParityShard, conn)
-	if err != nil {
-		return nil, &net.OpError{
-			Op:     "listen",
-			Net:    "pcap",
-			Source: conn.LocalAddr(),
-			Err:    fmt.Errorf("kcp: %w", err),
-		}
-	}
-
-	return listener, err
+	return listenKCPStreams(conn, config)
 }
 
 func tuneKCP(sess *kcp.UDPSession, config *config.KCPConfig) error {
@@ -0,0 +1,723 @@
+package pcap
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"ikago/internal/config"
+	"ikago/internal/crypto"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// pipeHandle is a handle which captures packets injected by its peer, packets are discarded if there is no peer or
+// they are dropped by drop.
+type pipeHandle struct {
+	in   chan []byte
+	out  chan []byte
+	drop func([]byte) bool
+	done chan struct{}
+	once sync.Once
+}
+
+// newPipeHandles returns a pair of handles connected to each other.
+func newPipeHandles() (*pipeHandle, *pipeHandle) {
+	a, b := make(chan []byte, fakeTCPQueueSize), make(chan []byte, fakeTCPQueueSize)
+
+	return &pipeHandle{in: a, out: b, done: make(chan struct{})}, &pipeHandle{in: b, out: a, done: make(chan struct{})}
+}
+
+func (h *pipeHandle) ZeroCopyReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	select {
+	case b := <-h.in:
+		return b, gopacket.CaptureInfo{CaptureLength: len(b), Length: len(b)}, nil
+	case <-h.done:
+		return nil, gopacket.CaptureInfo{}, io.EOF
+	}
+}
+
+func (h *pipeHandle) WritePacketData(b []byte) error {
+	if h.out == nil || (h.drop != nil && h.drop(b)) {
+		return nil
+	}
+
+	data := make([]byte, len(b))
+	copy(data, b)
+
+	select {
+	case h.out <- data:
+		return nil
+	case <-h.done:
+		return io.ErrClosedPipe
+	}
+}
+
+func (h *pipeHandle) LinkType() layers.LinkType {
+	return layers.LinkTypeNull
+}
+
+func (h *pipeHandle) SetBPFFilter(string) error {
+	return nil
+}
+
+func (h *pipeHandle) Close() {
+	h.once.Do(func() {
+		close(h.done)
+	})
+}
+
+// replayHandle is a handle which captures the same packet over and over, and discards injected packets.
+type replayHandle struct {
+	data []byte
+	done chan struct{}
+	once sync.Once
+}
+
+func newReplayHandle(data []byte) *replayHandle {
+	return &replayHandle{data: data, done: make(chan struct{})}
+}
+
+func (h *replayHandle) ZeroCopyReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	if isDone(h.done) {
+		return nil, gopacket.CaptureInfo{}, io.EOF
+	}
+
+	return h.data, gopacket.CaptureInfo{CaptureLength: len(h.data), Length: len(h.data)}, nil
+}
+
+func (h *replayHandle) WritePacketData([]byte) error {
+	return nil
+}
+
+func (h *replayHandle) LinkType() layers.LinkType {
+	return layers.LinkTypeNull
+}
+
+func (h *replayHandle) SetBPFFilter(string) error {
+	return nil
+}
+
+func (h *replayHandle) Close() {
+	h.once.Do(func() {
+		close(h.done)
+	})
+}
+
+var (
+	testClientAddr = &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40000}
+	testServerAddr = &net.TCPAddr{IP: net.IPv4(127, 0, 0, 2), Port: 8080}
+)
+
+func newTestDev(ip net.IP) *Device {
+	return &Device{
+		name:    "lo",
+		alias:   "lo",
+		ipAddrs: []*net.IPNet{{IP: ip, Mask: net.CIDRMask(8, 32)}},
+		isLoop:  true,
+	}
+}
+
+func newTestCrypt(tb testing.TB) crypto.Crypt {
+	crypt, err := crypto.ParseCrypt("aes-128-gcm", "ikago")
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	return crypt
+}
+
+// newTestConn returns a connection from the local address to the remote address over the handle, whose capture is not
+// started.
+func newTestConn(tb testing.TB, h handle, localAddr, remoteAddr *net.TCPAddr, crypt crypto.Crypt, cfg *config.FakeTCPConfig) *FakeTCPConn {
+	dev := newTestDev(localAddr.IP)
+
+	conn := newConn()
+	conn.srcPort = uint16(localAddr.Port)
+	conn.dstAddr = remoteAddr
+	conn.crypt = crypt
+	conn.conn = &RawConn{srcDev: dev, dstDev: dev, handle: h}
+	err := conn.setConfig(cfg)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	return conn
+}
+
+// newTestPair returns a client and a server connected to each other after handshaking.
+func newTestPair(tb testing.TB, cfg *config.FakeTCPConfig) (client, server *FakeTCPConn) {
+	a, b := newPipeHandles()
+
+	return newTestPairOver(tb, a, b, cfg)
+}
+
+// newTestPairOver returns a client and a server connected to each other over the handles after handshaking.
+func newTestPairOver(tb testing.TB, a, b *pipeHandle, cfg *config.FakeTCPConfig) (client, server *FakeTCPConn) {
+	crypt := newTestCrypt(tb)
+
+	client = newTestConn(tb, a, testClientAddr, testServerAddr, crypt, cfg)
+	server = newTestConn(tb, b, testServerAddr, testClientAddr, crypt, cfg)
+	go client.capture()
+	go server.capture()
+
+	handshakeTestPair(tb, client, server)
+
+	return client, server
+}
+
+// handshakeTestPair handshakes from the client to the server.
+func handshakeTestPair(tb testing.TB, client, server *FakeTCPConn) {
+	client.appear = time.Now()
+	err := client.handshakeSYN()
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	// SYN, SYN+ACK and ACK
+	buffer := make([]byte, IPv4MaxSize)
+	for _, conn := range []*FakeTCPConn{server, client, server} {
+		n, _, err := conn.ReadFrom(buffer)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		if n != 0 {
+			tb.Fatalf("handshake: read %d bytes", n)
+		}
+	}
+}
+
+// capturePacket returns the next packet the connection injects into the handle.
+func capturePacket(tb testing.TB, h *pipeHandle) []byte {
+	select {
+	case b := <-h.out:
+		return b
+	case <-time.After(time.Second):
+		tb.Fatal("missing packet")
+		return nil
+	}
+}
+
+func TestFakeTCPConnReadWrite(t *testing.T) {
+	client, server := newTestPair(t, config.NewFakeTCPConfig())
+	defer client.Close()
+	defer server.Close()
+
+	buffer := make([]byte, IPv4MaxSize)
+	for _, size := range []int{1, 100, 1400} {
+		data := bytes.Repeat([]byte{byte(size)}, size)
+
+		_, err := client.Write(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		n, addr, err := server.ReadFrom(buffer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if addr.String() != testClientAddr.String() {
+			t.Errorf("size %d: read from %s, want %s", size, addr, testClientAddr)
+		}
+		if !bytes.Equal(buffer[:n], data) {
+			t.Errorf("size %d: read %d bytes mismatch", size, n)
+		}
+	}
+}
+
+func TestFakeTCPConnDeadline(t *testing.T) {
+	client, server := newTestPair(t, config.NewFakeTCPConfig())
+	defer client.Close()
+	defer server.Close()
+
+	buffer := make([]byte, IPv4MaxSize)
+
+	// A passed deadline times out at once
+	err := server.SetReadDeadline(time.Now().Add(-time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = server.ReadFrom(buffer)
+	if e, ok := err.(net.Error); !ok || !e.Timeout() {
+		t.Fatalf("read with passed deadline: %v, want timeout", err)
+	}
+
+	// Setting a deadline wakes a blocked reader
+	err = server.SetReadDeadline(time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch := make(chan error)
+	go func() {
+		_, _, err := server.ReadFrom(buffer)
+		ch <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	err = server.SetReadDeadline(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-ch:
+		if e, ok := err.(net.Error); !ok || !e.Timeout() {
+			t.Fatalf("read with deadline set later: %v, want timeout", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("reader is not woken by the deadline")
+	}
+
+	// Clearing the deadline recovers the connection
+	err = server.SetReadDeadline(time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.Write([]byte{1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, _, err := server.ReadFrom(buffer)
+	if err != nil || n != 1 {
+		t.Fatalf("read after clearing deadline: %d, %v", n, err)
+	}
+
+	// Writes honour the write deadline
+	err = client.SetWriteDeadline(time.Now().Add(-time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.Write([]byte{1})
+	if e, ok := err.(net.Error); !ok || !e.Timeout() {
+		t.Fatalf("write with passed deadline: %v, want timeout", err)
+	}
+}
+
+func TestFakeTCPConnClose(t *testing.T) {
+	client, server := newTestPair(t, config.NewFakeTCPConfig())
+	defer server.Close()
+
+	ch := make(chan error)
+	go func() {
+		_, _, err := client.ReadFrom(make([]byte, IPv4MaxSize))
+		ch <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	err := client.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-ch:
+		if err != io.EOF {
+			t.Fatalf("read after close: %v, want EOF", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("reader is not woken by closing")
+	}
+
+	_, err = client.Write([]byte{1})
+	if err == nil {
+		t.Fatal("write after close succeeds")
+	}
+}
+
+func TestFakeTCPConnBidirectional(t *testing.T) {
+	tests := []struct {
+		name      string
+		emulation bool
+		profile   string
+		count     int
+		size      int
+	}{
+		{name: "raw", count: 200, size: 1000},
+		{name: "emulation", emulation: true, count: 200, size: 1000},
+		{name: "emulation with small packets", emulation: true, count: 500, size: 10},
+		{name: "emulation with linux", emulation: true, profile: "linux", count: 200, size: 1000},
+		{name: "emulation with windows", emulation: true, profile: "windows", count: 200, size: 100},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := config.NewFakeTCPConfig()
+			cfg.Emulation = test.emulation
+			cfg.Profile = test.profile
+
+			client, server := newTestPair(t, cfg)
+			defer client.Close()
+			defer server.Close()
+
+			// Both sides write and read at once, so acknowledgements are tracked in the reader while segments and delayed
+			// ACKs are sent
+			var wg sync.WaitGroup
+			errs := make(chan error, 4)
+			for _, pair := range [][2]*FakeTCPConn{{client, server}, {server, client}} {
+				from, to := pair[0], pair[1]
+				wg.Add(2)
+				go func() {
+					defer wg.Done()
+
+					for i := 0; i < test.count; i++ {
+						_, err := from.WriteTo(bytes.Repeat([]byte{byte(i)}, test.size), from.RemoteAddr())
+						if err != nil {
+							errs <- err
+							return
+						}
+					}
+				}()
+				go func() {
+					defer wg.Done()
+
+					_ = to.SetReadDeadline(time.Now().Add(5 * time.Second))
+					buffer := make([]byte, IPv4MaxSize)
+					for i := 0; i < test.count; {
+						n, _, err := to.ReadFrom(buffer)
+						if err != nil {
+							errs <- err
+							return
+						}
+						if n == 0 {
+							continue
+						}
+						if !bytes.Equal(buffer[:n], bytes.Repeat([]byte{byte(i)}, test.size)) {
+							errs <- fmt.Errorf("read packet %d mismatch", i)
+							return
+						}
+						i++
+					}
+				}()
+			}
+			wg.Wait()
+			close(errs)
+			for err := range errs {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+// writeTeardown writes a RST or FIN from the connection to the peer at the offset from the next sequence of the
+// connection.
+func writeTeardown(tb testing.TB, conn *FakeTCPConn, peer *net.TCPAddr, rst bool, offset uint32) {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+
+	client, _ := conn.client(peer.IP, uint16(peer.Port))
+	transportLayer, networkLayer, linkLayer, err := CreateLayers(conn.srcPort, uint16(peer.Port), client.seq+offset, client.ack, conn.window(client), conn.conn, peer.IP, conn.id, 64, nil)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	FlagTCPLayer(transportLayer.(*layers.TCP), false, false, true)
+	transportLayer.(*layers.TCP).RST = rst
+	transportLayer.(*layers.TCP).FIN = !rst
+
+	data, err := Serialize(linkLayer, networkLayer, transportLayer)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	_, err = conn.conn.Write(data)
+	if err != nil {
+		tb.Fatal(err)
+	}
+}
+
+func TestFakeTCPConnTeardown(t *testing.T) {
+	tests := []struct {
+		name        string
+		rst         bool
+		offset      uint32
+		isTornDown  bool
+		isChallenge bool
+	}{
+		{name: "rst in sequence", rst: true, offset: 0, isTornDown: true},
+		{name: "rst in window", rst: true, offset: 1, isChallenge: true},
+		{name: "rst out of window", rst: true, offset: 1 << 20},
+		{name: "rst before window", rst: true, offset: ^uint32(0)},
+		{name: "fin in sequence", rst: false, offset: 0, isTornDown: true},
+		{name: "fin in window", rst: false, offset: 1000, isTornDown: true},
+		{name: "fin out of window", rst: false, offset: 1 << 20},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a, b := newPipeHandles()
+			client, server := newTestPairOver(t, a, b, config.NewFakeTCPConfig())
+			defer client.Close()
+			defer server.Close()
+
+			// Pure ACKs from the client are challenge ACKs after handshaking
+			acks := make(chan struct{}, 1)
+			a.drop = func(data []byte) bool {
+				packet := gopacket.NewPacket(data, layers.LayerTypeLoopback, gopacket.Default)
+				if tcp, ok := packet.TransportLayer().(*layers.TCP); ok && tcp.ACK && !tcp.RST && !tcp.FIN && len(tcp.Payload) == 0 {
+					acks <- struct{}{}
+				}
+
+				return false
+			}
+
+			writeTeardown(t, server, testClientAddr, test.rst, test.offset)
+
+			_ = client.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+			_, _, err := client.ReadFrom(make([]byte, IPv4MaxSize))
+			if isTornDown := err == io.EOF; isTornDown != test.isTornDown {
+				t.Fatalf("read after %s: %v", test.name, err)
+			}
+
+			// The connection is closed instead of reconnected
+			if client.isClosed() != test.isTornDown {
+				t.Fatalf("connection closed: %t", client.isClosed())
+			}
+			if test.isTornDown {
+				_, err := client.Write([]byte{1, 2, 3})
+				if err == nil {
+					t.Fatal("write after teardown")
+				}
+			}
+
+			select {
+			case <-acks:
+				if !test.isChallenge {
+					t.Fatal("unexpected challenge ack")
+				}
+			default:
+				if test.isChallenge {
+					t.Fatal("missing challenge ack")
+				}
+			}
+		})
+	}
+}
+
+func TestFakeTCPConnTeardownMulticast(t *testing.T) {
+	tests := []struct {
+		name string
+		rst  bool
+	}{
+		{name: "rst", rst: true},
+		{name: "fin", rst: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			crypt := newTestCrypt(t)
+			a, b := newPipeHandles()
+
+			// The server serves any client
+			client := newTestConn(t, a, testClientAddr, testServerAddr, crypt, config.NewFakeTCPConfig())
+			server := newTestConn(t, b, testServerAddr, nil, crypt, config.NewFakeTCPConfig())
+			defer client.Close()
+			defer server.Close()
+			go client.capture()
+			go server.capture()
+			handshakeTestPair(t, client, server)
+
+			buffer := make([]byte, IPv4MaxSize)
+			writeTeardown(t, client, testServerAddr, test.rst, 0)
+
+			// The client is forgotten while the server keeps serving
+			_ = server.SetReadDeadline(time.Now().Add(time.Second))
+			_, _, err := server.ReadFrom(buffer)
+			if err != nil {
+				t.Fatalf("read after %s: %v", test.name, err)
+			}
+			if server.isClosed() {
+				t.Fatalf("server closed after %s", test.name)
+			}
+			if _, ok := server.client(testClientAddr.IP, uint16(testClientAddr.Port)); ok {
+				t.Fatalf("client mapped after %s", test.name)
+			}
+
+			_, err = client.Write([]byte{1, 2, 3})
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, _, err = server.ReadFrom(buffer)
+			if err == nil {
+				t.Fatalf("read from forgotten client")
+			}
+
+			// The client comes back after handshaking again
+			handshakeTestPair(t, client, server)
+
+			_, err = client.Write([]byte{1, 2, 3})
+			if err != nil {
+				t.Fatal(err)
+			}
+			n, _, err := server.ReadFrom(buffer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(buffer[:n], []byte{1, 2, 3}) {
+				t.Fatalf("read %d bytes mismatch", n)
+			}
+		})
+	}
+}
+
+func TestFakeTCPConnTLSRetransmit(t *testing.T) {
+	cfg := config.NewFakeTCPConfig()
+	cfg.TLS = true
+
+	// The first ClientHello is lost
+	a, b := newPipeHandles()
+	var isDropped bool
+	a.drop = func(data []byte) bool {
+		packet := gopacket.NewPacket(data, layers.LayerTypeLoopback, gopacket.Default)
+		if packet.ApplicationLayer() == nil || isDropped {
+			return false
+		}
+		isDropped = tlsHandshakeType(packet.ApplicationLayer().Payload()) == tlsHandshakeClientHello
+
+		return isDropped
+	}
+
+	client, server := newTestPairOver(t, a, b, cfg)
+	defer client.Close()
+	defer server.Close()
+
+	// ClientHello in retransmission, ServerHello and Finished
+	buffer := make([]byte, IPv4MaxSize)
+	for _, conn := range []*FakeTCPConn{server, client, server} {
+		_ = conn.SetReadDeadline(time.Now().Add(2 * tlsRetransmitTimeout))
+		n, _, err := conn.ReadFrom(buffer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 0 {
+			t.Fatalf("tls handshake: read %d bytes", n)
+		}
+	}
+	if !isDropped {
+		t.Fatal("missing ClientHello")
+	}
+
+	client.lock.Lock()
+	indicator, _ := client.client(testServerAddr.IP, uint16(testServerAddr.Port))
+	hello := indicator.hello
+	client.lock.Unlock()
+	if hello != nil {
+		t.Fatal("ClientHello is retransmitted after ServerHello")
+	}
+}
+
+func TestFakeTCPConnPaddingMTU(t *testing.T) {
+	crypt, err := crypto.CreateObfsCrypt(newTestCrypt(t), 65535, []int{1500})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, _ := newPipeHandles()
+
+	client := newTestConn(t, h, testClientAddr, testServerAddr, crypt, config.NewFakeTCPConfig())
+	defer client.Close()
+	client.mapClient(testServerAddr.IP, uint16(testServerAddr.Port), crypt)
+	client.SetMTU(1400)
+
+	for _, size := range []int{0, 1, 1000, 1400 - client.Overhead()} {
+		for i := 0; i < 10; i++ {
+			_, err := client.Write(make([]byte, size))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Packets are not fragmented
+			packet := gopacket.NewPacket(capturePacket(t, h), layers.LayerTypeLoopback, gopacket.Default)
+			ipv4Layer, ok := packet.NetworkLayer().(*layers.IPv4)
+			if !ok {
+				t.Fatalf("size %d: missing IPv4 layer", size)
+			}
+			if ipv4Layer.Flags&layers.IPv4MoreFragments != 0 || ipv4Layer.FragOffset != 0 {
+				t.Fatalf("size %d: packet is fragmented", size)
+			}
+			if ipv4Layer.Length > 1400 {
+				t.Fatalf("size %d: packet in size %d over MTU", size, ipv4Layer.Length)
+			}
+		}
+	}
+}
+
+// newBenchmarkReader returns a server which captures the same data packet from the client over and over.
+func newBenchmarkReader(b *testing.B, size int) *FakeTCPConn {
+	crypt := newTestCrypt(b)
+	h, _ := newPipeHandles()
+
+	client := newTestConn(b, h, testClientAddr, testServerAddr, crypt, config.NewFakeTCPConfig())
+	client.mapClient(testServerAddr.IP, uint16(testServerAddr.Port), crypt)
+	_, err := client.Write(make([]byte, size))
+	if err != nil {
+		b.Fatal(err)
+	}
+	data := capturePacket(b, h)
+	client.Close()
+
+	server := newTestConn(b, newReplayHandle(data), testServerAddr, testClientAddr, crypt, config.NewFakeTCPConfig())
+	server.mapClient(testClientAddr.IP, uint16(testClientAddr.Port), crypt)
+
+	return server
+}
+
+// newBenchmarkWriter returns a client whose packets are discarded.
+func newBenchmarkWriter(tb testing.TB) *FakeTCPConn {
+	crypt := newTestCrypt(tb)
+
+	client := newTestConn(tb, &pipeHandle{done: make(chan struct{})}, testClientAddr, testServerAddr, crypt, config.NewFakeTCPConfig())
+	client.mapClient(testServerAddr.IP, uint16(testServerAddr.Port), crypt)
+
+	return client
+}
+
+func TestFakeTCPConnWriteToAllocs(t *testing.T) {
+	if isRace {
+		t.Skip("pools are not reliable in race detection")
+	}
+
+	client := newBenchmarkWriter(t)
+	defer client.Close()
+
+	// Packets are encrypted and serialized in pooled buffers with layers reused in the connection
+	data := make([]byte, 1024)
+	allocs := testing.AllocsPerRun(100, func() {
+		_, err := client.WriteTo(data, testServerAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+	if allocs > 0 {
+		t.Fatalf("write in %.1f allocs", allocs)
+	}
+}
+
+func BenchmarkFakeTCPConnReadFrom(b *testing.B) {
+	server := newBenchmarkReader(b, 1024)
+	defer server.Close()
+	go server.capture()
+
+	buffer := make([]byte, IPv4MaxSize)
+	b.SetBytes(1024)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, _, err := server.ReadFrom(buffer)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkFakeTCPConnWriteTo(b *testing.B) {
+	client := newBenchmarkWriter(b)
+	defer client.Close()
+
+	data := make([]byte, 1024)
+	b.SetBytes(1024)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := client.WriteTo(data, testServerAddr)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
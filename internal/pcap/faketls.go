@@ -0,0 +1,282 @@
+package pcap
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Content types of TLS records.
+const (
+	tlsTypeChangeCipherSpec uint8 = 20
+	tlsTypeHandshake        uint8 = 22
+	tlsTypeApplicationData  uint8 = 23
+)
+
+// Types of TLS handshake messages.
+const (
+	tlsHandshakeClientHello uint8 = 1
+	tlsHandshakeServerHello uint8 = 2
+)
+
+// tlsRecordHeaderSize is the size of the header of a TLS record.
+const tlsRecordHeaderSize = 5
+
+// tlsMaxRecordSize is the max size of the protected fragment in a TLS 1.3 record, as described in RFC 8446.
+const tlsMaxRecordSize = 16384 + 256
+
+// tlsFinishedSize is the size of a protected Finished in TLS 1.3 with SHA-256 and a 16 bytes tag.
+const tlsFinishedSize = 4 + 32 + 1 + 16
+
+// tlsCipherSuites is the cipher suites offered in ClientHello, in the order of ordinary browsers.
+var tlsCipherSuites = []uint16{
+	0x1301, 0x1302, 0x1303, 0xc02b, 0xc02f, 0xc02c, 0xc030, 0xcca9, 0xcca8, 0xc013, 0xc014, 0x009c, 0x009d, 0x002f,
+	0x0035,
+}
+
+// tlsSignatureAlgorithms is the signature algorithms offered in ClientHello.
+var tlsSignatureAlgorithms = []uint16{0x0403, 0x0804, 0x0401, 0x0503, 0x0805, 0x0501, 0x0806, 0x0601}
+
+// tlsRecordsSize returns the size of TLS application data records which carry data in the size n.
+func tlsRecordsSize(n int) int {
+	count := (n + tlsMaxRecordSize - 1) / tlsMaxRecordSize
+	if count < 1 {
+		count = 1
+	}
+
+	return n + count*tlsRecordHeaderSize
+}
+
+// frameTLSRecords frames data in the size n at the end of b into TLS application data records in place, b must be in
+// the size of tlsRecordsSize(n).
+func frameTLSRecords(b []byte, n int) {
+	src := len(b) - n
+	dst := 0
+	for {
+		size := n
+		if size > tlsMaxRecordSize {
+			size = tlsMaxRecordSize
+		}
+
+		putTLSRecordHeader(b[dst:], tlsTypeApplicationData, size)
+		copy(b[dst+tlsRecordHeaderSize:], b[src:src+size])
+
+		dst = dst + tlsRecordHeaderSize + size
+		src = src + size
+		n = n - size
+		if n <= 0 {
+			break
+		}
+	}
+}
+
+// parseTLSRecords returns the content type of the first TLS record in b. If it is application data, fragments of all
+// records are joined in place and returned.
+func parseTLSRecords(b []byte) (uint8, []byte, error) {
+	if len(b) < tlsRecordHeaderSize {
+		return 0, nil, errors.New("missing record")
+	}
+
+	t := b[0]
+	if t != tlsTypeApplicationData {
+		return t, nil, nil
+	}
+
+	n := 0
+	for i := 0; i < len(b); {
+		if len(b)-i < tlsRecordHeaderSize {
+			return 0, nil, errors.New("missing record header")
+		}
+		if b[i] != tlsTypeApplicationData {
+			return 0, nil, fmt.Errorf("content type %d mismatch", b[i])
+		}
+		size := int(binary.BigEndian.Uint16(b[i+3:]))
+		if size > len(b)-i-tlsRecordHeaderSize {
+			return 0, nil, fmt.Errorf("record size %d out of range", size)
+		}
+
+		n = n + copy(b[n:], b[i+tlsRecordHeaderSize:i+tlsRecordHeaderSize+size])
+		i = i + tlsRecordHeaderSize + size
+	}
+
+	return t, b[:n], nil
+}
+
+// tlsHandshakeType returns the type of the handshake message in a TLS handshake record, or 0 if it is not.
+func tlsHandshakeType(b []byte) uint8 {
+	if len(b) <= tlsRecordHeaderSize || b[0] != tlsTypeHandshake {
+		return 0
+	}
+
+	return b[tlsRecordHeaderSize]
+}
+
+func putTLSRecordHeader(b []byte, t uint8, size int) {
+	b[0] = t
+	// TLS 1.3 records claim TLS 1.2 for compatibility
+	binary.BigEndian.PutUint16(b[1:], 0x0303)
+	binary.BigEndian.PutUint16(b[3:], uint16(size))
+}
+
+// createTLSRecord returns a TLS record of the type carrying the fragment.
+func createTLSRecord(t uint8, fragment []byte) []byte {
+	b := make([]byte, tlsRecordHeaderSize, tlsRecordHeaderSize+len(fragment))
+	putTLSRecordHeader(b, t, len(fragment))
+
+	return append(b, fragment...)
+}
+
+// createTLSHandshake returns a TLS handshake message of the type.
+func createTLSHandshake(t uint8, body []byte) []byte {
+	b := make([]byte, 4, 4+len(body))
+	b[0] = t
+	b[1] = byte(len(body) >> 16)
+	binary.BigEndian.PutUint16(b[2:], uint16(len(body)))
+
+	return append(b, body...)
+}
+
+// createTLSExtension returns a TLS extension of the type.
+func createTLSExtension(t uint16, data []byte) []byte {
+	b := make([]byte, 4, 4+len(data))
+	binary.BigEndian.PutUint16(b, t)
+	binary.BigEndian.PutUint16(b[2:], uint16(len(data)))
+
+	return append(b, data...)
+}
+
+func prefix8(data []byte) []byte {
+	return append([]byte{byte(len(data))}, data...)
+}
+
+func prefix16(data []byte) []byte {
+	b := make([]byte, 2, 2+len(data))
+	binary.BigEndian.PutUint16(b, uint16(len(data)))
+
+	return append(b, data...)
+}
+
+func uint16s(values []uint16) []byte {
+	b := make([]byte, 2*len(values))
+	for i, v := range values {
+		binary.BigEndian.PutUint16(b[2*i:], v)
+	}
+
+	return b
+}
+
+func randBytes(n int) []byte {
+	b := make([]byte, n)
+	_, _ = rand.Read(b)
+
+	return b
+}
+
+// createTLSClientHello returns a TLS 1.3 ClientHello in a record which looks like one from ordinary browsers. SNI is
+// omitted if the server name is empty.
+func createTLSClientHello(serverName string) []byte {
+	extensions := make([]byte, 0)
+	if serverName != "" {
+		name := append([]byte{0}, prefix16([]byte(serverName))...)
+		extensions = append(extensions, createTLSExtension(0x0000, prefix16(name))...)
+	}
+	// Extended master secret
+	extensions = append(extensions, createTLSExtension(0x0017, nil)...)
+	// Renegotiation info
+	extensions = append(extensions, createTLSExtension(0xff01, []byte{0})...)
+	// Supported groups in x25519, secp256r1 and secp384r1
+	extensions = append(extensions, createTLSExtension(0x000a, prefix16(uint16s([]uint16{0x001d, 0x0017, 0x0018})))...)
+	// EC point formats
+	extensions = append(extensions, createTLSExtension(0x000b, []byte{1, 0})...)
+	// Session ticket
+	extensions = append(extensions, createTLSExtension(0x0023, nil)...)
+	// ALPN
+	protos := make([]byte, 0)
+	for _, proto := range tlsNextProtos {
+		protos = append(protos, prefix8([]byte(proto))...)
+	}
+	extensions = append(extensions, createTLSExtension(0x0010, prefix16(protos))...)
+	// Status request
+	extensions = append(extensions, createTLSExtension(0x0005, []byte{1, 0, 0, 0, 0})...)
+	// Signature algorithms
+	extensions = append(extensions, createTLSExtension(0x000d, prefix16(uint16s(tlsSignatureAlgorithms)))...)
+	// Signed certificate timestamp
+	extensions = append(extensions, createTLSExtension(0x0012, nil)...)
+	// Key share in x25519
+	share := append(uint16s([]uint16{0x001d}), prefix16(randBytes(32))...)
+	extensions = append(extensions, createTLSExtension(0x0033, prefix16(share))...)
+	// PSK key exchange modes
+	extensions = append(extensions, createTLSExtension(0x002d, []byte{1, 1})...)
+	// Supported versions in TLS 1.3 and TLS 1.2
+	extensions = append(extensions, createTLSExtension(0x002b, prefix8(uint16s([]uint16{0x0304, 0x0303})))...)
+
+	body := uint16s([]uint16{0x0303})
+	body = append(body, randBytes(32)...)
+	// Legacy session ID for middlebox compatibility
+	body = append(body, prefix8(randBytes(32))...)
+	body = append(body, prefix16(uint16s(tlsCipherSuites))...)
+	// Null compression
+	body = append(body, 1, 0)
+	body = append(body, prefix16(extensions)...)
+
+	record := createTLSRecord(tlsTypeHandshake, createTLSHandshake(tlsHandshakeClientHello, body))
+	// The first ClientHello claims TLS 1.0 in the record
+	binary.BigEndian.PutUint16(record[1:], 0x0301)
+
+	return record
+}
+
+// createTLSServerFlight returns a TLS 1.3 ServerHello replying the ClientHello, followed by a ChangeCipherSpec and an
+// application data record in the size of protected messages, so the flight fits in a segment in the size.
+func createTLSServerFlight(clientHello []byte, size int) ([]byte, error) {
+	// Legacy session ID is echoed
+	i := tlsRecordHeaderSize + 4 + 2 + 32
+	if len(clientHello) <= i {
+		return nil, errors.New("missing session id")
+	}
+	n := int(clientHello[i])
+	if n > 32 || len(clientHello) < i+1+n {
+		return nil, fmt.Errorf("session id size %d out of range", n)
+	}
+	sessionID := clientHello[i+1 : i+1+n]
+
+	extensions := make([]byte, 0)
+	// Supported versions in TLS 1.3
+	extensions = append(extensions, createTLSExtension(0x002b, uint16s([]uint16{0x0304}))...)
+	// Key share in x25519
+	share := append(uint16s([]uint16{0x001d}), prefix16(randBytes(32))...)
+	extensions = append(extensions, createTLSExtension(0x0033, share)...)
+
+	body := uint16s([]uint16{0x0303})
+	body = append(body, randBytes(32)...)
+	body = append(body, prefix8(sessionID)...)
+	// TLS_AES_128_GCM_SHA256 in null compression
+	body = append(body, 0x13, 0x01, 0)
+	body = append(body, prefix16(extensions)...)
+
+	flight := createTLSRecord(tlsTypeHandshake, createTLSHandshake(tlsHandshakeServerHello, body))
+	flight = append(flight, createTLSRecord(tlsTypeChangeCipherSpec, []byte{1})...)
+
+	// EncryptedExtensions, Certificate, CertificateVerify and Finished are protected, they are in random contents in
+	// at least half of the rest size
+	rest := size - len(flight) - tlsRecordHeaderSize
+	if rest < tlsFinishedSize {
+		return nil, fmt.Errorf("size %d out of range", size)
+	}
+	rest = rest - int(randUint32()%uint32(rest/2+1))
+	if rest > tlsMaxRecordSize {
+		rest = tlsMaxRecordSize
+	}
+	flight = append(flight, createTLSRecord(tlsTypeApplicationData, randBytes(rest))...)
+
+	return flight, nil
+}
+
+// createTLSClientFinished returns a ChangeCipherSpec followed by a protected Finished, which finishes TLS 1.3
+// handshaking of the client.
+func createTLSClientFinished() []byte {
+	b := createTLSRecord(tlsTypeChangeCipherSpec, []byte{1})
+
+	return append(b, createTLSRecord(tlsTypeApplicationData, randBytes(tlsFinishedSize))...)
+}
@@ -0,0 +1,105 @@
+package pcap
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestFrameTLSRecords(t *testing.T) {
+	tests := []struct {
+		name  string
+		n     int
+		count int
+	}{
+		{name: "empty", n: 0, count: 1},
+		{name: "single byte", n: 1, count: 1},
+		{name: "16 KiB", n: 16384, count: 1},
+		{name: "max record", n: tlsMaxRecordSize, count: 1},
+		{name: "over max record", n: tlsMaxRecordSize + 1, count: 2},
+		{name: "several records", n: 2*tlsMaxRecordSize + 7, count: 3},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data := make([]byte, test.n)
+			for i := range data {
+				data[i] = byte(i)
+			}
+
+			size := tlsRecordsSize(test.n)
+			if size != test.n+test.count*tlsRecordHeaderSize {
+				t.Fatalf("records size %d, want %d", size, test.n+test.count*tlsRecordHeaderSize)
+			}
+
+			// Data at the end is framed in place
+			b := make([]byte, size)
+			copy(b[size-test.n:], data)
+			frameTLSRecords(b, test.n)
+
+			count := 0
+			for i := 0; i < len(b); count++ {
+				fragment := int(b[i+3])<<8 | int(b[i+4])
+				if fragment > tlsMaxRecordSize {
+					t.Fatalf("record %d in size %d", count, fragment)
+				}
+				i = i + tlsRecordHeaderSize + fragment
+			}
+			if count != test.count {
+				t.Fatalf("framed in %d records, want %d", count, test.count)
+			}
+
+			typ, contents, err := parseTLSRecords(b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if typ != tlsTypeApplicationData {
+				t.Fatalf("parse content type %d", typ)
+			}
+			if !bytes.Equal(contents, data) {
+				t.Fatalf("parse %d bytes mismatch", len(contents))
+			}
+		})
+	}
+}
+
+func TestParseTLSRecords(t *testing.T) {
+	data := createTLSRecord(tlsTypeApplicationData, []byte{1, 2, 3})
+
+	tests := []struct {
+		name     string
+		b        []byte
+		typ      uint8
+		contents []byte
+		isErr    bool
+	}{
+		{name: "record", b: data, typ: tlsTypeApplicationData, contents: []byte{1, 2, 3}},
+		{name: "records", b: append(append([]byte{}, data...), data...), typ: tlsTypeApplicationData, contents: []byte{1, 2, 3, 1, 2, 3}},
+		{name: "handshake", b: createTLSRecord(tlsTypeHandshake, []byte{tlsHandshakeServerHello}), typ: tlsTypeHandshake},
+		{name: "missing record", b: data[:tlsRecordHeaderSize-1], isErr: true},
+		{name: "missing record header", b: append(append([]byte{}, data...), tlsTypeApplicationData, 3), isErr: true},
+		{name: "truncated record", b: data[:len(data)-1], isErr: true},
+		{name: "content type mismatch", b: append(append([]byte{}, data...), createTLSRecord(tlsTypeHandshake, []byte{1})...), isErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Records are joined in place
+			b := make([]byte, len(test.b))
+			copy(b, test.b)
+
+			typ, contents, err := parseTLSRecords(b)
+			if test.isErr {
+				if err == nil {
+					t.Fatalf("parse %x", test.b)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if typ != test.typ || !bytes.Equal(contents, test.contents) {
+				t.Fatalf("parse content type %d with %x, want %d with %x", typ, contents, test.typ, test.contents)
+			}
+		})
+	}
+}
@@ -0,0 +1,997 @@
+package pcap
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/google/gopacket/layers"
+	"golang.org/x/net/bpf"
+)
+
+// filterConstants are the named constants in BPF filters.
+var filterConstants = map[string]uint32{
+	"icmptype":        0,
+	"icmpcode":        1,
+	"icmp-echoreply":  0,
+	"icmp-unreach":    3,
+	"icmp-echo":       8,
+	"icmp-timxceed":   11,
+	"tcpflags":        13,
+	"tcp-fin":         0x01,
+	"tcp-syn":         0x02,
+	"tcp-rst":         0x04,
+	"tcp-push":        0x08,
+	"tcp-ack":         0x10,
+	"tcp-urg":         0x20,
+	"ip-proto-icmp":   1,
+	"ip-proto-tcp":    6,
+	"ip-proto-udp":    17,
+	"ip-proto-icmpv6": 58,
+}
+
+// filterProtocols are the protocols in transport layer and their IP protocol numbers.
+var filterProtocols = map[string]uint32{
+	"icmp":  1,
+	"tcp":   6,
+	"udp":   17,
+	"icmp6": 58,
+}
+
+type filterNode interface{}
+
+type filterAnd struct {
+	left  filterNode
+	right filterNode
+}
+
+type filterOr struct {
+	left  filterNode
+	right filterNode
+}
+
+type filterNot struct {
+	node filterNode
+}
+
+type filterProto struct {
+	proto string
+}
+
+type filterHost struct {
+	dir string
+	ip  net.IP
+}
+
+type filterPort struct {
+	dir     string
+	port    uint16
+	maxPort uint16
+}
+
+type filterRelation struct {
+	op    string
+	left  filterNode
+	right filterNode
+}
+
+type filterConst uint32
+
+type filterLoad struct {
+	proto string
+	off   uint32
+	size  int
+}
+
+type filterArith struct {
+	op    string
+	left  filterNode
+	right filterNode
+}
+
+// filterOps are arithmetic operators in BPF filters ordered by their precedences.
+var filterOps = [][]string{{"|"}, {"&"}, {"+", "-"}, {"*"}}
+
+func tokenizeFilter(s string) []string {
+	tokens := make([]string, 0)
+	depth := 0
+
+	for i := 0; i < len(s); {
+		ch := s[i]
+
+		switch {
+		case ch == ' ' || ch == '\t' || ch == '\r' || ch == '\n':
+			i++
+		case isFilterWord(ch):
+			j := i + 1
+			for j < len(s) {
+				// Colons in brackets split offsets and sizes, and dashes only appear in names
+				if isFilterWord(s[j]) || (s[j] == ':' && depth == 0) || (s[j] == '-' && isFilterLetter(s[i])) {
+					j++
+					continue
+				}
+				break
+			}
+			tokens = append(tokens, s[i:j])
+			i = j
+		default:
+			if i+1 < len(s) {
+				switch s[i : i+2] {
+				case "&&", "||", "==", "!=", ">=", "<=":
+					tokens = append(tokens, s[i:i+2])
+					i = i + 2
+					continue
+				}
+			}
+
+			switch ch {
+			case '[':
+				depth++
+			case ']':
+				depth--
+			}
+			tokens = append(tokens, s[i:i+1])
+			i++
+		}
+	}
+
+	return tokens
+}
+
+func isFilterLetter(ch byte) bool {
+	return (ch >= 'a' && ch <= 'z') || (ch >= 'A' && ch <= 'Z')
+}
+
+func isFilterWord(ch byte) bool {
+	return isFilterLetter(ch) || (ch >= '0' && ch <= '9') || ch == '_' || ch == '.'
+}
+
+type filterParser struct {
+	tokens []string
+	pos    int
+}
+
+func (p *filterParser) peek() string {
+	if p.pos >= len(p.tokens) {
+		return ""
+	}
+
+	return p.tokens[p.pos]
+}
+
+func (p *filterParser) next() string {
+	token := p.peek()
+	if token != "" {
+		p.pos++
+	}
+
+	return token
+}
+
+func (p *filterParser) expect(token string) error {
+	t := p.next()
+	if t != token {
+		if t == "" {
+			return fmt.Errorf("expect %s but end", token)
+		}
+
+		return fmt.Errorf("expect %s but %s", token, t)
+	}
+
+	return nil
+}
+
+func (p *filterParser) parseOr() (filterNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.peek() == "||" || p.peek() == "or" {
+		p.next()
+
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+
+		left = &filterOr{left: left, right: right}
+	}
+
+	return left, nil
+}
+
+func (p *filterParser) parseAnd() (filterNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.peek() == "&&" || p.peek() == "and" {
+		p.next()
+
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+
+		left = &filterAnd{left: left, right: right}
+	}
+
+	return left, nil
+}
+
+func (p *filterParser) parseUnary() (filterNode, error) {
+	if p.peek() == "!" || p.peek() == "not" {
+		p.next()
+
+		node, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+
+		return &filterNot{node: node}, nil
+	}
+
+	return p.parsePrimary()
+}
+
+func (p *filterParser) parsePrimary() (filterNode, error) {
+	// Relations like (ip[6:2] & 0x1fff) != 0 also start with parentheses
+	pos := p.pos
+	relation, err := p.parseRelation()
+	if err == nil {
+		return relation, nil
+	}
+	p.pos = pos
+
+	if p.peek() == "(" {
+		p.next()
+
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+
+		err = p.expect(")")
+		if err != nil {
+			return nil, err
+		}
+
+		return node, nil
+	}
+
+	return p.parsePrimitive()
+}
+
+func (p *filterParser) parsePrimitive() (filterNode, error) {
+	var dir string
+	if p.peek() == "src" || p.peek() == "dst" {
+		dir = p.next()
+	}
+
+	token := p.next()
+	switch token {
+	case "host":
+		s := p.next()
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid host %s", s)
+		}
+
+		return &filterHost{dir: dir, ip: ip}, nil
+	case "port":
+		s := p.next()
+		port, err := strconv.ParseUint(s, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("parse port %s: %w", s, err)
+		}
+
+		return &filterPort{dir: dir, port: uint16(port), maxPort: uint16(port)}, nil
+	case "portrange":
+		s := p.next()
+		port, err := strconv.ParseUint(s, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("parse port %s: %w", s, err)
+		}
+		err = p.expect("-")
+		if err != nil {
+			return nil, err
+		}
+		s = p.next()
+		maxPort, err := strconv.ParseUint(s, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("parse port %s: %w", s, err)
+		}
+		if maxPort < port {
+			return nil, fmt.Errorf("port range %d-%d out of range", port, maxPort)
+		}
+
+		return &filterPort{dir: dir, port: uint16(port), maxPort: uint16(maxPort)}, nil
+	case "":
+		return nil, errors.New("unexpected end")
+	}
+
+	if dir != "" {
+		return nil, fmt.Errorf("%s %s not support", dir, token)
+	}
+
+	switch token {
+	case "ip", "ip6", "arp", "tcp", "udp", "icmp", "icmp6":
+		return &filterProto{proto: token}, nil
+	default:
+		return nil, fmt.Errorf("primitive %s not support", token)
+	}
+}
+
+func (p *filterParser) parseRelation() (filterNode, error) {
+	left, err := p.parseArith(0)
+	if err != nil {
+		return nil, err
+	}
+
+	op := p.next()
+	switch op {
+	case "=", "==", "!=", ">", "<", ">=", "<=":
+		break
+	default:
+		return nil, fmt.Errorf("relation %s not support", op)
+	}
+
+	right, err := p.parseArith(0)
+	if err != nil {
+		return nil, err
+	}
+
+	return &filterRelation{op: op, left: left, right: right}, nil
+}
+
+func (p *filterParser) parseArith(level int) (filterNode, error) {
+	if level >= len(filterOps) {
+		return p.parseValue()
+	}
+
+	left, err := p.parseArith(level + 1)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		op := p.peek()
+
+		var ok bool
+		for _, o := range filterOps[level] {
+			if op == o {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return left, nil
+		}
+		p.next()
+
+		right, err := p.parseArith(level + 1)
+		if err != nil {
+			return nil, err
+		}
+
+		// Fold constants
+		l, lok := left.(filterConst)
+		r, rok := right.(filterConst)
+		if lok && rok {
+			left = foldFilterConst(op, uint32(l), uint32(r))
+		} else {
+			left = &filterArith{op: op, left: left, right: right}
+		}
+	}
+}
+
+func foldFilterConst(op string, left, right uint32) filterConst {
+	switch op {
+	case "|":
+		return filterConst(left | right)
+	case "&":
+		return filterConst(left & right)
+	case "+":
+		return filterConst(left + right)
+	case "-":
+		return filterConst(left - right)
+	case "*":
+		return filterConst(left * right)
+	default:
+		panic(fmt.Errorf("operator %s not support", op))
+	}
+}
+
+func (p *filterParser) parseValue() (filterNode, error) {
+	token := p.next()
+
+	switch token {
+	case "(":
+		node, err := p.parseArith(0)
+		if err != nil {
+			return nil, err
+		}
+
+		err = p.expect(")")
+		if err != nil {
+			return nil, err
+		}
+
+		return node, nil
+	case "ip", "ip6", "arp", "tcp", "udp", "icmp":
+		err := p.expect("[")
+		if err != nil {
+			return nil, err
+		}
+
+		off, err := p.parseArith(0)
+		if err != nil {
+			return nil, err
+		}
+		c, ok := off.(filterConst)
+		if !ok {
+			return nil, errors.New("variable offset not support")
+		}
+
+		size := 1
+		if p.peek() == ":" {
+			p.next()
+
+			s := p.next()
+			size, err = strconv.Atoi(s)
+			if err != nil {
+				return nil, fmt.Errorf("parse size %s: %w", s, err)
+			}
+			if size != 1 && size != 2 && size != 4 {
+				return nil, fmt.Errorf("size %d out of range", size)
+			}
+		}
+
+		err = p.expect("]")
+		if err != nil {
+			return nil, err
+		}
+
+		return &filterLoad{proto: token, off: uint32(c), size: size}, nil
+	case "":
+		return nil, errors.New("unexpected end")
+	}
+
+	v, ok := filterConstants[token]
+	if ok {
+		return filterConst(v), nil
+	}
+
+	v64, err := strconv.ParseUint(token, 0, 32)
+	if err != nil {
+		return nil, fmt.Errorf("value %s not support", token)
+	}
+
+	return filterConst(v64), nil
+}
+
+// filterInsn is an instruction whose jumps are to labels.
+type filterInsn struct {
+	insn   bpf.Instruction
+	isJump bool
+	isX    bool
+	cond   bpf.JumpTest
+	val    uint32
+	jt     int
+	jf     int
+}
+
+type filterCompiler struct {
+	isRaw   bool
+	linkOff uint32
+	insns   []filterInsn
+	labels  []int
+	scratch int
+}
+
+func (c *filterCompiler) newLabel() int {
+	c.labels = append(c.labels, -1)
+
+	return len(c.labels) - 1
+}
+
+func (c *filterCompiler) mark(label int) {
+	c.labels[label] = len(c.insns)
+}
+
+func (c *filterCompiler) emit(insns ...bpf.Instruction) {
+	for _, insn := range insns {
+		c.insns = append(c.insns, filterInsn{insn: insn})
+	}
+}
+
+func (c *filterCompiler) jump(cond bpf.JumpTest, val uint32, t, f int) {
+	c.insns = append(c.insns, filterInsn{isJump: true, cond: cond, val: val, jt: t, jf: f})
+}
+
+func (c *filterCompiler) jumpX(cond bpf.JumpTest, t, f int) {
+	c.insns = append(c.insns, filterInsn{isJump: true, isX: true, cond: cond, jt: t, jf: f})
+}
+
+func (c *filterCompiler) goTo(label int) {
+	c.insns = append(c.insns, filterInsn{isJump: true, jt: label, jf: -1})
+}
+
+func (c *filterCompiler) compile(node filterNode, t, f int) error {
+	switch n := node.(type) {
+	case *filterAnd:
+		mid := c.newLabel()
+		err := c.compile(n.left, mid, f)
+		if err != nil {
+			return err
+		}
+		c.mark(mid)
+
+		return c.compile(n.right, t, f)
+	case *filterOr:
+		mid := c.newLabel()
+		err := c.compile(n.left, t, mid)
+		if err != nil {
+			return err
+		}
+		c.mark(mid)
+
+		return c.compile(n.right, t, f)
+	case *filterNot:
+		return c.compile(n.node, f, t)
+	case *filterProto:
+		c.compileProto(n.proto, t, f)
+
+		return nil
+	case *filterHost:
+		c.compileHost(n.dir, n.ip, t, f)
+
+		return nil
+	case *filterPort:
+		c.compilePort(n.dir, n.port, n.maxPort, t, f)
+
+		return nil
+	case *filterRelation:
+		return c.compileRelation(n, t, f)
+	default:
+		return fmt.Errorf("type %T not support", n)
+	}
+}
+
+func (c *filterCompiler) compileEtherType(etherType uint16, t, f int) {
+	if !c.isRaw {
+		c.emit(bpf.LoadAbsolute{Off: 12, Size: 2})
+		c.jump(bpf.JumpEqual, uint32(etherType), t, f)
+
+		return
+	}
+
+	// Packets without link layer are distinguished by IP versions
+	switch layers.EthernetType(etherType) {
+	case layers.EthernetTypeIPv4:
+		c.emit(bpf.LoadAbsolute{Off: 0, Size: 1}, bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: 0xf0})
+		c.jump(bpf.JumpEqual, 0x40, t, f)
+	case layers.EthernetTypeIPv6:
+		c.emit(bpf.LoadAbsolute{Off: 0, Size: 1}, bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: 0xf0})
+		c.jump(bpf.JumpEqual, 0x60, t, f)
+	default:
+		c.goTo(f)
+	}
+}
+
+func (c *filterCompiler) compileProto(proto string, t, f int) {
+	switch proto {
+	case "ip":
+		c.compileEtherType(uint16(layers.EthernetTypeIPv4), t, f)
+	case "ip6":
+		c.compileEtherType(uint16(layers.EthernetTypeIPv6), t, f)
+	case "arp":
+		c.compileEtherType(uint16(layers.EthernetTypeARP), t, f)
+	default:
+		n := filterProtocols[proto]
+
+		// ICMPv6 is for IPv6 only
+		if proto == "icmp6" {
+			l := c.newLabel()
+			c.compileEtherType(uint16(layers.EthernetTypeIPv6), l, f)
+			c.mark(l)
+			c.emit(bpf.LoadAbsolute{Off: c.linkOff + 6, Size: 1})
+			c.jump(bpf.JumpEqual, n, t, f)
+			break
+		}
+
+		// IPv4
+		l1, l2 := c.newLabel(), c.newLabel()
+		c.compileEtherType(uint16(layers.EthernetTypeIPv4), l1, l2)
+		c.mark(l1)
+		c.emit(bpf.LoadAbsolute{Off: c.linkOff + 9, Size: 1})
+		c.jump(bpf.JumpEqual, n, t, f)
+
+		// IPv6, ICMP is for IPv4 only
+		c.mark(l2)
+		if proto == "icmp" {
+			c.goTo(f)
+			break
+		}
+		l3 := c.newLabel()
+		c.compileEtherType(uint16(layers.EthernetTypeIPv6), l3, f)
+		c.mark(l3)
+		c.emit(bpf.LoadAbsolute{Off: c.linkOff + 6, Size: 1})
+		c.jump(bpf.JumpEqual, n, t, f)
+	}
+}
+
+func (c *filterCompiler) compileAddr(off uint32, ip net.IP, t, f int) {
+	for i := 0; i < len(ip); i = i + 4 {
+		next := t
+		if i+4 < len(ip) {
+			next = c.newLabel()
+		}
+
+		c.emit(bpf.LoadAbsolute{Off: off + uint32(i), Size: 4})
+		c.jump(bpf.JumpEqual, uint32(ip[i])<<24|uint32(ip[i+1])<<16|uint32(ip[i+2])<<8|uint32(ip[i+3]), next, f)
+
+		if next != t {
+			c.mark(next)
+		}
+	}
+}
+
+func (c *filterCompiler) compileAddrs(dir string, srcOff, dstOff uint32, ip net.IP, t, f int) {
+	switch dir {
+	case "src":
+		c.compileAddr(srcOff, ip, t, f)
+	case "dst":
+		c.compileAddr(dstOff, ip, t, f)
+	default:
+		mid := c.newLabel()
+		c.compileAddr(srcOff, ip, t, mid)
+		c.mark(mid)
+		c.compileAddr(dstOff, ip, t, f)
+	}
+}
+
+func (c *filterCompiler) compileHost(dir string, ip net.IP, t, f int) {
+	if ip.To4() == nil {
+		l := c.newLabel()
+		c.compileEtherType(uint16(layers.EthernetTypeIPv6), l, f)
+		c.mark(l)
+		c.compileAddrs(dir, c.linkOff+8, c.linkOff+24, ip.To16(), t, f)
+
+		return
+	}
+
+	// IPv4
+	l1, l2 := c.newLabel(), c.newLabel()
+	c.compileEtherType(uint16(layers.EthernetTypeIPv4), l1, l2)
+	c.mark(l1)
+	c.compileAddrs(dir, c.linkOff+12, c.linkOff+16, ip.To4(), t, f)
+
+	// ARP
+	c.mark(l2)
+	l3 := c.newLabel()
+	c.compileEtherType(uint16(layers.EthernetTypeARP), l3, f)
+	c.mark(l3)
+	c.compileAddrs(dir, c.linkOff+14, c.linkOff+24, ip.To4(), t, f)
+}
+
+// jumpPort jumps to t if the loaded port is in the range from port to maxPort, otherwise to f.
+func (c *filterCompiler) jumpPort(port, maxPort uint16, t, f int) {
+	if port == maxPort {
+		c.jump(bpf.JumpEqual, uint32(port), t, f)
+
+		return
+	}
+
+	l := c.newLabel()
+	c.jump(bpf.JumpGreaterOrEqual, uint32(port), l, f)
+	c.mark(l)
+	c.jump(bpf.JumpGreaterThan, uint32(maxPort), f, t)
+}
+
+func (c *filterCompiler) compilePorts(dir string, port, maxPort uint16, indirect bool, off uint32, t, f int) {
+	load := func(o uint32) bpf.Instruction {
+		if indirect {
+			return bpf.LoadIndirect{Off: off + o, Size: 2}
+		}
+
+		return bpf.LoadAbsolute{Off: off + o, Size: 2}
+	}
+
+	switch dir {
+	case "src":
+		c.emit(load(0))
+		c.jumpPort(port, maxPort, t, f)
+	case "dst":
+		c.emit(load(2))
+		c.jumpPort(port, maxPort, t, f)
+	default:
+		mid := c.newLabel()
+		c.emit(load(0))
+		c.jumpPort(port, maxPort, t, mid)
+		c.mark(mid)
+		c.emit(load(2))
+		c.jumpPort(port, maxPort, t, f)
+	}
+}
+
+func (c *filterCompiler) compilePort(dir string, port, maxPort uint16, t, f int) {
+	// IPv4, ports are only in the first fragment
+	l1, l2, l3, l4, l5 := c.newLabel(), c.newLabel(), c.newLabel(), c.newLabel(), c.newLabel()
+	c.compileEtherType(uint16(layers.EthernetTypeIPv4), l1, l2)
+	c.mark(l1)
+	c.emit(bpf.LoadAbsolute{Off: c.linkOff + 9, Size: 1})
+	c.jump(bpf.JumpEqual, filterProtocols["tcp"], l3, l4)
+	c.mark(l4)
+	c.jump(bpf.JumpEqual, filterProtocols["udp"], l3, f)
+	c.mark(l3)
+	c.emit(bpf.LoadAbsolute{Off: c.linkOff + 6, Size: 2})
+	c.jump(bpf.JumpBitsSet, 0x1fff, f, l5)
+	c.mark(l5)
+	c.emit(bpf.LoadMemShift{Off: c.linkOff})
+	c.compilePorts(dir, port, maxPort, true, c.linkOff, t, f)
+
+	// IPv6
+	c.mark(l2)
+	l6, l7, l8 := c.newLabel(), c.newLabel(), c.newLabel()
+	c.compileEtherType(uint16(layers.EthernetTypeIPv6), l6, f)
+	c.mark(l6)
+	c.emit(bpf.LoadAbsolute{Off: c.linkOff + 6, Size: 1})
+	c.jump(bpf.JumpEqual, filterProtocols["tcp"], l7, l8)
+	c.mark(l8)
+	c.jump(bpf.JumpEqual, filterProtocols["udp"], l7, f)
+	c.mark(l7)
+	c.compilePorts(dir, port, maxPort, false, c.linkOff+40, t, f)
+}
+
+func (c *filterCompiler) compileAccess(proto string, f int) {
+	l := c.newLabel()
+
+	switch proto {
+	case "ip":
+		c.compileEtherType(uint16(layers.EthernetTypeIPv4), l, f)
+	case "ip6":
+		c.compileEtherType(uint16(layers.EthernetTypeIPv6), l, f)
+	case "arp":
+		c.compileEtherType(uint16(layers.EthernetTypeARP), l, f)
+	default:
+		// Headers in transport layer can only be accessed in the first fragment of IPv4
+		l1, l2 := c.newLabel(), c.newLabel()
+		c.compileEtherType(uint16(layers.EthernetTypeIPv4), l1, f)
+		c.mark(l1)
+		c.emit(bpf.LoadAbsolute{Off: c.linkOff + 9, Size: 1})
+		c.jump(bpf.JumpEqual, filterProtocols[proto], l2, f)
+		c.mark(l2)
+		c.emit(bpf.LoadAbsolute{Off: c.linkOff + 6, Size: 2})
+		c.jump(bpf.JumpBitsSet, 0x1fff, f, l)
+	}
+
+	c.mark(l)
+}
+
+func collectFilterLoads(node filterNode, protos []string) []string {
+	switch n := node.(type) {
+	case *filterLoad:
+		for _, proto := range protos {
+			if proto == n.proto {
+				return protos
+			}
+		}
+
+		return append(protos, n.proto)
+	case *filterArith:
+		return collectFilterLoads(n.right, collectFilterLoads(n.left, protos))
+	default:
+		return protos
+	}
+}
+
+func (c *filterCompiler) compileRelation(relation *filterRelation, t, f int) error {
+	var cond bpf.JumpTest
+	switch relation.op {
+	case "=", "==":
+		cond = bpf.JumpEqual
+	case "!=":
+		cond = bpf.JumpNotEqual
+	case ">":
+		cond = bpf.JumpGreaterThan
+	case "<":
+		cond = bpf.JumpLessThan
+	case ">=":
+		cond = bpf.JumpGreaterOrEqual
+	case "<=":
+		cond = bpf.JumpLessOrEqual
+	default:
+		return fmt.Errorf("relation %s not support", relation.op)
+	}
+
+	// Relations are false if headers accessed are not in the packet
+	protos := collectFilterLoads(relation.right, collectFilterLoads(relation.left, make([]string, 0)))
+	for _, proto := range protos {
+		c.compileAccess(proto, f)
+	}
+
+	right, ok := relation.right.(filterConst)
+	if ok {
+		err := c.compileArith(relation.left)
+		if err != nil {
+			return err
+		}
+		c.jump(cond, uint32(right), t, f)
+
+		return nil
+	}
+
+	err := c.compileArith(relation.right)
+	if err != nil {
+		return err
+	}
+	err = c.store()
+	if err != nil {
+		return err
+	}
+	err = c.compileArith(relation.left)
+	if err != nil {
+		return err
+	}
+	c.load()
+	c.jumpX(cond, t, f)
+
+	return nil
+}
+
+func (c *filterCompiler) store() error {
+	if c.scratch >= 16 {
+		return errors.New("too many scratches")
+	}
+
+	c.emit(bpf.StoreScratch{Src: bpf.RegA, N: c.scratch})
+	c.scratch++
+
+	return nil
+}
+
+func (c *filterCompiler) load() {
+	c.scratch--
+	c.emit(bpf.LoadScratch{Dst: bpf.RegX, N: c.scratch})
+}
+
+func (c *filterCompiler) compileArith(node filterNode) error {
+	switch n := node.(type) {
+	case filterConst:
+		c.emit(bpf.LoadConstant{Dst: bpf.RegA, Val: uint32(n)})
+	case *filterLoad:
+		switch n.proto {
+		case "ip", "ip6", "arp":
+			c.emit(bpf.LoadAbsolute{Off: c.linkOff + n.off, Size: n.size})
+		default:
+			c.emit(bpf.LoadMemShift{Off: c.linkOff}, bpf.LoadIndirect{Off: c.linkOff + n.off, Size: n.size})
+		}
+	case *filterArith:
+		var op bpf.ALUOp
+		switch n.op {
+		case "|":
+			op = bpf.ALUOpOr
+		case "&":
+			op = bpf.ALUOpAnd
+		case "+":
+			op = bpf.ALUOpAdd
+		case "-":
+			op = bpf.ALUOpSub
+		case "*":
+			op = bpf.ALUOpMul
+		default:
+			return fmt.Errorf("operator %s not support", n.op)
+		}
+
+		right, ok := n.right.(filterConst)
+		if ok {
+			err := c.compileArith(n.left)
+			if err != nil {
+				return err
+			}
+			c.emit(bpf.ALUOpConstant{Op: op, Val: uint32(right)})
+
+			return nil
+		}
+
+		err := c.compileArith(n.right)
+		if err != nil {
+			return err
+		}
+		err = c.store()
+		if err != nil {
+			return err
+		}
+		err = c.compileArith(n.left)
+		if err != nil {
+			return err
+		}
+		c.load()
+		c.emit(bpf.ALUOpX{Op: op})
+	default:
+		return fmt.Errorf("type %T not support", n)
+	}
+
+	return nil
+}
+
+func (c *filterCompiler) assemble() ([]bpf.Instruction, error) {
+	insns := make([]bpf.Instruction, 0, len(c.insns))
+
+	for i, insn := range c.insns {
+		if !insn.isJump {
+			insns = append(insns, insn.insn)
+			continue
+		}
+
+		skipTrue := c.labels[insn.jt] - i - 1
+
+		// Unconditional jumps
+		if insn.jf < 0 {
+			insns = append(insns, bpf.Jump{Skip: uint32(skipTrue)})
+			continue
+		}
+
+		skipFalse := c.labels[insn.jf] - i - 1
+		if skipTrue > 255 || skipFalse > 255 {
+			return nil, errors.New("filter too long")
+		}
+
+		if insn.isX {
+			insns = append(insns, bpf.JumpIfX{Cond: insn.cond, SkipTrue: uint8(skipTrue), SkipFalse: uint8(skipFalse)})
+		} else {
+			insns = append(insns, bpf.JumpIf{Cond: insn.cond, Val: insn.val, SkipTrue: uint8(skipTrue), SkipFalse: uint8(skipFalse)})
+		}
+	}
+
+	return insns, nil
+}
+
+// compileFilter compiles a BPF filter into a BPF program for packets in the given link type. Only a subset of the
+// filter syntax of libpcap is supported.
+func compileFilter(filter string, linkType layers.LinkType) ([]bpf.Instruction, error) {
+	c := &filterCompiler{
+		insns:  make([]filterInsn, 0),
+		labels: make([]int, 0),
+	}
+
+	switch linkType {
+	case layers.LinkTypeEthernet:
+		c.linkOff = 14
+	case layers.LinkTypeRaw:
+		c.isRaw = true
+	default:
+		return nil, fmt.Errorf("link type %s not support", linkType)
+	}
+
+	accept, reject := c.newLabel(), c.newLabel()
+
+	if strings.TrimSpace(filter) != "" {
+		p := &filterParser{tokens: tokenizeFilter(filter)}
+
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, fmt.Errorf("parse: %w", err)
+		}
+		if p.peek() != "" {
+			return nil, fmt.Errorf("parse: %w", fmt.Errorf("unexpected %s", p.peek()))
+		}
+
+		err = c.compile(node, accept, reject)
+		if err != nil {
+			return nil, fmt.Errorf("compile: %w", err)
+		}
+	}
+
+	c.mark(accept)
+	c.emit(bpf.RetConstant{Val: maxSnapLen})
+	c.mark(reject)
+	c.emit(bpf.RetConstant{Val: 0})
+
+	return c.assemble()
+}
@@ -0,0 +1,324 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"golang.org/x/net/bpf"
+	"net"
+	"testing"
+)
+
+// filterPacket describes a packet a filter is run against.
+type filterPacket struct {
+	isRaw    bool
+	isARP    bool
+	srcIP    net.IP
+	dstIP    net.IP
+	proto    layers.IPProtocol
+	srcPort  uint16
+	dstPort  uint16
+	isSYN    bool
+	fragment uint16
+	icmpType uint8
+	icmpCode uint8
+	icmpId   uint16
+	arpOp    uint16
+	payload  []byte
+}
+
+func (p *filterPacket) serialize(tb testing.TB) []byte {
+	var (
+		etherType layers.EthernetType
+		network   gopacket.SerializableLayer
+	)
+
+	switch {
+	case p.isARP:
+		op := p.arpOp
+		if op == 0 {
+			op = layers.ARPRequest
+		}
+
+		etherType = layers.EthernetTypeARP
+		network = &layers.ARP{
+			AddrType:          layers.LinkTypeEthernet,
+			Protocol:          layers.EthernetTypeIPv4,
+			HwAddressSize:     6,
+			ProtAddressSize:   4,
+			Operation:         op,
+			SourceHwAddress:   make([]byte, 6),
+			SourceProtAddress: p.srcIP.To4(),
+			DstHwAddress:      make([]byte, 6),
+			DstProtAddress:    p.dstIP.To4(),
+		}
+	case p.srcIP.To4() != nil:
+		etherType = layers.EthernetTypeIPv4
+		network = &layers.IPv4{
+			Version:    4,
+			TTL:        64,
+			Protocol:   p.proto,
+			FragOffset: p.fragment,
+			SrcIP:      p.srcIP,
+			DstIP:      p.dstIP,
+		}
+	default:
+		etherType = layers.EthernetTypeIPv6
+		network = &layers.IPv6{
+			Version:    6,
+			HopLimit:   64,
+			NextHeader: p.proto,
+			SrcIP:      p.srcIP,
+			DstIP:      p.dstIP,
+		}
+	}
+
+	ls := make([]gopacket.SerializableLayer, 0)
+	if !p.isRaw {
+		ls = append(ls, &layers.Ethernet{
+			SrcMAC:       make(net.HardwareAddr, 6),
+			DstMAC:       make(net.HardwareAddr, 6),
+			EthernetType: etherType,
+		})
+	}
+	ls = append(ls, network)
+
+	// Fragment header in IPv6
+	if p.srcIP.To4() == nil && p.fragment != 0 {
+		network.(*layers.IPv6).NextHeader = layers.IPProtocolIPv6Fragment
+
+		header := make([]byte, 8)
+		header[0] = byte(p.proto)
+		binary.BigEndian.PutUint16(header[2:], p.fragment<<3)
+		ls = append(ls, gopacket.Payload(header))
+	}
+
+	switch p.proto {
+	case layers.IPProtocolTCP:
+		ls = append(ls, &layers.TCP{
+			SrcPort: layers.TCPPort(p.srcPort),
+			DstPort: layers.TCPPort(p.dstPort),
+			SYN:     p.isSYN,
+			ACK:     !p.isSYN,
+			Window:  65535,
+		})
+	case layers.IPProtocolUDP:
+		ls = append(ls, &layers.UDP{
+			SrcPort: layers.UDPPort(p.srcPort),
+			DstPort: layers.UDPPort(p.dstPort),
+		})
+	case layers.IPProtocolICMPv4:
+		ls = append(ls, &layers.ICMPv4{
+			TypeCode: layers.CreateICMPv4TypeCode(p.icmpType, p.icmpCode),
+			Id:       p.icmpId,
+		})
+	case layers.IPProtocolICMPv6:
+		ls = append(ls, &layers.ICMPv6{
+			TypeCode: layers.CreateICMPv6TypeCode(p.icmpType, p.icmpCode),
+		})
+	}
+	payload := p.payload
+	if payload == nil {
+		payload = []byte{1, 2, 3}
+	}
+	ls = append(ls, gopacket.Payload(payload))
+
+	buffer := gopacket.NewSerializeBuffer()
+	err := gopacket.SerializeLayers(buffer, gopacket.SerializeOptions{FixLengths: true}, ls...)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	return buffer.Bytes()
+}
+
+func TestCompileFilter(t *testing.T) {
+	var (
+		ip1 = net.IPv4(10, 0, 0, 1)
+		ip2 = net.IPv4(10, 0, 0, 2)
+		ip3 = net.ParseIP("2001:db8::1")
+		ip4 = net.ParseIP("2001:db8::2")
+		ip5 = net.IPv4(10, 0, 0, 3)
+		ip6 = net.ParseIP("2001:db8::3")
+	)
+
+	tcp := &filterPacket{srcIP: ip1, dstIP: ip2, proto: layers.IPProtocolTCP, srcPort: 8080, dstPort: 1500}
+	syn := &filterPacket{srcIP: ip1, dstIP: ip2, proto: layers.IPProtocolTCP, srcPort: 8080, dstPort: 1500, isSYN: true}
+	udp := &filterPacket{srcIP: ip2, dstIP: ip1, proto: layers.IPProtocolUDP, srcPort: 40000, dstPort: 53}
+	fragment := &filterPacket{srcIP: ip1, dstIP: ip2, proto: layers.IPProtocolTCP, srcPort: 8080, dstPort: 1500, fragment: 100}
+	tcp6 := &filterPacket{srcIP: ip3, dstIP: ip4, proto: layers.IPProtocolTCP, srcPort: 8080, dstPort: 1500}
+	udp6 := &filterPacket{srcIP: ip4, dstIP: ip3, proto: layers.IPProtocolUDP, srcPort: 40000, dstPort: 53}
+	arp := &filterPacket{isARP: true, srcIP: ip1, dstIP: ip2}
+	rawTCP := &filterPacket{isRaw: true, srcIP: ip1, dstIP: ip2, proto: layers.IPProtocolTCP, srcPort: 8080, dstPort: 1500}
+	rawTCP6 := &filterPacket{isRaw: true, srcIP: ip3, dstIP: ip4, proto: layers.IPProtocolTCP, srcPort: 8080, dstPort: 1500}
+	fromServer := &filterPacket{srcIP: ip2, dstIP: ip1, proto: layers.IPProtocolTCP, srcPort: 1501, dstPort: 40000}
+	echoRequest := &filterPacket{srcIP: ip1, dstIP: ip2, proto: layers.IPProtocolICMPv4, icmpType: layers.ICMPv4TypeEchoRequest, icmpId: 7}
+	echoReply := &filterPacket{srcIP: ip2, dstIP: ip1, proto: layers.IPProtocolICMPv4, icmpType: layers.ICMPv4TypeEchoReply, icmpId: 7}
+	fragNeeded := &filterPacket{srcIP: ip2, dstIP: ip1, proto: layers.IPProtocolICMPv4, icmpType: layers.ICMPv4TypeDestinationUnreachable, icmpCode: 4}
+	portUnreach := &filterPacket{srcIP: ip2, dstIP: ip1, proto: layers.IPProtocolICMPv4, icmpType: layers.ICMPv4TypeDestinationUnreachable, icmpCode: 3}
+	arpPublish := &filterPacket{isARP: true, srcIP: ip1, dstIP: ip5}
+	arpReply := &filterPacket{isARP: true, arpOp: layers.ARPReply, srcIP: ip1, dstIP: ip5}
+	syn6 := &filterPacket{srcIP: ip3, dstIP: ip4, proto: layers.IPProtocolTCP, srcPort: 8080, dstPort: 1500, isSYN: true}
+	fragment6 := &filterPacket{srcIP: ip3, dstIP: ip4, proto: layers.IPProtocolTCP, srcPort: 8080, dstPort: 1500, fragment: 100}
+	echo6 := &filterPacket{srcIP: ip3, dstIP: ip4, proto: layers.IPProtocolICMPv6, icmpType: layers.ICMPv6TypeEchoRequest}
+	// Neighbor solicitations with the target address behind 4 bytes reserved
+	ns6 := &filterPacket{srcIP: ip4, dstIP: ip6, proto: layers.IPProtocolICMPv6, icmpType: layers.ICMPv6TypeNeighborSolicitation, payload: append(make([]byte, 4), ip6...)}
+	nsOther := &filterPacket{srcIP: ip4, dstIP: ip3, proto: layers.IPProtocolICMPv6, icmpType: layers.ICMPv6TypeNeighborSolicitation, payload: append(make([]byte, 4), ip3...)}
+
+	// Filter of the client listening on sources 10.0.0.1, 10.0.0.2 and 2001:db8::1, with the server 10.0.0.2 in
+	// FakeTCP hopping in ports 1500-1503, publishing 10.0.0.3 and 2001:db8::3
+	sources := "(src host 10.0.0.1) || (src host 10.0.0.2) || (src host 2001:0db8:0000:0000:0000:0000:0000:0001)"
+	clientFilter := "ip && (((tcp || udp) && (" + sources + ") && not ((src host 10.0.0.2) && (src portrange 1500-1503))) || " +
+		"((icmp || (ip[6:2] & 0x1fff) != 0) && (" + sources + ") && not (src host 10.0.0.2))) || " +
+		"(ip6 && (((tcp || udp) && not ((src host 10.0.0.2) && (src portrange 1500-1503))) || (icmp6 && ip6[40] < 130 && not (src host 10.0.0.2))) && (" + sources + ")) || " +
+		"(icmp6 && ip6[40] = 135 && ip6[48:4] = 0x20010db8 && ip6[52:4] = 0x00000000 && ip6[56:4] = 0x00000000 && ip6[60:4] = 0x00000003) || " +
+		"(arp[6:2] = 1 && (dst host 10.0.0.3))"
+	// Filter of the server routing upstream with endpoints in FakeTCP on ports 1500-1503 and in ICMP, over IPv6
+	serverFilter := "ip && (((tcp || udp) && not ((dst portrange 1500-1503))) || (icmp && icmp[icmptype] != icmp-echo) || (ip[6:2] & 0x1fff) != 0) || " +
+		"(ip6 && (((tcp || udp) && not ((dst portrange 1500-1503))) || (icmp6 && ip6[40] < 130)))"
+
+	tests := []struct {
+		name     string
+		filter   string
+		linkType layers.LinkType
+		packet   *filterPacket
+		isAccept bool
+	}{
+		{name: "empty", filter: "", packet: udp, isAccept: true},
+		{name: "tcp", filter: "tcp", packet: tcp, isAccept: true},
+		{name: "tcp in udp", filter: "tcp", packet: udp},
+		{name: "tcp in ipv6", filter: "tcp", packet: tcp6, isAccept: true},
+		{name: "icmp in ipv6", filter: "icmp", packet: tcp6},
+		{name: "not icmp", filter: "not icmp", packet: tcp, isAccept: true},
+		{name: "ip6", filter: "ip6", packet: tcp6, isAccept: true},
+		{name: "ip6 in ipv4", filter: "ip6", packet: tcp},
+		{name: "arp", filter: "arp", packet: arp, isAccept: true},
+		{name: "arp in ipv4", filter: "arp", packet: tcp},
+		{name: "host", filter: "host 10.0.0.1", packet: udp, isAccept: true},
+		{name: "host mismatch", filter: "host 10.0.0.3", packet: udp},
+		{name: "src host", filter: "src host 10.0.0.1", packet: tcp, isAccept: true},
+		{name: "src host in dst", filter: "src host 10.0.0.1", packet: udp},
+		{name: "host in arp", filter: "dst host 10.0.0.2", packet: arp, isAccept: true},
+		{name: "host in ipv6", filter: "host 2001:db8::2", packet: udp6, isAccept: true},
+		{name: "host in ipv6 mismatch", filter: "host 2001:db8::3", packet: udp6},
+		{name: "port", filter: "port 8080", packet: tcp, isAccept: true},
+		{name: "dst port", filter: "udp and dst port 53", packet: udp, isAccept: true},
+		{name: "dst port in src", filter: "dst port 8080", packet: tcp},
+		{name: "port in ipv6", filter: "dst port 53", packet: udp6, isAccept: true},
+		{name: "port in fragment", filter: "port 8080", packet: fragment},
+		{name: "portrange", filter: "dst portrange 1000-2000", packet: tcp, isAccept: true},
+		{name: "portrange mismatch", filter: "dst portrange 1501-2000", packet: tcp},
+		{name: "and", filter: "tcp && src port 8080 && dst host 10.0.0.2", packet: tcp, isAccept: true},
+		{name: "or", filter: "icmp or (udp and port 53)", packet: udp, isAccept: true},
+		{name: "tcp flags", filter: "tcp[tcpflags] & tcp-syn != 0", packet: syn, isAccept: true},
+		{name: "tcp flags mismatch", filter: "tcp[tcpflags] & tcp-syn != 0", packet: tcp},
+		{name: "tcp flags in udp", filter: "tcp[tcpflags] & tcp-syn = 0", packet: udp},
+		{name: "fragment", filter: "(ip[6:2] & 0x1fff) != 0", packet: fragment, isAccept: true},
+		{name: "fragment mismatch", filter: "(ip[6:2] & 0x1fff) != 0", packet: tcp},
+		{name: "load relation", filter: "tcp[2:2] = tcp[0:2] - 6580", packet: tcp, isAccept: true},
+		{name: "raw", filter: "tcp and dst port 1500", linkType: layers.LinkTypeRaw, packet: rawTCP, isAccept: true},
+		{name: "raw ipv6", filter: "ip6 and src port 8080", linkType: layers.LinkTypeRaw, packet: rawTCP6, isAccept: true},
+		{name: "raw arp", filter: "arp", linkType: layers.LinkTypeRaw, packet: rawTCP},
+		{name: "icmp id", filter: "icmp[icmptype] == icmp-echoreply && icmp[4:2] == 7", packet: echoReply, isAccept: true},
+		{name: "icmp id mismatch", filter: "icmp[icmptype] == icmp-echoreply && icmp[4:2] == 8", packet: echoReply},
+		{name: "icmp type mismatch", filter: "icmp[icmptype] == icmp-echoreply && icmp[4:2] == 7", packet: echoRequest},
+		{name: "icmp code", filter: "icmp[icmptype] = icmp-unreach && icmp[icmpcode] = 4", packet: fragNeeded, isAccept: true},
+		{name: "icmp code mismatch", filter: "icmp[icmptype] = icmp-unreach && icmp[icmpcode] = 4", packet: portUnreach},
+		{name: "icmp code in tcp", filter: "icmp[icmpcode] = 4", packet: tcp},
+		{name: "arp request", filter: "arp[6:2] = 1", packet: arp, isAccept: true},
+		{name: "arp reply", filter: "arp[6:2] = 1", packet: arpReply},
+		{name: "icmpv6 type", filter: "ip6[40] < 130", packet: echo6, isAccept: true},
+		{name: "icmpv6 type mismatch", filter: "ip6[40] < 130", packet: ns6},
+		{name: "ipv6 fragment", filter: "ip6[6] = 44", packet: fragment6, isAccept: true},
+		{name: "ipv6 fragment mismatch", filter: "ip6[6] = 44", packet: tcp6},
+		{name: "ipv6 tcp flags", filter: "ip6[53] & tcp-syn != 0", packet: syn6, isAccept: true},
+		{name: "ipv6 tcp flags mismatch", filter: "ip6[53] & tcp-syn != 0", packet: tcp6},
+		{name: "ip or ip6", filter: "(ip || ip6)", packet: tcp, isAccept: true},
+		{name: "ip or ip6 in ipv6", filter: "(ip || ip6)", packet: tcp6, isAccept: true},
+		{name: "ip or ip6 in arp", filter: "(ip || ip6)", packet: arp},
+		{name: "client tcp", filter: clientFilter, packet: tcp, isAccept: true},
+		{name: "client udp from server host", filter: clientFilter, packet: udp, isAccept: true},
+		{name: "client from server port", filter: clientFilter, packet: fromServer},
+		{name: "client icmp", filter: clientFilter, packet: echoRequest, isAccept: true},
+		{name: "client icmp from server", filter: clientFilter, packet: echoReply},
+		{name: "client fragment", filter: clientFilter, packet: fragment, isAccept: true},
+		{name: "client ipv6", filter: clientFilter, packet: tcp6, isAccept: true},
+		{name: "client ipv6 from other", filter: clientFilter, packet: udp6},
+		{name: "client icmpv6", filter: clientFilter, packet: echo6, isAccept: true},
+		{name: "client ndp", filter: clientFilter, packet: ns6, isAccept: true},
+		{name: "client ndp mismatch", filter: clientFilter, packet: nsOther},
+		{name: "client arp", filter: clientFilter, packet: arpPublish, isAccept: true},
+		{name: "client arp reply", filter: clientFilter, packet: arpReply},
+		{name: "client arp mismatch", filter: clientFilter, packet: arp},
+		{name: "server tcp", filter: serverFilter, packet: tcp},
+		{name: "server udp", filter: serverFilter, packet: udp, isAccept: true},
+		{name: "server echo request", filter: serverFilter, packet: echoRequest},
+		{name: "server echo reply", filter: serverFilter, packet: echoReply, isAccept: true},
+		{name: "server fragment", filter: serverFilter, packet: fragment, isAccept: true},
+		{name: "server ipv6 tcp", filter: serverFilter, packet: tcp6},
+		{name: "server ipv6 udp", filter: serverFilter, packet: udp6, isAccept: true},
+		{name: "server icmpv6", filter: serverFilter, packet: echo6, isAccept: true},
+		{name: "server ndp", filter: serverFilter, packet: ns6},
+		{name: "server arp", filter: serverFilter, packet: arp},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			linkType := test.linkType
+			if linkType == 0 {
+				linkType = layers.LinkTypeEthernet
+			}
+
+			insns, err := compileFilter(test.filter, linkType)
+			if err != nil {
+				t.Fatal(err)
+			}
+			vm, err := bpf.NewVM(insns)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			n, err := vm.Run(test.packet.serialize(t))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if isAccept := n > 0; isAccept != test.isAccept {
+				t.Fatalf("filter %q accepts packet: %t", test.filter, isAccept)
+			}
+		})
+	}
+}
+
+func TestCompileFilterError(t *testing.T) {
+	tests := []struct {
+		name     string
+		filter   string
+		linkType layers.LinkType
+	}{
+		{name: "link type", filter: "tcp", linkType: layers.LinkTypeLinuxSLL},
+		{name: "primitive", filter: "foo"},
+		{name: "direction", filter: "src tcp"},
+		{name: "host", filter: "host example.com"},
+		{name: "port", filter: "port 65536"},
+		{name: "portrange", filter: "portrange 2000-1000"},
+		{name: "variable offset", filter: "tcp[tcp[0]] = 0"},
+		{name: "size", filter: "tcp[0:3] = 0"},
+		{name: "parenthesis", filter: "(tcp or udp"},
+		{name: "end", filter: "tcp or"},
+		{name: "trailing", filter: "tcp udp"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			linkType := test.linkType
+			if linkType == 0 {
+				linkType = layers.LinkTypeEthernet
+			}
+
+			_, err := compileFilter(test.filter, linkType)
+			if err == nil {
+				t.Fatalf("compile filter %q", test.filter)
+			}
+		})
+	}
+}
@@ -1,6 +1,7 @@
 package pcap
 
 import (
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"github.com/google/gopacket"
@@ -11,8 +12,11 @@
 	"time"
 )
 
+// ipv6FragmentHeaderLength is the length of the IPv6 fragment header.
+const ipv6FragmentHeaderLength = 8
+
 type fragFlow struct {
-	id  uint16
+	id  uint32
 	src string
 }
 
@@ -75,6 +79,13 @@ func (indicator *fragIndicator) concatenate() (*PacketIndicator, error) {
 		newNetworkLayer = &temp
 
 		FlagIPv4Layer(newNetworkLayer.(*layers.IPv4), false, false, 0)
+	case layers.LayerTypeIPv6:
+		ipv6Layer := indicator.frags[0].IPv6Layer()
+		temp := *ipv6Layer
+		newNetworkLayer = &temp
+
+		// Drop the fragment header
+		newNetworkLayer.(*layers.IPv6).NextHeader = indicator.frags[0].IPv6FragmentLayer().NextHeader
 	default:
 		return nil, fmt.Errorf("network layer type %s not support", t)
 	}
@@ -139,6 +150,11 @@ func NewEasyDefragmenter() *EasyDefragmenter {
 }
 
 func (defrag *EasyDefragmenter) Append(ind *PacketIndicator) (*PacketIndicator, error) {
+	// Most packets are not fragments
+	if !ind.IsFrag() {
+		return ind, nil
+	}
+
 	indicator, _, err := defrag.AppendOriginal(ind)
 
 	return indicator, err
@@ -204,6 +220,9 @@ func (defrag *StrictDefragmenter) Append(ind *PacketIndicator) (*PacketIndicator
 	if !ind.IsFrag() {
 		return ind, nil
 	}
+	if ind.IPv4Layer() == nil {
+		return nil, fmt.Errorf("network layer type %s not support", ind.NetworkLayer().LayerType())
+	}
 
 	// Discard old fragments
 	if defrag.deadline > 0 {
@@ -268,7 +287,11 @@ func CreateFragmentPackets(linkLayer, networkLayer, transportLayer, payload gopa
 
 	// Fragment
 	if len(networkLayerData)+len(networkLayerPayload) > fragment {
-		var newNetworkLayer gopacket.NetworkLayer
+		var (
+			newNetworkLayer gopacket.NetworkLayer
+			headerLength    int
+			fragId          uint32
+		)
 
 		// Create new network layer
 		switch t := networkLayer.LayerType(); t {
@@ -276,6 +299,17 @@ func CreateFragmentPackets(linkLayer, networkLayer, transportLayer, payload gopa
 			newIPv4Layer := networkLayer.(*layers.IPv4)
 			temp := *newIPv4Layer
 			newNetworkLayer = &temp
+
+			headerLength = len(networkLayerData)
+		case layers.LayerTypeIPv6:
+			newIPv6Layer := networkLayer.(*layers.IPv6)
+			temp := *newIPv6Layer
+			temp.NextHeader = layers.IPProtocolIPv6Fragment
+			newNetworkLayer = &temp
+
+			// Every fragment carries a fragment header
+			headerLength = len(networkLayerData) + ipv6FragmentHeaderLength
+			fragId = randUint32()
 		default:
 			return nil, fmt.Errorf("network layer type %s not support", t)
 		}
@@ -286,7 +320,7 @@ func CreateFragmentPackets(linkLayer, networkLayer, transportLayer, payload gopa
 				err  error
 				data []byte
 			)
-			length := min(fragment-len(networkLayerData), len(networkLayerPayload)-i)
+			length := min(fragment-headerLength, len(networkLayerPayload)-i)
 			remain := len(networkLayerPayload) - i - length
 
 			// Align
@@ -301,6 +335,8 @@ func CreateFragmentPackets(linkLayer, networkLayer, transportLayer, payload gopa
 				remain = len(networkLayerPayload) - i - length
 			}
 
+			fragPayload := networkLayerPayload[i : i+length]
+
 			switch t := newNetworkLayer.LayerType(); t {
 			case layers.LayerTypeIPv4:
 				ipv4Layer := newNetworkLayer.(*layers.IPv4)
@@ -310,6 +346,9 @@ func CreateFragmentPackets(linkLayer, networkLayer, transportLayer, payload gopa
 				} else {
 					FlagIPv4Layer(ipv4Layer, false, true, uint16(i/8))
 				}
+			case layers.LayerTypeIPv6:
+				header := createIPv6FragmentHeader(networkLayer.(*layers.IPv6).NextHeader, uint16(i/8), remain > 0, fragId)
+				fragPayload = append(header, fragPayload...)
 			default:
 				return nil, fmt.Errorf("network layer type %s not support", t)
 			}
@@ -317,11 +356,11 @@ func CreateFragmentPackets(linkLayer, networkLayer, transportLayer, payload gopa
 			// Serialize layers
 			if linkLayer == nil {
 				data, err = Serialize(newNetworkLayer.(gopacket.SerializableLayer),
-					gopacket.Payload(networkLayerPayload[i:i+length]))
+					gopacket.Payload(fragPayload))
 			} else {
 				data, err = Serialize(linkLayer.(gopacket.SerializableLayer),
 					newNetworkLayer.(gopacket.SerializableLayer),
-					gopacket.Payload(networkLayerPayload[i:i+length]))
+					gopacket.Payload(fragPayload))
 			}
 			if err != nil {
 				return nil, fmt.Errorf("serialize: %w", err)
@@ -356,6 +395,21 @@ func CreateFragmentPackets(linkLayer, networkLayer, transportLayer, payload gopa
 	return fragments, nil
 }
 
+// createIPv6FragmentHeader creates an IPv6 fragment header, which gopacket cannot serialize. The offset is in 8 bytes.
+func createIPv6FragmentHeader(nextHeader layers.IPProtocol, offset uint16, moreFragments bool, id uint32) []byte {
+	header := make([]byte, ipv6FragmentHeaderLength)
+
+	header[0] = byte(nextHeader)
+	flags := offset << 3
+	if moreFragments {
+		flags = flags | 1
+	}
+	binary.BigEndian.PutUint16(header[2:4], flags)
+	binary.BigEndian.PutUint32(header[4:8], id)
+
+	return header
+}
+
 func min(a, b int) int {
 	if a > b {
 		return b
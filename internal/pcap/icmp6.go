@@ -0,0 +1,311 @@
+package pcap
+
+import (
+	"errors"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"ikago/internal/addr"
+	"net"
+)
+
+// ICMPv6Indicator indicates an ICMPv6 layer.
+type ICMPv6Indicator struct {
+	layer             *layers.ICMPv6
+	echoLayer         *layers.ICMPv6Echo
+	nsLayer           *layers.ICMPv6NeighborSolicitation
+	embIPv6Layer      *layers.IPv6
+	embTransportLayer gopacket.Layer
+	embEchoLayer      *layers.ICMPv6Echo
+}
+
+// ParseICMPv6Layer parses an ICMPv6 layer and returns an ICMPv6 indicator.
+func ParseICMPv6Layer(layer *layers.ICMPv6) (*ICMPv6Indicator, error) {
+	var (
+		echoLayer         *layers.ICMPv6Echo
+		nsLayer           *layers.ICMPv6NeighborSolicitation
+		embIPv6Layer      *layers.IPv6
+		embTransportLayer gopacket.Layer
+		embEchoLayer      *layers.ICMPv6Echo
+	)
+
+	switch t := layer.TypeCode.Type(); t {
+	case layers.ICMPv6TypeEchoRequest,
+		layers.ICMPv6TypeEchoReply:
+		echoLayer = &layers.ICMPv6Echo{}
+		err := echoLayer.DecodeFromBytes(layer.Payload, gopacket.NilDecodeFeedback)
+		if err != nil {
+			return nil, fmt.Errorf("decode echo: %w", err)
+		}
+	case layers.ICMPv6TypeNeighborSolicitation:
+		nsLayer = &layers.ICMPv6NeighborSolicitation{}
+		err := nsLayer.DecodeFromBytes(layer.Payload, gopacket.NilDecodeFeedback)
+		if err != nil {
+			return nil, fmt.Errorf("decode neighbor solicitation: %w", err)
+		}
+	case layers.ICMPv6TypeDestinationUnreachable,
+		layers.ICMPv6TypePacketTooBig,
+		layers.ICMPv6TypeTimeExceeded,
+		layers.ICMPv6TypeParameterProblem:
+		// Parse IPv6 header and as much content as possible behind 4 bytes unused, MTU or pointer
+		if len(layer.Payload) < 4 {
+			return nil, errors.New("missing network layer")
+		}
+		packet := gopacket.NewPacket(layer.Payload[4:], layers.LayerTypeIPv6, gopacket.NoCopy)
+		if len(packet.Layers()) <= 0 {
+			return nil, errors.New("missing network layer")
+		}
+		if len(packet.Layers()) <= 1 {
+			return nil, errors.New("missing transport layer")
+		}
+
+		// Parse network layer
+		networkLayer := packet.Layers()[0]
+		if t := networkLayer.LayerType(); t != layers.LayerTypeIPv6 {
+			return nil, fmt.Errorf("network layer type %s not support", t)
+		}
+
+		embIPv6Layer = networkLayer.(*layers.IPv6)
+		if embIPv6Layer.Version != 6 {
+			return nil, errors.New("network layer type not support")
+		}
+
+		_, err := parseIPProtocol(embIPv6Layer.NextHeader)
+		if err != nil {
+			return nil, err
+		}
+
+		// Parse transport layer
+		embTransportLayer = packet.Layers()[1]
+		switch t := embTransportLayer.LayerType(); t {
+		case layers.LayerTypeTCP, layers.LayerTypeUDP:
+			break
+		case layers.LayerTypeICMPv6:
+			embEchoLayer, _ = packet.Layer(layers.LayerTypeICMPv6Echo).(*layers.ICMPv6Echo)
+		default:
+			return nil, fmt.Errorf("transport layer type %s not support", t)
+		}
+	default:
+		return nil, fmt.Errorf("icmpv6 type %d not support", t)
+	}
+
+	return &ICMPv6Indicator{
+		layer:             layer,
+		echoLayer:         echoLayer,
+		nsLayer:           nsLayer,
+		embIPv6Layer:      embIPv6Layer,
+		embTransportLayer: embTransportLayer,
+		embEchoLayer:      embEchoLayer,
+	}, nil
+}
+
+// NewPureICMPv6Layer returns an new ICMPv6 layer copied from the original ICMPv6 layer without any encapped layers.
+func (indicator *ICMPv6Indicator) NewPureICMPv6Layer() *layers.ICMPv6 {
+	return &layers.ICMPv6{
+		TypeCode: indicator.layer.TypeCode,
+	}
+}
+
+// ICMPv6Layer returns the ICMPv6 layer.
+func (indicator *ICMPv6Indicator) ICMPv6Layer() *layers.ICMPv6 {
+	return indicator.layer
+}
+
+// EchoLayer returns the ICMPv6 echo layer.
+func (indicator *ICMPv6Indicator) EchoLayer() *layers.ICMPv6Echo {
+	return indicator.echoLayer
+}
+
+// NeighborSolicitationLayer returns the neighbor solicitation layer.
+func (indicator *ICMPv6Indicator) NeighborSolicitationLayer() *layers.ICMPv6NeighborSolicitation {
+	return indicator.nsLayer
+}
+
+// IsQuery returns if the ICMPv6 layer is a query.
+func (indicator *ICMPv6Indicator) IsQuery() bool {
+	return indicator.echoLayer != nil
+}
+
+// IsNDP returns if the ICMPv6 layer is a neighbor discovery message.
+func (indicator *ICMPv6Indicator) IsNDP() bool {
+	return indicator.nsLayer != nil
+}
+
+// Id returns the ICMPv6 Id.
+func (indicator *ICMPv6Indicator) Id() uint16 {
+	return indicator.echoLayer.Identifier
+}
+
+// Prefix returns the 4 bytes unused, MTU or pointer in front of the embedded packet.
+func (indicator *ICMPv6Indicator) Prefix() []byte {
+	return indicator.layer.Payload[:4]
+}
+
+// EmbIPv6Layer returns the embedded IPv6 layer.
+func (indicator *ICMPv6Indicator) EmbIPv6Layer() *layers.IPv6 {
+	return indicator.embIPv6Layer
+}
+
+// EmbSrcIP returns the embedded source IP.
+func (indicator *ICMPv6Indicator) EmbSrcIP() net.IP {
+	return indicator.embIPv6Layer.SrcIP
+}
+
+// EmbDstIP returns the embedded destination IP.
+func (indicator *ICMPv6Indicator) EmbDstIP() net.IP {
+	return indicator.embIPv6Layer.DstIP
+}
+
+// EmbTransportProtocol returns the protocol of the transport layer.
+func (indicator *ICMPv6Indicator) EmbTransportProtocol() gopacket.LayerType {
+	p, err := parseIPProtocol(indicator.EmbIPv6Layer().NextHeader)
+	if err != nil {
+		panic(err)
+	}
+
+	return p
+}
+
+// EmbTransportLayer returns the embedded transport layer.
+func (indicator *ICMPv6Indicator) EmbTransportLayer() gopacket.Layer {
+	return indicator.embTransportLayer
+}
+
+// EmbTCPLayer returns the embedded TCP layer.
+func (indicator *ICMPv6Indicator) EmbTCPLayer() *layers.TCP {
+	if indicator.EmbTransportLayer().LayerType() == layers.LayerTypeTCP {
+		return indicator.embTransportLayer.(*layers.TCP)
+	}
+
+	return nil
+}
+
+// EmbUDPLayer returns the embedded UDP layer.
+func (indicator *ICMPv6Indicator) EmbUDPLayer() *layers.UDP {
+	if indicator.EmbTransportLayer().LayerType() == layers.LayerTypeUDP {
+		return indicator.embTransportLayer.(*layers.UDP)
+	}
+
+	return nil
+}
+
+// EmbICMPv6Layer returns the embedded ICMPv6 layer.
+func (indicator *ICMPv6Indicator) EmbICMPv6Layer() *layers.ICMPv6 {
+	if indicator.EmbTransportLayer().LayerType() == layers.LayerTypeICMPv6 {
+		return indicator.embTransportLayer.(*layers.ICMPv6)
+	}
+
+	return nil
+}
+
+// EmbEchoLayer returns the embedded ICMPv6 echo layer.
+func (indicator *ICMPv6Indicator) EmbEchoLayer() *layers.ICMPv6Echo {
+	return indicator.embEchoLayer
+}
+
+// EmbId returns the embedded ICMPv6 Id.
+func (indicator *ICMPv6Indicator) EmbId() uint16 {
+	switch t := indicator.EmbTransportLayer().LayerType(); t {
+	case layers.LayerTypeICMPv6:
+		return indicator.embEchoLayer.Identifier
+	default:
+		panic(fmt.Errorf("transport layer type %s not support", t))
+	}
+}
+
+// EmbSrcPort returns the embedded source port.
+func (indicator *ICMPv6Indicator) EmbSrcPort() uint16 {
+	switch t := indicator.EmbTransportLayer().LayerType(); t {
+	case layers.LayerTypeTCP:
+		return uint16(indicator.EmbTCPLayer().SrcPort)
+	case layers.LayerTypeUDP:
+		return uint16(indicator.EmbUDPLayer().SrcPort)
+	default:
+		panic(fmt.Errorf("transport layer type %s not support", t))
+	}
+}
+
+// EmbDstPort returns the embedded destination port.
+func (indicator *ICMPv6Indicator) EmbDstPort() uint16 {
+	switch t := indicator.EmbTransportLayer().LayerType(); t {
+	case layers.LayerTypeTCP:
+		return uint16(indicator.EmbTCPLayer().DstPort)
+	case layers.LayerTypeUDP:
+		return uint16(indicator.EmbUDPLayer().DstPort)
+	default:
+		panic(fmt.Errorf("transport layer type %s not support", t))
+	}
+}
+
+// IsEmbQuery returns if the embedded ICMPv6 layer is a query.
+func (indicator *ICMPv6Indicator) IsEmbQuery() bool {
+	return indicator.embEchoLayer != nil
+}
+
+// EmbSrc returns the embedded source.
+func (indicator *ICMPv6Indicator) EmbSrc() net.Addr {
+	if indicator.IsQuery() || indicator.IsNDP() {
+		panic(errors.New("icmpv6 query not support"))
+	} else {
+		// Flip source and destination
+		switch t := indicator.EmbTransportLayer().LayerType(); t {
+		case layers.LayerTypeTCP:
+			return &net.TCPAddr{
+				IP:   indicator.EmbDstIP(),
+				Port: int(indicator.EmbDstPort()),
+			}
+		case layers.LayerTypeUDP:
+			return &net.UDPAddr{
+				IP:   indicator.EmbDstIP(),
+				Port: int(indicator.EmbDstPort()),
+			}
+		case layers.LayerTypeICMPv6:
+			if indicator.IsEmbQuery() {
+				return &addr.ICMPQueryAddr{
+					IP: indicator.EmbDstIP(),
+					Id: indicator.EmbId(),
+				}
+			}
+
+			return &net.IPAddr{
+				IP: indicator.EmbDstIP(),
+			}
+		default:
+			panic(fmt.Errorf("transport layer type %s not support", t))
+		}
+	}
+}
+
+// EmbDst returns the embedded destination.
+func (indicator *ICMPv6Indicator) EmbDst() net.Addr {
+	if indicator.IsQuery() || indicator.IsNDP() {
+		panic(errors.New("icmpv6 query not support"))
+	} else {
+		// Flip source and destination
+		switch t := indicator.EmbTransportLayer().LayerType(); t {
+		case layers.LayerTypeTCP:
+			return &net.TCPAddr{
+				IP:   indicator.EmbSrcIP(),
+				Port: int(indicator.EmbSrcPort()),
+			}
+		case layers.LayerTypeUDP:
+			return &net.UDPAddr{
+				IP:   indicator.EmbSrcIP(),
+				Port: int(indicator.EmbSrcPort()),
+			}
+		case layers.LayerTypeICMPv6:
+			if indicator.IsEmbQuery() {
+				return &addr.ICMPQueryAddr{
+					IP: indicator.EmbSrcIP(),
+					Id: indicator.EmbId(),
+				}
+			}
+
+			return &net.IPAddr{
+				IP: indicator.EmbSrcIP(),
+			}
+		default:
+			panic(fmt.Errorf("transport layer type %s not support", t))
+		}
+	}
+}
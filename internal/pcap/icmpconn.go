@@ -0,0 +1,671 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"ikago/internal/addr"
+	"ikago/internal/crypto"
+	"ikago/internal/log"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// icmpMagic is the magic in front of the payload of each echo in the ICMP tunnel.
+const icmpMagic = 0x494b
+
+const (
+	// icmpDirectionUp describes the echo is sent from the client to the server.
+	icmpDirectionUp byte = iota
+	// icmpDirectionDown describes the echo is sent from the server to the client.
+	icmpDirectionDown
+)
+
+// icmpHeaderSize is the size of the magic and the direction in front of the payload of each echo.
+const icmpHeaderSize = 3
+
+// icmpPollInterval is the interval the client checks for echo requests too old to be replied.
+const icmpPollInterval = 100 * time.Millisecond
+
+// icmpPollWindow is the count of empty echo requests the client keeps outstanding for the server to reply with.
+const icmpPollWindow = 16
+
+// icmpSlotTimeout is the max duration the server may still reply to an echo request.
+const icmpSlotTimeout = 10 * time.Second
+
+// icmpPollTimeout is the duration after which the client takes an echo request as never replied, it is shorter than
+// icmpSlotTimeout so the window is refilled before the server drops the request.
+const icmpPollTimeout = icmpSlotTimeout / 2
+
+// icmpQueueSize is the max count of payloads or echo requests queued in an ICMP connection.
+const icmpQueueSize = 1000
+
+type icmpSlot struct {
+	seq    uint16
+	appear time.Time
+}
+
+// ICMPConn is a packet pcap network connection which transmits packets in the payload of ICMPv4 echoes. The client
+// sends packets in echo requests, and the server sends packets in echo replies, so the client polls the server with
+// empty echo requests to keep the return path open.
+type ICMPConn struct {
+	lock          sync.Mutex
+	conn          *RawConn
+	listener      *ICMPListener
+	srcId         uint16
+	dstAddr       *addr.ICMPQueryAddr
+	crypt         crypto.Crypt
+	mtu           int
+	id            uint16
+	seq           uint16
+	queue         chan []byte
+	slots         chan icmpSlot
+	poll          chan struct{}
+	done          chan struct{}
+	once          sync.Once
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+func newICMPConn() *ICMPConn {
+	return &ICMPConn{
+		mtu:   MaxMTU,
+		queue: make(chan []byte, icmpQueueSize),
+		done:  make(chan struct{}),
+	}
+}
+
+// DialICMP connects to the remote address in the ICMP network. srcId is the identifier of echoes.
+func DialICMP(srcDev, dstDev *Device, srcId uint16, dstIP net.IP, crypt crypto.Crypt, mtu int) (*ICMPConn, error) {
+	srcAddr := &addr.ICMPQueryAddr{IP: srcDev.IPAddr().IP, Id: srcId}
+	dstAddr := &addr.ICMPQueryAddr{IP: dstIP, Id: srcId}
+
+	// ICMP is transmitted in IPv4 only
+	if dstIP.To4() == nil {
+		return nil, &net.OpError{
+			Op:     "dial",
+			Net:    "pcap",
+			Source: srcAddr,
+			Addr:   dstAddr,
+			Err:    errors.New("ipv6 not support"),
+		}
+	}
+
+	filter, err := addr.SrcBPFFilter(&net.IPAddr{IP: dstIP})
+	if err != nil {
+		return nil, &net.OpError{
+			Op:     "dial",
+			Net:    "pcap",
+			Source: srcAddr,
+			Addr:   dstAddr,
+			Err:    fmt.Errorf("parse filter %s: %w", dstIP, err),
+		}
+	}
+
+	rawConn, err := CreateRawConn(srcDev, dstDev, fmt.Sprintf("ip && ((icmp && icmp[icmptype] == icmp-echoreply && icmp[4:2] == %d && %s) || ((ip[6:2] & 0x1fff) != 0 && %s))", srcId, filter, filter))
+	if err != nil {
+		return nil, &net.OpError{
+			Op:     "dial",
+			Net:    "pcap",
+			Source: srcAddr,
+			Addr:   dstAddr,
+			Err:    fmt.Errorf("create raw connection: %w", err),
+		}
+	}
+
+	log.Infof("Connect to server %s\n", dstIP)
+
+	conn := newICMPConn()
+	conn.conn = rawConn
+	conn.srcId = srcId
+	conn.dstAddr = dstAddr
+	conn.crypt = crypt
+	conn.mtu = mtu
+	conn.poll = make(chan struct{}, icmpPollWindow)
+
+	go conn.serve()
+	go conn.keepPolling()
+
+	return conn, nil
+}
+
+// serve receives echo replies from the server.
+func (c *ICMPConn) serve() {
+	defrag := NewEasyDefragmenter()
+	defrag.SetDeadline(keepFragments)
+
+	for {
+		packet, err := c.conn.ReadPacket()
+		if err != nil {
+			select {
+			case <-c.done:
+				return
+			default:
+				log.Errorln(fmt.Errorf("read device %s: %w", c.conn.LocalDev().Alias(), err))
+				continue
+			}
+		}
+
+		// Parse packet
+		indicator, err := ParsePacket(packet)
+		if err != nil {
+			log.Verboseln(fmt.Errorf("parse packet: %w", err))
+			continue
+		}
+
+		// Handle fragments
+		indicator, err = defrag.Append(indicator)
+		if err != nil {
+			log.Verboseln(fmt.Errorf("defrag: %w", err))
+			continue
+		}
+		if indicator == nil {
+			continue
+		}
+
+		contents, ok := parseEcho(indicator, layers.ICMPv4TypeEchoReply, icmpDirectionDown)
+		if !ok || indicator.ICMPv4Indicator().Id() != c.srcId {
+			continue
+		}
+
+		// Each reply takes one request out of the window
+		select {
+		case c.poll <- struct{}{}:
+			break
+		default:
+			break
+		}
+
+		c.push(contents)
+	}
+}
+
+// keepPolling keeps a window of empty echo requests outstanding, so the server can reply to several packets in a row.
+// A request is sent again whenever one is replied or too old to be replied.
+func (c *ICMPConn) keepPolling() {
+	ticker := time.NewTicker(icmpPollInterval)
+	defer ticker.Stop()
+
+	// Sent times of outstanding requests in order, the server replies to the oldest first
+	polls := make([]time.Time, 0, icmpPollWindow)
+	for {
+		now := time.Now()
+		for len(polls) > 0 && now.Sub(polls[0]) > icmpPollTimeout {
+			polls = polls[1:]
+		}
+
+		for len(polls) < icmpPollWindow {
+			err := c.writeEcho(layers.ICMPv4TypeEchoRequest, 0, nil)
+			if err != nil {
+				log.Errorln(fmt.Errorf("poll: %w", err))
+				break
+			}
+			polls = append(polls, now)
+		}
+
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			break
+		case <-c.poll:
+			if len(polls) > 0 {
+				polls = polls[1:]
+			}
+		}
+	}
+}
+
+// parseEcho returns the contents of an echo in the ICMP tunnel, and if the packet is such an echo.
+func parseEcho(indicator *PacketIndicator, t uint8, direction byte) ([]byte, bool) {
+	if indicator.TransportLayer() == nil || indicator.TransportLayer().LayerType() != layers.LayerTypeICMPv4 {
+		return nil, false
+	}
+	if indicator.ICMPv4Indicator().ICMPv4Layer().TypeCode.Type() != t {
+		return nil, false
+	}
+
+	// Magic and direction, echoes replied by the system carry the direction of requests and are ignored
+	payload := indicator.ICMPv4Indicator().ICMPv4Layer().Payload
+	if len(payload) < icmpHeaderSize || binary.BigEndian.Uint16(payload) != icmpMagic || payload[2] != direction {
+		return nil, false
+	}
+
+	return payload[icmpHeaderSize:], true
+}
+
+func (c *ICMPConn) push(contents []byte) {
+	// Empty polls
+	if len(contents) <= 0 {
+		return
+	}
+
+	b := make([]byte, len(contents))
+	copy(b, contents)
+
+	// Drop payloads if the connection is too busy
+	select {
+	case c.queue <- b:
+		break
+	default:
+		break
+	}
+}
+
+// Read reads one packet from the connection and returns the decrypted packet.
+func (c *ICMPConn) Read(b []byte) (n int, err error) {
+	var (
+		timeout  <-chan time.Time
+		contents []byte
+	)
+
+	if !c.readDeadline.IsZero() {
+		d := c.readDeadline.Sub(time.Now())
+		if d <= 0 {
+			return 0, &timeoutError{Err: "timeout"}
+		}
+		timeout = time.After(d)
+	}
+
+	select {
+	case contents = <-c.queue:
+		break
+	case <-c.done:
+		return 0, io.EOF
+	case <-timeout:
+		return 0, &timeoutError{Err: "timeout"}
+	}
+
+	// Decrypt in place
+	contents, err = crypto.Open(c.crypt, contents)
+	if err != nil {
+		return 0, &net.OpError{
+			Op:     "read",
+			Net:    "pcap",
+			Source: c.LocalAddr(),
+			Addr:   c.RemoteAddr(),
+			Err:    fmt.Errorf("decrypt: %w", err),
+		}
+	}
+
+	n = copy(b, contents)
+	if n < len(contents) {
+		return n, &net.OpError{
+			Op:     "read",
+			Net:    "pcap",
+			Source: c.LocalAddr(),
+			Addr:   c.RemoteAddr(),
+			Err:    io.ErrShortBuffer,
+		}
+	}
+
+	return n, nil
+}
+
+// Write encrypts b and writes it to the connection in one echo, which may be fragmented.
+func (c *ICMPConn) Write(b []byte) (n int, err error) {
+	// Encrypt, padding never pushes the echo over the MTU
+	room := c.mtu - 20 - 8 - icmpHeaderSize
+	contents, err := crypto.SealSized(c.crypt, nil, b, crypto.Size(c.crypt, len(b), room))
+	if err != nil {
+		return 0, &net.OpError{
+			Op:     "write",
+			Net:    "pcap",
+			Source: c.LocalAddr(),
+			Addr:   c.RemoteAddr(),
+			Err:    fmt.Errorf("encrypt: %w", err),
+		}
+	}
+
+	// The client sends in echo requests freely
+	if c.listener == nil {
+		err = c.writeEcho(layers.ICMPv4TypeEchoRequest, 0, contents)
+	} else {
+		var seq uint16
+
+		seq, err = c.nextSlot()
+		if err == nil {
+			err = c.writeEcho(layers.ICMPv4TypeEchoReply, seq, contents)
+		}
+	}
+	if err != nil {
+		return 0, &net.OpError{
+			Op:     "write",
+			Net:    "pcap",
+			Source: c.LocalAddr(),
+			Addr:   c.RemoteAddr(),
+			Err:    err,
+		}
+	}
+
+	return len(b), nil
+}
+
+// nextSlot waits for an echo request from the client which is not replied yet until the write deadline, and returns
+// its sequence.
+func (c *ICMPConn) nextSlot() (uint16, error) {
+	var timeout <-chan time.Time
+
+	if !c.writeDeadline.IsZero() {
+		d := c.writeDeadline.Sub(time.Now())
+		if d <= 0 {
+			return 0, &timeoutError{Err: "timeout"}
+		}
+		timeout = time.After(d)
+	}
+
+	for {
+		select {
+		case slot := <-c.slots:
+			// The path may be closed if the request is too old
+			if time.Now().Sub(slot.appear) > icmpSlotTimeout {
+				continue
+			}
+
+			return slot.seq, nil
+		case <-c.done:
+			return 0, errors.New("connection closed")
+		case <-timeout:
+			return 0, &timeoutError{Err: "timeout"}
+		}
+	}
+}
+
+func (c *ICMPConn) writeEcho(t uint8, seq uint16, contents []byte) error {
+	var (
+		icmpType  uint8
+		direction byte
+	)
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	// Client sends echo requests in its own sequence
+	if t == layers.ICMPv4TypeEchoRequest {
+		c.seq++
+		seq = c.seq
+		icmpType = layers.ICMPv4TypeEchoRequest
+		direction = icmpDirectionUp
+	} else {
+		icmpType = layers.ICMPv4TypeEchoReply
+		direction = icmpDirectionDown
+	}
+
+	// Payload
+	payload := make([]byte, icmpHeaderSize+len(contents))
+	binary.BigEndian.PutUint16(payload, icmpMagic)
+	payload[2] = direction
+	copy(payload[icmpHeaderSize:], contents)
+
+	// Create layers
+	transportLayer := CreateICMPv4Layer(icmpType, c.dstAddr.Id, seq)
+
+	networkLayer, err := CreateIPv4Layer(c.conn.LocalDev().IPAddr().IP, c.dstAddr.IP, c.id, 64, transportLayer)
+	if err != nil {
+		return fmt.Errorf("create network layer: %w", err)
+	}
+
+	linkLayer, err := createLinkLayer(&packetLayers{}, c.conn, networkLayer, c.conn.RemoteDev().HardwareAddr())
+	if err != nil {
+		return err
+	}
+
+	// Fragment
+	fragments, err := CreateFragmentPackets(linkLayer.(gopacket.Layer), networkLayer, transportLayer, gopacket.Payload(payload), c.mtu)
+	if err != nil {
+		return fmt.Errorf("fragment: %w", err)
+	}
+
+	// Write packet data
+	for _, frag := range fragments {
+		_, err := c.conn.Write(frag)
+		if err != nil {
+			return fmt.Errorf("write: %w", err)
+		}
+	}
+
+	// IPv4 Id
+	c.id++
+
+	return nil
+}
+
+func (c *ICMPConn) Close() error {
+	c.once.Do(func() {
+		close(c.done)
+	})
+
+	// Accepted connections share the handle of the listener
+	if c.listener != nil {
+		c.listener.remove(c)
+
+		return nil
+	}
+
+	err := c.conn.Close()
+	if err != nil {
+		return &net.OpError{
+			Op:   "close",
+			Net:  "pcap",
+			Addr: c.LocalAddr(),
+			Err:  err,
+		}
+	}
+
+	return nil
+}
+
+// LocalDev returns the local device.
+func (c *ICMPConn) LocalDev() *Device {
+	return c.conn.LocalDev()
+}
+
+func (c *ICMPConn) LocalAddr() net.Addr {
+	return &addr.ICMPQueryAddr{IP: c.LocalDev().IPAddr().IP, Id: c.srcId}
+}
+
+// RemoteDev returns the remote device.
+func (c *ICMPConn) RemoteDev() *Device {
+	return c.conn.RemoteDev()
+}
+
+func (c *ICMPConn) RemoteAddr() net.Addr {
+	return c.dstAddr
+}
+
+func (c *ICMPConn) SetDeadline(t time.Time) error {
+	err := c.SetReadDeadline(t)
+	if err != nil {
+		return err
+	}
+
+	return c.SetWriteDeadline(t)
+}
+
+func (c *ICMPConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline = t
+
+	return nil
+}
+
+// SetWriteDeadline sets the deadline for the server to wait for an echo request to reply with, the client writes
+// without waiting.
+func (c *ICMPConn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline = t
+
+	return nil
+}
+
+// ICMPListener is a pcap network listener in the ICMP network, which demultiplexes echo requests into connections by
+// their sources and identifiers.
+type ICMPListener struct {
+	conn        *RawConn
+	mtu         int
+	crypt       crypto.Crypt
+	clientsLock sync.RWMutex
+	clients     map[string]*ICMPConn
+	accept      chan *ICMPConn
+	done        chan struct{}
+	once        sync.Once
+}
+
+// ListenICMP announces on the local network address in the ICMP network.
+func ListenICMP(srcDev, dstDev *Device, crypt crypto.Crypt, mtu int) (*ICMPListener, error) {
+	conn, err := CreateRawConn(srcDev, dstDev, "ip && ((icmp && icmp[icmptype] == icmp-echo) || (ip[6:2] & 0x1fff) != 0)")
+	if err != nil {
+		return nil, &net.OpError{
+			Op:     "listen",
+			Net:    "pcap",
+			Source: &net.IPAddr{IP: srcDev.IPAddr().IP},
+			Err:    fmt.Errorf("create raw connection: %w", err),
+		}
+	}
+
+	listener := &ICMPListener{
+		conn:    conn,
+		mtu:     mtu,
+		crypt:   crypt,
+		clients: make(map[string]*ICMPConn),
+		accept:  make(chan *ICMPConn, icmpQueueSize),
+		done:    make(chan struct{}),
+	}
+
+	go listener.serve()
+
+	return listener, nil
+}
+
+// serve receives echo requests from clients.
+func (l *ICMPListener) serve() {
+	defrag := NewEasyDefragmenter()
+	defrag.SetDeadline(keepFragments)
+
+	for {
+		packet, err := l.conn.ReadPacket()
+		if err != nil {
+			select {
+			case <-l.done:
+				return
+			default:
+				log.Errorln(fmt.Errorf("read device %s: %w", l.Dev().Alias(), err))
+				continue
+			}
+		}
+
+		// Parse packet
+		indicator, err := ParsePacket(packet)
+		if err != nil {
+			log.Verboseln(fmt.Errorf("parse packet: %w", err))
+			continue
+		}
+
+		// Handle fragments
+		indicator, err = defrag.Append(indicator)
+		if err != nil {
+			log.Verboseln(fmt.Errorf("defrag: %w", err))
+			continue
+		}
+		if indicator == nil {
+			continue
+		}
+
+		contents, ok := parseEcho(indicator, layers.ICMPv4TypeEchoRequest, icmpDirectionUp)
+		if !ok {
+			continue
+		}
+		icmpLayer := indicator.ICMPv4Indicator().ICMPv4Layer()
+		dstAddr := &addr.ICMPQueryAddr{IP: indicator.SrcIP(), Id: icmpLayer.Id}
+
+		l.clientsLock.RLock()
+		conn, ok := l.clients[dstAddr.String()]
+		l.clientsLock.RUnlock()
+		if !ok {
+			conn = newICMPConn()
+			conn.conn = l.conn
+			conn.listener = l
+			conn.srcId = icmpLayer.Id
+			conn.dstAddr = dstAddr
+			conn.crypt = l.crypt
+			conn.mtu = l.mtu
+			conn.slots = make(chan icmpSlot, icmpQueueSize)
+
+			l.clientsLock.Lock()
+			l.clients[dstAddr.String()] = conn
+			l.clientsLock.Unlock()
+
+			select {
+			case l.accept <- conn:
+				break
+			default:
+				l.remove(conn)
+				log.Errorf("Cannot accept client %s, too many pending connections\n", dstAddr)
+				continue
+			}
+		}
+
+		// Each echo request can be replied once
+		select {
+		case conn.slots <- icmpSlot{seq: icmpLayer.Seq, appear: time.Now()}:
+			break
+		default:
+			break
+		}
+
+		conn.push(contents)
+	}
+}
+
+func (l *ICMPListener) remove(conn *ICMPConn) {
+	l.clientsLock.Lock()
+	defer l.clientsLock.Unlock()
+
+	if l.clients[conn.dstAddr.String()] == conn {
+		delete(l.clients, conn.dstAddr.String())
+	}
+}
+
+func (l *ICMPListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.accept:
+		return conn, nil
+	case <-l.done:
+		return nil, &net.OpError{
+			Op:   "accept",
+			Net:  "pcap",
+			Addr: l.Addr(),
+			Err:  errors.New("listener closed"),
+		}
+	}
+}
+
+func (l *ICMPListener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+	})
+
+	err := l.conn.Close()
+	if err != nil {
+		return &net.OpError{
+			Op:   "close",
+			Net:  "pcap",
+			Addr: l.Addr(),
+			Err:  err,
+		}
+	}
+
+	return nil
+}
+
+// Dev returns the device.
+func (l *ICMPListener) Dev() *Device {
+	return l.conn.LocalDev()
+}
+
+func (l *ICMPListener) Addr() net.Addr {
+	return &net.IPAddr{IP: l.Dev().IPAddr().IP}
+}
@@ -0,0 +1,128 @@
+package pcap
+
+import (
+	"bytes"
+	"ikago/internal/addr"
+	"net"
+	"testing"
+	"time"
+)
+
+var (
+	testICMPClientIP = net.IPv4(127, 0, 0, 1)
+	testICMPServerIP = net.IPv4(127, 0, 0, 2)
+)
+
+// newTestICMPConn returns a connection from the local IP to the remote IP over the handle, which is accepted by a
+// listener if isServer. Nothing is started in the connection.
+func newTestICMPConn(tb testing.TB, h handle, localIP, remoteIP net.IP, isServer bool) *ICMPConn {
+	dev := newTestDev(localIP)
+
+	conn := newICMPConn()
+	conn.conn = &RawConn{srcDev: dev, dstDev: dev, handle: h}
+	conn.srcId = 1
+	conn.dstAddr = &addr.ICMPQueryAddr{IP: remoteIP, Id: 1}
+	conn.crypt = newTestCrypt(tb)
+	if isServer {
+		conn.listener = &ICMPListener{}
+		conn.slots = make(chan icmpSlot, icmpQueueSize)
+	} else {
+		conn.poll = make(chan struct{}, icmpPollWindow)
+	}
+
+	return conn
+}
+
+func TestICMPConnWriteDeadline(t *testing.T) {
+	tests := []struct {
+		name      string
+		slot      *icmpSlot
+		deadline  time.Duration
+		isTimeout bool
+	}{
+		{name: "slot", slot: &icmpSlot{seq: 1, appear: time.Now()}, deadline: time.Second},
+		{name: "no deadline", slot: &icmpSlot{seq: 1, appear: time.Now()}},
+		{name: "no slot", deadline: 100 * time.Millisecond, isTimeout: true},
+		{name: "expired slot", slot: &icmpSlot{seq: 1, appear: time.Now().Add(-2 * icmpSlotTimeout)}, deadline: 100 * time.Millisecond, isTimeout: true},
+		{name: "passed deadline", slot: &icmpSlot{seq: 1, appear: time.Now()}, deadline: -time.Second, isTimeout: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a, b := newPipeHandles()
+			defer a.Close()
+			defer b.Close()
+
+			conn := newTestICMPConn(t, b, testICMPServerIP, testICMPClientIP, true)
+			defer conn.Close()
+
+			if test.slot != nil {
+				conn.slots <- *test.slot
+			}
+			if test.deadline != 0 {
+				err := conn.SetWriteDeadline(time.Now().Add(test.deadline))
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// The server waits for a request to reply with until the deadline
+			_, err := conn.Write([]byte{1, 2, 3})
+			if test.isTimeout {
+				if err, ok := err.(net.Error); !ok || !err.Timeout() {
+					t.Fatalf("write: %v, want timeout", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			capturePacket(t, b)
+		})
+	}
+}
+
+func TestICMPConnPollWindow(t *testing.T) {
+	a, b := newPipeHandles()
+	defer b.Close()
+
+	client := newTestICMPConn(t, a, testICMPClientIP, testICMPServerIP, false)
+	server := newTestICMPConn(t, b, testICMPServerIP, testICMPClientIP, true)
+	defer client.Close()
+	defer server.Close()
+
+	go client.serve()
+	go client.keepPolling()
+
+	// The window is filled at once, and never overflows
+	for i := 0; i < icmpPollWindow; i++ {
+		capturePacket(t, a)
+	}
+	select {
+	case <-a.out:
+		t.Fatal("poll over the window")
+	case <-time.After(3 * icmpPollInterval):
+		break
+	}
+
+	// A reply takes a request out of the window, which is refilled
+	server.slots <- icmpSlot{seq: 1, appear: time.Now()}
+	_, err := server.Write([]byte{1, 2, 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = client.SetReadDeadline(time.Now().Add(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buffer := make([]byte, MaxMTU)
+	n, err := client.Read(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buffer[:n], []byte{1, 2, 3}) {
+		t.Fatalf("read %d bytes mismatch", n)
+	}
+	capturePacket(t, a)
+}
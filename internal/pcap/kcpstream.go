@@ -0,0 +1,649 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/xtaci/kcp-go"
+	"ikago/internal/config"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// kcpStreamHeaderSize is the size of the header which records the stream of a packet and the count of streams in KCP.
+const kcpStreamHeaderSize = 2
+
+// kcpMaxStreams is the max count of streams the header can record.
+const kcpMaxStreams = 256
+
+// kcpStreamAddr is the address of a stream of a peer, streams of a peer are distinguished by KCP as different peers.
+// The count of streams is decided by the client.
+type kcpStreamAddr struct {
+	net.Addr
+	stream  uint8
+	streams int
+}
+
+func (addr *kcpStreamAddr) String() string {
+	return fmt.Sprintf("%s#%d", addr.Addr, addr.stream)
+}
+
+// flowHash returns a hash of the flow of an IP packet, which is the same in both directions of the flow. Fragments and
+// packets other than TCP and UDP are hashed by addresses and the protocol only, and other contents are hashed as 0.
+func flowHash(b []byte) uint32 {
+	var (
+		src, dst         []byte
+		protocol         byte
+		transport        []byte
+		srcPort, dstPort []byte
+	)
+
+	if len(b) <= 0 {
+		return 0
+	}
+
+	switch b[0] >> 4 {
+	case 4:
+		if len(b) < 20 {
+			return 0
+		}
+		ihl := int(b[0]&0x0f) * 4
+		if ihl < 20 || len(b) < ihl {
+			return 0
+		}
+		src, dst, protocol = b[12:16], b[16:20], b[9]
+		// Not a fragment
+		if binary.BigEndian.Uint16(b[6:])&0x3fff == 0 {
+			transport = b[ihl:]
+		}
+	case 6:
+		if len(b) < 40 {
+			return 0
+		}
+		// Extension headers are not followed, so fragments are never hashed by ports
+		src, dst, protocol = b[8:24], b[24:40], b[6]
+		transport = b[40:]
+	default:
+		return 0
+	}
+
+	if (protocol == 6 || protocol == 17) && len(transport) >= 4 {
+		srcPort, dstPort = transport[0:2], transport[2:4]
+	}
+
+	// Endpoints are hashed separately and combined in an order-independent way
+	return (fnvHash(src, srcPort) ^ fnvHash(dst, dstPort)) + uint32(protocol)
+}
+
+// fnvHash returns the FNV-1a hash of the contents.
+func fnvHash(contents ...[]byte) uint32 {
+	h := uint32(2166136261)
+	for _, content := range contents {
+		for _, b := range content {
+			h = h ^ uint32(b)
+			h = h * 16777619
+		}
+	}
+
+	return h
+}
+
+// kcpStreamPacketConn is a packet connection which records the stream of packets and the count of streams in a header,
+// and returns the address of the stream of the peer in reading.
+type kcpStreamPacketConn struct {
+	net.PacketConn
+}
+
+func (c *kcpStreamPacketConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	n, addr, err = c.PacketConn.ReadFrom(p)
+	if err != nil || n <= 0 {
+		return n, addr, err
+	}
+	if n < kcpStreamHeaderSize {
+		return 0, addr, nil
+	}
+
+	// The count of streams is recorded in minus 1, so 256 streams fit in a byte
+	stream, streams := p[0], int(p[1])+1
+	copy(p, p[kcpStreamHeaderSize:n])
+
+	return n - kcpStreamHeaderSize, &kcpStreamAddr{Addr: addr, stream: stream, streams: streams}, nil
+}
+
+func (c *kcpStreamPacketConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+	streamAddr, ok := addr.(*kcpStreamAddr)
+	if !ok {
+		return 0, &net.OpError{
+			Op:     "write",
+			Net:    "pcap",
+			Source: c.LocalAddr(),
+			Addr:   addr,
+			Err:    fmt.Errorf("type %T not support", addr),
+		}
+	}
+
+	b := GetBuffer()
+	defer PutBuffer(b)
+	if len(b) < kcpStreamHeaderSize+len(p) {
+		b = make([]byte, kcpStreamHeaderSize+len(p))
+	}
+	b[0] = streamAddr.stream
+	b[1] = uint8(streamAddr.streams - 1)
+	copy(b[kcpStreamHeaderSize:], p)
+
+	_, err = c.PacketConn.WriteTo(b[:kcpStreamHeaderSize+len(p)], streamAddr.Addr)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// kcpStreamPacket describes a packet of a stream.
+type kcpStreamPacket struct {
+	bytes []byte
+	addr  net.Addr
+}
+
+// kcpStreamDemux reads packets from a packet connection of streams and delivers them to views of their streams, so
+// KCP sessions of streams in a client can share the connection.
+type kcpStreamDemux struct {
+	conn   *kcpStreamPacketConn
+	queues []chan kcpStreamPacket
+	done   chan struct{}
+	once   sync.Once
+}
+
+func newKCPStreamDemux(conn net.PacketConn, streams int) *kcpStreamDemux {
+	d := &kcpStreamDemux{
+		conn:   &kcpStreamPacketConn{PacketConn: conn},
+		queues: make([]chan kcpStreamPacket, streams),
+		done:   make(chan struct{}),
+	}
+	for i := range d.queues {
+		d.queues[i] = make(chan kcpStreamPacket, 1000)
+	}
+
+	go d.run()
+
+	return d
+}
+
+func (d *kcpStreamDemux) run() {
+	for {
+		b := GetBuffer()
+		n, addr, err := d.conn.ReadFrom(b)
+		if err != nil {
+			PutBuffer(b)
+			select {
+			case <-d.done:
+			default:
+				d.Close()
+			}
+			return
+		}
+		// Packets of handshaking
+		if n <= 0 {
+			PutBuffer(b)
+			continue
+		}
+		stream := addr.(*kcpStreamAddr)
+		if int(stream.stream) >= len(d.queues) {
+			PutBuffer(b)
+			continue
+		}
+
+		select {
+		case d.queues[stream.stream] <- kcpStreamPacket{bytes: b[:n], addr: stream}:
+		default:
+			// The stream is too slow, and the packet is dropped as if it is lost
+			PutBuffer(b)
+		}
+	}
+}
+
+// view returns a packet connection of the stream.
+func (d *kcpStreamDemux) view(stream int) *kcpStreamView {
+	return &kcpStreamView{demux: d, stream: stream}
+}
+
+// Close closes the demultiplexer and the underlying connection.
+func (d *kcpStreamDemux) Close() error {
+	var err error
+
+	d.once.Do(func() {
+		close(d.done)
+		err = d.conn.Close()
+	})
+
+	return err
+}
+
+// kcpStreamView is a packet connection of a stream in a demultiplexer.
+type kcpStreamView struct {
+	demux  *kcpStreamDemux
+	stream int
+}
+
+func (v *kcpStreamView) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	select {
+	case item := <-v.demux.queues[v.stream]:
+		n = copy(p, item.bytes)
+		PutBuffer(item.bytes)
+
+		return n, item.addr, nil
+	case <-v.demux.done:
+		return 0, nil, io.EOF
+	}
+}
+
+func (v *kcpStreamView) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+	return v.demux.conn.WriteTo(p, addr)
+}
+
+// Close does nothing, the underlying connection is closed with the demultiplexer.
+func (v *kcpStreamView) Close() error {
+	return nil
+}
+
+func (v *kcpStreamView) LocalAddr() net.Addr {
+	return v.demux.conn.LocalAddr()
+}
+
+func (v *kcpStreamView) SetDeadline(t time.Time) error {
+	return nil
+}
+
+func (v *kcpStreamView) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (v *kcpStreamView) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// KCPStreamConn is a connection of multiple KCP streams. Packets are spread across streams by their flows, so a lost
+// segment only stalls flows in its stream.
+type KCPStreamConn struct {
+	lock         sync.RWMutex
+	sessions     []*kcp.UDPSession
+	streams      int
+	localAddr    net.Addr
+	remoteAddr   net.Addr
+	queue        chan []byte
+	readDeadline *deadline
+	closer       io.Closer
+	listener     *KCPStreamListener
+	done         chan struct{}
+	once         sync.Once
+}
+
+func newKCPStreamConn(localAddr, remoteAddr net.Addr, streams int) *KCPStreamConn {
+	return &KCPStreamConn{
+		sessions:     make([]*kcp.UDPSession, kcpMaxStreams),
+		streams:      streams,
+		localAddr:    localAddr,
+		remoteAddr:   remoteAddr,
+		queue:        make(chan []byte, 1000),
+		readDeadline: newDeadline(),
+		done:         make(chan struct{}),
+	}
+}
+
+// add adds the session of the stream, the previous session of the stream is closed if exists.
+func (c *KCPStreamConn) add(stream uint8, sess *kcp.UDPSession) {
+	c.lock.Lock()
+	prev := c.sessions[stream]
+	c.sessions[stream] = sess
+	c.lock.Unlock()
+
+	if prev != nil {
+		prev.Close()
+	}
+
+	go c.read(stream, sess)
+}
+
+// remove removes the session of the stream, so packets of the stream fall back to other streams. The connection is
+// closed if no stream is left.
+func (c *KCPStreamConn) remove(stream uint8, sess *kcp.UDPSession) {
+	c.lock.Lock()
+	if c.sessions[stream] == sess {
+		c.sessions[stream] = nil
+	}
+	isEmpty := true
+	for _, sess := range c.sessions {
+		if sess != nil {
+			isEmpty = false
+			break
+		}
+	}
+	c.lock.Unlock()
+
+	sess.Close()
+
+	if isEmpty {
+		c.Close()
+	}
+}
+
+// read reads from the session of the stream until it fails, and removes the session then.
+func (c *KCPStreamConn) read(stream uint8, sess *kcp.UDPSession) {
+	defer c.remove(stream, sess)
+
+	for {
+		b := GetBuffer()
+		n, err := sess.Read(b)
+		if err != nil {
+			PutBuffer(b)
+			return
+		}
+
+		select {
+		case c.queue <- b[:n]:
+		case <-c.done:
+			PutBuffer(b)
+			return
+		}
+	}
+}
+
+// session returns the session of the stream the packet belongs to. The first session is used if the session of the
+// stream is not created by the peer yet.
+func (c *KCPStreamConn) session(b []byte) *kcp.UDPSession {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	sess := c.sessions[flowHash(b)%uint32(c.streams)]
+	if sess != nil {
+		return sess
+	}
+
+	for _, sess := range c.sessions {
+		if sess != nil {
+			return sess
+		}
+	}
+
+	return nil
+}
+
+func (c *KCPStreamConn) isClosed() bool {
+	return isDone(c.done)
+}
+
+func (c *KCPStreamConn) Read(b []byte) (n int, err error) {
+	select {
+	case p := <-c.queue:
+		n = copy(b, p)
+		PutBuffer(p)
+
+		return n, nil
+	case <-c.done:
+		return 0, io.EOF
+	case <-c.readDeadline.wait():
+		return 0, &net.OpError{
+			Op:     "read",
+			Net:    "pcap",
+			Source: c.LocalAddr(),
+			Addr:   c.RemoteAddr(),
+			Err:    &timeoutError{Err: "timeout"},
+		}
+	}
+}
+
+func (c *KCPStreamConn) Write(b []byte) (n int, err error) {
+	if c.isClosed() {
+		return 0, io.ErrClosedPipe
+	}
+
+	sess := c.session(b)
+	if sess == nil {
+		return 0, &net.OpError{
+			Op:     "write",
+			Net:    "pcap",
+			Source: c.LocalAddr(),
+			Addr:   c.RemoteAddr(),
+			Err:    errors.New("missing stream"),
+		}
+	}
+
+	return sess.Write(b)
+}
+
+// Close closes all streams of the connection.
+func (c *KCPStreamConn) Close() error {
+	var err error
+
+	c.once.Do(func() {
+		close(c.done)
+
+		c.lock.RLock()
+		for _, sess := range c.sessions {
+			if sess != nil {
+				sess.Close()
+			}
+		}
+		c.lock.RUnlock()
+
+		if c.listener != nil {
+			c.listener.remove(c)
+		}
+		if c.closer != nil {
+			err = c.closer.Close()
+		}
+	})
+
+	return err
+}
+
+func (c *KCPStreamConn) LocalAddr() net.Addr {
+	return c.localAddr
+}
+
+func (c *KCPStreamConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+func (c *KCPStreamConn) SetDeadline(t time.Time) error {
+	err := c.SetReadDeadline(t)
+	if err != nil {
+		return err
+	}
+
+	return c.SetWriteDeadline(t)
+}
+
+func (c *KCPStreamConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+
+	return nil
+}
+
+func (c *KCPStreamConn) SetWriteDeadline(t time.Time) error {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	for _, sess := range c.sessions {
+		if sess != nil {
+			err := sess.SetWriteDeadline(t)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// KCPStreamListener is a KCP listener which groups streams of a client into a connection.
+type KCPStreamListener struct {
+	listener *kcp.Listener
+	config   *config.KCPConfig
+	lock     sync.Mutex
+	conns    map[string]*KCPStreamConn
+}
+
+// Accept waits for and returns the next client, streams of existing clients are added to their connections in
+// between.
+func (l *KCPStreamListener) Accept() (net.Conn, error) {
+	for {
+		sess, err := l.listener.AcceptKCP()
+		if err != nil {
+			return nil, err
+		}
+
+		addr, ok := sess.RemoteAddr().(*kcpStreamAddr)
+		if !ok {
+			sess.Close()
+			continue
+		}
+
+		err = tuneKCPStream(sess, l.config)
+		if err != nil {
+			sess.Close()
+			return nil, &net.OpError{
+				Op:     "accept",
+				Net:    "pcap",
+				Source: sess.LocalAddr(),
+				Addr:   addr.Addr,
+				Err:    fmt.Errorf("tune: %w", err),
+			}
+		}
+
+		// Streams in the count of the client
+		if int(addr.stream) >= addr.streams {
+			sess.Close()
+			return nil, &net.OpError{
+				Op:     "accept",
+				Net:    "pcap",
+				Source: sess.LocalAddr(),
+				Addr:   addr.Addr,
+				Err:    fmt.Errorf("stream %d out of range %d", addr.stream, addr.streams),
+			}
+		}
+
+		l.lock.Lock()
+		conn, ok := l.conns[addr.Addr.String()]
+		// The client reconnects in another count of streams, and the previous connection is replaced
+		var prev *KCPStreamConn
+		if ok && !conn.isClosed() && conn.streams != addr.streams {
+			prev = conn
+		}
+		isNew := !ok || conn.isClosed() || prev != nil
+		if isNew {
+			conn = newKCPStreamConn(sess.LocalAddr(), addr.Addr, addr.streams)
+			conn.listener = l
+			l.conns[addr.Addr.String()] = conn
+		}
+		l.lock.Unlock()
+
+		if prev != nil {
+			prev.Close()
+		}
+
+		conn.add(addr.stream, sess)
+
+		if isNew {
+			return conn, nil
+		}
+	}
+}
+
+// remove removes the connection from the listener.
+func (l *KCPStreamListener) remove(conn *KCPStreamConn) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.conns[conn.RemoteAddr().String()] == conn {
+		delete(l.conns, conn.RemoteAddr().String())
+	}
+}
+
+func (l *KCPStreamListener) Close() error {
+	return l.listener.Close()
+}
+
+func (l *KCPStreamListener) Addr() net.Addr {
+	return l.listener.Addr()
+}
+
+// tuneKCPStream tunes a KCP session of a stream, which leaves room for the header of streams.
+func tuneKCPStream(sess *kcp.UDPSession, config *config.KCPConfig) error {
+	err := tuneKCP(sess, config)
+	if err != nil {
+		return err
+	}
+
+	ok := sess.SetMtu(config.MTU - kcpStreamHeaderSize)
+	if !ok {
+		return fmt.Errorf("cannot set mtu")
+	}
+
+	return nil
+}
+
+func dialKCPStreams(conn *FakeTCPConn, dstAddr *net.TCPAddr, config *config.KCPConfig) (net.Conn, error) {
+	demux := newKCPStreamDemux(conn, config.Streams)
+
+	c := newKCPStreamConn(conn.LocalAddr(), conn.RemoteAddr(), config.Streams)
+	c.closer = demux
+
+	for i := 0; i < config.Streams; i++ {
+		addr := &kcpStreamAddr{
+			Addr:    &net.UDPAddr{IP: dstAddr.IP, Port: dstAddr.Port},
+			stream:  uint8(i),
+			streams: config.Streams,
+		}
+
+		sess, err := kcp.NewConn2(addr, nil, config.DataShard, config.ParityShard, demux.view(i))
+		if err != nil {
+			c.Close()
+			return nil, &net.OpError{
+				Op:     "dial",
+				Net:    "pcap",
+				Source: conn.LocalAddr(),
+				Addr:   conn.RemoteAddr(),
+				Err:    fmt.Errorf("kcp: %w", err),
+			}
+		}
+
+		// Tuning
+		err = tuneKCPStream(sess, config)
+		if err != nil {
+			sess.Close()
+			c.Close()
+			return nil, &net.OpError{
+				Op:     "dial",
+				Net:    "pcap",
+				Source: conn.LocalAddr(),
+				Addr:   conn.RemoteAddr(),
+				Err:    fmt.Errorf("tune: %w", err),
+			}
+		}
+
+		c.add(uint8(i), sess)
+	}
+
+	return c, nil
+}
+
+func listenKCPStreams(conn *FakeTCPConn, config *config.KCPConfig) (net.Listener, error) {
+	listener, err := kcp.ServeConn(nil, config.DataShard, config.ParityShard, &kcpStreamPacketConn{PacketConn: conn})
+	if err != nil {
+		return nil, &net.OpError{
+			Op:     "listen",
+			Net:    "pcap",
+			Source: conn.LocalAddr(),
+			Err:    fmt.Errorf("kcp: %w", err),
+		}
+	}
+
+	return &KCPStreamListener{
+		listener: listener,
+		config:   config,
+		conns:    make(map[string]*KCPStreamConn),
+	}, nil
+}
@@ -0,0 +1,162 @@
+package pcap
+
+import (
+	"bytes"
+	"github.com/google/gopacket/layers"
+	"github.com/xtaci/kcp-go"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestFlowHash(t *testing.T) {
+	var (
+		ip1 = net.IPv4(10, 0, 0, 1)
+		ip2 = net.IPv4(10, 0, 0, 2)
+		ip3 = net.ParseIP("2001:db8::1")
+		ip4 = net.ParseIP("2001:db8::2")
+	)
+
+	tests := []struct {
+		name   string
+		packet *filterPacket
+		other  *filterPacket
+		isSame bool
+	}{
+		{
+			name:   "tcp",
+			packet: &filterPacket{isRaw: true, srcIP: ip1, dstIP: ip2, proto: layers.IPProtocolTCP, srcPort: 40000, dstPort: 443},
+			other:  &filterPacket{isRaw: true, srcIP: ip1, dstIP: ip2, proto: layers.IPProtocolTCP, srcPort: 40001, dstPort: 443},
+		},
+		{
+			name:   "udp",
+			packet: &filterPacket{isRaw: true, srcIP: ip1, dstIP: ip2, proto: layers.IPProtocolUDP, srcPort: 40000, dstPort: 53},
+			other:  &filterPacket{isRaw: true, srcIP: ip1, dstIP: ip2, proto: layers.IPProtocolTCP, srcPort: 40000, dstPort: 53},
+		},
+		{
+			name:   "ipv6",
+			packet: &filterPacket{isRaw: true, srcIP: ip3, dstIP: ip4, proto: layers.IPProtocolTCP, srcPort: 40000, dstPort: 443},
+			other:  &filterPacket{isRaw: true, srcIP: ip3, dstIP: ip1.To16(), proto: layers.IPProtocolTCP, srcPort: 40000, dstPort: 443},
+		},
+		{
+			name:   "fragment",
+			packet: &filterPacket{isRaw: true, srcIP: ip1, dstIP: ip2, proto: layers.IPProtocolUDP, srcPort: 40000, dstPort: 53, fragment: 100},
+			other:  &filterPacket{isRaw: true, srcIP: ip1, dstIP: ip2, proto: layers.IPProtocolUDP, srcPort: 1, dstPort: 2, fragment: 200},
+			isSame: true,
+		},
+		{
+			name:   "icmp",
+			packet: &filterPacket{isRaw: true, srcIP: ip1, dstIP: ip2, proto: layers.IPProtocolICMPv4},
+			other:  &filterPacket{isRaw: true, srcIP: ip2, dstIP: ip1, proto: layers.IPProtocolICMPv4},
+			isSame: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reverse := *test.packet
+			reverse.srcIP, reverse.dstIP = test.packet.dstIP, test.packet.srcIP
+			reverse.srcPort, reverse.dstPort = test.packet.dstPort, test.packet.srcPort
+
+			// Both directions of a flow are in the same stream
+			h := flowHash(test.packet.serialize(t))
+			if r := flowHash(reverse.serialize(t)); r != h {
+				t.Fatalf("hash %08x in reverse, want %08x", r, h)
+			}
+			if isSame := flowHash(test.other.serialize(t)) == h; isSame != test.isSame {
+				t.Fatalf("hash of other flow is the same: %t", isSame)
+			}
+		})
+	}
+}
+
+func TestKCPStreamPacketConn(t *testing.T) {
+	a, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	b, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	from, to := &kcpStreamPacketConn{PacketConn: a}, &kcpStreamPacketConn{PacketConn: b}
+
+	tests := []struct {
+		stream  uint8
+		streams int
+	}{
+		{stream: 0, streams: 1},
+		{stream: 3, streams: 4},
+		{stream: 255, streams: kcpMaxStreams},
+	}
+
+	buffer := make([]byte, 1500)
+	for _, test := range tests {
+		data := []byte{1, 2, 3}
+
+		_, err := from.WriteTo(data, &kcpStreamAddr{Addr: b.LocalAddr(), stream: test.stream, streams: test.streams})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The stream and the count of streams are carried with the packet
+		n, addr, err := to.ReadFrom(buffer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		streamAddr, ok := addr.(*kcpStreamAddr)
+		if !ok {
+			t.Fatalf("read from %T, want stream address", addr)
+		}
+		if streamAddr.stream != test.stream || streamAddr.streams != test.streams {
+			t.Errorf("read from stream %d of %d, want %d of %d", streamAddr.stream, streamAddr.streams, test.stream, test.streams)
+		}
+		if !bytes.Equal(buffer[:n], data) {
+			t.Errorf("stream %d of %d: read %d bytes mismatch", test.stream, test.streams, n)
+		}
+	}
+}
+
+func TestKCPStreamConnRemove(t *testing.T) {
+	c := newKCPStreamConn(nil, nil, 2)
+	defer c.Close()
+
+	sessions := make([]*kcp.UDPSession, 2)
+	for i := range sessions {
+		sess, err := kcp.DialWithOptions("127.0.0.1:9", nil, 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sessions[i] = sess
+		c.add(uint8(i), sess)
+	}
+
+	// Packets of a failed stream fall back to a live one
+	sessions[1].Close()
+	time.Sleep(10 * time.Millisecond)
+	isFallback := false
+	for i := 0; i < 16; i++ {
+		b := make([]byte, 20)
+		b[0], b[15] = 0x45, byte(i)
+
+		isFallback = isFallback || flowHash(b)%2 == 1
+		if sess := c.session(b); sess != sessions[0] {
+			t.Fatal("packet is assigned to a failed stream")
+		}
+	}
+	if !isFallback {
+		t.Fatal("no packet is in the failed stream")
+	}
+
+	// The connection is closed if all streams fail
+	sessions[0].Close()
+	_ = c.SetReadDeadline(time.Now().Add(time.Second))
+	_, err := c.Read(make([]byte, 1500))
+	if err != io.EOF {
+		t.Fatalf("read after all streams fail: %v, want EOF", err)
+	}
+}
@@ -5,11 +5,20 @@
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 	"net"
+	"runtime"
 )
 
 // CreateTCPLayer returns a TCP layer.
 func CreateTCPLayer(srcPort, dstPort uint16, seq, ack uint32) *layers.TCP {
-	return &layers.TCP{
+	layer := &layers.TCP{}
+	initTCPLayer(layer, srcPort, dstPort, seq, ack)
+
+	return layer
+}
+
+// initTCPLayer initializes a TCP layer in place.
+func initTCPLayer(layer *layers.TCP, srcPort, dstPort uint16, seq, ack uint32) {
+	*layer = layers.TCP{
 		SrcPort:    layers.TCPPort(srcPort),
 		DstPort:    layers.TCPPort(dstPort),
 		Seq:        seq,
@@ -39,9 +48,30 @@ func CreateUDPLayer(srcPort, dstPort uint16) *layers.UDP {
 	}
 }
 
+// CreateICMPv4Layer returns an ICMPv4 layer.
+func CreateICMPv4Layer(t uint8, id, seq uint16) *layers.ICMPv4 {
+	return &layers.ICMPv4{
+		TypeCode: layers.CreateICMPv4TypeCode(t, 0),
+		Id:       id,
+		Seq:      seq,
+		// Checksum: 0,
+	}
+}
+
 // CreateIPv4Layer returns an IPv4 layer.
-func CreateIPv4Layer(srcIP, dstIP net.IP, id uint16, ttl uint8, transportLayer gopacket.TransportLayer) (*layers.IPv4, error) {
-	ipv4Layer := &layers.IPv4{
+func CreateIPv4Layer(srcIP, dstIP net.IP, id uint16, ttl uint8, transportLayer gopacket.Layer) (*layers.IPv4, error) {
+	ipv4Layer := &layers.IPv4{}
+	err := initIPv4Layer(ipv4Layer, srcIP, dstIP, id, ttl, transportLayer)
+	if err != nil {
+		return nil, err
+	}
+
+	return ipv4Layer, nil
+}
+
+// initIPv4Layer initializes an IPv4 layer in place.
+func initIPv4Layer(ipv4Layer *layers.IPv4, srcIP, dstIP net.IP, id uint16, ttl uint8, transportLayer gopacket.Layer) error {
+	*ipv4Layer = layers.IPv4{
 		Version: 4,
 		IHL:     5,
 		// Length: 0,
@@ -62,7 +92,7 @@ func CreateIPv4Layer(srcIP, dstIP net.IP, id uint16, ttl uint8, transportLayer g
 		tcpLayer := transportLayer.(*layers.TCP)
 		err := tcpLayer.SetNetworkLayerForChecksum(ipv4Layer)
 		if err != nil {
-			return nil, fmt.Errorf("set network layer for checksum: %w", err)
+			return fmt.Errorf("set network layer for checksum: %w", err)
 		}
 	case layers.LayerTypeUDP:
 		ipv4Layer.Protocol = layers.IPProtocolUDP
@@ -71,13 +101,73 @@ func CreateIPv4Layer(srcIP, dstIP net.IP, id uint16, ttl uint8, transportLayer g
 		udpLayer := transportLayer.(*layers.UDP)
 		err := udpLayer.SetNetworkLayerForChecksum(ipv4Layer)
 		if err != nil {
-			return nil, fmt.Errorf("set network layer for checksum: %w", err)
+			return fmt.Errorf("set network layer for checksum: %w", err)
 		}
+	case layers.LayerTypeICMPv4:
+		ipv4Layer.Protocol = layers.IPProtocolICMPv4
 	default:
-		return nil, fmt.Errorf("transport layer type %s not support", t)
+		return fmt.Errorf("transport layer type %s not support", t)
 	}
 
-	return ipv4Layer, nil
+	return nil
+}
+
+// CreateIPv6Layer returns an IPv6 layer.
+func CreateIPv6Layer(srcIP, dstIP net.IP, hopLimit uint8, transportLayer gopacket.Layer) (*layers.IPv6, error) {
+	ipv6Layer := &layers.IPv6{}
+	err := initIPv6Layer(ipv6Layer, srcIP, dstIP, hopLimit, transportLayer)
+	if err != nil {
+		return nil, err
+	}
+
+	return ipv6Layer, nil
+}
+
+// initIPv6Layer initializes an IPv6 layer in place.
+func initIPv6Layer(ipv6Layer *layers.IPv6, srcIP, dstIP net.IP, hopLimit uint8, transportLayer gopacket.Layer) error {
+	*ipv6Layer = layers.IPv6{
+		Version: 6,
+		// Length: 0,
+		// NextHeader: 0,
+		HopLimit: hopLimit,
+		SrcIP:    srcIP,
+		DstIP:    dstIP,
+	}
+
+	// Protocol
+	switch t := transportLayer.LayerType(); t {
+	case layers.LayerTypeTCP:
+		ipv6Layer.NextHeader = layers.IPProtocolTCP
+
+		// Checksum of transport layer
+		tcpLayer := transportLayer.(*layers.TCP)
+		err := tcpLayer.SetNetworkLayerForChecksum(ipv6Layer)
+		if err != nil {
+			return fmt.Errorf("set network layer for checksum: %w", err)
+		}
+	case layers.LayerTypeUDP:
+		ipv6Layer.NextHeader = layers.IPProtocolUDP
+
+		// Checksum of transport layer
+		udpLayer := transportLayer.(*layers.UDP)
+		err := udpLayer.SetNetworkLayerForChecksum(ipv6Layer)
+		if err != nil {
+			return fmt.Errorf("set network layer for checksum: %w", err)
+		}
+	case layers.LayerTypeICMPv6:
+		ipv6Layer.NextHeader = layers.IPProtocolICMPv6
+
+		// Checksum of transport layer
+		icmpv6Layer := transportLayer.(*layers.ICMPv6)
+		err := icmpv6Layer.SetNetworkLayerForChecksum(ipv6Layer)
+		if err != nil {
+			return fmt.Errorf("set network layer for checksum: %w", err)
+		}
+	default:
+		return fmt.Errorf("transport layer type %s not support", t)
+	}
+
+	return nil
 }
 
 // FlagIPv4Layer reflags flags in an IPv4 layer.
@@ -98,21 +188,53 @@ func FlagIPv4Layer(layer *layers.IPv4, df, mf bool, offset uint16) {
 // CreateLoopbackLayer returns a loopback layer.
 func CreateLoopbackLayer(networkLayer gopacket.NetworkLayer) (*layers.Loopback, error) {
 	loopbackLayer := &layers.Loopback{}
+	err := initLoopbackLayer(loopbackLayer, networkLayer)
+	if err != nil {
+		return nil, err
+	}
+
+	return loopbackLayer, nil
+}
+
+// initLoopbackLayer initializes a loopback layer in place.
+func initLoopbackLayer(loopbackLayer *layers.Loopback, networkLayer gopacket.NetworkLayer) error {
+	*loopbackLayer = layers.Loopback{}
 
 	// Protocol
 	switch t := networkLayer.LayerType(); t {
 	case layers.LayerTypeIPv4:
 		loopbackLayer.Family = layers.ProtocolFamilyIPv4
+	case layers.LayerTypeIPv6:
+		// The family of IPv6 differs in systems
+		switch runtime.GOOS {
+		case "darwin":
+			loopbackLayer.Family = layers.ProtocolFamilyIPv6Darwin
+		case "freebsd":
+			loopbackLayer.Family = layers.ProtocolFamilyIPv6FreeBSD
+		default:
+			loopbackLayer.Family = layers.ProtocolFamilyIPv6BSD
+		}
 	default:
-		return nil, fmt.Errorf("network layer type %s not support", t)
+		return fmt.Errorf("network layer type %s not support", t)
 	}
 
-	return loopbackLayer, nil
+	return nil
 }
 
 // CreateEthernetLayer returns an Ethernet layer.
 func CreateEthernetLayer(srcMAC, dstMAC net.HardwareAddr, networkLayer gopacket.NetworkLayer) (*layers.Ethernet, error) {
-	ethernetLayer := &layers.Ethernet{
+	ethernetLayer := &layers.Ethernet{}
+	err := initEthernetLayer(ethernetLayer, srcMAC, dstMAC, networkLayer)
+	if err != nil {
+		return nil, err
+	}
+
+	return ethernetLayer, nil
+}
+
+// initEthernetLayer initializes an Ethernet layer in place.
+func initEthernetLayer(ethernetLayer *layers.Ethernet, srcMAC, dstMAC net.HardwareAddr, networkLayer gopacket.NetworkLayer) error {
+	*ethernetLayer = layers.Ethernet{
 		SrcMAC: srcMAC,
 		DstMAC: dstMAC,
 		// EthernetType: 0,
@@ -122,11 +244,13 @@ func CreateEthernetLayer(srcMAC, dstMAC net.HardwareAddr, networkLayer gopacket.
 	switch t := networkLayer.LayerType(); t {
 	case layers.LayerTypeIPv4:
 		ethernetLayer.EthernetType = layers.EthernetTypeIPv4
+	case layers.LayerTypeIPv6:
+		ethernetLayer.EthernetType = layers.EthernetTypeIPv6
 	default:
-		return nil, fmt.Errorf("network layer type %s not support", t)
+		return fmt.Errorf("network layer type %s not support", t)
 	}
 
-	return ethernetLayer, nil
+	return nil
 }
 
 // Serialize serializes layers to byte array.
@@ -143,6 +267,22 @@ func Serialize(layers ...gopacket.SerializableLayer) ([]byte, error) {
 	return buffer.Bytes(), nil
 }
 
+// serializeTo serializes layers in front of the contents already in the buffer, which is usually the payload.
+func serializeTo(buffer gopacket.SerializeBuffer, layers ...gopacket.SerializableLayer) error {
+	// Recalculate checksum and length
+	options := gopacket.SerializeOptions{ComputeChecksums: true, FixLengths: true}
+
+	for i := len(layers) - 1; i >= 0; i-- {
+		err := layers[i].SerializeTo(buffer, options)
+		if err != nil {
+			return err
+		}
+		buffer.PushLayer(layers[i].LayerType())
+	}
+
+	return nil
+}
+
 // SerializeRaw serializes layers to byte array without computing checksums and updating lengths.
 func SerializeRaw(layers ...gopacket.SerializableLayer) ([]byte, error) {
 	// Recalculate checksum and length
@@ -157,22 +297,62 @@ func SerializeRaw(layers ...gopacket.SerializableLayer) ([]byte, error) {
 	return buffer.Bytes(), nil
 }
 
+// packetLayers are layers of transmission between client and server, which are reused in every packet.
+type packetLayers struct {
+	tcp      layers.TCP
+	ipv4     layers.IPv4
+	ipv6     layers.IPv6
+	loopback layers.Loopback
+	ethernet layers.Ethernet
+}
+
 // CreateLayers return layers of transmission between client and server.
-func CreateLayers(srcPort, dstPort uint16, seq, ack uint32, conn *RawConn, dstIP net.IP, id uint16, hop uint8,
+func CreateLayers(srcPort, dstPort uint16, seq, ack uint32, window uint16, conn *RawConn, dstIP net.IP, id uint16, hop uint8,
 	dstHardwareAddr net.HardwareAddr) (transportLayer, networkLayer, linkLayer gopacket.SerializableLayer, err error) {
-	var (
-		linkLayerType gopacket.LayerType
-	)
+	return createLayersIn(&packetLayers{}, srcPort, dstPort, seq, ack, window, conn, dstIP, id, hop, dstHardwareAddr)
+}
 
+// createLayersIn returns layers of transmission between client and server in the packet layers, which overwrites
+// layers returned previously.
+func createLayersIn(l *packetLayers, srcPort, dstPort uint16, seq, ack uint32, window uint16, conn *RawConn, dstIP net.IP,
+	id uint16, hop uint8, dstHardwareAddr net.HardwareAddr) (transportLayer, networkLayer, linkLayer gopacket.SerializableLayer, err error) {
 	// Create transport layer
-	transportLayer = CreateTCPLayer(srcPort, dstPort, seq, ack)
+	initTCPLayer(&l.tcp, srcPort, dstPort, seq, ack)
+	l.tcp.Window = window
+	transportLayer = &l.tcp
 
-	// Create new network layer
-	networkLayer, err = CreateIPv4Layer(conn.LocalDev().IPAddr().IP, dstIP, id, hop-1, transportLayer.(gopacket.TransportLayer))
+	// Create new network layer in the family of the destination
+	srcIP := conn.LocalDev().srcIP(dstIP)
+	if srcIP == nil {
+		return nil, nil, nil, fmt.Errorf("missing address to %s", dstIP)
+	}
+	if dstIP.To4() == nil {
+		err = initIPv6Layer(&l.ipv6, srcIP, dstIP, hop-1, &l.tcp)
+		networkLayer = &l.ipv6
+	} else {
+		err = initIPv4Layer(&l.ipv4, srcIP, dstIP, id, hop-1, &l.tcp)
+		networkLayer = &l.ipv4
+	}
 	if err != nil {
 		return nil, nil, nil, fmt.Errorf("create network layer: %w", err)
 	}
 
+	// Create new link layer
+	linkLayer, err = createLinkLayer(l, conn, networkLayer.(gopacket.NetworkLayer), dstHardwareAddr)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	return transportLayer, networkLayer, linkLayer, nil
+}
+
+func createLinkLayer(l *packetLayers, conn *RawConn, networkLayer gopacket.NetworkLayer, dstHardwareAddr net.HardwareAddr) (gopacket.SerializableLayer, error) {
+	var (
+		err           error
+		linkLayerType gopacket.LayerType
+		linkLayer     gopacket.SerializableLayer
+	)
+
 	// Decide Loopback or Ethernet
 	if conn.IsLoop() {
 		linkLayerType = layers.LayerTypeLoopback
@@ -183,15 +363,17 @@ func CreateLayers(srcPort, dstPort uint16, seq, ack uint32, conn *RawConn, dstIP
 	// Create new link layer
 	switch linkLayerType {
 	case layers.LayerTypeLoopback:
-		linkLayer, err = CreateLoopbackLayer(networkLayer.(gopacket.NetworkLayer))
+		err = initLoopbackLayer(&l.loopback, networkLayer)
+		linkLayer = &l.loopback
 	case layers.LayerTypeEthernet:
-		linkLayer, err = CreateEthernetLayer(conn.LocalDev().HardwareAddr(), dstHardwareAddr, networkLayer.(gopacket.NetworkLayer))
+		err = initEthernetLayer(&l.ethernet, conn.LocalDev().HardwareAddr(), dstHardwareAddr, networkLayer)
+		linkLayer = &l.ethernet
 	default:
-		return nil, nil, nil, fmt.Errorf("link layer type %s not support", linkLayerType)
+		return nil, fmt.Errorf("link layer type %s not support", linkLayerType)
 	}
 	if err != nil {
-		return nil, nil, nil, fmt.Errorf("create link layer: %w", err)
+		return nil, fmt.Errorf("create link layer: %w", err)
 	}
 
-	return transportLayer, networkLayer, linkLayer, nil
+	return linkLayer, nil
 }
@@ -0,0 +1,148 @@
+// +build !linux cgo
+
+package pcap
+
+import (
+	"fmt"
+	"ikago/internal/log"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/pcap"
+)
+
+// isPcapSupported describes if libpcap is available, which requires cgo in Linux.
+const isPcapSupported = true
+
+const flagPcapLoopback = 1
+
+var blacklist map[string]bool
+
+func openPcap(dev, filter string) (handle, error) {
+	h, err := pcap.OpenLive(dev, maxSnapLen, true, pcap.BlockForever)
+	if err != nil {
+		return nil, err
+	}
+
+	err = h.SetBPFFilter(filter)
+	if err != nil {
+		h.Close()
+		return nil, err
+	}
+
+	return h, nil
+}
+
+// matchPcapDevs names devices after the pcap devices they match.
+func matchPcapDevs(t []*Device) ([]*Device, error) {
+	result := make([]*Device, 0)
+	if blacklist == nil {
+		blacklist = make(map[string]bool)
+	}
+
+	// Enumerate pcap devices
+	mid := make([]*Device, 0)
+	devs, err := pcap.FindAllDevs()
+	if err != nil {
+		return nil, fmt.Errorf("find pcap devices: %w", err)
+	}
+	for _, dev := range devs {
+		// Check blacklist
+		_, ok := blacklist[dev.Name]
+		if ok {
+			continue
+		}
+
+		// Match pcap device with interface
+		if dev.Flags&flagPcapLoopback != 0 {
+			d := FindLoopDev(t)
+			if d == nil {
+				continue
+			}
+			if d.name != "" {
+				// return nil, errors.New("too many loopback devices")
+				blacklist[dev.Name] = true
+				blacklist[d.name] = true
+				log.Infof("Device %s is a loopback device but so is %s, these devices will not be used\n", dev.Name, d.name)
+			}
+			d.name = dev.Name
+			mid = append(mid, d)
+		} else {
+			if len(dev.Addresses) <= 0 {
+				continue
+			}
+			for _, a := range dev.Addresses {
+				d := FindDev(t, a.IP)
+				if d == nil {
+					continue
+				}
+				if d.name != "" {
+					// return nil, fmt.Errorf("parse pcap device %s: %w", dev.Name, fmt.Errorf("same address with %s", d.Name))
+					blacklist[dev.Name] = true
+					blacklist[d.name] = true
+					log.Infof("Device %s has the same address with %s, these devices will not be used\n", dev.Name, d.name)
+					break
+				}
+				d.name = dev.Name
+				mid = append(mid, d)
+				break
+			}
+		}
+	}
+
+	// Check blacklist
+	for _, dev := range mid {
+		_, ok := blacklist[dev.name]
+		if !ok {
+			result = append(result, dev)
+		}
+	}
+
+	return result, nil
+}
+
+// Reader is a reader reads packets from a pcap file.
+type Reader struct {
+	handle *pcap.Handle
+	ps     *gopacket.PacketSource
+}
+
+// CreateReader creates a reader reading a pcap file.
+func CreateReader(file string) (*Reader, error) {
+	handle, err := pcap.OpenOffline(file)
+	if err != nil {
+		return nil, err
+	}
+
+	ps := gopacket.NewPacketSource(handle, handle.LinkType())
+
+	return &Reader{
+		handle: handle,
+		ps:     ps,
+	}, nil
+}
+
+func (r *Reader) Read(b []byte) (n int, err error) {
+	packet, err := r.ReadPacket()
+	if err != nil {
+		return 0, err
+	}
+
+	copy(b, packet.Data())
+
+	return len(packet.Data()), nil
+}
+
+func (r *Reader) ReadPacket() (gopacket.Packet, error) {
+	packet, err := r.ps.NextPacket()
+	if err != nil {
+		return nil, err
+	}
+
+	return packet, nil
+}
+
+func (r *Reader) Close() error {
+	r.handle.Close()
+
+	return nil
+}
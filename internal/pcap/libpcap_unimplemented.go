@@ -0,0 +1,16 @@
+// +build linux,!cgo
+
+package pcap
+
+import "errors"
+
+// isPcapSupported describes if libpcap is available, which requires cgo in Linux.
+const isPcapSupported = false
+
+func openPcap(_, _ string) (handle, error) {
+	return nil, errors.New("pcap not support")
+}
+
+func matchPcapDevs(_ []*Device) ([]*Device, error) {
+	return nil, errors.New("pcap not support")
+}
@@ -38,8 +38,10 @@ type PacketIndicator struct {
 	packet           gopacket.Packet
 	linkLayer        gopacket.Layer
 	networkLayer     gopacket.Layer
+	fragLayer        *layers.IPv6Fragment
 	transportLayer   gopacket.Layer
 	icmpv4Indicator  *ICMPv4Indicator
+	icmpv6Indicator  *ICMPv6Indicator
 	applicationLayer gopacket.ApplicationLayer
 	dnsIndicator     *DNSIndicator
 }
@@ -92,6 +94,20 @@ func (indicator *PacketIndicator) IPv4Layer() *layers.IPv4 {
 	return nil
 }
 
+// IPv6Layer returns the IPv6 layer.
+func (indicator *PacketIndicator) IPv6Layer() *layers.IPv6 {
+	if indicator.NetworkLayer().LayerType() == layers.LayerTypeIPv6 {
+		return indicator.networkLayer.(*layers.IPv6)
+	}
+
+	return nil
+}
+
+// IPv6FragmentLayer returns the IPv6 fragment layer.
+func (indicator *PacketIndicator) IPv6FragmentLayer() *layers.IPv6Fragment {
+	return indicator.fragLayer
+}
+
 // ARPLayer returns the ARP layer.
 func (indicator *PacketIndicator) ARPLayer() *layers.ARP {
 	if indicator.NetworkLayer().LayerType() == layers.LayerTypeARP {
@@ -106,6 +122,8 @@ func (indicator *PacketIndicator) SrcIP() net.IP {
 	switch t := indicator.NetworkLayer().LayerType(); t {
 	case layers.LayerTypeIPv4:
 		return indicator.IPv4Layer().SrcIP
+	case layers.LayerTypeIPv6:
+		return indicator.IPv6Layer().SrcIP
 	case layers.LayerTypeARP:
 		return indicator.ARPLayer().SourceProtAddress
 	default:
@@ -118,6 +136,8 @@ func (indicator *PacketIndicator) DstIP() net.IP {
 	switch t := indicator.NetworkLayer().LayerType(); t {
 	case layers.LayerTypeIPv4:
 		return indicator.IPv4Layer().DstIP
+	case layers.LayerTypeIPv6:
+		return indicator.IPv6Layer().DstIP
 	case layers.LayerTypeARP:
 		return indicator.ARPLayer().DstProtAddress
 	default:
@@ -130,16 +150,20 @@ func (indicator *PacketIndicator) TTL() uint8 {
 	switch t := indicator.NetworkLayer().LayerType(); t {
 	case layers.LayerTypeIPv4:
 		return indicator.IPv4Layer().TTL
+	case layers.LayerTypeIPv6:
+		return indicator.IPv6Layer().HopLimit
 	default:
 		panic(fmt.Errorf("network layer type %s not support", t))
 	}
 }
 
 // Id returns the Id in the network layer.
-func (indicator *PacketIndicator) NetworkId() uint16 {
+func (indicator *PacketIndicator) NetworkId() uint32 {
 	switch t := indicator.NetworkLayer().LayerType(); t {
 	case layers.LayerTypeIPv4:
-		return indicator.IPv4Layer().Id
+		return uint32(indicator.IPv4Layer().Id)
+	case layers.LayerTypeIPv6:
+		return indicator.fragLayer.Identification
 	default:
 		panic(fmt.Errorf("network layer type %s not support", t))
 	}
@@ -156,6 +180,8 @@ func (indicator *PacketIndicator) IsFrag() bool {
 		}
 
 		return ipv4Layer.FragOffset != 0
+	case layers.LayerTypeIPv6:
+		return indicator.fragLayer != nil
 	default:
 		panic(fmt.Errorf("network layer type %s not support", t))
 	}
@@ -166,6 +192,8 @@ func (indicator *PacketIndicator) FragOffset() uint16 {
 	switch t := indicator.NetworkLayer().LayerType(); t {
 	case layers.LayerTypeIPv4:
 		return indicator.IPv4Layer().FragOffset
+	case layers.LayerTypeIPv6:
+		return indicator.fragLayer.FragmentOffset
 	default:
 		panic(fmt.Errorf("network layer type %s not support", t))
 	}
@@ -176,6 +204,8 @@ func (indicator *PacketIndicator) MoreFragments() bool {
 	switch t := indicator.NetworkLayer().LayerType(); t {
 	case layers.LayerTypeIPv4:
 		return indicator.IPv4Layer().Flags&layers.IPv4MoreFragments != 0
+	case layers.LayerTypeIPv6:
+		return indicator.fragLayer.MoreFragments
 	default:
 		panic(fmt.Errorf("network layer type %s not support", t))
 	}
@@ -190,6 +220,18 @@ func (indicator *PacketIndicator) TransportProtocol() gopacket.LayerType {
 			panic(err)
 		}
 
+		return p
+	case layers.LayerTypeIPv6:
+		protocol := indicator.IPv6Layer().NextHeader
+		if indicator.fragLayer != nil {
+			protocol = indicator.fragLayer.NextHeader
+		}
+
+		p, err := parseIPProtocol(protocol)
+		if err != nil {
+			panic(err)
+		}
+
 		return p
 	default:
 		panic(fmt.Errorf("network layer type %s not support", t))
@@ -224,6 +266,11 @@ func (indicator *PacketIndicator) ICMPv4Indicator() *ICMPv4Indicator {
 	return indicator.icmpv4Indicator
 }
 
+// ICMPv6Indicator returns the ICMPv6 indicator.
+func (indicator *PacketIndicator) ICMPv6Indicator() *ICMPv6Indicator {
+	return indicator.icmpv6Indicator
+}
+
 // SrcPort returns the source port.
 func (indicator *PacketIndicator) SrcPort() uint16 {
 	switch t := indicator.TransportLayer().LayerType(); t {
@@ -290,26 +337,38 @@ func (indicator *PacketIndicator) IsFIN() bool {
 
 // NATSrc returns the source used in NAT.
 func (indicator *PacketIndicator) NATSrc() net.Addr {
+	// The address may be kept after the packet is released, so it does not share memory with the packet
+	ip := append(net.IP(nil), indicator.SrcIP()...)
+
 	switch t := indicator.TransportLayer().LayerType(); t {
 	case layers.LayerTypeTCP:
 		return &net.TCPAddr{
-			IP:   indicator.SrcIP(),
+			IP:   ip,
 			Port: int(indicator.SrcPort()),
 		}
 	case layers.LayerTypeUDP:
 		return &net.UDPAddr{
-			IP:   indicator.SrcIP(),
+			IP:   ip,
 			Port: int(indicator.SrcPort()),
 		}
 	case layers.LayerTypeICMPv4:
 		if indicator.icmpv4Indicator.IsQuery() {
 			return &addr.ICMPQueryAddr{
-				IP: indicator.SrcIP(),
+				IP: ip,
 				Id: indicator.icmpv4Indicator.Id(),
 			}
 		}
 
 		return indicator.icmpv4Indicator.EmbSrc()
+	case layers.LayerTypeICMPv6:
+		if indicator.icmpv6Indicator.IsQuery() {
+			return &addr.ICMPQueryAddr{
+				IP: ip,
+				Id: indicator.icmpv6Indicator.Id(),
+			}
+		}
+
+		return indicator.icmpv6Indicator.EmbSrc()
 	default:
 		panic(fmt.Errorf("transport layer type %s not support", t))
 	}
@@ -337,6 +396,15 @@ func (indicator *PacketIndicator) NATDst() net.Addr {
 		}
 
 		return indicator.icmpv4Indicator.EmbDst()
+	case layers.LayerTypeICMPv6:
+		if indicator.icmpv6Indicator.IsQuery() {
+			return &addr.ICMPQueryAddr{
+				IP: indicator.DstIP(),
+				Id: indicator.icmpv6Indicator.Id(),
+			}
+		}
+
+		return indicator.icmpv6Indicator.EmbDst()
 	default:
 		panic(fmt.Errorf("transport layer type %s not support", t))
 	}
@@ -353,6 +421,12 @@ func (indicator *PacketIndicator) NATProtocol() gopacket.LayerType {
 		}
 
 		return indicator.icmpv4Indicator.EmbTransportLayer().LayerType()
+	case layers.LayerTypeICMPv6:
+		if indicator.icmpv6Indicator.IsQuery() {
+			return t
+		}
+
+		return indicator.icmpv6Indicator.EmbTransportLayer().LayerType()
 	default:
 		panic(fmt.Errorf("transport layer type %s not support", t))
 	}
@@ -385,6 +459,15 @@ func (indicator *PacketIndicator) Src() net.Addr {
 			}
 		}
 
+		return &net.IPAddr{IP: indicator.SrcIP()}
+	case layers.LayerTypeICMPv6:
+		if indicator.icmpv6Indicator.IsQuery() {
+			return &addr.ICMPQueryAddr{
+				IP: indicator.SrcIP(),
+				Id: indicator.icmpv6Indicator.Id(),
+			}
+		}
+
 		return &net.IPAddr{IP: indicator.SrcIP()}
 	default:
 		panic(fmt.Errorf("transport layer type %s not support", t))
@@ -418,6 +501,15 @@ func (indicator *PacketIndicator) Dst() net.Addr {
 			}
 		}
 
+		return &net.IPAddr{IP: indicator.DstIP()}
+	case layers.LayerTypeICMPv6:
+		if indicator.icmpv6Indicator.IsQuery() {
+			return &addr.ICMPQueryAddr{
+				IP: indicator.DstIP(),
+				Id: indicator.icmpv6Indicator.Id(),
+			}
+		}
+
 		return &net.IPAddr{IP: indicator.DstIP()}
 	default:
 		panic(fmt.Errorf("transport layer type %s not support", t))
@@ -435,6 +527,11 @@ func (indicator *PacketIndicator) NetworkPayload() []byte {
 		return nil
 	}
 
+	// Leave out the IPv6 fragment header
+	if indicator.fragLayer != nil {
+		return indicator.fragLayer.LayerPayload()
+	}
+
 	return indicator.NetworkLayer().LayerPayload()
 }
 
@@ -462,8 +559,10 @@ func ParsePacket(packet gopacket.Packet) (*PacketIndicator, error) {
 	var (
 		linkLayer        gopacket.Layer
 		networkLayer     gopacket.Layer
+		fragLayer        *layers.IPv6Fragment
 		transportLayer   gopacket.Layer
 		icmpv4Indicator  *ICMPv4Indicator
+		icmpv6Indicator  *ICMPv6Indicator
 		applicationLayer gopacket.ApplicationLayer
 		dnsIndicator     *DNSIndicator
 	)
@@ -491,8 +590,11 @@ func ParsePacket(packet gopacket.Packet) (*PacketIndicator, error) {
 	}
 	transportLayer = packet.TransportLayer()
 	if transportLayer == nil {
-		// Guess ICMPv4
+		// Guess ICMPv4 and ICMPv6
 		transportLayer = packet.Layer(layers.LayerTypeICMPv4)
+		if transportLayer == nil {
+			transportLayer = packet.Layer(layers.LayerTypeICMPv6)
+		}
 		if transportLayer == nil {
 			// Guess fragment
 			if packet.Layer(gopacket.LayerTypeFragment) == nil {
@@ -528,6 +630,25 @@ func ParsePacket(packet gopacket.Packet) (*PacketIndicator, error) {
 		if err != nil {
 			return nil, err
 		}
+	case layers.LayerTypeIPv6:
+		ipv6Layer := networkLayer.(*layers.IPv6)
+
+		// Extension headers are not supported except fragments
+		protocol := ipv6Layer.NextHeader
+		if protocol == layers.IPProtocolIPv6Fragment {
+			var ok bool
+			fragLayer, ok = packet.Layer(layers.LayerTypeIPv6Fragment).(*layers.IPv6Fragment)
+			if !ok {
+				return nil, errors.New("missing fragment layer")
+			}
+
+			protocol = fragLayer.NextHeader
+		}
+
+		_, err := parseIPProtocol(protocol)
+		if err != nil {
+			return nil, err
+		}
 	case layers.LayerTypeARP:
 		break
 	default:
@@ -545,6 +666,12 @@ func ParsePacket(packet gopacket.Packet) (*PacketIndicator, error) {
 			if err != nil {
 				return nil, fmt.Errorf("parse icmpv4 layer: %w", err)
 			}
+		case layers.LayerTypeICMPv6:
+			var err error
+			icmpv6Indicator, err = ParseICMPv6Layer(transportLayer.(*layers.ICMPv6))
+			if err != nil {
+				return nil, fmt.Errorf("parse icmpv6 layer: %w", err)
+			}
 		default:
 			return nil, fmt.Errorf("transport layer type %s not support", t)
 		}
@@ -561,8 +688,10 @@ func ParsePacket(packet gopacket.Packet) (*PacketIndicator, error) {
 		packet:           packet,
 		linkLayer:        linkLayer,
 		networkLayer:     networkLayer,
+		fragLayer:        fragLayer,
 		transportLayer:   transportLayer,
 		icmpv4Indicator:  icmpv4Indicator,
+		icmpv6Indicator:  icmpv6Indicator,
 		applicationLayer: applicationLayer,
 		dnsIndicator:     dnsIndicator,
 	}, nil
@@ -570,22 +699,30 @@ func ParsePacket(packet gopacket.Packet) (*PacketIndicator, error) {
 
 // ParseEmbPacket parses an embedded packet used in transmission between client and server without link layer.
 func ParseEmbPacket(contents []byte) (*PacketIndicator, error) {
-	// Guess network layer type
-	packet := gopacket.NewPacket(contents, layers.LayerTypeIPv4, gopacket.NoCopy)
-	networkLayer := packet.NetworkLayer()
-	if networkLayer == nil {
+	if len(contents) <= 0 {
 		return nil, errors.New("missing network layer")
 	}
-	if networkLayer.LayerType() != layers.LayerTypeIPv4 {
-		return nil, errors.New("network layer type not support")
-	}
-	switch networkLayer.(*layers.IPv4).Version {
+
+	// Guess network layer type by the version
+	var t gopacket.LayerType
+	switch contents[0] >> 4 {
 	case 4:
-		break
+		t = layers.LayerTypeIPv4
+	case 6:
+		t = layers.LayerTypeIPv6
 	default:
 		return nil, errors.New("network layer type not support")
 	}
 
+	packet := gopacket.NewPacket(contents, t, gopacket.NoCopy)
+	networkLayer := packet.NetworkLayer()
+	if networkLayer == nil {
+		return nil, errors.New("missing network layer")
+	}
+	if networkLayer.LayerType() != t {
+		return nil, errors.New("network layer type not support")
+	}
+
 	// Parse packet
 	indicator, err := ParsePacket(packet)
 	if err != nil {
@@ -664,6 +801,8 @@ func parseIPProtocol(protocol layers.IPProtocol) (gopacket.LayerType, error) {
 		return layers.LayerTypeUDP, nil
 	case layers.IPProtocolICMPv4:
 		return layers.LayerTypeICMPv4, nil
+	case layers.IPProtocolICMPv6:
+		return layers.LayerTypeICMPv6, nil
 	default:
 		return gopacket.LayerTypeZero, fmt.Errorf("ip protocol %s not support", protocol)
 	}
@@ -673,6 +812,8 @@ func parseEthernetType(t layers.EthernetType) (gopacket.LayerType, error) {
 	switch t {
 	case layers.EthernetTypeIPv4:
 		return layers.LayerTypeIPv4, nil
+	case layers.EthernetTypeIPv6:
+		return layers.LayerTypeIPv6, nil
 	case layers.EthernetTypeARP:
 		return layers.LayerTypeARP, nil
 	default:
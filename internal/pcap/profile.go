@@ -0,0 +1,274 @@
+package pcap
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+// TCPProfile describes the TCP fingerprint of an operating system, which is applied to segments in FakeTCP.
+type TCPProfile struct {
+	name        string
+	ttl         uint8
+	window      uint16
+	windowScale uint8
+	// options are kinds of options in SYN in order, including paddings
+	options []layers.TCPOptionKind
+}
+
+var (
+	// TCPProfileLinux describes the TCP fingerprint of Linux.
+	TCPProfileLinux = &TCPProfile{
+		name:        "linux",
+		ttl:         64,
+		window:      64240,
+		windowScale: 7,
+		options: []layers.TCPOptionKind{
+			layers.TCPOptionKindMSS,
+			layers.TCPOptionKindSACKPermitted,
+			layers.TCPOptionKindTimestamps,
+			layers.TCPOptionKindNop,
+			layers.TCPOptionKindWindowScale,
+		},
+	}
+	// TCPProfileWindows describes the TCP fingerprint of Windows.
+	TCPProfileWindows = &TCPProfile{
+		name:        "windows",
+		ttl:         128,
+		window:      64240,
+		windowScale: 8,
+		options: []layers.TCPOptionKind{
+			layers.TCPOptionKindMSS,
+			layers.TCPOptionKindNop,
+			layers.TCPOptionKindWindowScale,
+			layers.TCPOptionKindNop,
+			layers.TCPOptionKindNop,
+			layers.TCPOptionKindSACKPermitted,
+		},
+	}
+	// TCPProfileMacOS describes the TCP fingerprint of macOS.
+	TCPProfileMacOS = &TCPProfile{
+		name:        "macos",
+		ttl:         64,
+		window:      65535,
+		windowScale: 6,
+		options: []layers.TCPOptionKind{
+			layers.TCPOptionKindMSS,
+			layers.TCPOptionKindNop,
+			layers.TCPOptionKindWindowScale,
+			layers.TCPOptionKindNop,
+			layers.TCPOptionKindNop,
+			layers.TCPOptionKindTimestamps,
+			layers.TCPOptionKindSACKPermitted,
+			layers.TCPOptionKindEndList,
+		},
+	}
+)
+
+// ParseTCPProfile returns a TCP profile by the given name, or nil if the name is empty.
+func ParseTCPProfile(s string) (*TCPProfile, error) {
+	switch s {
+	case "":
+		return nil, nil
+	case "linux":
+		return TCPProfileLinux, nil
+	case "windows":
+		return TCPProfileWindows, nil
+	case "macos":
+		return TCPProfileMacOS, nil
+	default:
+		return nil, fmt.Errorf("tcp profile %s not support", s)
+	}
+}
+
+func (p *TCPProfile) String() string {
+	return p.name
+}
+
+// has returns if the profile offers the option in SYN.
+func (p *TCPProfile) has(kind layers.TCPOptionKind) bool {
+	for _, k := range p.options {
+		if k == kind {
+			return true
+		}
+	}
+
+	return false
+}
+
+// tcpOptions describes options negotiated between a FakeTCP connection and its peer in handshaking.
+type tcpOptions struct {
+	lock      sync.Mutex
+	isSACK    bool
+	isTS      bool
+	tsOffset  uint32
+	tsRecent  uint32
+	isScale   bool
+	scale     uint8
+	peerScale uint8
+	appear    time.Time
+	segment   [3]layers.TCPOption
+	tsData    [8]byte
+}
+
+func newTCPOptions() *tcpOptions {
+	return &tcpOptions{
+		tsOffset: randUint32(),
+		appear:   time.Now(),
+	}
+}
+
+// negotiate records options of the peer in SYN or SYN+ACK, an option is in use if both sides offer it.
+func (o *tcpOptions) negotiate(profile *TCPProfile, options []layers.TCPOption) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	o.isSACK, o.isTS, o.isScale = false, false, false
+	for _, option := range options {
+		switch option.OptionType {
+		case layers.TCPOptionKindSACKPermitted:
+			o.isSACK = profile.has(layers.TCPOptionKindSACKPermitted)
+		case layers.TCPOptionKindTimestamps:
+			if len(option.OptionData) >= 8 && profile.has(layers.TCPOptionKindTimestamps) {
+				o.isTS = true
+				o.tsRecent = binary.BigEndian.Uint32(option.OptionData)
+			}
+		case layers.TCPOptionKindWindowScale:
+			if len(option.OptionData) >= 1 && profile.has(layers.TCPOptionKindWindowScale) {
+				o.isScale = true
+				o.scale = profile.windowScale
+				// The max shift is 14, as described in RFC 7323
+				o.peerScale = option.OptionData[0]
+				if o.peerScale > 14 {
+					o.peerScale = 14
+				}
+			}
+		}
+	}
+}
+
+// receive records the timestamp of a segment from the peer.
+func (o *tcpOptions) receive(options []layers.TCPOption) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	if !o.isTS {
+		return
+	}
+
+	for _, option := range options {
+		if option.OptionType == layers.TCPOptionKindTimestamps && len(option.OptionData) >= 8 {
+			o.tsRecent = binary.BigEndian.Uint32(option.OptionData)
+		}
+	}
+}
+
+// tsVal returns the timestamp of the local side, which ticks in milliseconds from a random offset.
+func (o *tcpOptions) tsVal() uint32 {
+	return o.tsOffset + uint32(time.Now().Sub(o.appear).Milliseconds())
+}
+
+// synOptions returns options in SYN, or options the peer offers in SYN+ACK if isReply is true.
+func (o *tcpOptions) synOptions(profile *TCPProfile, mss uint16, isReply bool) []layers.TCPOption {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	options := make([]layers.TCPOption, 0, len(profile.options))
+	paddings := 0
+	for _, kind := range profile.options {
+		var option layers.TCPOption
+
+		switch kind {
+		case layers.TCPOptionKindNop:
+			paddings++
+			continue
+		case layers.TCPOptionKindEndList:
+			option = layers.TCPOption{OptionType: kind}
+		case layers.TCPOptionKindMSS:
+			data := make([]byte, 2)
+			binary.BigEndian.PutUint16(data, mss)
+			option = layers.TCPOption{OptionType: kind, OptionLength: 4, OptionData: data}
+		case layers.TCPOptionKindSACKPermitted:
+			if isReply && !o.isSACK {
+				paddings = 0
+				continue
+			}
+			option = layers.TCPOption{OptionType: kind, OptionLength: 2}
+		case layers.TCPOptionKindTimestamps:
+			if isReply && !o.isTS {
+				paddings = 0
+				continue
+			}
+			data := make([]byte, 8)
+			binary.BigEndian.PutUint32(data, o.tsVal())
+			// The echo is 0 in SYN
+			if isReply {
+				binary.BigEndian.PutUint32(data[4:], o.tsRecent)
+			}
+			option = layers.TCPOption{OptionType: kind, OptionLength: 10, OptionData: data}
+		case layers.TCPOptionKindWindowScale:
+			if isReply && !o.isScale {
+				paddings = 0
+				continue
+			}
+			option = layers.TCPOption{OptionType: kind, OptionLength: 3, OptionData: []byte{profile.windowScale}}
+		default:
+			panic(fmt.Errorf("tcp option kind %s not support", kind))
+		}
+
+		// Paddings are kept only in front of options in use
+		for ; paddings > 0; paddings-- {
+			options = append(options, layers.TCPOption{OptionType: layers.TCPOptionKindNop})
+		}
+		options = append(options, option)
+	}
+
+	return options
+}
+
+// segmentOptions returns options in segments other than SYN and SYN+ACK. The options are overwritten in the next call,
+// so the caller must hold the lock of the connection until the segment is serialized.
+func (o *tcpOptions) segmentOptions() []layers.TCPOption {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	if !o.isTS {
+		return nil
+	}
+
+	binary.BigEndian.PutUint32(o.tsData[:], o.tsVal())
+	binary.BigEndian.PutUint32(o.tsData[4:], o.tsRecent)
+
+	o.segment[0] = layers.TCPOption{OptionType: layers.TCPOptionKindNop}
+	o.segment[1] = layers.TCPOption{OptionType: layers.TCPOptionKindNop}
+	o.segment[2] = layers.TCPOption{OptionType: layers.TCPOptionKindTimestamps, OptionLength: 10, OptionData: o.tsData[:]}
+
+	return o.segment[:]
+}
+
+// scaleWindow returns the window to advertise in segments other than SYN and SYN+ACK.
+func (o *tcpOptions) scaleWindow(window uint16) uint16 {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	if o.isScale {
+		return window >> o.scale
+	}
+
+	return window
+}
+
+// peerWindow returns the window the peer advertises in segments other than SYN and SYN+ACK.
+func (o *tcpOptions) peerWindow(window uint16) uint32 {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	if o.isScale {
+		return uint32(window) << o.peerScale
+	}
+
+	return uint32(window)
+}
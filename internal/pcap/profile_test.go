@@ -0,0 +1,130 @@
+package pcap
+
+import (
+	"github.com/google/gopacket/layers"
+	"reflect"
+	"testing"
+)
+
+// optionKinds returns kinds of the options in order.
+func optionKinds(options []layers.TCPOption) []layers.TCPOptionKind {
+	kinds := make([]layers.TCPOptionKind, 0, len(options))
+	for _, option := range options {
+		kinds = append(kinds, option.OptionType)
+	}
+
+	return kinds
+}
+
+func TestTCPProfileSYN(t *testing.T) {
+	tests := []struct {
+		name    string
+		profile *TCPProfile
+	}{
+		{name: "linux", profile: TCPProfileLinux},
+		{name: "windows", profile: TCPProfileWindows},
+		{name: "macos", profile: TCPProfileMacOS},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			profile, err := ParseTCPProfile(test.name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if profile != test.profile {
+				t.Fatalf("parse profile %s", profile)
+			}
+
+			// Options in SYN follow the profile in order, including paddings
+			kinds := optionKinds(newTCPOptions().synOptions(test.profile, 1460, false))
+			if !reflect.DeepEqual(kinds, test.profile.options) {
+				t.Fatalf("options in %v, want %v", kinds, test.profile.options)
+			}
+		})
+	}
+}
+
+func TestTCPProfileNegotiate(t *testing.T) {
+	mss := layers.TCPOption{OptionType: layers.TCPOptionKindMSS, OptionLength: 4, OptionData: []byte{0x05, 0xb4}}
+	sack := layers.TCPOption{OptionType: layers.TCPOptionKindSACKPermitted, OptionLength: 2}
+	ts := layers.TCPOption{OptionType: layers.TCPOptionKindTimestamps, OptionLength: 10, OptionData: make([]byte, 8)}
+	ws := func(scale uint8) layers.TCPOption {
+		return layers.TCPOption{OptionType: layers.TCPOptionKindWindowScale, OptionLength: 3, OptionData: []byte{scale}}
+	}
+
+	tests := []struct {
+		name      string
+		profile   *TCPProfile
+		peer      []layers.TCPOption
+		isSACK    bool
+		isTS      bool
+		isScale   bool
+		peerScale uint8
+		reply     []layers.TCPOptionKind
+	}{
+		{
+			name:      "linux with all",
+			profile:   TCPProfileLinux,
+			peer:      []layers.TCPOption{mss, sack, ts, ws(7)},
+			isSACK:    true,
+			isTS:      true,
+			isScale:   true,
+			peerScale: 7,
+			reply:     TCPProfileLinux.options,
+		},
+		{
+			name:    "linux with mss only",
+			profile: TCPProfileLinux,
+			peer:    []layers.TCPOption{mss},
+			reply:   []layers.TCPOptionKind{layers.TCPOptionKindMSS},
+		},
+		{
+			name:      "linux without timestamps",
+			profile:   TCPProfileLinux,
+			peer:      []layers.TCPOption{mss, sack, ws(8)},
+			isSACK:    true,
+			isScale:   true,
+			peerScale: 8,
+			reply:     []layers.TCPOptionKind{layers.TCPOptionKindMSS, layers.TCPOptionKindSACKPermitted, layers.TCPOptionKindNop, layers.TCPOptionKindWindowScale},
+		},
+		{
+			name:      "windows ignores timestamps",
+			profile:   TCPProfileWindows,
+			peer:      []layers.TCPOption{mss, ts, ws(2)},
+			isScale:   true,
+			peerScale: 2,
+			reply:     []layers.TCPOptionKind{layers.TCPOptionKindMSS, layers.TCPOptionKindNop, layers.TCPOptionKindWindowScale},
+		},
+		{
+			name:      "macos with scale over max",
+			profile:   TCPProfileMacOS,
+			peer:      []layers.TCPOption{mss, ws(15)},
+			isScale:   true,
+			peerScale: 14,
+			reply:     []layers.TCPOptionKind{layers.TCPOptionKindMSS, layers.TCPOptionKindNop, layers.TCPOptionKindWindowScale, layers.TCPOptionKindEndList},
+		},
+		{
+			name:    "malformed options",
+			profile: TCPProfileMacOS,
+			peer:    []layers.TCPOption{{OptionType: layers.TCPOptionKindTimestamps}, {OptionType: layers.TCPOptionKindWindowScale}},
+			reply:   []layers.TCPOptionKind{layers.TCPOptionKindMSS, layers.TCPOptionKindEndList},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			o := newTCPOptions()
+			o.negotiate(test.profile, test.peer)
+			if o.isSACK != test.isSACK || o.isTS != test.isTS || o.isScale != test.isScale || o.peerScale != test.peerScale {
+				t.Fatalf("negotiate sack %t, timestamps %t, scale %t by %d", o.isSACK, o.isTS, o.isScale, o.peerScale)
+			}
+
+			// Options not in use are left out of SYN+ACK with their paddings
+			kinds := optionKinds(o.synOptions(test.profile, 1460, true))
+			if !reflect.DeepEqual(kinds, test.reply) {
+				t.Fatalf("options in %v, want %v", kinds, test.reply)
+			}
+		})
+	}
+}
@@ -0,0 +1,6 @@
+// +build race
+
+package pcap
+
+// isRace is true if the race detector is enabled, which drops buffers put into pools at random.
+const isRace = true
@@ -2,7 +2,6 @@
 
 import (
 	"github.com/google/gopacket"
-	"github.com/google/gopacket/pcap"
 )
 
 type timeoutError struct {
@@ -20,6 +19,9 @@ func (err *timeoutError) Timeout() bool {
 // MaxMTU is the max transmission and receive unit in pcap raw conn.
 const MaxMTU = 1500
 
+// minMTU is the min MTU every host must accept, as described in RFC 791.
+const minMTU = 576
+
 // IPv4MaxSize is the max size of an IPv4 packet.
 const IPv4MaxSize = 65535
 
@@ -30,7 +32,7 @@ func (err *timeoutError) Timeout() bool {
 type RawConn struct {
 	srcDev *Device
 	dstDev *Device
-	handle *pcap.Handle
+	handle handle
 }
 
 func newRawConn() *RawConn {
@@ -38,18 +40,13 @@ func newRawConn() *RawConn {
 }
 
 func createPureRawConn(dev, filter string) (*RawConn, error) {
-	handle, err := pcap.OpenLive(dev, maxSnapLen, true, pcap.BlockForever)
-	if err != nil {
-		return nil, err
-	}
-
-	err = handle.SetBPFFilter(filter)
+	h, err := openHandle(dev, filter)
 	if err != nil {
 		return nil, err
 	}
 
 	conn := newRawConn()
-	conn.handle = handle
+	conn.handle = h
 
 	return conn, nil
 }
@@ -80,13 +77,15 @@ func (c *RawConn) Read(b []byte) (n int, err error) {
 
 // ReadPacket reads packet from the connection.
 func (c *RawConn) ReadPacket() (gopacket.Packet, error) {
-	b := make([]byte, maxSnapLen)
-
-	_, err := c.Read(b)
+	d, _, err := c.handle.ZeroCopyReadPacketData()
 	if err != nil {
 		return nil, err
 	}
 
+	// The data is only valid until the next read, so it is copied in its own size
+	b := make([]byte, len(d))
+	copy(b, d)
+
 	packet := gopacket.NewPacket(b, c.handle.LinkType(), gopacket.NoCopy)
 
 	return packet, nil
@@ -101,6 +100,11 @@ func (c *RawConn) Write(b []byte) (n int, err error) {
 	return len(b), nil
 }
 
+// SetFilter replaces the BPF filter of the connection.
+func (c *RawConn) SetFilter(filter string) error {
+	return c.handle.SetBPFFilter(filter)
+}
+
 func (c *RawConn) Close() error {
 	c.handle.Close()
 
@@ -121,50 +125,3 @@ func (c *RawConn) RemoteDev() *Device {
 func (c *RawConn) IsLoop() bool {
 	return c.dstDev.IsLoop()
 }
-
-// Reader is a reader reads packets from a pcap file.
-type Reader struct {
-	handle *pcap.Handle
-	ps     *gopacket.PacketSource
-}
-
-// CreateReader creates a reader reading a pcap file.
-func CreateReader(file string) (*Reader, error) {
-	handle, err := pcap.OpenOffline(file)
-	if err != nil {
-		return nil, err
-	}
-
-	ps := gopacket.NewPacketSource(handle, handle.LinkType())
-
-	return &Reader{
-		handle: handle,
-		ps:     ps,
-	}, nil
-}
-
-func (r *Reader) Read(b []byte) (n int, err error) {
-	packet, err := r.ReadPacket()
-	if err != nil {
-		return 0, err
-	}
-
-	copy(b, packet.Data())
-
-	return len(packet.Data()), nil
-}
-
-func (r *Reader) ReadPacket() (gopacket.Packet, error) {
-	packet, err := r.ps.NextPacket()
-	if err != nil {
-		return nil, err
-	}
-
-	return packet, nil
-}
-
-func (r *Reader) Close() error {
-	r.handle.Close()
-
-	return nil
-}
@@ -1,39 +1,90 @@
 package pcap
 
 import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"ikago/internal/crypto"
 	"ikago/internal/log"
+	"io"
 	"net"
+	"sync"
 	"time"
 )
 
-const keepSticky = 30 * time.Second
+// recordHeaderSize is the size of the length header in front of each record in standard TCP.
+const recordHeaderSize = 2
 
+// maxRecordSize is the max size of a sealed record in standard TCP.
+const maxRecordSize = 65535
+
+// TCPConn is a standard TCP connection which transmits packets in length-prefixed records, optionally wrapped in TLS.
 type TCPConn struct {
-	conn    *net.TCPConn
-	crypt   crypto.Crypt
-	buffer  []byte
-	destick *Desticker
-	stash   [][]byte
-	stashId int
+	conn      net.Conn
+	crypt     crypto.Crypt
+	reader    *bufio.Reader
+	readLock  sync.Mutex
+	writeLock sync.Mutex
+	header    []byte
+	buffer    []byte
 }
 
-func newTCPConn() *TCPConn {
-	conn := &TCPConn{
-		buffer:  make([]byte, 65535),
-		destick: NewDesticker(),
-		stash:   make([][]byte, 0),
+func newTCPConn(conn net.Conn, crypt crypto.Crypt) *TCPConn {
+	return &TCPConn{
+		conn:   conn,
+		crypt:  crypt,
+		reader: bufio.NewReaderSize(conn, maxRecordSize+recordHeaderSize),
+		header: make([]byte, recordHeaderSize),
+		buffer: make([]byte, maxRecordSize),
 	}
-	conn.destick.SetDeadline(keepSticky)
-
-	return conn
 }
 
 // DialTCP acts like DialTCP for pcap networks.
 func DialTCP(dev *Device, srcPort uint16, dstAddr *net.TCPAddr, crypt crypto.Crypt) (*TCPConn, error) {
+	conn, err := dialTCP(dev, srcPort, dstAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	return newTCPConn(conn, crypt), nil
+}
+
+// DialTCPWithTLS connects to the remote address in the standard TCP network with TLS support.
+func DialTCPWithTLS(dev *Device, srcPort uint16, dstAddr *net.TCPAddr, crypt crypto.Crypt, tlsConfig *tls.Config) (*TCPConn, error) {
+	conn, err := dialTCP(dev, srcPort, dstAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConn := tls.Client(conn, tlsConfig)
+
+	// Handshake
+	err = tlsConn.SetDeadline(time.Now().Add(establishDeadline))
+	if err == nil {
+		err = tlsConn.Handshake()
+	}
+	if err == nil {
+		err = tlsConn.SetDeadline(time.Time{})
+	}
+	if err != nil {
+		conn.Close()
+		return nil, &net.OpError{
+			Op:     "dial",
+			Net:    "pcap",
+			Source: conn.LocalAddr(),
+			Addr:   dstAddr,
+			Err:    fmt.Errorf("tls handshake: %w", err),
+		}
+	}
+
+	return newTCPConn(tlsConn, crypt), nil
+}
+
+func dialTCP(dev *Device, srcPort uint16, dstAddr *net.TCPAddr) (*net.TCPConn, error) {
 	srcAddr := &net.TCPAddr{
-		IP:   dev.IPAddr().IP,
+		IP:   dev.srcIP(dstAddr.IP),
 		Port: int(srcPort),
 	}
 
@@ -41,7 +92,7 @@ func DialTCP(dev *Device, srcPort uint16, dstAddr *net.TCPAddr, crypt crypto.Cry
 
 	t := time.Now()
 
-	conn, err := net.DialTCP("tcp4", srcAddr, dstAddr)
+	conn, err := net.DialTCP("tcp", srcAddr, dstAddr)
 	if err != nil {
 		return nil, &net.OpError{
 			Op:     "dial",
@@ -56,63 +107,66 @@ func DialTCP(dev *Device, srcPort uint16, dstAddr *net.TCPAddr, crypt crypto.Cry
 
 	log.Infof("Connected to server %s in %.3f ms (RTT)\n", dstAddr.String(), float64(duration.Microseconds())/1000)
 
-	tcpConn := newTCPConn()
-	tcpConn.conn = conn
-	tcpConn.crypt = crypt
-
-	return tcpConn, nil
+	return conn, nil
 }
 
+// Read reads exactly one record from the connection and returns the decrypted packet.
 func (c *TCPConn) Read(b []byte) (n int, err error) {
-	// If stashed packets exist, read from stash, otherwise, read from conn
-	if c.stash == nil || len(c.stash) <= c.stashId {
-		n, err = c.conn.Read(c.buffer)
-		if err != nil {
-			return 0, err
-		}
+	c.readLock.Lock()
+	defer c.readLock.Unlock()
 
-		dp, err := c.crypt.Decrypt(c.buffer[:n])
-		if err != nil {
-			return 0, &net.OpError{
-				Op:     "read",
-				Net:    "pcap",
-				Source: c.LocalAddr(),
-				Addr:   c.RemoteAddr(),
-				Err:    fmt.Errorf("decrypt: %w", err),
-			}
-		}
+	// Length header
+	_, err = io.ReadFull(c.reader, c.header)
+	if err != nil {
+		return 0, err
+	}
+	size := int(binary.BigEndian.Uint16(c.header))
+	if size == 0 {
+		return 0, nil
+	}
 
-		// Destick
-		packets, err := c.destick.Append(dp)
-		if err != nil {
-			return 0, &net.OpError{
-				Op:     "read",
-				Net:    "pcap",
-				Source: c.LocalAddr(),
-				Addr:   c.RemoteAddr(),
-				Err:    fmt.Errorf("destick: %w", err),
-			}
+	// Sealed record, which may arrive across several reads
+	_, err = io.ReadFull(c.reader, c.buffer[:size])
+	if err != nil {
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return 0, io.EOF
 		}
+		return 0, err
+	}
 
-		if len(packets) == 0 {
-			return 0, nil
+	// Decrypt in place
+	contents, err := crypto.Open(c.crypt, c.buffer[:size])
+	if err != nil {
+		return 0, &net.OpError{
+			Op:     "read",
+			Net:    "pcap",
+			Source: c.LocalAddr(),
+			Addr:   c.RemoteAddr(),
+			Err:    fmt.Errorf("decrypt: %w", err),
 		}
-
-		c.stash = packets
-		c.stashId = 0
 	}
 
-	// Read stashed packet
-	copy(b, c.stash[c.stashId])
-
-	c.stashId++
+	n = copy(b, contents)
+	if n < len(contents) {
+		return n, &net.OpError{
+			Op:     "read",
+			Net:    "pcap",
+			Source: c.LocalAddr(),
+			Addr:   c.RemoteAddr(),
+			Err:    io.ErrShortBuffer,
+		}
+	}
 
-	return len(c.stash[c.stashId-1]), nil
+	return n, nil
 }
 
+// Write seals b into one record and writes it to the connection.
 func (c *TCPConn) Write(b []byte) (n int, err error) {
-	// Encrypt
-	contents, err := c.crypt.Encrypt(b)
+	buffer := GetBuffer()
+	defer PutBuffer(buffer)
+
+	// Encrypt behind the room of length header, padding never pushes the record over the max size
+	record, err := crypto.SealSized(c.crypt, buffer[:recordHeaderSize], b, crypto.Size(c.crypt, len(b), maxRecordSize))
 	if err != nil {
 		return 0, &net.OpError{
 			Op:     "write",
@@ -122,8 +176,29 @@ func (c *TCPConn) Write(b []byte) (n int, err error) {
 			Err:    fmt.Errorf("encrypt: %w", err),
 		}
 	}
+	size := len(record) - recordHeaderSize
+	if size > maxRecordSize {
+		return 0, &net.OpError{
+			Op:     "write",
+			Net:    "pcap",
+			Source: c.LocalAddr(),
+			Addr:   c.RemoteAddr(),
+			Err:    fmt.Errorf("record size %d out of range", size),
+		}
+	}
 
-	return c.conn.Write(contents)
+	// Length header
+	binary.BigEndian.PutUint16(record, uint16(size))
+
+	// Records must not interleave
+	c.writeLock.Lock()
+	_, err = c.conn.Write(record)
+	c.writeLock.Unlock()
+	if err != nil {
+		return 0, err
+	}
+
+	return len(b), nil
 }
 
 func (c *TCPConn) Close() error {
@@ -150,19 +225,28 @@ func (c *TCPConn) SetWriteDeadline(t time.Time) error {
 	return c.conn.SetWriteDeadline(t)
 }
 
+// TCPListener is a standard TCP listener which accepts connections transmitting packets in length-prefixed records,
+// optionally wrapped in TLS.
 type TCPListener struct {
-	listener *net.TCPListener
-	crypt    crypto.Crypt
+	listener  *net.TCPListener
+	crypt     crypto.Crypt
+	tlsConfig *tls.Config
 }
 
 // ListenTCP acts like ListenTCP for pcap networks.
 func ListenTCP(dev *Device, srcPort uint16, crypt crypto.Crypt) (*TCPListener, error) {
+	return ListenTCPWithTLS(dev, srcPort, crypt, nil)
+}
+
+// ListenTCPWithTLS listens for incoming connections addressed to the local address in the standard TCP network with
+// TLS support. TLS is disabled if tlsConfig is nil.
+func ListenTCPWithTLS(dev *Device, srcPort uint16, crypt crypto.Crypt, tlsConfig *tls.Config) (*TCPListener, error) {
 	srcAddr := &net.TCPAddr{
-		IP:   dev.IPAddr().IP,
+		IP:   dev.listenIP(),
 		Port: int(srcPort),
 	}
 
-	listener, err := net.ListenTCP("tcp4", srcAddr)
+	listener, err := net.ListenTCP("tcp", srcAddr)
 	if err != nil {
 		return nil, &net.OpError{
 			Op:     "listen",
@@ -173,8 +257,9 @@ func ListenTCP(dev *Device, srcPort uint16, crypt crypto.Crypt) (*TCPListener, e
 	}
 
 	return &TCPListener{
-		listener: listener,
-		crypt:    crypt,
+		listener:  listener,
+		crypt:     crypt,
+		tlsConfig: tlsConfig,
 	}, nil
 }
 
@@ -184,11 +269,12 @@ func (l *TCPListener) Accept() (net.Conn, error) {
 		return nil, err
 	}
 
-	tcpConn := newTCPConn()
-	tcpConn.conn = conn
-	tcpConn.crypt = l.crypt
+	// The handshake is performed on the first read or write, so a slow client would not block accepting
+	if l.tlsConfig != nil {
+		return newTCPConn(tls.Server(conn, l.tlsConfig), l.crypt), nil
+	}
 
-	return tcpConn, nil
+	return newTCPConn(conn, l.crypt), nil
 }
 
 func (l *TCPListener) Close() error {
@@ -0,0 +1,203 @@
+package pcap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"ikago/internal/crypto"
+	"io"
+	"net"
+	"testing"
+)
+
+// newTCPPipe returns both ends of a TCP connection in the loopback.
+func newTCPPipe(tb testing.TB) (*net.TCPConn, *net.TCPConn) {
+	listener, err := net.ListenTCP("tcp4", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer listener.Close()
+
+	a, err := net.DialTCP("tcp4", nil, listener.Addr().(*net.TCPAddr))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	b, err := listener.AcceptTCP()
+	if err != nil {
+		a.Close()
+		tb.Fatal(err)
+	}
+
+	return a, b
+}
+
+func TestTCPConnRecord(t *testing.T) {
+	crypt, err := crypto.ParseCrypt("aes-128-gcm", "ikago")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		size  int
+		isErr bool
+	}{
+		{name: "empty", size: 0},
+		{name: "single byte", size: 1},
+		{name: "packet", size: 1400},
+		{name: "max record", size: maxRecordSize - crypt.Cost()},
+		{name: "oversize record", size: maxRecordSize - crypt.Cost() + 1, isErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a, b := newTCPPipe(t)
+			from, to := newTCPConn(a, crypt), newTCPConn(b, crypt)
+			defer from.Close()
+			defer to.Close()
+
+			data := bytes.Repeat([]byte{byte(test.size)}, test.size)
+
+			ch := make(chan error, 1)
+			go func() {
+				_, err := from.Write(data)
+				ch <- err
+			}()
+
+			if test.isErr {
+				if err := <-ch; err == nil {
+					t.Fatal("oversize record is written")
+				}
+				return
+			}
+
+			buffer := make([]byte, maxRecordSize)
+			n, err := to.Read(buffer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(buffer[:n], data) {
+				t.Fatalf("read %d bytes mismatch", n)
+			}
+			if err := <-ch; err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestTCPConnPadding(t *testing.T) {
+	plain, err := crypto.ParseCrypt("aes-128-gcm", "ikago")
+	if err != nil {
+		t.Fatal(err)
+	}
+	crypt, err := crypto.CreateObfsCrypt(plain, 65535, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		size int
+	}{
+		{name: "empty", size: 0},
+		{name: "packet", size: 1400},
+		{name: "half record", size: maxRecordSize / 2},
+		{name: "max record", size: maxRecordSize - crypt.Cost()},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a, b := newTCPPipe(t)
+			from, to := newTCPConn(a, crypt), newTCPConn(b, crypt)
+			defer from.Close()
+			defer to.Close()
+
+			data := bytes.Repeat([]byte{byte(test.size)}, test.size)
+
+			// Padding is cut to the max size of a record
+			ch := make(chan error, 1)
+			go func() {
+				_, err := from.Write(data)
+				if err != nil {
+					from.Close()
+				}
+				ch <- err
+			}()
+
+			buffer := make([]byte, maxRecordSize)
+			n, err := to.Read(buffer)
+			if err != nil {
+				t.Fatalf("read: %v, write: %v", err, <-ch)
+			}
+			if !bytes.Equal(buffer[:n], data) {
+				t.Fatalf("read %d bytes mismatch", n)
+			}
+			if err := <-ch; err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestTCPConnRead(t *testing.T) {
+	crypt, err := crypto.ParseCrypt("aes-128-gcm", "ikago")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	contents, err := crypt.Encrypt([]byte{1, 2, 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed := make([]byte, recordHeaderSize+len(contents))
+	binary.BigEndian.PutUint16(sealed, uint16(len(contents)))
+	copy(sealed[recordHeaderSize:], contents)
+
+	tests := []struct {
+		name   string
+		chunks [][]byte
+		size   int
+		n      int
+		err    error
+	}{
+		{name: "whole", chunks: [][]byte{sealed}, size: 3, n: 3},
+		{name: "split header", chunks: [][]byte{sealed[:1], sealed[1:]}, size: 3, n: 3},
+		{name: "split record", chunks: [][]byte{sealed[:5], sealed[5:]}, size: 3, n: 3},
+		{name: "empty record", chunks: [][]byte{{0, 0}}, size: 3, n: 0},
+		{name: "truncated header", chunks: [][]byte{sealed[:1]}, size: 3, err: io.ErrUnexpectedEOF},
+		{name: "truncated record", chunks: [][]byte{sealed[:len(sealed)-1]}, size: 3, err: io.EOF},
+		{name: "short buffer", chunks: [][]byte{sealed}, size: 2, n: 2, err: io.ErrShortBuffer},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a, b := newTCPPipe(t)
+			conn := newTCPConn(b, crypt)
+			defer conn.Close()
+
+			// Records may arrive in any chunks before the stream ends
+			go func() {
+				for _, chunk := range test.chunks {
+					_, err := a.Write(chunk)
+					if err != nil {
+						break
+					}
+				}
+				a.Close()
+			}()
+
+			buffer := make([]byte, test.size)
+			n, err := conn.Read(buffer)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("read: %v, want %v", err, test.err)
+			}
+			if n != test.n {
+				t.Fatalf("read %d bytes, want %d", n, test.n)
+			}
+			if n > 0 && !bytes.Equal(buffer[:n], []byte{1, 2, 3}[:n]) {
+				t.Fatalf("read %d bytes mismatch", n)
+			}
+		})
+	}
+}
@@ -0,0 +1,184 @@
+package pcap
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"sync"
+	"time"
+)
+
+// delayedACK is the max duration a received segment waits before being acknowledged.
+const delayedACK = 40 * time.Millisecond
+
+// windowWait is the max duration a segment waits for the peer's window to open.
+const windowWait = 200 * time.Millisecond
+
+// emulatedHop is the hop of all segments in TCP emulation.
+const emulatedHop = 65
+
+// emulatedRecvWindow is the size of the receive buffer advertised in TCP emulation.
+const emulatedRecvWindow = 64240
+
+// emulatedMSS is the estimated MSS used in TCP emulation.
+const emulatedMSS = 1460
+
+// tcpState describes the emulated TCP state between a FakeTCP connection and its peer.
+type tcpState struct {
+	lock        sync.Mutex
+	una         uint32
+	window      uint32
+	isACKed     bool
+	pendingSegs int
+	pendingSize int
+	timer       *time.Timer
+	update      chan struct{}
+}
+
+func newTCPState() *tcpState {
+	return &tcpState{
+		window: emulatedRecvWindow,
+		update: make(chan struct{}),
+	}
+}
+
+// handshake records the sequence and the window of the peer in handshaking.
+func (s *tcpState) handshake(una uint32, window uint32) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.una = una
+	s.window = window
+}
+
+// receive records the acknowledgement and the window of a segment from the peer, nxt is the next sequence to send.
+func (s *tcpState) receive(ack uint32, window uint32, nxt uint32) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	// Ignore acknowledgements of data never sent or already acknowledged
+	if seqAfter(ack, nxt) || seqBefore(ack, s.una) {
+		return
+	}
+
+	if seqAfter(ack, s.una) {
+		s.una = ack
+		s.isACKed = true
+	}
+	s.window = window
+
+	// Wake writers waiting for the window
+	close(s.update)
+	s.update = make(chan struct{})
+}
+
+// wait blocks until the peer's window can hold size bytes after sequence nxt, or the wait times out.
+func (s *tcpState) wait(nxt uint32, size int) {
+	deadline := time.Now().Add(windowWait)
+
+	for {
+		s.lock.Lock()
+		// The peer does not acknowledge passively, there is no window to honour
+		if !s.isACKed || nxt-s.una+uint32(size) <= s.window {
+			s.lock.Unlock()
+			return
+		}
+		update := s.update
+		s.lock.Unlock()
+
+		duration := deadline.Sub(time.Now())
+		if duration <= 0 {
+			return
+		}
+
+		select {
+		case <-update:
+		case <-time.After(duration):
+			return
+		}
+	}
+}
+
+// data records a received data segment and returns if it should be acknowledged immediately, otherwise f will be
+// called after a delay unless the data is acknowledged in between.
+func (s *tcpState) data(size int, f func()) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.pendingSegs++
+	s.pendingSize = s.pendingSize + size
+
+	// Acknowledge every second full-sized segment
+	if s.pendingSegs >= 2 || s.pendingSize >= 2*emulatedMSS {
+		return true
+	}
+
+	if s.timer == nil {
+		s.timer = time.AfterFunc(delayedACK, f)
+	}
+
+	return false
+}
+
+// acknowledge records all received data is acknowledged.
+func (s *tcpState) acknowledge() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.pendingSegs = 0
+	s.pendingSize = 0
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+}
+
+// isPending returns if any received data is not acknowledged.
+func (s *tcpState) isPending() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.pendingSegs > 0
+}
+
+// advertise returns the window to advertise to the peer.
+func (s *tcpState) advertise() uint16 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	window := emulatedRecvWindow - s.pendingSize
+	if window < emulatedMSS {
+		window = emulatedMSS
+	}
+
+	return uint16(window)
+}
+
+// close stops all timers.
+func (s *tcpState) close() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+}
+
+func seqAfter(a, b uint32) bool {
+	return int32(a-b) > 0
+}
+
+func seqBefore(a, b uint32) bool {
+	return int32(a-b) < 0
+}
+
+func randUint32() uint32 {
+	b := make([]byte, 4)
+
+	_, err := rand.Read(b)
+	if err != nil {
+		return uint32(time.Now().UnixNano())
+	}
+
+	return binary.BigEndian.Uint32(b)
+}
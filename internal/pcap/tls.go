@@ -0,0 +1,146 @@
+package pcap
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"ikago/internal/config"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// tlsNextProtos is the application protocols advertised in TLS, which are the same as ordinary HTTPS.
+var tlsNextProtos = []string{"h2", "http/1.1"}
+
+// selfSignedValidity is the validity period of self-signed certificates.
+const selfSignedValidity = 365 * 24 * time.Hour
+
+// NewTLSClientConfig returns a TLS config for clients. If the fingerprint is provided, the certificate of the server
+// is pinned instead of being verified by the system.
+func NewTLSClientConfig(config *config.TLSConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName: config.ServerName,
+		NextProtos: tlsNextProtos,
+	}
+
+	if config.Fingerprint != "" {
+		fingerprint, err := parseFingerprint(config.Fingerprint)
+		if err != nil {
+			return nil, fmt.Errorf("parse fingerprint %s: %w", config.Fingerprint, err)
+		}
+
+		// Certificate pinning
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+			if len(rawCerts) <= 0 {
+				return errors.New("missing certificate")
+			}
+
+			sum := sha256.Sum256(rawCerts[0])
+			if !bytes.Equal(sum[:], fingerprint) {
+				return fmt.Errorf("fingerprint %s mismatch", Fingerprint(rawCerts[0]))
+			}
+
+			return nil
+		}
+	}
+
+	return tlsConfig, nil
+}
+
+// NewTLSServerConfig returns a TLS config for servers. A self-signed certificate is generated if the certificate and the
+// key are not provided.
+func NewTLSServerConfig(config *config.TLSConfig) (*tls.Config, error) {
+	var (
+		err  error
+		cert tls.Certificate
+	)
+
+	if config.Cert != "" || config.Key != "" {
+		cert, err = tls.LoadX509KeyPair(config.Cert, config.Key)
+		if err != nil {
+			return nil, fmt.Errorf("load certificate: %w", err)
+		}
+	} else {
+		cert, err = generateCertificate(config.ServerName)
+		if err != nil {
+			return nil, fmt.Errorf("generate certificate: %w", err)
+		}
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   tlsNextProtos,
+	}, nil
+}
+
+func generateCertificate(serverName string) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("generate key: %w", err)
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("generate serial: %w", err)
+	}
+
+	if serverName == "" {
+		serverName = "localhost"
+	}
+
+	t := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: serverName},
+		DNSNames:              []string{serverName},
+		NotBefore:             t.Add(-time.Hour),
+		NotAfter:              t.Add(selfSignedValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("create certificate: %w", err)
+	}
+
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+	}, nil
+}
+
+// Fingerprint returns the SHA-256 fingerprint of a certificate in colon-separated hex.
+func Fingerprint(cert []byte) string {
+	sum := sha256.Sum256(cert)
+
+	s := make([]string, 0, len(sum))
+	for _, b := range sum {
+		s = append(s, fmt.Sprintf("%02X", b))
+	}
+
+	return strings.Join(s, ":")
+}
+
+func parseFingerprint(s string) ([]byte, error) {
+	b, err := hex.DecodeString(strings.ReplaceAll(s, ":", ""))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) != sha256.Size {
+		return nil, fmt.Errorf("size %d out of range", len(b))
+	}
+
+	return b, nil
+}
@@ -0,0 +1,493 @@
+package pcap
+
+import (
+	"errors"
+	"fmt"
+	"ikago/internal/config"
+	"ikago/internal/crypto"
+	"ikago/internal/log"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/xtaci/kcp-go"
+)
+
+// udpQueueSize is the max count of datagrams queued in an accepted UDP connection.
+const udpQueueSize = 1000
+
+// UDPConn is a standard UDP connection which transmits packets in datagrams.
+type UDPConn struct {
+	conn         *net.UDPConn
+	dstAddr      *net.UDPAddr
+	crypt        crypto.Crypt
+	listener     *UDPListener
+	queue        chan []byte
+	done         chan struct{}
+	once         sync.Once
+	readDeadline time.Time
+}
+
+// DialUDP acts like DialUDP for pcap networks.
+func DialUDP(dev *Device, srcPort uint16, dstAddr *net.UDPAddr, crypt crypto.Crypt) (*UDPConn, error) {
+	srcAddr := &net.UDPAddr{
+		IP:   dev.srcIP(dstAddr.IP),
+		Port: int(srcPort),
+	}
+
+	conn, err := net.ListenUDP("udp", srcAddr)
+	if err != nil {
+		return nil, &net.OpError{
+			Op:     "dial",
+			Net:    "pcap",
+			Source: srcAddr,
+			Addr:   dstAddr,
+			Err:    err,
+		}
+	}
+
+	log.Infof("Connect to server %s\n", dstAddr.String())
+
+	return &UDPConn{
+		conn:    conn,
+		dstAddr: dstAddr,
+		crypt:   crypt,
+		done:    make(chan struct{}),
+	}, nil
+}
+
+// Read reads one datagram from the connection and returns the decrypted packet.
+func (c *UDPConn) Read(b []byte) (n int, err error) {
+	var contents []byte
+
+	if c.queue != nil {
+		contents, err = c.readQueue()
+	} else {
+		contents, err = c.readConn()
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	defer PutBuffer(contents)
+
+	// Decrypt in place
+	plain, err := crypto.Open(c.crypt, contents)
+	if err != nil {
+		return 0, &net.OpError{
+			Op:     "read",
+			Net:    "pcap",
+			Source: c.LocalAddr(),
+			Addr:   c.RemoteAddr(),
+			Err:    fmt.Errorf("decrypt: %w", err),
+		}
+	}
+
+	n = copy(b, plain)
+	if n < len(plain) {
+		return n, &net.OpError{
+			Op:     "read",
+			Net:    "pcap",
+			Source: c.LocalAddr(),
+			Addr:   c.RemoteAddr(),
+			Err:    io.ErrShortBuffer,
+		}
+	}
+
+	return n, nil
+}
+
+func (c *UDPConn) readConn() ([]byte, error) {
+	b := GetBuffer()
+
+	for {
+		n, addr, err := c.conn.ReadFromUDP(b)
+		if err != nil {
+			PutBuffer(b)
+			return nil, err
+		}
+
+		// Ignore datagrams from others
+		if !addr.IP.Equal(c.dstAddr.IP) || addr.Port != c.dstAddr.Port {
+			continue
+		}
+
+		return b[:n], nil
+	}
+}
+
+func (c *UDPConn) readQueue() ([]byte, error) {
+	var timeout <-chan time.Time
+
+	if !c.readDeadline.IsZero() {
+		d := c.readDeadline.Sub(time.Now())
+		if d <= 0 {
+			return nil, &timeoutError{Err: "timeout"}
+		}
+		timeout = time.After(d)
+	}
+
+	select {
+	case contents := <-c.queue:
+		return contents, nil
+	case <-c.done:
+		return nil, io.EOF
+	case <-timeout:
+		return nil, &timeoutError{Err: "timeout"}
+	}
+}
+
+// udpRoom returns the room for data in a datagram to the IP, padding is never over it so the datagram is not
+// fragmented in the max MTU.
+func udpRoom(ip net.IP) int {
+	room := MaxMTU - 20 - 8
+	if ip.To4() == nil {
+		room = room - 20
+	}
+
+	return room
+}
+
+// Write encrypts b and writes it to the connection in one datagram.
+func (c *UDPConn) Write(b []byte) (n int, err error) {
+	buffer := GetBuffer()
+	defer PutBuffer(buffer)
+
+	// Encrypt
+	contents, err := crypto.SealSized(c.crypt, buffer[:0], b, crypto.Size(c.crypt, len(b), udpRoom(c.dstAddr.IP)))
+	if err != nil {
+		return 0, &net.OpError{
+			Op:     "write",
+			Net:    "pcap",
+			Source: c.LocalAddr(),
+			Addr:   c.RemoteAddr(),
+			Err:    fmt.Errorf("encrypt: %w", err),
+		}
+	}
+
+	_, err = c.conn.WriteToUDP(contents, c.dstAddr)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(b), nil
+}
+
+func (c *UDPConn) Close() error {
+	c.once.Do(func() {
+		close(c.done)
+	})
+
+	// Accepted connections share the socket of the listener
+	if c.listener != nil {
+		c.listener.remove(c)
+
+		return nil
+	}
+
+	return c.conn.Close()
+}
+
+func (c *UDPConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *UDPConn) RemoteAddr() net.Addr {
+	return c.dstAddr
+}
+
+func (c *UDPConn) SetDeadline(t time.Time) error {
+	err := c.SetReadDeadline(t)
+	if err != nil {
+		return err
+	}
+
+	return c.SetWriteDeadline(t)
+}
+
+func (c *UDPConn) SetReadDeadline(t time.Time) error {
+	if c.queue != nil {
+		c.readDeadline = t
+
+		return nil
+	}
+
+	return c.conn.SetReadDeadline(t)
+}
+
+func (c *UDPConn) SetWriteDeadline(t time.Time) error {
+	if c.listener != nil {
+		return nil
+	}
+
+	return c.conn.SetWriteDeadline(t)
+}
+
+// UDPListener is a standard UDP listener which demultiplexes datagrams into connections by their sources.
+type UDPListener struct {
+	conn        *net.UDPConn
+	crypt       crypto.Crypt
+	clientsLock sync.RWMutex
+	clients     map[string]*UDPConn
+	accept      chan *UDPConn
+	done        chan struct{}
+	once        sync.Once
+}
+
+// ListenUDP acts like ListenUDP for pcap networks.
+func ListenUDP(dev *Device, srcPort uint16, crypt crypto.Crypt) (*UDPListener, error) {
+	srcAddr := &net.UDPAddr{
+		IP:   dev.listenIP(),
+		Port: int(srcPort),
+	}
+
+	conn, err := net.ListenUDP("udp", srcAddr)
+	if err != nil {
+		return nil, &net.OpError{
+			Op:     "listen",
+			Net:    "pcap",
+			Source: srcAddr,
+			Err:    err,
+		}
+	}
+
+	listener := &UDPListener{
+		conn:    conn,
+		crypt:   crypt,
+		clients: make(map[string]*UDPConn),
+		accept:  make(chan *UDPConn, udpQueueSize),
+		done:    make(chan struct{}),
+	}
+
+	go listener.serve()
+
+	return listener, nil
+}
+
+func (l *UDPListener) serve() {
+	for {
+		b := GetBuffer()
+
+		n, addr, err := l.conn.ReadFromUDP(b)
+		if err != nil {
+			PutBuffer(b)
+			select {
+			case <-l.done:
+				return
+			default:
+				log.Errorln(fmt.Errorf("read listen: %w", err))
+				continue
+			}
+		}
+
+		// The buffer is handed over to the connection
+		contents := b[:n]
+
+		l.clientsLock.RLock()
+		conn, ok := l.clients[addr.String()]
+		l.clientsLock.RUnlock()
+		if !ok {
+			conn = &UDPConn{
+				conn:     l.conn,
+				dstAddr:  addr,
+				crypt:    l.crypt,
+				listener: l,
+				queue:    make(chan []byte, udpQueueSize),
+				done:     make(chan struct{}),
+			}
+
+			l.clientsLock.Lock()
+			l.clients[addr.String()] = conn
+			l.clientsLock.Unlock()
+
+			select {
+			case l.accept <- conn:
+				break
+			default:
+				l.remove(conn)
+				PutBuffer(contents)
+				log.Errorf("Cannot accept client %s, too many pending connections\n", addr)
+				continue
+			}
+		}
+
+		// Drop datagrams if the connection is too busy
+		select {
+		case conn.queue <- contents:
+			break
+		default:
+			PutBuffer(contents)
+		}
+	}
+}
+
+func (l *UDPListener) remove(conn *UDPConn) {
+	l.clientsLock.Lock()
+	defer l.clientsLock.Unlock()
+
+	if l.clients[conn.dstAddr.String()] == conn {
+		delete(l.clients, conn.dstAddr.String())
+	}
+}
+
+func (l *UDPListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.accept:
+		return conn, nil
+	case <-l.done:
+		return nil, &net.OpError{
+			Op:   "accept",
+			Net:  "pcap",
+			Addr: l.Addr(),
+			Err:  errors.New("listener closed"),
+		}
+	}
+}
+
+func (l *UDPListener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+	})
+
+	return l.conn.Close()
+}
+
+func (l *UDPListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
+
+// udpPacketConn is a standard UDP packet connection which encrypts each datagram.
+type udpPacketConn struct {
+	*net.UDPConn
+	crypt crypto.Crypt
+}
+
+func (c *udpPacketConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	b := GetBuffer()
+	defer PutBuffer(b)
+
+	for {
+		n, addr, err := c.UDPConn.ReadFrom(b)
+		if err != nil {
+			return 0, addr, err
+		}
+
+		// Decrypt in place, datagrams cannot be decrypted are dropped so the reader would not stop
+		contents, err := crypto.Open(c.crypt, b[:n])
+		if err != nil {
+			log.Verboseln(fmt.Errorf("decrypt from %s: %w", addr, err))
+			continue
+		}
+
+		return copy(p, contents), addr, nil
+	}
+}
+
+func (c *udpPacketConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+	buffer := GetBuffer()
+	defer PutBuffer(buffer)
+
+	// Encrypt, in the room of IPv6 if the address is unknown
+	ip := net.IPv6zero
+	if udpAddr, ok := addr.(*net.UDPAddr); ok {
+		ip = udpAddr.IP
+	}
+	contents, err := crypto.SealSized(c.crypt, buffer[:0], p, crypto.Size(c.crypt, len(p), udpRoom(ip)))
+	if err != nil {
+		return 0, &net.OpError{
+			Op:     "write",
+			Net:    "pcap",
+			Source: c.LocalAddr(),
+			Addr:   addr,
+			Err:    fmt.Errorf("encrypt: %w", err),
+		}
+	}
+
+	_, err = c.UDPConn.WriteTo(contents, addr)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// DialUDPWithKCP connects to the remote address in the standard UDP network with KCP support.
+func DialUDPWithKCP(dev *Device, srcPort uint16, dstAddr *net.UDPAddr, crypt crypto.Crypt, config *config.KCPConfig) (*kcp.UDPSession, error) {
+	srcAddr := &net.UDPAddr{
+		IP:   dev.srcIP(dstAddr.IP),
+		Port: int(srcPort),
+	}
+
+	conn, err := net.ListenUDP("udp", srcAddr)
+	if err != nil {
+		return nil, &net.OpError{
+			Op:     "dial",
+			Net:    "pcap",
+			Source: srcAddr,
+			Addr:   dstAddr,
+			Err:    err,
+		}
+	}
+
+	log.Infof("Connect to server %s\n", dstAddr.String())
+
+	sess, err := kcp.NewConn(dstAddr.String(), nil, config.DataShard, config.ParityShard, &udpPacketConn{UDPConn: conn, crypt: crypt})
+	if err != nil {
+		conn.Close()
+		return nil, &net.OpError{
+			Op:     "dial",
+			Net:    "pcap",
+			Source: srcAddr,
+			Addr:   dstAddr,
+			Err:    fmt.Errorf("kcp: %w", err),
+		}
+	}
+
+	// Tuning
+	err = tuneKCP(sess, config)
+	if err != nil {
+		sess.Close()
+		return nil, &net.OpError{
+			Op:     "dial",
+			Net:    "pcap",
+			Source: srcAddr,
+			Addr:   dstAddr,
+			Err:    fmt.Errorf("tune: %w", err),
+		}
+	}
+
+	return sess, nil
+}
+
+// ListenUDPWithKCP listens for incoming packets addressed to the local address in the standard UDP network with KCP
+// support.
+func ListenUDPWithKCP(dev *Device, srcPort uint16, crypt crypto.Crypt, config *config.KCPConfig) (*kcp.Listener, error) {
+	srcAddr := &net.UDPAddr{
+		IP:   dev.listenIP(),
+		Port: int(srcPort),
+	}
+
+	conn, err := net.ListenUDP("udp", srcAddr)
+	if err != nil {
+		return nil, &net.OpError{
+			Op:     "listen",
+			Net:    "pcap",
+			Source: srcAddr,
+			Err:    err,
+		}
+	}
+
+	listener, err := kcp.ServeConn(nil, config.DataShard, config.ParityShard, &udpPacketConn{UDPConn: conn, crypt: crypt})
+	if err != nil {
+		conn.Close()
+		return nil, &net.OpError{
+			Op:     "listen",
+			Net:    "pcap",
+			Source: srcAddr,
+			Err:    fmt.Errorf("kcp: %w", err),
+		}
+	}
+
+	return listener, nil
+}
@@ -0,0 +1,600 @@
+package pcap
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"ikago/internal/addr"
+	"ikago/internal/config"
+	"ikago/internal/crypto"
+	"ikago/internal/log"
+	"io"
+	"io/ioutil"
+	stdlog "log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// wsGUID is the GUID appended to the key in the opening handshake of WebSocket, as described in RFC 6455.
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const (
+	wsOpContinuation byte = 0x0
+	wsOpText         byte = 0x1
+	wsOpBinary       byte = 0x2
+	wsOpClose        byte = 0x8
+	wsOpPing         byte = 0x9
+	wsOpPong         byte = 0xa
+)
+
+// wsMaxMessageSize is the max size of a message in WebSocket.
+const wsMaxMessageSize = 1 << 20
+
+// wsQueueSize is the max count of connections pending to be accepted in a WebSocket listener.
+const wsQueueSize = 128
+
+// WSConn is a WebSocket connection which transmits packets in binary messages.
+type WSConn struct {
+	conn      net.Conn
+	reader    *bufio.Reader
+	crypt     crypto.Crypt
+	isClient  bool
+	readLock  sync.Mutex
+	writeLock sync.Mutex
+	once      sync.Once
+}
+
+func newWSConn(conn net.Conn, reader *bufio.Reader, crypt crypto.Crypt, isClient bool) *WSConn {
+	return &WSConn{
+		conn:     conn,
+		reader:   reader,
+		crypt:    crypt,
+		isClient: isClient,
+	}
+}
+
+// DialWS connects to the remote address in the WebSocket network. The connection goes through the HTTP proxy in
+// config if any, and TLS is disabled if tlsConfig is nil.
+func DialWS(dev *Device, srcPort uint16, dstAddr *net.TCPAddr, crypt crypto.Crypt, config *config.WSConfig, tlsConfig *tls.Config) (*WSConn, error) {
+	var (
+		err  error
+		conn net.Conn
+	)
+
+	srcAddr := &net.TCPAddr{
+		IP:   dev.srcIP(dstAddr.IP),
+		Port: int(srcPort),
+	}
+
+	if config.Proxy != "" {
+		proxyAddr, err := addr.ParseTCPAddr(config.Proxy)
+		if err != nil {
+			return nil, &net.OpError{
+				Op:     "dial",
+				Net:    "pcap",
+				Source: srcAddr,
+				Addr:   dstAddr,
+				Err:    fmt.Errorf("parse proxy %s: %w", config.Proxy, err),
+			}
+		}
+
+		log.Infof("Connect to server %s through proxy %s\n", dstAddr.String(), proxyAddr.String())
+
+		srcAddr.IP = dev.srcIP(proxyAddr.IP)
+
+		conn, err = net.DialTCP("tcp", srcAddr, proxyAddr)
+		if err != nil {
+			return nil, &net.OpError{
+				Op:     "dial",
+				Net:    "pcap",
+				Source: srcAddr,
+				Addr:   dstAddr,
+				Err:    err,
+			}
+		}
+	} else {
+		conn, err = dialTCP(dev, srcPort, dstAddr)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	host := config.Host
+	if host == "" {
+		host = dstAddr.String()
+	}
+
+	wsConn, reader, err := handshakeWS(conn, dstAddr, host, config, tlsConfig)
+	if err != nil {
+		conn.Close()
+		return nil, &net.OpError{
+			Op:     "dial",
+			Net:    "pcap",
+			Source: srcAddr,
+			Addr:   dstAddr,
+			Err:    err,
+		}
+	}
+
+	return newWSConn(wsConn, reader, crypt, true), nil
+}
+
+// handshakeWS establishes the tunnel in the HTTP proxy, TLS and WebSocket in turn on conn, and returns the connection
+// and the reader of the established WebSocket.
+func handshakeWS(conn net.Conn, dstAddr *net.TCPAddr, host string, config *config.WSConfig, tlsConfig *tls.Config) (net.Conn, *bufio.Reader, error) {
+	err := conn.SetDeadline(time.Now().Add(establishDeadline))
+	if err != nil {
+		return nil, nil, fmt.Errorf("set deadline: %w", err)
+	}
+
+	reader := bufio.NewReader(conn)
+
+	// HTTP CONNECT
+	if config.Proxy != "" {
+		req, err := http.NewRequest(http.MethodConnect, "http://"+dstAddr.String(), nil)
+		if err != nil {
+			return nil, nil, fmt.Errorf("create connect request: %w", err)
+		}
+		req.Host = dstAddr.String()
+
+		err = req.Write(conn)
+		if err != nil {
+			return nil, nil, fmt.Errorf("write connect request: %w", err)
+		}
+
+		resp, err := http.ReadResponse(reader, req)
+		if err != nil {
+			return nil, nil, fmt.Errorf("read connect response: %w", err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, nil, fmt.Errorf("connect proxy: %s", resp.Status)
+		}
+	}
+
+	// TLS, WebSocket is only available in HTTP/1.1
+	if tlsConfig != nil {
+		tlsConfig = tlsConfig.Clone()
+		tlsConfig.NextProtos = []string{"http/1.1"}
+
+		tlsConn := tls.Client(conn, tlsConfig)
+
+		err = tlsConn.Handshake()
+		if err != nil {
+			return nil, nil, fmt.Errorf("tls handshake: %w", err)
+		}
+
+		conn = tlsConn
+		reader = bufio.NewReader(tlsConn)
+	}
+
+	// WebSocket opening handshake
+	b := make([]byte, 16)
+	_, err = rand.Read(b)
+	if err != nil {
+		return nil, nil, fmt.Errorf("generate key: %w", err)
+	}
+	key := base64.StdEncoding.EncodeToString(b)
+
+	req, err := http.NewRequest(http.MethodGet, "http://"+host+config.Path, nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("create upgrade request: %w", err)
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+
+	err = req.Write(conn)
+	if err != nil {
+		return nil, nil, fmt.Errorf("write upgrade request: %w", err)
+	}
+
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		return nil, nil, fmt.Errorf("read upgrade response: %w", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		resp.Body.Close()
+		return nil, nil, fmt.Errorf("upgrade: %s", resp.Status)
+	}
+	if resp.Header.Get("Sec-WebSocket-Accept") != wsAccept(key) {
+		return nil, nil, errors.New("upgrade: accept mismatch")
+	}
+
+	err = conn.SetDeadline(time.Time{})
+	if err != nil {
+		return nil, nil, fmt.Errorf("set deadline: %w", err)
+	}
+
+	return conn, reader, nil
+}
+
+func wsAccept(key string) string {
+	sum := sha1.Sum([]byte(key + wsGUID))
+
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// readFrame reads one frame and returns if it is the final fragment, its opcode and its unmasked payload.
+func (c *WSConn) readFrame() (bool, byte, []byte, error) {
+	header := make([]byte, 8)
+
+	_, err := io.ReadFull(c.reader, header[:2])
+	if err != nil {
+		return false, 0, nil, err
+	}
+	fin := header[0]&0x80 != 0
+	opcode := header[0] & 0x0f
+	isMasked := header[1]&0x80 != 0
+
+	// Extended payload length
+	size := uint64(header[1] & 0x7f)
+	switch size {
+	case 126:
+		_, err = io.ReadFull(c.reader, header[:2])
+		if err != nil {
+			return false, 0, nil, err
+		}
+		size = uint64(binary.BigEndian.Uint16(header))
+	case 127:
+		_, err = io.ReadFull(c.reader, header)
+		if err != nil {
+			return false, 0, nil, err
+		}
+		size = binary.BigEndian.Uint64(header)
+	}
+	if size > wsMaxMessageSize {
+		return false, 0, nil, fmt.Errorf("frame size %d out of range", size)
+	}
+
+	var mask []byte
+	if isMasked {
+		mask = make([]byte, 4)
+		_, err = io.ReadFull(c.reader, mask)
+		if err != nil {
+			return false, 0, nil, err
+		}
+	}
+
+	payload := make([]byte, size)
+	_, err = io.ReadFull(c.reader, payload)
+	if err != nil {
+		return false, 0, nil, err
+	}
+	if isMasked {
+		for i := range payload {
+			payload[i] = payload[i] ^ mask[i%4]
+		}
+	}
+
+	return fin, opcode, payload, nil
+}
+
+// readMessage reads frames until a whole data message is received, and handles control frames in between.
+func (c *WSConn) readMessage() ([]byte, error) {
+	message := make([]byte, 0)
+
+	for {
+		fin, opcode, payload, err := c.readFrame()
+		if err != nil {
+			if errors.Is(err, io.ErrUnexpectedEOF) {
+				return nil, io.EOF
+			}
+			return nil, err
+		}
+
+		switch opcode {
+		case wsOpContinuation, wsOpText, wsOpBinary:
+			message = append(message, payload...)
+			if len(message) > wsMaxMessageSize {
+				return nil, fmt.Errorf("message size %d out of range", len(message))
+			}
+			if fin {
+				return message, nil
+			}
+		case wsOpClose:
+			// Echo the status code
+			if len(payload) > 2 {
+				payload = payload[:2]
+			}
+			c.writeFrame(wsOpClose, payload)
+
+			return nil, io.EOF
+		case wsOpPing:
+			err = c.writeFrame(wsOpPong, payload)
+			if err != nil {
+				return nil, err
+			}
+		case wsOpPong:
+			break
+		default:
+			return nil, fmt.Errorf("opcode %d not support", opcode)
+		}
+	}
+}
+
+// writeFrame writes payload in one final frame, which is masked if the connection is a client.
+func (c *WSConn) writeFrame(opcode byte, payload []byte) error {
+	var maskBit byte
+	if c.isClient {
+		maskBit = 0x80
+	}
+
+	frame := make([]byte, 0, 14+len(payload))
+	frame = append(frame, 0x80|opcode)
+
+	// Payload length
+	switch {
+	case len(payload) < 126:
+		frame = append(frame, maskBit|byte(len(payload)))
+	case len(payload) <= 65535:
+		frame = append(frame, maskBit|126, 0, 0)
+		binary.BigEndian.PutUint16(frame[2:], uint16(len(payload)))
+	default:
+		frame = append(frame, maskBit|127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(frame[2:], uint64(len(payload)))
+	}
+
+	// Mask
+	if c.isClient {
+		mask := make([]byte, 4)
+		_, err := rand.Read(mask)
+		if err != nil {
+			return fmt.Errorf("generate mask: %w", err)
+		}
+		frame = append(frame, mask...)
+
+		for i, b := range payload {
+			frame = append(frame, b^mask[i%4])
+		}
+	} else {
+		frame = append(frame, payload...)
+	}
+
+	// Frames must not interleave
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	_, err := c.conn.Write(frame)
+
+	return err
+}
+
+// Read reads exactly one message from the connection and returns the decrypted packet.
+func (c *WSConn) Read(b []byte) (n int, err error) {
+	c.readLock.Lock()
+	defer c.readLock.Unlock()
+
+	contents, err := c.readMessage()
+	if err != nil {
+		return 0, err
+	}
+	if len(contents) <= 0 {
+		return 0, nil
+	}
+
+	// Decrypt in place
+	contents, err = crypto.Open(c.crypt, contents)
+	if err != nil {
+		return 0, &net.OpError{
+			Op:     "read",
+			Net:    "pcap",
+			Source: c.LocalAddr(),
+			Addr:   c.RemoteAddr(),
+			Err:    fmt.Errorf("decrypt: %w", err),
+		}
+	}
+
+	n = copy(b, contents)
+	if n < len(contents) {
+		return n, &net.OpError{
+			Op:     "read",
+			Net:    "pcap",
+			Source: c.LocalAddr(),
+			Addr:   c.RemoteAddr(),
+			Err:    io.ErrShortBuffer,
+		}
+	}
+
+	return n, nil
+}
+
+// Write encrypts b and writes it to the connection in one binary message.
+func (c *WSConn) Write(b []byte) (n int, err error) {
+	// Encrypt, padding never pushes the message over the max size
+	contents, err := crypto.SealSized(c.crypt, nil, b, crypto.Size(c.crypt, len(b), wsMaxMessageSize))
+	if err != nil {
+		return 0, &net.OpError{
+			Op:     "write",
+			Net:    "pcap",
+			Source: c.LocalAddr(),
+			Addr:   c.RemoteAddr(),
+			Err:    fmt.Errorf("encrypt: %w", err),
+		}
+	}
+
+	err = c.writeFrame(wsOpBinary, contents)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(b), nil
+}
+
+func (c *WSConn) Close() error {
+	// Send a close frame with status code 1000 (normal closure) in best effort
+	c.once.Do(func() {
+		c.conn.SetWriteDeadline(time.Now().Add(time.Second))
+		c.writeFrame(wsOpClose, []byte{0x03, 0xe8})
+	})
+
+	return c.conn.Close()
+}
+
+func (c *WSConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *WSConn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+func (c *WSConn) SetDeadline(t time.Time) error {
+	return c.conn.SetDeadline(t)
+}
+
+func (c *WSConn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+func (c *WSConn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
+
+// WSListener is a WebSocket listener which hosts the endpoint on a path of an HTTP server. Requests to other paths
+// are responded as an ordinary web server does.
+type WSListener struct {
+	listener net.Listener
+	server   *http.Server
+	crypt    crypto.Crypt
+	accept   chan *WSConn
+	done     chan struct{}
+	once     sync.Once
+}
+
+// ListenWS listens for incoming connections addressed to the local address in the WebSocket network. TLS is disabled
+// if tlsConfig is nil.
+func ListenWS(dev *Device, srcPort uint16, crypt crypto.Crypt, config *config.WSConfig, tlsConfig *tls.Config) (*WSListener, error) {
+	var listener net.Listener
+
+	srcAddr := &net.TCPAddr{
+		IP:   dev.listenIP(),
+		Port: int(srcPort),
+	}
+
+	listener, err := net.ListenTCP("tcp", srcAddr)
+	if err != nil {
+		return nil, &net.OpError{
+			Op:     "listen",
+			Net:    "pcap",
+			Source: srcAddr,
+			Err:    err,
+		}
+	}
+	if tlsConfig != nil {
+		tlsConfig = tlsConfig.Clone()
+		tlsConfig.NextProtos = []string{"http/1.1"}
+
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+
+	wsListener := &WSListener{
+		listener: listener,
+		crypt:    crypt,
+		accept:   make(chan *WSConn, wsQueueSize),
+		done:     make(chan struct{}),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(config.Path, wsListener.handle)
+
+	wsListener.server = &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: establishDeadline,
+		ErrorLog:          stdlog.New(ioutil.Discard, "", 0),
+	}
+
+	go func() {
+		err := wsListener.server.Serve(listener)
+		if err != nil && err != http.ErrServerClosed {
+			log.Errorln(fmt.Errorf("serve %s: %w", srcAddr, err))
+		}
+	}()
+
+	return wsListener, nil
+}
+
+func (l *WSListener) handle(w http.ResponseWriter, req *http.Request) {
+	// Not WebSocket
+	if req.Method != http.MethodGet ||
+		!strings.EqualFold(req.Header.Get("Upgrade"), "websocket") ||
+		!strings.Contains(strings.ToLower(req.Header.Get("Connection")), "upgrade") ||
+		req.Header.Get("Sec-WebSocket-Version") != "13" ||
+		req.Header.Get("Sec-WebSocket-Key") == "" {
+		http.NotFound(w, req)
+		return
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		log.Errorln(fmt.Errorf("hijack %s: %w", req.RemoteAddr, err))
+		return
+	}
+
+	err = conn.SetDeadline(time.Time{})
+	if err != nil {
+		conn.Close()
+		log.Errorln(fmt.Errorf("set deadline %s: %w", req.RemoteAddr, err))
+		return
+	}
+
+	_, err = fmt.Fprintf(conn, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n", wsAccept(req.Header.Get("Sec-WebSocket-Key")))
+	if err != nil {
+		conn.Close()
+		log.Errorln(fmt.Errorf("upgrade %s: %w", req.RemoteAddr, err))
+		return
+	}
+
+	wsConn := newWSConn(conn, rw.Reader, l.crypt, false)
+
+	select {
+	case l.accept <- wsConn:
+		break
+	case <-l.done:
+		conn.Close()
+	default:
+		conn.Close()
+		log.Errorf("Cannot accept client %s, too many pending connections\n", req.RemoteAddr)
+	}
+}
+
+func (l *WSListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.accept:
+		return conn, nil
+	case <-l.done:
+		return nil, &net.OpError{
+			Op:   "accept",
+			Net:  "pcap",
+			Addr: l.Addr(),
+			Err:  errors.New("listener closed"),
+		}
+	}
+}
+
+func (l *WSListener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+	})
+
+	return l.server.Close()
+}
+
+func (l *WSListener) Addr() net.Addr {
+	return l.listener.Addr()
+}
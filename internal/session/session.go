@@ -0,0 +1,113 @@
+package session
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"ikago/internal/addr"
+	"net"
+	"sync"
+	"time"
+)
+
+// Session is a session of a client which outlives its connections, so the client can reconnect from another address
+// and keep its NAT.
+type Session struct {
+	lock     sync.RWMutex
+	id       uint64
+	token    []byte
+	conn     net.Conn
+	detached time.Time
+}
+
+// NewSession returns a new session.
+func NewSession(id uint64, token []byte) *Session {
+	return &Session{
+		id:       id,
+		token:    token,
+		detached: time.Now(),
+	}
+}
+
+// Authenticate returns if the token matches the token of the session.
+func (s *Session) Authenticate(token []byte) bool {
+	return subtle.ConstantTimeCompare(s.token, token) == 1
+}
+
+// Attach attaches a connection to the session and returns the connection previously attached.
+func (s *Session) Attach(conn net.Conn) net.Conn {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	prev := s.conn
+	s.conn = conn
+
+	return prev
+}
+
+// Detach detaches the connection from the session, and returns if it is the connection attached.
+func (s *Session) Detach(conn net.Conn) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.conn != conn {
+		return false
+	}
+	s.conn = nil
+	s.detached = time.Now()
+
+	return true
+}
+
+// IsExpired returns if the session has been detached for the duration.
+func (s *Session) IsExpired(d time.Duration) bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.conn == nil && time.Now().Sub(s.detached) >= d
+}
+
+// Conn returns the connection attached to the session.
+func (s *Session) Conn() net.Conn {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return s.conn
+}
+
+// Id returns the identifier of the session.
+func (s *Session) Id() uint64 {
+	return s.id
+}
+
+// Addr returns the address of the session.
+func (s *Session) Addr() net.Addr {
+	return &addr.SessionAddr{Id: s.id}
+}
+
+// Write writes b to the connection attached to the session.
+func (s *Session) Write(b []byte) (n int, err error) {
+	conn := s.Conn()
+	if conn == nil {
+		return 0, errors.New("session detached")
+	}
+
+	return conn.Write(b)
+}
+
+func (s *Session) MarshalJSON() ([]byte, error) {
+	var remote string
+
+	conn := s.Conn()
+	if conn != nil {
+		remote = conn.RemoteAddr().String()
+	}
+
+	return json.Marshal(&struct {
+		Id     string `json:"id"`
+		Remote string `json:"remote"`
+	}{
+		Id:     s.Addr().String(),
+		Remote: remote,
+	})
+}
@@ -0,0 +1,125 @@
+package session
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+// sessionConn is a connection attached to a session which counts packets written to it.
+type sessionConn struct {
+	net.Conn
+	n int
+}
+
+func (c *sessionConn) Write(b []byte) (int, error) {
+	c.n++
+
+	return len(b), nil
+}
+
+// sessionOp attaches or detaches a connection.
+type sessionOp struct {
+	isDetach bool
+	conn     int
+}
+
+func TestSessionMigrate(t *testing.T) {
+	tests := []struct {
+		name string
+		ops  []sessionOp
+		conn int
+	}{
+		{name: "new", conn: -1},
+		{name: "attach", ops: []sessionOp{{conn: 0}}, conn: 0},
+		{name: "migrate", ops: []sessionOp{{conn: 0}, {conn: 1}}, conn: 1},
+		{name: "migrate back", ops: []sessionOp{{conn: 0}, {conn: 1}, {conn: 0}}, conn: 0},
+		{name: "detach", ops: []sessionOp{{conn: 0}, {isDetach: true, conn: 0}}, conn: -1},
+		{name: "detach replaced", ops: []sessionOp{{conn: 0}, {conn: 1}, {isDetach: true, conn: 0}}, conn: 1},
+		{name: "detach unattached", ops: []sessionOp{{conn: 0}, {isDetach: true, conn: 2}}, conn: 0},
+		{name: "attach after detach", ops: []sessionOp{{conn: 0}, {isDetach: true, conn: 0}, {conn: 1}}, conn: 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := NewSession(1, nil)
+			conns := []*sessionConn{{}, {}, {}}
+
+			// A connection replaced by another one is left attached no more, and detaching it does not detach the session
+			current := -1
+			for _, op := range test.ops {
+				conn := conns[op.conn]
+				if op.isDetach {
+					isDetached := s.Detach(conn)
+					if isDetached != (current == op.conn) {
+						t.Fatalf("detach connection %d: %t", op.conn, isDetached)
+					}
+					if isDetached {
+						current = -1
+					}
+					continue
+				}
+
+				prev := s.Attach(conn)
+				if (current < 0 && prev != nil) || (current >= 0 && prev != conns[current]) {
+					t.Fatalf("attach connection %d replacing %v", op.conn, prev)
+				}
+				current = op.conn
+			}
+			if current != test.conn {
+				t.Fatalf("attach connection %d, want %d", current, test.conn)
+			}
+
+			_, err := s.Write([]byte{0})
+			if test.conn < 0 {
+				if err == nil {
+					t.Fatal("write in detached session")
+				}
+				if s.Conn() != nil || !s.IsExpired(0) || s.IsExpired(time.Hour) {
+					t.Fatal("detached session is expired out of time")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Packets are only written in the connection attached, which never expires
+			for i, conn := range conns {
+				if isCurrent := i == test.conn; (conn.n == 1) != isCurrent {
+					t.Fatalf("write %d packets in connection %d", conn.n, i)
+				}
+			}
+			if s.Conn() != conns[test.conn] || s.IsExpired(0) {
+				t.Fatal("attached session is expired")
+			}
+		})
+	}
+}
+
+func TestSessionAuthenticate(t *testing.T) {
+	token := bytes.Repeat([]byte{0x5a}, 16)
+
+	tests := []struct {
+		name   string
+		token  []byte
+		isAuth bool
+	}{
+		{name: "token", token: bytes.Repeat([]byte{0x5a}, 16), isAuth: true},
+		{name: "token mismatch", token: append(bytes.Repeat([]byte{0x5a}, 15), 0x5b)},
+		{name: "truncated", token: token[:15]},
+		{name: "trailer", token: append(bytes.Repeat([]byte{0x5a}, 16), 0)},
+		{name: "empty", token: []byte{}},
+		{name: "nil", token: nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := NewSession(1, token)
+			if isAuth := s.Authenticate(test.token); isAuth != test.isAuth {
+				t.Fatalf("authenticate %x: %t", test.token, isAuth)
+			}
+		})
+	}
+}
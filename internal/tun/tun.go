@@ -0,0 +1,34 @@
+package tun
+
+import "os"
+
+// Device is a TUN device which reads and writes IP packets without link layers.
+type Device struct {
+	name string
+	file *os.File
+}
+
+// Open creates a TUN device with the given name, the name is chosen by the system if it is empty.
+func Open(name string) (*Device, error) {
+	return open(name)
+}
+
+// Name returns the name of the device.
+func (dev *Device) Name() string {
+	return dev.name
+}
+
+// Read reads one packet from the device.
+func (dev *Device) Read(b []byte) (n int, err error) {
+	return dev.file.Read(b)
+}
+
+// Write writes one packet to the device.
+func (dev *Device) Write(b []byte) (n int, err error) {
+	return dev.file.Write(b)
+}
+
+// Close closes the device, which is removed from the system then.
+func (dev *Device) Close() error {
+	return dev.file.Close()
+}
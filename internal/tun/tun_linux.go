@@ -0,0 +1,49 @@
+package tun
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+type ifreq struct {
+	name  [unix.IFNAMSIZ]byte
+	flags uint16
+	_     [22]byte
+}
+
+func open(name string) (*Device, error) {
+	if len(name) >= unix.IFNAMSIZ {
+		return nil, fmt.Errorf("name %s too long", name)
+	}
+
+	fd, err := unix.Open("/dev/net/tun", unix.O_RDWR|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("open: %w", err)
+	}
+
+	// Packets are without packet information
+	var req ifreq
+	copy(req.name[:], name)
+	req.flags = unix.IFF_TUN | unix.IFF_NO_PI
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), unix.TUNSETIFF, uintptr(unsafe.Pointer(&req)))
+	if errno != 0 {
+		unix.Close(fd)
+		return nil, fmt.Errorf("ioctl: %w", errno)
+	}
+
+	// Non-blocking, so reads can be interrupted by closing
+	err = unix.SetNonblock(fd, true)
+	if err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("set nonblock: %w", err)
+	}
+
+	return &Device{
+		name: string(req.name[:bytes.IndexByte(req.name[:], 0)]),
+		file: os.NewFile(uintptr(fd), "/dev/net/tun"),
+	}, nil
+}
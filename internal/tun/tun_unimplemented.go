@@ -0,0 +1,9 @@
+// +build !linux
+
+package tun
+
+import "errors"
+
+func open(_ string) (*Device, error) {
+	return nil, errors.New("tun not support")
+}